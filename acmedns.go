@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ACMEDNSStore = "./acme-dns.json"
+
+	// acmeChallengeLength is the length of a DNS-01 key authorization digest,
+	// base64url encoded SHA-256 without padding.
+	acmeChallengeLength = 43
+	acmeTXTValues       = 2
+)
+
+var ACMEDNS bool
+
+// acmeAccount is an acme-dns account: credentials allowed to publish the TXT
+// record of one subdomain. Like acme-dns, the two latest values are served,
+// so a wildcard and a bare name can be validated in the same order.
+type acmeAccount struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Subdomain    string    `json:"subdomain"`
+	AllowFrom    []string  `json:"allowfrom,omitempty"`
+	TXT          []string  `json:"txt,omitempty"`
+	Updated      time.Time `json:"updated,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// acmeDNS serves an acme-dns compatible API, so certbot, lego and other ACME
+// clients running elsewhere can answer DNS-01 challenges through CoWitness.
+// Clients point _acme-challenge.<their domain> at the account's fulldomain
+// with a CNAME, then publish the challenge with /acme-dns/update.
+type acmeDNS struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]*acmeAccount
+}
+
+func newACMEDNS(path string) (*acmeDNS, error) {
+	a := &acmeDNS{path: path, accounts: make(map[string]*acmeAccount)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*acmeAccount
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, account := range list {
+		a.accounts[account.Username] = account
+	}
+	return a, nil
+}
+
+func (a *acmeDNS) saveLocked() error {
+	list := make([]*acmeAccount, 0, len(a.accounts))
+	for _, account := range a.accounts {
+		list = append(list, account)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// register creates an account and returns its password, which is only
+// stored hashed.
+func (a *acmeDNS) register(allowFrom []string) (*acmeAccount, string, error) {
+	for _, cidr := range allowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, "", fmt.Errorf("invalid allowfrom %q: %v", cidr, err)
+		}
+	}
+	password := newID() + newID() + newID()
+	account := &acmeAccount{
+		Username:     uuidV4(),
+		PasswordHash: hashToken(password),
+		Subdomain:    uuidV4(),
+		AllowFrom:    allowFrom,
+		Created:      time.Now().UTC(),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accounts[account.Username] = account
+	if err := a.saveLocked(); err != nil {
+		delete(a.accounts, account.Username)
+		return nil, "", err
+	}
+	return account, password, nil
+}
+
+// authenticate returns the account for the X-Api-User and X-Api-Key headers,
+// when the request comes from an address the account allows.
+func (a *acmeDNS) authenticate(r *http.Request) *acmeAccount {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	account := a.accounts[r.Header.Get("X-Api-User")]
+	if account == nil || subtle.ConstantTimeCompare([]byte(hashToken(r.Header.Get("X-Api-Key"))), []byte(account.PasswordHash)) != 1 {
+		return nil
+	}
+	if len(account.AllowFrom) == 0 {
+		return account
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	for _, cidr := range account.AllowFrom {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+			return account
+		}
+	}
+	return nil
+}
+
+func (a *acmeDNS) update(account *acmeAccount, txt string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous := account.TXT
+	account.TXT = append([]string{txt}, account.TXT...)
+	if len(account.TXT) > acmeTXTValues {
+		account.TXT = account.TXT[:acmeTXTValues]
+	}
+	account.Updated = time.Now().UTC()
+	if err := a.saveLocked(); err != nil {
+		account.TXT = previous
+		return err
+	}
+	return nil
+}
+
+// answer returns the TXT records of the account owning qname, which is the
+// account's fulldomain or the _acme-challenge name below it.
+func (a *acmeDNS) answer(qname string, qtype uint16, ttl uint32) []dns.RR {
+	if a == nil || qtype != dns.TypeTXT {
+		return nil
+	}
+	name, ok := relativeName(qname)
+	if !ok {
+		return nil
+	}
+	subdomain := strings.TrimPrefix(name, "_acme-challenge.")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var answer []dns.RR
+	for _, account := range a.accounts {
+		if account.Subdomain != subdomain {
+			continue
+		}
+		for _, txt := range account.TXT {
+			answer = append(answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+				Txt: []string{txt},
+			})
+		}
+	}
+	return answer
+}
+
+func (a *acmeDNS) fullDomain(account *acmeAccount) string {
+	return account.Subdomain + "." + strings.TrimSuffix(DNSResponseName, ".")
+}
+
+// handleACMERegister implements acme-dns's POST /register. Unlike acme-dns
+// registration needs an operator, so hand the credentials to the ACME client
+// instead of letting it register itself.
+func handleACMERegister(a *acmeDNS, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		var req struct {
+			AllowFrom []string `json:"allowfrom"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		account, password, err := a.register(req.AllowFrom)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		audit.record(r, "acme-dns.register", account.Username, a.fullDomain(account))
+		log.Printf("User %s registered acme-dns account %s for %s\n", requestUser(r).Name, account.Username, a.fullDomain(account))
+		allowFrom := account.AllowFrom
+		if allowFrom == nil {
+			allowFrom = []string{}
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"username":   account.Username,
+			"password":   password,
+			"fulldomain": a.fullDomain(account),
+			"subdomain":  account.Subdomain,
+			"allowfrom":  allowFrom,
+		})
+	}
+}
+
+// handleACMEUpdate implements acme-dns's POST /update, authenticated with the
+// account's X-Api-User and X-Api-Key headers.
+func handleACMEUpdate(a *acmeDNS, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		account := a.authenticate(r)
+		if account == nil {
+			writeJSONError(w, http.StatusUnauthorized, "forbidden")
+			return
+		}
+		var req struct {
+			Subdomain string `json:"subdomain"`
+			TXT       string `json:"txt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "malformed_json")
+			return
+		}
+		if req.Subdomain != account.Subdomain {
+			writeJSONError(w, http.StatusUnauthorized, "forbidden")
+			return
+		}
+		if len(req.TXT) != acmeChallengeLength || strings.Trim(req.TXT, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_txt")
+			return
+		}
+		if err := a.update(account, req.TXT); err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		audit.write(auditEntry{User: "acme-dns:" + account.Username, RemoteIP: host, Action: "acme-dns.update", Target: a.fullDomain(account), Detail: req.TXT})
+		writeJSON(w, http.StatusOK, map[string]string{"txt": req.TXT})
+	}
+}
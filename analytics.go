@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Engagement names the campaign this instance is deployed for. It is recorded
+// on every interaction and minted token so reports can be grouped by it.
+var Engagement string
+
+type protocolSummary struct {
+	Protocol  string    `json:"protocol"`
+	Total     int       `json:"total"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// tokenCallbackSummary tells how long a canary token took to call back after
+// it was minted.
+type tokenCallbackSummary struct {
+	ID                  string     `json:"id"`
+	Kind                string     `json:"kind"`
+	Description         string     `json:"description"`
+	Created             time.Time  `json:"created"`
+	Callbacks           int        `json:"callbacks"`
+	FirstCallback       *time.Time `json:"first_callback,omitempty"`
+	TimeToFirstCallback string     `json:"time_to_first_callback,omitempty"`
+}
+
+type networkSummary struct {
+	Network string `json:"network"`
+	Total   int    `json:"total"`
+	Sources int    `json:"sources"`
+}
+
+// asnSummary aggregates the interactions from one network, by the AS number
+// and organization the ASN enricher recorded. New is set when one of them was
+// the first from the network in its engagement.
+type asnSummary struct {
+	ASN         string         `json:"asn"`
+	Total       int            `json:"total"`
+	Sources     int            `json:"sources"`
+	Counts      map[string]int `json:"counts"`
+	Engagements []string       `json:"engagements,omitempty"`
+	FirstSeen   time.Time      `json:"first_seen"`
+	LastSeen    time.Time      `json:"last_seen"`
+	New         bool           `json:"new,omitempty"`
+
+	sources, engagements map[string]bool
+}
+
+type engagementSummary struct {
+	Engagement    string                  `json:"engagement"`
+	Interactions  int                     `json:"interactions"`
+	FirstSeen     *time.Time              `json:"first_seen,omitempty"`
+	LastSeen      *time.Time              `json:"last_seen,omitempty"`
+	Protocols     []*protocolSummary      `json:"protocols"`
+	Tokens        []*tokenCallbackSummary `json:"tokens"`
+	UniqueSources int                     `json:"unique_sources"`
+	Networks      []*networkSummary       `json:"networks"`
+	ASNs          []*asnSummary           `json:"asns"`
+}
+
+// sourceNetwork groups addresses by the /24 for IPv4 and the /48 for IPv6,
+// the usual size of a single site's allocation.
+func sourceNetwork(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// summarizeEngagement reports which protocols produced interactions, how
+// quickly each token called back and which networks the callbacks came from.
+// Interactions flagged as noise are left out. Tokens are those minted for the
+// engagement plus any that fired in the interactions given.
+func summarizeEngagement(engagement string, list []*Interaction, tokens []*CanaryToken) *engagementSummary {
+	summary := &engagementSummary{Engagement: engagement, Protocols: []*protocolSummary{}, Tokens: []*tokenCallbackSummary{}, Networks: []*networkSummary{}}
+	protocols := make(map[string]*protocolSummary)
+	networks := make(map[string]*networkSummary)
+	sources := make(map[string]bool)
+	networkSources := make(map[string]bool)
+	callbacks := make(map[string]int)
+	firstCallback := make(map[string]time.Time)
+	var signal []*Interaction
+	for _, i := range list {
+		if i.Noise {
+			continue
+		}
+		signal = append(signal, i)
+		summary.Interactions++
+		if summary.FirstSeen == nil || i.Time.Before(*summary.FirstSeen) {
+			t := i.Time
+			summary.FirstSeen = &t
+		}
+		if summary.LastSeen == nil || i.Time.After(*summary.LastSeen) {
+			t := i.Time
+			summary.LastSeen = &t
+		}
+
+		p, ok := protocols[i.Protocol]
+		if !ok {
+			p = &protocolSummary{Protocol: i.Protocol, FirstSeen: i.Time, LastSeen: i.Time}
+			protocols[i.Protocol] = p
+			summary.Protocols = append(summary.Protocols, p)
+		}
+		p.Total++
+		if i.Time.Before(p.FirstSeen) {
+			p.FirstSeen = i.Time
+		}
+		if i.Time.After(p.LastSeen) {
+			p.LastSeen = i.Time
+		}
+
+		network := sourceNetwork(i.RemoteIP)
+		n, ok := networks[network]
+		if !ok {
+			n = &networkSummary{Network: network}
+			networks[network] = n
+			summary.Networks = append(summary.Networks, n)
+		}
+		n.Total++
+		if !networkSources[i.RemoteIP] {
+			networkSources[i.RemoteIP] = true
+			n.Sources++
+		}
+		sources[i.RemoteIP] = true
+
+		if i.Token != "" {
+			callbacks[i.Token]++
+			if first, ok := firstCallback[i.Token]; !ok || i.Time.Before(first) {
+				firstCallback[i.Token] = i.Time
+			}
+		}
+	}
+	summary.UniqueSources = len(sources)
+	summary.ASNs = summarizeASNs(signal)
+
+	for _, t := range tokens {
+		if (engagement == "" || t.Engagement != engagement) && callbacks[t.ID] == 0 {
+			continue
+		}
+		s := &tokenCallbackSummary{ID: t.ID, Kind: t.Kind, Description: t.Description, Created: t.Created, Callbacks: callbacks[t.ID]}
+		// The store may have dropped the first callback already, the token
+		// itself remembers when it first fired.
+		first, ok := firstCallback[t.ID]
+		if !t.FirstFired.IsZero() && (!ok || t.FirstFired.Before(first)) {
+			first, ok = t.FirstFired, true
+		}
+		if ok {
+			s.FirstCallback = &first
+			s.TimeToFirstCallback = first.Sub(t.Created).Round(time.Second).String()
+		}
+		summary.Tokens = append(summary.Tokens, s)
+	}
+
+	sort.SliceStable(summary.Protocols, func(a, b int) bool {
+		return summary.Protocols[a].Total > summary.Protocols[b].Total
+	})
+	sort.SliceStable(summary.Networks, func(a, b int) bool {
+		return summary.Networks[a].Total > summary.Networks[b].Total
+	})
+	return summary
+}
+
+// summarizeASNs groups interactions by source network, networks new to an
+// engagement first and then by the number of interactions, so a network
+// that has never touched a canary before isn't buried under the cloud
+// providers scanners run from. Interactions without a network are left out.
+func summarizeASNs(list []*Interaction) []*asnSummary {
+	networks := []*asnSummary{}
+	byName := make(map[string]*asnSummary)
+	for _, i := range list {
+		name := i.Enrichment["asn"]
+		if name == "" {
+			continue
+		}
+		n, ok := byName[name]
+		if !ok {
+			n = &asnSummary{ASN: name, Counts: make(map[string]int), FirstSeen: i.Time, LastSeen: i.Time, sources: make(map[string]bool), engagements: make(map[string]bool)}
+			byName[name] = n
+			networks = append(networks, n)
+		}
+		n.Total++
+		n.Counts[i.Protocol]++
+		if !n.sources[i.RemoteIP] {
+			n.sources[i.RemoteIP] = true
+			n.Sources++
+		}
+		if i.Engagement != "" {
+			n.engagements[i.Engagement] = true
+		}
+		if i.Time.Before(n.FirstSeen) {
+			n.FirstSeen = i.Time
+		}
+		if i.Time.After(n.LastSeen) {
+			n.LastSeen = i.Time
+		}
+		if hasTag(i, newASNTag) {
+			n.New = true
+		}
+	}
+	for _, n := range networks {
+		n.Engagements = sortedKeys(n.engagements)
+	}
+	sort.SliceStable(networks, func(a, b int) bool {
+		if networks[a].New != networks[b].New {
+			return networks[a].New
+		}
+		return networks[a].Total > networks[b].Total
+	})
+	return networks
+}
+
+func handleEngagementSummary(store interactionStore, tokens *tokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		q, err := parseInteractionQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.URL.Query().Get("limit") == "" {
+			q.Limit = maxQueryLimit
+		}
+
+		list, err := store.Query(q)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		writeJSON(w, http.StatusOK, summarizeEngagement(q.Engagement, list, tokens.list()))
+	}
+}
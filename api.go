@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	APIAddr     string
+	APIToken    string
+	APICert     string
+	APIKey      string
+	APIClientCA string
+)
+
+// apiServices bundles the stores the operator API works on.
+type apiServices struct {
+	tokens  *tokenStore
+	store   interactionStore
+	events  interactionSink
+	bus     *eventBus
+	users   *userStore
+	audit   *auditLog
+	misp    *mispClient
+	zone    *dnsZone
+	acme    *acmeDNS
+	webRoot string
+}
+
+type apiToken struct {
+	*CanaryToken
+	Address string `json:"address"`
+}
+
+// startAPIServer exposes the operator API. Without TLS it is meant to stay on
+// a loopback or otherwise private address. Callers authenticate as a user from
+// users.json, with the -api-token bearer, or with a client certificate signed
+// by -api-client-ca.
+func startAPIServer(addr, bearer string, services *apiServices) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/ingest", requireRole(roleOperator, handleIngest(services.events)))
+	mux.HandleFunc("/api/users", requireRole(roleAdmin, handleUsers(services.users, services.audit)))
+	mux.HandleFunc("/api/stats", handleStats(services.store))
+	mux.HandleFunc("/api/metrics", handleMetrics)
+	mux.HandleFunc("/api/screenshots/", handleScreenshot)
+	if webRootManaged(services.webRoot) {
+		mux.HandleFunc("/api/files", handleWebRoot(services.webRoot, services.audit))
+		mux.HandleFunc("/api/files/", handleWebRoot(services.webRoot, services.audit))
+	}
+	mux.HandleFunc("/api/misp", requireRole(roleOperator, handleMISPPublish(services.misp, services.store, services.audit)))
+	if services.zone != nil {
+		mux.HandleFunc("/api/records", handleRecords(services.zone, services.audit))
+		mux.HandleFunc("/api/records/", requireRole(roleOperator, handleRecordDelete(services.zone, services.audit)))
+	}
+	mux.HandleFunc("/api/summary", handleEngagementSummary(services.store, services.tokens))
+	mux.HandleFunc("/api/engagements", handleEngagements)
+	mux.HandleFunc("/api/engagements/", requireRole(roleOperator, handleArming(services.audit)))
+	mux.HandleFunc("/api/interactions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		q, err := parseInteractionQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		list, err := services.store.Query(q)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		services.audit.record(r, "interactions.query", "", r.URL.RawQuery)
+		if list == nil {
+			list = []*Interaction{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("/api/interactions/stream", handleStream(services.bus))
+	mux.HandleFunc("/api/interactions/", requireRole(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			w.Header().Set("Allow", "PATCH")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/interactions/")
+		var a annotation
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		i, err := services.store.Annotate(id, a)
+		if err == errInteractionNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		services.audit.record(r, "interaction.annotate", id, fmt.Sprintf("tags: %s, note: %s", strings.Join(i.Tags, ","), i.Note))
+		writeJSON(w, http.StatusOK, i)
+	}))
+	mux.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			var list []apiToken
+			for _, t := range services.tokens.list() {
+				list = append(list, apiToken{t, t.Address(DNSResponseName)})
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			if !requestUser(r).can(roleOperator) {
+				writeJSONError(w, http.StatusForbidden, "this needs the "+roleOperator+" role")
+				return
+			}
+			var req struct {
+				Kind        string `json:"kind"`
+				Description string `json:"description"`
+				TTL         string `json:"ttl"`
+				MaxUses     int    `json:"max_uses"`
+				// Files, by path and in base64, make a URL token with its
+				// own document root.
+				Files map[string]string `json:"files"`
+				Index string            `json:"index"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.Kind == "" {
+				req.Kind = "dns"
+			}
+			var ttl time.Duration
+			if req.TTL != "" {
+				var err error
+				if ttl, err = time.ParseDuration(req.TTL); err != nil {
+					writeJSONError(w, http.StatusBadRequest, "ttl: "+err.Error())
+					return
+				}
+			}
+			var t *CanaryToken
+			var err error
+			if req.Files != nil {
+				if req.Kind != "url" {
+					writeJSONError(w, http.StatusBadRequest, "files need the url kind")
+					return
+				}
+				t, err = services.tokens.mintRoot(req.Description, ttl, req.MaxUses, writeTokenRoot(req.Files, req.Index))
+			} else {
+				t, err = services.tokens.mint(req.Kind, req.Description, ttl, req.MaxUses)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			services.audit.record(r, "token.mint", t.ID, t.Kind+": "+t.Description)
+			log.Printf("User %s minted %s canary token %s via the API\n", requestUser(r).Name, t.Kind, t.ID)
+			writeJSON(w, http.StatusCreated, apiToken{t, t.Address(DNSResponseName)})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		}
+	})
+
+	root := http.NewServeMux()
+	root.HandleFunc("/", serveDashboard)
+	root.Handle("/api/", requireUser(services.users, bearer, mux))
+	root.Handle("/taxii2/", requireUser(services.users, bearer, handleTAXII(services.store, services.audit)))
+	if services.acme != nil {
+		root.Handle("/acme-dns/register", requireUser(services.users, bearer, requireRole(roleOperator, handleACMERegister(services.acme, services.audit))))
+		root.HandleFunc("/acme-dns/update", handleACMEUpdate(services.acme, services.audit))
+		root.HandleFunc("/acme-dns/health", func(w http.ResponseWriter, r *http.Request) {})
+	}
+	if SlackSigningSecret != "" {
+		root.HandleFunc("/slack/command", handleSlackCommand(services.store, services.tokens, services.audit))
+	}
+	server := &http.Server{Addr: addr, Handler: root}
+	if APICert != "" {
+		tlsConfig, err := serverTLSConfig(APICert, APIKey, APIClientCA)
+		if err != nil {
+			log.Fatalf("API certificate: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			infof("Starting API server on https://%s\n", addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			infof("Starting API server on %s\n", addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// ensureAPIToken generates a random admin bearer token when there is no other
+// way to authenticate: no token, no client certificates and no users.
+func ensureAPIToken(users *userStore) {
+	if APIToken == "" && APIClientCA == "" && len(users.list()) == 0 {
+		APIToken = newID() + newID()
+		log.Printf("Generated API token: %s\n", APIToken)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
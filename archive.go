@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxPendingArchives = 48
+
+var (
+	ArchiveURL          string
+	ArchiveEndpoint     string
+	ArchiveRegion       string
+	ArchiveInterval     time.Duration
+	ArchiveStorageClass string
+	ArchiveTags         string
+)
+
+// archiver batches interactions and uploads them as gzipped JSON lines to an
+// S3 compatible bucket (AWS S3, MinIO, or GCS through its interoperability
+// API), so the evidence outlives a disposable callback host.
+type archiver struct {
+	mu      sync.Mutex
+	batch   bytes.Buffer
+	count   int
+	pending [][]byte
+
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func newArchiver(archiveURL, endpoint, region string) (*archiver, error) {
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" && u.Scheme != "gs" {
+		return nil, fmt.Errorf("archive URL must look like s3://bucket/prefix or gs://bucket/prefix, got %q", archiveURL)
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+		if u.Scheme == "gs" {
+			endpoint = "https://storage.googleapis.com"
+		}
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &archiver{
+		endpoint:    e,
+		bucket:      u.Host,
+		prefix:      strings.TrimPrefix(u.Path, "/"),
+		region:      region,
+		credentials: awsCredentialsFromEnv(),
+		client:      newOutboundClient(2*time.Minute, nil),
+	}
+	if !a.credentials.valid() {
+		return nil, fmt.Errorf("archiving needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (HMAC keys for GCS) in the environment")
+	}
+	if a.prefix != "" && !strings.HasSuffix(a.prefix, "/") {
+		a.prefix += "/"
+	}
+	return a, nil
+}
+
+func (a *archiver) Write(i *Interaction) {
+	line, err := json.Marshal(i)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	a.mu.Lock()
+	a.batch.Write(line)
+	a.batch.WriteByte('\n')
+	a.count++
+	a.mu.Unlock()
+}
+
+func (a *archiver) run(interval time.Duration) {
+	infof("Archiving interactions to %s/%s every %s\n", a.bucket, a.prefix, interval)
+	for range time.Tick(interval) {
+		a.flush()
+	}
+}
+
+// flush compresses the current batch and uploads it together with any batches
+// that failed earlier. Failed uploads are kept for the next run.
+func (a *archiver) flush() {
+	a.mu.Lock()
+	if a.count > 0 {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(a.batch.Bytes())
+		gz.Close()
+		a.pending = append(a.pending, compressed.Bytes())
+		a.batch.Reset()
+		a.count = 0
+	}
+	if len(a.pending) > maxPendingArchives {
+		log.Printf("Archive backlog too large, dropping %d batch(es)\n", len(a.pending)-maxPendingArchives)
+		a.pending = a.pending[len(a.pending)-maxPendingArchives:]
+	}
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	var failed [][]byte
+	for _, body := range pending {
+		now := time.Now().UTC()
+		key := fmt.Sprintf("%s%s/%s-%s.jsonl.gz", a.prefix, now.Format("2006/01/02"), now.Format("20060102T150405Z"), newID())
+		if err := a.put(key, body); err != nil {
+			log.Printf("Archive upload of %s failed: %v\n", key, err)
+			failed = append(failed, body)
+			continue
+		}
+		verbosef("Archived interactions to %s/%s\n", a.bucket, key)
+	}
+
+	if len(failed) > 0 {
+		a.mu.Lock()
+		a.pending = append(failed, a.pending...)
+		a.mu.Unlock()
+	}
+}
+
+func (a *archiver) put(key string, body []byte) error {
+	u := *a.endpoint
+	u.Path = "/" + a.bucket + "/" + key
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	if ArchiveStorageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", ArchiveStorageClass)
+	}
+	// Tags let bucket lifecycle rules expire or transition archives without
+	// relying on key prefixes alone.
+	if ArchiveTags != "" {
+		req.Header.Set("X-Amz-Tagging", strings.ReplaceAll(ArchiveTags, ",", "&"))
+	}
+	a.credentials.sign(req, body, time.Now().UTC(), a.region, "s3")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// awsCredentials are the keys requests to AWS, or an S3 compatible service,
+// are signed with.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func awsCredentialsFromEnv() awsCredentials {
+	return awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func (c awsCredentials) valid() bool {
+	return c.accessKey != "" && c.secretKey != ""
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, for
+// service in region.
+func (c awsCredentials) sign(req *http.Request, body []byte, now time.Time, region, service string) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const ArmingFile = "./arming.json"
+
+// arming is the armed state of the engagements, nil when every engagement is
+// armed, as in the selftest.
+var arming *engagementArming
+
+// engagementArming records which engagements are disarmed, e.g. between the
+// test windows agreed with a client. Interactions of a disarmed engagement
+// are still recorded, but webhooks, plugin notifiers, MISP token events,
+// alert rules and canary token alerts skip them, payload URLs serve the
+// decoy and token roots the pixel. The state lives in arming.json,
+// shared by the server, the engagement subcommand and the API. Engagements
+// with windows in engagements.json are also disarmed outside of them.
+type engagementArming struct {
+	mu       sync.Mutex
+	path     string
+	mod      time.Time
+	disarmed map[string]time.Time
+	windows  map[string][]*engagementWindow
+	open     map[string]bool
+}
+
+func newEngagementArming(path string) *engagementArming {
+	a := &engagementArming{path: path, disarmed: make(map[string]time.Time)}
+	if err := a.reload(); err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
+
+func (a *engagementArming) reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reloadLocked()
+}
+
+func (a *engagementArming) reloadLocked() error {
+	var mod time.Time
+	if info, err := os.Stat(a.path); err == nil {
+		mod = info.ModTime()
+	}
+	if mod.Equal(a.mod) {
+		return nil
+	}
+
+	disarmed := make(map[string]time.Time)
+	data, err := os.ReadFile(a.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &disarmed); err != nil {
+			return fmt.Errorf("%s: %v", a.path, err)
+		}
+	}
+	for engagement := range disarmed {
+		if _, was := a.disarmed[engagement]; !was {
+			log.Printf("Engagement %q is disarmed\n", engagement)
+		}
+	}
+	for engagement := range a.disarmed {
+		if _, still := disarmed[engagement]; !still {
+			log.Printf("Engagement %q is armed\n", engagement)
+		}
+	}
+	a.disarmed, a.mod = disarmed, mod
+	return nil
+}
+
+// schedule takes over the windows of the engagements.
+func (a *engagementArming) schedule(namespaces []*engagementNamespace) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.windows = make(map[string][]*engagementWindow)
+	a.open = make(map[string]bool)
+	for _, ns := range namespaces {
+		if len(ns.Windows) > 0 {
+			a.windows[ns.Name] = ns.Windows
+			a.open[ns.Name] = inWindows(ns.Windows, time.Now())
+			if !a.open[ns.Name] {
+				log.Printf("Engagement %q is outside its windows\n", ns.Name)
+			}
+		}
+	}
+}
+
+func (a *engagementArming) watch() {
+	for range time.Tick(tokenScanTime) {
+		if err := a.reload(); err != nil {
+			log.Println(err)
+		}
+		a.logWindows()
+	}
+}
+
+// logWindows notes when an engagement's window opens or closes.
+func (a *engagementArming) logWindows() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for engagement, windows := range a.windows {
+		open := inWindows(windows, now)
+		if open == a.open[engagement] {
+			continue
+		}
+		a.open[engagement] = open
+		if open {
+			log.Printf("Engagement %q entered its window\n", engagement)
+		} else {
+			log.Printf("Engagement %q left its window and is disarmed until the next one\n", engagement)
+		}
+	}
+}
+
+func (a *engagementArming) armed(engagement string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, disarmed := a.disarmed[engagement]
+	return !disarmed && inWindows(a.windows[engagement], time.Now())
+}
+
+// set arms or disarms an engagement and saves the state. It reports whether
+// the state changed.
+func (a *engagementArming) set(engagement string, armed bool) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reloadLocked(); err != nil {
+		return false, err
+	}
+	if _, disarmed := a.disarmed[engagement]; disarmed != armed {
+		return false, nil
+	}
+	if armed {
+		delete(a.disarmed, engagement)
+	} else {
+		a.disarmed[engagement] = time.Now().UTC()
+	}
+
+	data, err := json.MarshalIndent(a.disarmed, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(a.path); err == nil {
+		a.mod = info.ModTime()
+	}
+	return true, nil
+}
+
+// engagementState is an engagement as listed by the API and the engagement
+// subcommand.
+type engagementState struct {
+	Name          string     `json:"name"`
+	Armed         bool       `json:"armed"`
+	Disarmed      *time.Time `json:"disarmed,omitempty"`
+	OutsideWindow bool       `json:"outside_window,omitempty"`
+}
+
+// states lists the engagements this instance knows of: -engagement, those of
+// engagements.json and any that are disarmed.
+func (a *engagementArming) states(namespaces []*engagementNamespace) []engagementState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := make(map[string]bool)
+	if Engagement != "" {
+		names[Engagement] = true
+	}
+	for _, ns := range namespaces {
+		names[ns.Name] = true
+	}
+	for name := range a.disarmed {
+		names[name] = true
+	}
+
+	states := make([]engagementState, 0, len(names))
+	for name := range names {
+		s := engagementState{Name: name, Armed: true}
+		if since, disarmed := a.disarmed[name]; disarmed {
+			s.Armed, s.Disarmed = false, &since
+		}
+		if !inWindows(a.windows[name], time.Now()) {
+			s.Armed, s.OutsideWindow = false, true
+		}
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// armedSink passes on the interactions of armed engagements only, for the
+// sinks that notify someone.
+type armedSink struct {
+	next interactionSink
+}
+
+func (s *armedSink) Write(i *Interaction) {
+	if arming.armed(i.Engagement) {
+		s.next.Write(i)
+	}
+}
+
+// handleEngagements serves GET /api/engagements with the armed state of
+// every engagement.
+func handleEngagements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	writeJSON(w, http.StatusOK, arming.states(engagementNamespaces))
+}
+
+// handleArming serves POST /api/engagements/<name>/arm and
+// POST /api/engagements/<name>/disarm.
+func handleArming(audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		engagement, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/engagements/"), "/")
+		if !ok || engagement == "" || (action != "arm" && action != "disarm") {
+			writeJSONError(w, http.StatusNotFound, "expected /api/engagements/<name>/arm or /api/engagements/<name>/disarm")
+			return
+		}
+		changed, err := arming.set(engagement, action == "arm")
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if changed {
+			audit.record(r, "engagement."+action, engagement, "")
+			log.Printf("User %s %sed engagement %q via the API\n", requestUser(r).Name, action, engagement)
+		}
+		for _, s := range arming.states(engagementNamespaces) {
+			if s.Name == engagement {
+				writeJSON(w, http.StatusOK, s)
+				return
+			}
+		}
+	}
+}
+
+// runEngagementCommand implements the "engagement" subcommand.
+func runEngagementCommand(args []string) {
+	if len(args) == 0 || (args[0] != "list" && len(args) != 2) {
+		fmt.Fprintln(os.Stderr, "Usage: cowitness engagement list|arm <name>|disarm <name>")
+		os.Exit(2)
+	}
+	a := newEngagementArming(ArmingFile)
+
+	switch args[0] {
+	case "list":
+		namespaces, err := loadEngagements(EngagementsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.schedule(namespaces)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ENGAGEMENT\tSTATE\tSINCE")
+		for _, s := range a.states(namespaces) {
+			switch {
+			case s.Disarmed != nil:
+				fmt.Fprintf(tw, "%s\tdisarmed\t%s\n", s.Name, s.Disarmed.Format(time.RFC3339))
+			case s.OutsideWindow:
+				fmt.Fprintf(tw, "%s\toutside window\t-\n", s.Name)
+			default:
+				fmt.Fprintf(tw, "%s\tarmed\t-\n", s.Name)
+			}
+		}
+		tw.Flush()
+	case "arm", "disarm":
+		changed, err := a.set(args[1], args[0] == "arm")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !changed {
+			fmt.Printf("Engagement %q is already %sed\n", args[1], args[0])
+			return
+		}
+		openAuditLog(AuditLogFile).recordLocal("engagement."+args[0], args[1], "")
+		fmt.Printf("Engagement %q %sed\n", args[1], args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown engagement command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useArming makes a the arming state for the rest of the test.
+func useArming(t *testing.T, a *engagementArming) {
+	t.Helper()
+	previous := arming
+	arming = a
+	t.Cleanup(func() { arming = previous })
+}
+
+// newURLToken mints a URL token whose alerts go to the returned builder.
+func newURLToken(t *testing.T) (*tokenStore, *CanaryToken, *strings.Builder) {
+	t.Helper()
+	alerts := &strings.Builder{}
+	tokens, err := newTokenStore(filepath.Join(t.TempDir(), "tokens.json"), log.New(alerts, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.mint("url", "arming test", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens, token, alerts
+}
+
+func TestDisarmedTokenDoesNotAlert(t *testing.T) {
+	tokens, token, alerts := newURLToken(t)
+	a := newEngagementArming(filepath.Join(t.TempDir(), "arming.json"))
+	if _, err := a.set(token.Engagement, false); err != nil {
+		t.Fatal(err)
+	}
+	useArming(t, a)
+
+	rec := httptest.NewRecorder()
+	tokens.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, TokenURLPrefix+token.ID, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want the pixel", rec.Code)
+	}
+	if alerts.Len() != 0 {
+		t.Errorf("disarmed token alerted: %q", alerts.String())
+	}
+	if token.Fired != 1 {
+		t.Errorf("token fired %d times, want 1", token.Fired)
+	}
+
+	if _, err := a.set(token.Engagement, true); err != nil {
+		t.Fatal(err)
+	}
+	tokens.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, TokenURLPrefix+token.ID, nil))
+	if !strings.Contains(alerts.String(), "Token: "+token.ID) {
+		t.Errorf("armed token didn't alert: %q", alerts.String())
+	}
+}
+
+func TestDisarmedRuleDoesNotAlert(t *testing.T) {
+	a := newEngagementArming(filepath.Join(t.TempDir(), "arming.json"))
+	if _, err := a.set("quiet", false); err != nil {
+		t.Fatal(err)
+	}
+	useArming(t, a)
+
+	var alerts strings.Builder
+	sink := &collectSink{}
+	e := &ruleEngine{alerts: log.New(&alerts, "", 0), next: sink, rules: []*alertRule{{Name: "admin", Field: "path", Contains: "admin"}}}
+	e.Write(&Interaction{Engagement: "quiet", Protocol: "http", Path: "/admin"})
+	if alerts.Len() != 0 {
+		t.Errorf("disarmed engagement alerted: %q", alerts.String())
+	}
+	if list := sink.interactions(); len(list) != 1 || !hasTag(list[0], "rule:admin") {
+		t.Errorf("interaction not recorded with its rule tag: %+v", list)
+	}
+
+	e.Write(&Interaction{Engagement: "loud", Protocol: "http", Path: "/admin"})
+	if !strings.Contains(alerts.String(), "Rule: admin") {
+		t.Errorf("armed engagement didn't alert: %q", alerts.String())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ASNSeenFile remembers the networks seen per engagement, so a network
+// stays known across restarts.
+const ASNSeenFile = "./asn-seen.json"
+
+// newASNTag marks the first interaction from a network in its engagement.
+const newASNTag = "new-asn"
+
+var ASNFile string
+
+// asnDatabase names the network of source addresses from a file of address
+// ranges and their AS numbers, such as the DB-IP lite ASN CSV file or the
+// iptoasn.com TSV file:
+//
+//	1.0.0.0,1.0.0.255,13335,"Cloudflare, Inc."
+//
+// The AS number and organization are recorded under "asn". The first
+// interaction from a network in an engagement is tagged newASNTag, so a
+// corporate network touching a canary for the first time stands out from
+// the cloud providers scanners keep coming from.
+type asnDatabase struct {
+	*ipRangeTable
+
+	mu   sync.Mutex
+	seen map[string]map[string]time.Time // engagement, AS number, first seen
+}
+
+func loadASNDatabase(path string) (*asnDatabase, error) {
+	table, err := loadIPRanges(path, func(columns []string) (string, bool) {
+		number := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(columns[0])), "AS")
+		if number == "" || number == "0" {
+			return "", false // not routed
+		}
+		network := "AS" + number
+		if org := strings.TrimSpace(columns[len(columns)-1]); len(columns) > 1 && org != "" && org != "Not routed" {
+			network += " " + org
+		}
+		return network, true
+	})
+	if err != nil {
+		return nil, err
+	}
+	db := &asnDatabase{ipRangeTable: table, seen: make(map[string]map[string]time.Time)}
+	data, err := os.ReadFile(ASNSeenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &db.seen); err != nil {
+			return nil, err
+		}
+	}
+	infof("Naming source networks with %d ranges from %s\n", len(table.ranges), path)
+	return db, nil
+}
+
+// asnNumber returns the AS number of a network as recorded under "asn".
+func asnNumber(network string) string {
+	number, _, _ := strings.Cut(network, " ")
+	return number
+}
+
+// firstSeen reports whether network has not been seen in engagement before,
+// and remembers it.
+func (db *asnDatabase) firstSeen(engagement, network string, at time.Time) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	number := asnNumber(network)
+	if _, ok := db.seen[engagement][number]; ok {
+		return false
+	}
+	if db.seen[engagement] == nil {
+		db.seen[engagement] = make(map[string]time.Time)
+	}
+	db.seen[engagement][number] = at.UTC()
+
+	data, err := json.MarshalIndent(db.seen, "", "  ")
+	if err == nil {
+		tmp := ASNSeenFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, ASNSeenFile)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+func (db *asnDatabase) name() string { return "asn" }
+
+func (db *asnDatabase) timeout() time.Duration { return enrichLocalTimeout }
+
+func (db *asnDatabase) applies(i *Interaction) bool {
+	return net.ParseIP(i.RemoteIP) != nil && i.Enrichment["asn"] == ""
+}
+
+func (db *asnDatabase) enrich(ctx context.Context, i *Interaction) (func(*Interaction), error) {
+	network := db.lookup(net.ParseIP(i.RemoteIP))
+	if network == "" || i.Noise {
+		return func(i *Interaction) { setEnrichment(i, "asn", network) }, nil
+	}
+	isNew := db.firstSeen(i.Engagement, network, i.Time)
+	if isNew {
+		engagement := ""
+		if i.Engagement != "" {
+			engagement = " in engagement " + i.Engagement
+		}
+		log.Printf("First interaction from network %s%s, from %s\n", network, engagement, i.RemoteIP)
+	}
+	return func(i *Interaction) {
+		setEnrichment(i, "asn", network)
+		if isNew && !hasTag(i, newASNTag) {
+			i.Tags = append(i.Tags, newASNTag)
+		}
+	}, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+const AuditLogFile = "./audit.log"
+
+// auditEntry records who did what through the API or the subcommands.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	Role     string    `json:"role,omitempty"`
+	RemoteIP string    `json:"remote_ip,omitempty"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// auditLog is an append-only JSON lines file. It is never rotated or
+// truncated by CoWitness itself.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAuditLog(path string) *auditLog {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &auditLog{f: f}
+}
+
+func (a *auditLog) write(e auditEntry) {
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
+
+// record audits an action taken by the authenticated caller of an API request.
+func (a *auditLog) record(r *http.Request, action, target, detail string) {
+	e := auditEntry{
+		RemoteIP: remoteIP(r),
+		Action:   action,
+		Target:   target,
+		Detail:   detail,
+	}
+	if u := requestUser(r); u != nil {
+		e.User, e.Role = u.Name, u.Role
+	}
+	a.write(e)
+}
+
+// recordLocal audits an action taken with a subcommand on the server itself.
+func (a *auditLog) recordLocal(action, target, detail string) {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	a.write(auditEntry{User: "local:" + name, Action: action, Target: target, Detail: detail})
+}
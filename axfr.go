@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const zoneTransferTag = "zone-transfer"
+
+var ZoneTransfer string
+
+// defaultDecoyZone is served to zone transfers when zone.json has no decoy
+// section: a few names worth probing, all pointing back at CoWitness so the
+// follow-up requests are captured too.
+func defaultDecoyZone() []*zoneRecord {
+	records := []*zoneRecord{
+		{Name: "@", Type: "MX", Value: "10 mail." + DNSResponseName},
+		{Name: "@", Type: "TXT", Value: "v=spf1 mx -all"},
+	}
+	for _, name := range []string{"www", "mail", "vpn", "dev", "gitlab", "jenkins", "backup"} {
+		records = append(records, &zoneRecord{Name: name, Type: "A", Value: DNSResponseIP})
+	}
+	return records
+}
+
+func isZoneTransfer(q dns.Question) bool {
+	return q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR
+}
+
+// raiseZoneTransferAlert flags a transfer attempt, nobody has a reason to
+// transfer the callback zone but someone mapping it.
+func raiseZoneTransferAlert(alertLogger *log.Logger, ipAddress, detail string) {
+	alertLogger.Printf("Zone transfer: Protocol: DNS, IP address: %s, Detail: %s\n", ipAddress, detail)
+	log.Printf("ALERT: zone transfer attempted from %s: %s\n", ipAddress, detail)
+}
+
+// answerZoneTransfer refuses AXFR and IXFR, or with -zone-transfer decoy
+// answers them with a full transfer of the decoy zone. Transfers need TCP,
+// so over UDP the decoy answer is an empty truncated reply asking the client
+// to retry over TCP.
+func answerZoneTransfer(w dns.ResponseWriter, r *dns.Msg, zone *dnsZone) {
+	response := new(dns.Msg)
+	q := r.Question[0]
+	switch {
+	case ZoneTransfer != "decoy" || !strings.EqualFold(q.Name, DNSResponseName):
+		response.SetRcode(r, dns.RcodeRefused)
+	case w.LocalAddr().Network() == "udp":
+		response.SetReply(r)
+		response.Truncated = true
+	default:
+		response.SetReply(r)
+		response.Authoritative = true
+		response.Answer = decoyTransfer(zone)
+	}
+	writeDNSResponse(w, r, response)
+}
+
+// decoyTransfer builds the records of an AXFR answer: the SOA, the name
+// servers and the decoy records, closed by the SOA again.
+func decoyTransfer(zone *dnsZone) []dns.RR {
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: DNSResponseName, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zone.ttl(DNSResponseName, dns.TypeSOA)},
+		Ns:      "ns1." + DNSResponseName,
+		Mbox:    "hostmaster." + DNSResponseName,
+		Serial:  decoySerial(time.Now().UTC()),
+		Refresh: 3600,
+		Retry:   900,
+		Expire:  1209600,
+		Minttl:  300,
+	}
+	rrs := []dns.RR{soa}
+	for _, ns := range []string{"ns1.", "ns2."} {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: DNSResponseName, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zone.ttl(DNSResponseName, dns.TypeNS)},
+			Ns:  ns + DNSResponseName,
+		})
+	}
+
+	records := zone.decoy()
+	if len(records) == 0 {
+		records = defaultDecoyZone()
+	}
+	for _, record := range records {
+		name := DNSResponseName
+		if record.Name != "@" {
+			name = record.Name + "." + DNSResponseName
+		}
+		ttl := zone.ttl(name, dns.StringToType[record.Type])
+		if record.TTL != nil {
+			ttl = uint32(*record.TTL)
+		}
+		rr, err := record.rr(name, ttl, nil)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return append(rrs, soa)
+}
+
+// decoySerial is today's date in the usual YYYYMMDDnn serial format.
+func decoySerial(t time.Time) uint32 {
+	return uint32(t.Year())*1000000 + uint32(t.Month())*10000 + uint32(t.Day())*100 + 1
+}
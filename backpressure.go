@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A queue at three quarters of its size is overloaded and keeps only one
+	// in noiseSampleRate noise interactions.
+	queueOverloadNumerator   = 3
+	queueOverloadDenominator = 4
+	noiseSampleRate          = 10
+	dropReportInterval       = time.Minute
+)
+
+// sinkQueue is the bounded queue in front of a sink that talks to the
+// network or a database. When the sink can't keep up the queue degrades in
+// steps instead of dropping whatever comes next: once it is overloaded only
+// a sample of the noise goes through, once it is full other interactions
+// are dropped, and interactions correlated with a canary token wait for room
+// instead, as they are the ones an engagement depends on. They wait in a
+// goroutine of their own, so the protocol handler doesn't, and may reach the
+// sink out of order. Everything dropped is counted and exposed on
+// /api/metrics.
+type sinkQueue struct {
+	name    string
+	queue   chan *Interaction
+	noise   atomic.Uint64
+	sampled atomic.Uint64
+	dropped atomic.Uint64
+	waited  atomic.Uint64
+}
+
+func newSinkQueue(name string, size int) *sinkQueue {
+	q := &sinkQueue{name: name, queue: make(chan *Interaction, size)}
+	queueMetrics.register(q)
+	return q
+}
+
+// offer queues i and reports whether it was queued.
+func (q *sinkQueue) offer(i *Interaction) bool {
+	if i.Noise && len(q.queue)*queueOverloadDenominator >= cap(q.queue)*queueOverloadNumerator &&
+		q.noise.Add(1)%noiseSampleRate != 0 {
+		q.sampled.Add(1)
+		return false
+	}
+	select {
+	case q.queue <- i:
+		return true
+	default:
+	}
+	if i.Token == "" {
+		q.dropped.Add(1)
+		return false
+	}
+	q.waited.Add(1)
+	go func() { q.queue <- i }()
+	return true
+}
+
+// drop counts interactions a sink gave up on after queueing them, such as
+// the forwarder's backlog overflowing.
+func (q *sinkQueue) drop(n int) {
+	q.dropped.Add(uint64(n))
+}
+
+// queueMetrics holds every sinkQueue of the process.
+var queueMetrics = &sinkQueues{}
+
+type sinkQueues struct {
+	mu     sync.Mutex
+	queues []*sinkQueue
+	report sync.Once
+}
+
+func (s *sinkQueues) register(q *sinkQueue) {
+	s.mu.Lock()
+	s.queues = append(s.queues, q)
+	s.mu.Unlock()
+	s.report.Do(func() { go s.reportDrops() })
+}
+
+func (s *sinkQueues) list() []*sinkQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queues := append([]*sinkQueue(nil), s.queues...)
+	sort.SliceStable(queues, func(a, b int) bool { return queues[a].name < queues[b].name })
+	return queues
+}
+
+// reportDrops logs what each queue dropped in the last interval, instead of
+// a line per interaction that would only add to the overload.
+func (s *sinkQueues) reportDrops() {
+	last := make(map[*sinkQueue][2]uint64)
+	for range time.Tick(dropReportInterval) {
+		for _, q := range s.list() {
+			now := [2]uint64{q.sampled.Load(), q.dropped.Load()}
+			sampled, dropped := now[0]-last[q][0], now[1]-last[q][1]
+			last[q] = now
+			if sampled > 0 || dropped > 0 {
+				log.Printf("%s can't keep up: dropped %d interaction(s) and sampled away %d noise interaction(s) in the last %s\n", q.name, dropped, sampled, dropReportInterval)
+			}
+		}
+	}
+}
+
+// handleMetrics serves GET /api/metrics: the queue lengths and drop counters
+// in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	queues := queueMetrics.list()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, "# HELP cowitness_queue_length Interactions waiting for a sink.\n# TYPE cowitness_queue_length gauge\n")
+	for _, q := range queues {
+		fmt.Fprintf(w, "cowitness_queue_length{sink=%q} %d\n", q.name, len(q.queue))
+	}
+	fmt.Fprint(w, "# HELP cowitness_queue_capacity Size of a sink's queue.\n# TYPE cowitness_queue_capacity gauge\n")
+	for _, q := range queues {
+		fmt.Fprintf(w, "cowitness_queue_capacity{sink=%q} %d\n", q.name, cap(q.queue))
+	}
+	fmt.Fprint(w, "# HELP cowitness_dropped_interactions_total Interactions a sink never received.\n# TYPE cowitness_dropped_interactions_total counter\n")
+	for _, q := range queues {
+		fmt.Fprintf(w, "cowitness_dropped_interactions_total{sink=%q,reason=\"noise_sampled\"} %d\n", q.name, q.sampled.Load())
+		fmt.Fprintf(w, "cowitness_dropped_interactions_total{sink=%q,reason=\"queue_full\"} %d\n", q.name, q.dropped.Load())
+	}
+	fmt.Fprint(w, "# HELP cowitness_token_waits_total Token interactions that had to wait for room in a full queue.\n# TYPE cowitness_token_waits_total counter\n")
+	for _, q := range queues {
+		fmt.Fprintf(w, "cowitness_token_waits_total{sink=%q} %d\n", q.name, q.waited.Load())
+	}
+}
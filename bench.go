@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// benchResult is the outcome of one load test, as printed and as saved with
+// -o for a later -baseline run.
+type benchResult struct {
+	Target      string        `json:"target"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"duration"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	Rate        float64       `json:"rate"`
+	P50         time.Duration `json:"p50"`
+	P90         time.Duration `json:"p90"`
+	P99         time.Duration `json:"p99"`
+	Max         time.Duration `json:"max"`
+}
+
+// runBenchCommand implements the "bench" subcommand. It loads a running
+// instance with DNS queries and HTTP requests from -c concurrent clients and
+// reports the rate and latency percentiles, so changes to the hot paths can
+// be measured before and after. With -baseline it fails when a rate dropped
+// by more than -tolerance against an earlier run saved with -o.
+//
+// Every query and request is recorded as an interaction, so point it at an
+// instance that isn't used for an engagement.
+func runBenchCommand(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	dnsAddr := fs.String("dns", "", "DNS listener to query, e.g. 127.0.0.1:53")
+	qname := fs.String("qname", "bench.example.com", "name to query, a random label is prepended to every query")
+	httpURL := fs.String("http", "", "URL to request, e.g. http://127.0.0.1/bench")
+	concurrency := fs.Int("c", 32, "number of concurrent clients")
+	duration := fs.Duration("d", 10*time.Second, "duration of each load test")
+	output := fs.String("o", "", "save the results as JSON to this file")
+	baseline := fs.String("baseline", "", "compare the rates with the results saved in this file")
+	tolerance := fs.Float64("tolerance", 10, "percentage a rate may drop below -baseline")
+	fs.Parse(args)
+
+	if *dnsAddr == "" && *httpURL == "" {
+		fmt.Fprintln(os.Stderr, "Usage: cowitness bench -dns host:port | -http URL [flags]")
+		os.Exit(2)
+	}
+	if *concurrency <= 0 {
+		log.Fatalf("Invalid -c value %d, expected a positive number", *concurrency)
+	}
+	if *duration <= 0 {
+		log.Fatalf("Invalid -d value %s, expected a positive duration", *duration)
+	}
+
+	var results []*benchResult
+	if *dnsAddr != "" {
+		results = append(results, runBench("dns "+*dnsAddr, *concurrency, *duration, dnsBenchClient(*dnsAddr, dns.Fqdn(*qname))))
+	}
+	if *httpURL != "" {
+		results = append(results, runBench("http "+*httpURL, *concurrency, *duration, httpBenchClient(*httpURL, *concurrency)))
+	}
+
+	fmt.Printf("%-40s %10s %8s %10s %10s %10s %10s %10s\n", "TARGET", "REQUESTS", "ERRORS", "RATE/S", "P50", "P90", "P99", "MAX")
+	for _, r := range results {
+		fmt.Printf("%-40s %10d %8d %10.0f %10s %10s %10s %10s\n", r.Target, r.Requests, r.Errors, r.Rate,
+			r.P50.Round(time.Microsecond), r.P90.Round(time.Microsecond), r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond))
+	}
+
+	if *output != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*output, append(data, '\n'), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *baseline != "" && !compareBench(*baseline, results, *tolerance) {
+		os.Exit(1)
+	}
+}
+
+// runBench sends requests from concurrency goroutines for duration. Each
+// goroutine gets its own request function from newClient.
+func runBench(target string, concurrency int, duration time.Duration, newClient func() func() error) *benchResult {
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errors    int
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	deadline := time.Now().Add(duration)
+	start := time.Now()
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := newClient()
+			var own []time.Duration
+			failed := 0
+			var lastErr error
+			for time.Now().Before(deadline) {
+				began := time.Now()
+				if err := request(); err != nil {
+					failed++
+					lastErr = err
+					continue
+				}
+				own = append(own, time.Since(began))
+			}
+			mu.Lock()
+			latencies = append(latencies, own...)
+			errors += failed
+			if firstErr == nil {
+				firstErr = lastErr
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		log.Printf("%s: %d error(s), e.g. %v\n", target, errors, firstErr)
+	}
+
+	r := &benchResult{Target: target, Concurrency: concurrency, Duration: duration, Requests: len(latencies), Errors: errors}
+	r.Rate = float64(len(latencies)) / elapsed.Seconds()
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+		percentile := func(p int) time.Duration { return latencies[(len(latencies)-1)*p/100] }
+		r.P50, r.P90, r.P99, r.Max = percentile(50), percentile(90), percentile(99), latencies[len(latencies)-1]
+	}
+	return r
+}
+
+// dnsBenchClient queries qname with a random label, over one UDP socket per
+// client.
+func dnsBenchClient(addr, qname string) func() func() error {
+	return func() func() error {
+		client := &dns.Client{Timeout: 2 * time.Second}
+		var conn *dns.Conn
+		return func() error {
+			if conn == nil {
+				var err error
+				if conn, err = client.Dial(addr); err != nil {
+					return err
+				}
+			}
+			msg := new(dns.Msg)
+			msg.SetQuestion(newID()[:8]+"."+qname, dns.TypeA)
+			resp, _, err := client.ExchangeWithConn(msg, conn)
+			if err != nil {
+				// A late answer would be read as the answer to the next
+				// query, so start over on a new socket.
+				conn.Close()
+				conn = nil
+				return err
+			}
+			if resp.Rcode != dns.RcodeSuccess {
+				return fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+			}
+			return nil
+		}
+	}
+}
+
+// httpBenchClient requests url over keep-alive connections shared by the
+// clients.
+func httpBenchClient(url string, concurrency int) func() func() error {
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: concurrency, DisableCompression: true},
+	}
+	request := func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	}
+	return func() func() error { return request }
+}
+
+// compareBench reports whether every target of results reached its rate in
+// the baseline file within tolerance percent.
+func compareBench(path string, results []*benchResult, tolerance float64) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var baseline []*benchResult
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	rates := make(map[string]float64)
+	for _, r := range baseline {
+		rates[r.Target] = r.Rate
+	}
+
+	ok := true
+	for _, r := range results {
+		before, found := rates[r.Target]
+		if !found || before == 0 {
+			fmt.Printf("%s: not in %s\n", r.Target, path)
+			continue
+		}
+		change := (r.Rate - before) / before * 100
+		verdict := "ok"
+		if change < -tolerance {
+			verdict, ok = "REGRESSION", false
+		}
+		fmt.Printf("%s: %.0f/s against %.0f/s (%+.1f%%) %s\n", r.Target, r.Rate, before, change, verdict)
+	}
+	if !ok {
+		fmt.Printf("Rates dropped by more than %g%%\n", tolerance)
+	}
+	return ok
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The benchmarks run the hot paths in process, without the network, so
+// go test -bench measures the handlers themselves. The bench subcommand
+// load tests a running instance instead.
+
+// quietLog silences the per-request log lines for the rest of the benchmark.
+func quietLog(b *testing.B) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+}
+
+func BenchmarkHandleDNSQuery(b *testing.B) {
+	quietLog(b)
+	query := new(dns.Msg)
+	query.SetQuestion("probe.fuzz.invalid.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+	// fuzzDNS sets up the services on its first call.
+	fuzzDNS(packed)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		handleDNSQuery(&fuzzDNSWriter{}, query, fuzzDNSServices)
+	}
+}
+
+func BenchmarkHTTPHandler(b *testing.B) {
+	quietLog(b)
+	dir := b.TempDir()
+	discard := log.New(io.Discard, "", 0)
+	noise, err := newNoiseFilter("log", "", discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	payloads, err := newPayloadStore(filepath.Join(dir, "payloads"), filepath.Join(dir, "payloads.json"), discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tokens, err := newTokenStore(filepath.Join(dir, "tokens.json"), discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler := newHTTPHandler(nil, &httpServices{
+		rootDir:      dir,
+		httpLogger:   discard,
+		uploadLogger: discard,
+		secretLogger: discard,
+		alertLogger:  discard,
+		events:       newSignatureTagger(SignatureFile, discardSink{}),
+		noise:        noise,
+		payloads:     payloads,
+		tokens:       tokens,
+	})
+	body := "user=admin&password=hunter2"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		req := httptest.NewRequest(http.MethodPost, "/bench/login?next=%2F", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:50000"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkDecodeBody(b *testing.B) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(bytes.Repeat([]byte(`{"user":"admin","password":"hunter2"}`), 256))
+	w.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(gz.Len()))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		decodeBody(gz.Bytes(), "gzip")
+	}
+}
+
+func BenchmarkJA3(b *testing.B) {
+	hello, complete := clientHello(tlsHelloFuzzSeeds()[0])
+	if !complete || hello == nil {
+		b.Fatal("no ClientHello captured")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ja3Digest(hello)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	BodyDir     string
+	BodyQuotaMB int64
+)
+
+var errDiskQuota = errors.New("disk quota for captured bodies exceeded")
+
+// diskQuota caps the disk space used by spooled request bodies and uploads
+// together, so a flood of large requests can't fill the disk. A nil quota
+// is unlimited. Files deleted from its directories, by hand or by a cleanup
+// job, are given back the next time the quota runs full.
+type diskQuota struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	dirs    []string
+	scanned time.Time
+}
+
+const quotaRescanInterval = 30 * time.Second
+
+// newDiskQuota starts from the size of the files already in dirs.
+func newDiskQuota(limit int64, dirs ...string) *diskQuota {
+	q := &diskQuota{limit: limit, dirs: dirs}
+	q.rescanLocked()
+	return q
+}
+
+// rescanLocked sets the used space to the size of the files in the quota's
+// directories.
+func (q *diskQuota) rescanLocked() {
+	q.used, q.scanned = 0, time.Now()
+	for _, dir := range q.dirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					q.used += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// reserve claims n bytes, or reports false when they don't fit. A full
+// quota measures the directories again, at most every quotaRescanInterval,
+// in case files were deleted.
+func (q *diskQuota) reserve(n int64) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used+n > q.limit && time.Since(q.scanned) >= quotaRescanInterval {
+		q.rescanLocked()
+	}
+	if q.used+n > q.limit {
+		return false
+	}
+	q.used += n
+	return true
+}
+
+// release gives back n reserved bytes that weren't written.
+func (q *diskQuota) release(n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used -= n; q.used < 0 {
+		q.used = 0
+	}
+}
+
+// quotaWriter fails with errDiskQuota once the quota is used up.
+type quotaWriter struct {
+	w     io.Writer
+	quota *diskQuota
+}
+
+func (w quotaWriter) Write(p []byte) (int, error) {
+	if !w.quota.reserve(int64(len(p))) {
+		return 0, errDiskQuota
+	}
+	n, err := w.w.Write(p)
+	w.quota.release(int64(len(p) - n))
+	return n, err
+}
+
+type spoolKey struct{}
+
+// spooledRequest carries a large body being written to disk from the
+// request logger, which starts the spool, to spoolBodies, which finishes it
+// once the handler is done.
+type spooledRequest struct {
+	file        *os.File
+	path        string
+	hash        hash.Hash
+	size        int64
+	truncated   bool
+	body        io.Reader
+	interaction *Interaction
+	events      interactionSink
+	// upload is the interaction of a request to the upload endpoint, which
+	// handleUpload completes with the stored files.
+	upload *Interaction
+}
+
+// Write receives the body as it is read, by the handler or by the final
+// drain, and keeps as much of it as the quota allows.
+func (s *spooledRequest) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	if s.truncated {
+		return len(p), nil
+	}
+	if _, err := (quotaWriter{s.file, bodyQuota}).Write(p); err != nil {
+		if err != errDiskQuota {
+			log.Println(err)
+		}
+		s.truncated = true
+		return len(p), nil
+	}
+	s.hash.Write(p)
+	return len(p), nil
+}
+
+// bodyQuota is shared by the spool and the upload handler.
+var bodyQuota *diskQuota
+
+// spoolBodies lets the request logger stream bodies larger than the part
+// kept in the interaction to BodyDir. The interaction is only recorded
+// once the whole body went through, with its size and hash. Uploads are
+// likewise recorded once the upload handler stored them.
+func spoolBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spool := &spooledRequest{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), spoolKey{}, spool)))
+		if spool.file != nil {
+			spool.finish()
+		}
+		if spool.upload != nil {
+			spool.events.Write(spool.upload)
+		}
+	})
+}
+
+// spoolBody starts spooling the body of r to disk, returning false when
+// the request isn't served through spoolBodies or the file can't be
+// created. Uploads aren't spooled, the upload handler stores them itself.
+func spoolBody(r *http.Request, i *Interaction, events interactionSink) bool {
+	spool, ok := r.Context().Value(spoolKey{}).(*spooledRequest)
+	if !ok || strings.HasPrefix(r.URL.Path, UploadURLPrefix) {
+		return false
+	}
+	if err := os.MkdirAll(BodyDir, 0700); err != nil {
+		log.Println(err)
+		return false
+	}
+	path := filepath.Join(BodyDir, i.ID+".body")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	spool.file, spool.path, spool.hash = f, path, sha256.New()
+	spool.interaction, spool.events = i, events
+	spool.body = io.TeeReader(r.Body, spool)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{spool.body, r.Body}
+	return true
+}
+
+// finish reads what the handler left of the body, while the quota lasts,
+// and records the interaction.
+func (s *spooledRequest) finish() {
+	buf := make([]byte, 32<<10)
+	for !s.truncated {
+		if _, err := s.body.Read(buf); err != nil {
+			break
+		}
+	}
+	if err := s.file.Close(); err != nil {
+		log.Println(err)
+	}
+
+	i := s.interaction
+	i.Data = fmt.Sprintf("Body: %d bytes, SHA256: %s, File: %s", s.size, hex.EncodeToString(s.hash.Sum(nil)), s.path)
+	if s.truncated {
+		i.Data = fmt.Sprintf("Body: %d bytes read, truncated at the disk quota, File: %s", s.size, s.path)
+	}
+	s.events.Write(i)
+	verbosef("Spooled the %d byte request body of interaction %s to %s\n", s.size, i.ID, s.path)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskQuotaLimit(t *testing.T) {
+	q := newDiskQuota(100)
+	if !q.reserve(60) || !q.reserve(40) {
+		t.Fatal("reservations within the limit refused")
+	}
+	if q.reserve(1) {
+		t.Fatal("reservation over the limit granted")
+	}
+	q.release(40)
+	if !q.reserve(30) {
+		t.Fatal("released bytes not given back")
+	}
+}
+
+func TestDiskQuotaRescansDeletedFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "old.body")
+	if err := os.WriteFile(file, make([]byte, 600), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q := newDiskQuota(1000, dir)
+	if q.reserve(500) {
+		t.Fatal("reservation over the limit granted")
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if q.reserve(500) {
+		t.Fatal("directories measured again before quotaRescanInterval")
+	}
+	q.scanned = time.Now().Add(-quotaRescanInterval)
+	if !q.reserve(500) {
+		t.Fatal("deleted file still counted against the quota")
+	}
+}
+
+// shortWriter writes half of every buffer.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, errors.New("disk full")
+}
+
+func TestQuotaWriterReleasesUnwrittenBytes(t *testing.T) {
+	q := newDiskQuota(100)
+	if _, err := (quotaWriter{shortWriter{}, q}).Write(make([]byte, 80)); err == nil {
+		t.Fatal("write error lost")
+	}
+	if q.used != 40 {
+		t.Fatalf("%d bytes used, want 40", q.used)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// bootstrapProviders holds what differs between the cloud providers: the
+// default region and size, and how a VPS learns its public address from the
+// metadata service.
+var bootstrapProviders = map[string]struct {
+	region, size string
+	publicIP     string
+}{
+	"aws": {"us-east-1", "t3.micro",
+		`TOKEN=$(curl -fsS -X PUT http://169.254.169.254/latest/api/token -H 'X-aws-ec2-metadata-token-ttl-seconds: 60'); curl -fsS -H "X-aws-ec2-metadata-token: $TOKEN" http://169.254.169.254/latest/meta-data/public-ipv4`},
+	"do":      {"fra1", "s-1vcpu-1gb", `curl -fsS http://169.254.169.254/metadata/v1/interfaces/public/0/ipv4/address`},
+	"hetzner": {"fsn1", "cx22", `curl -fsS http://169.254.169.254/hetzner/v1/metadata/public-ipv4`},
+}
+
+// bootstrapName also names Terraform resources.
+var bootstrapName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// bootstrapPort is a port the firewall opens.
+type bootstrapPort struct {
+	Protocol string
+	Port     int
+	Admin    bool // only from -admin-cidr
+}
+
+type bootstrapConfig struct {
+	Provider  string
+	Name      string
+	Domain    string
+	Listen    string
+	APIAddr   string
+	Version   string
+	Repo      string
+	Key       string
+	Region    string
+	Size      string
+	AdminCIDR string
+	PublicIP  string
+	Ports     []bootstrapPort
+}
+
+// runBootstrapCommand implements the "bootstrap" subcommand. It writes the
+// cloud-init user data, or a Terraform configuration around it, that turns a
+// fresh Ubuntu VPS into a CoWitness server for a domain: the release binary
+// checked against its checksum, a config file, a systemd unit, the firewall
+// and systemd-resolved moved off port 53. The NS and glue records the parent
+// zone needs are printed as hints.
+func runBootstrapCommand(args []string) {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	provider := fs.String("provider", "", "cloud provider: aws, do (DigitalOcean) or hetzner")
+	format := fs.String("format", "cloud-init", "output: cloud-init user data or a terraform configuration")
+	domain := fs.String("domain", "", "callback zone the server is authoritative for, e.g. oob.example.com")
+	listen := fs.String("listen", "http:80,https:443,dns:53", "listeners of the server, as for -listen")
+	apiAddr := fs.String("api-addr", "127.0.0.1:8053", "address of the operator API, reached over an SSH tunnel when on loopback")
+	version := fs.String("version", Version, "release installed on the server")
+	repo := fs.String("repo", UpdateRepo, "GitHub repository the release is downloaded from")
+	key := fs.String("key", UpdateKey, "minisign public key the release checksums are verified with (default only the checksums are checked)")
+	name := fs.String("name", "cowitness", "name of the server and its cloud resources")
+	region := fs.String("region", "", "terraform: region or location (default us-east-1, fra1 or fsn1)")
+	size := fs.String("size", "", "terraform: instance type or size (default t3.micro, s-1vcpu-1gb or cx22)")
+	adminCIDR := fs.String("admin-cidr", "0.0.0.0/0", "addresses allowed to reach SSH and a non-loopback operator API")
+	output := fs.String("o", "", "output file (default standard output)")
+	fs.Parse(args)
+
+	p, ok := bootstrapProviders[*provider]
+	if !ok {
+		log.Fatalf("Invalid -provider value %q, expected aws, do or hetzner", *provider)
+	}
+	if *format != "cloud-init" && *format != "terraform" {
+		log.Fatalf("Invalid -format value %q, expected cloud-init or terraform", *format)
+	}
+	if !bootstrapName.MatchString(*name) {
+		log.Fatalf("Invalid -name value %q, expected letters, digits, - and _", *name)
+	}
+	zone := strings.ToLower(strings.TrimSuffix(*domain, "."))
+	if _, ok := dns.IsDomainName(zone); !ok || !strings.Contains(zone, ".") {
+		log.Fatalf("Invalid -domain value %q, expected a domain name such as oob.example.com", *domain)
+	}
+	if _, err := net.ResolveTCPAddr("tcp", *apiAddr); *apiAddr != "" && err != nil {
+		log.Fatalf("Invalid -api-addr value %q: %v", *apiAddr, err)
+	}
+	if _, _, err := net.ParseCIDR(*adminCIDR); err != nil {
+		log.Fatalf("Invalid -admin-cidr value %q: %v", *adminCIDR, err)
+	}
+	if *key != "" {
+		if _, err := parseMinisignKey(*key); err != nil {
+			log.Fatalf("-key: %v", err)
+		}
+	}
+	ports, err := bootstrapPorts(*listen, *apiAddr)
+	if err != nil {
+		log.Fatalf("-listen: %v", err)
+	}
+
+	c := &bootstrapConfig{
+		Provider: *provider, Name: *name, Domain: zone, Listen: *listen, APIAddr: *apiAddr,
+		Version: *version, Repo: *repo, Key: *key, Region: *region, Size: *size,
+		AdminCIDR: *adminCIDR, PublicIP: p.publicIP, Ports: ports,
+	}
+	if c.Region == "" {
+		c.Region = p.region
+	}
+	if c.Size == "" {
+		c.Size = p.size
+	}
+
+	var out bytes.Buffer
+	userData, err := renderBootstrap(cloudInitTemplate, c)
+	if err == nil && *format == "terraform" {
+		err = bootstrapTemplates.ExecuteTemplate(&out, "terraform-"+c.Provider, struct {
+			*bootstrapConfig
+			UserData string
+		}{c, userData})
+	} else {
+		out.WriteString(userData)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		fmt.Print(out.String())
+	} else if err := os.WriteFile(*output, out.Bytes(), 0o644); err != nil {
+		log.Fatal(err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Wrote %s %s for %s to %s\n", c.Provider, *format, zone, *output)
+	}
+	fmt.Fprintf(os.Stderr, "Delegate %s to the server at the parent zone's DNS provider:\n%s", zone, delegationHints(zone, "<server IP>"))
+}
+
+// bootstrapPorts lists the ports the firewall opens for the listeners, DNS
+// over both UDP and TCP, and SSH and the operator API for administration.
+func bootstrapPorts(listen, apiAddr string) ([]bootstrapPort, error) {
+	listeners, err := parseListen(listen)
+	if err != nil {
+		return nil, err
+	}
+	var ports []bootstrapPort
+	seen := make(map[bootstrapPort]bool)
+	add := func(p bootstrapPort) {
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	for _, l := range listeners {
+		if l.network() == "tcp" && l.Port == 22 {
+			return nil, fmt.Errorf("port 22 is kept for administering the server over SSH, listen on another port such as ssh:2222")
+		}
+		add(bootstrapPort{Protocol: l.network(), Port: l.Port})
+		if l.Module == "dns" {
+			add(bootstrapPort{Protocol: "tcp", Port: l.Port})
+		}
+	}
+	add(bootstrapPort{Protocol: "tcp", Port: 22, Admin: true})
+	if host, port, err := net.SplitHostPort(apiAddr); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			var n int
+			fmt.Sscan(port, &n)
+			add(bootstrapPort{Protocol: "tcp", Port: n, Admin: true})
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		return ports[i].Protocol > ports[j].Protocol
+	})
+	return ports, nil
+}
+
+// delegationHints returns the records delegating zone to the server.
+func delegationHints(zone, ip string) string {
+	return fmt.Sprintf("  %s. NS ns1.%s.\n  ns1.%s. A %s\n", zone, zone, zone, ip)
+}
+
+func renderBootstrap(name string, c *bootstrapConfig) (string, error) {
+	var b bytes.Buffer
+	err := bootstrapTemplates.ExecuteTemplate(&b, name, c)
+	return b.String(), err
+}
+
+// bootstrapUnit is the systemd unit of the server. It runs as its own user
+// with only the capability to bind ports below 1024.
+const bootstrapUnit = `[Unit]
+Description=CoWitness callback server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+User=cowitness
+Group=cowitness
+WorkingDirectory=/var/lib/cowitness
+ExecStart=/usr/local/bin/cowitness -config /etc/cowitness/cowitness.yaml -no-banner
+StandardInput=null
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+NoNewPrivileges=true
+ProtectSystem=strict
+ProtectHome=true
+PrivateTmp=true
+ReadWritePaths=/var/lib/cowitness
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const cloudInitTemplate = "cloud-init"
+
+// The cloud-init user data is also embedded in Terraform heredocs, so it
+// avoids ${ and %{, which Terraform would interpolate.
+var bootstrapTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"indent": func(n int, s string) string {
+		lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = strings.Repeat(" ", n) + line
+			}
+		}
+		return strings.Join(lines, "\n")
+	},
+	"comment": func(s string) string {
+		return "#" + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n#")
+	},
+	"list": func(s ...string) []string { return s },
+	"outputs": func(domain, ip string) interface{} {
+		return struct{ Domain, IP string }{domain, ip}
+	},
+	"unit":       func() string { return bootstrapUnit },
+	"hints":      delegationHints,
+	"trimPrefix": strings.TrimPrefix,
+	"resolved": func() string {
+		return resolvedDropInDir + "/" + resolvedDropInFile
+	},
+}).Parse(`
+{{- define "cloud-init" -}}
+#cloud-config
+# CoWitness {{.Version}} for {{.Domain}} on {{.Provider}}, generated by cowitness bootstrap.
+#
+# Delegate the zone to this server at the parent zone's DNS provider:
+#
+{{comment (hints .Domain "<server IP>")}}
+package_update: true
+packages:
+  - curl
+  - ufw
+{{- if .Key}}
+  - minisign
+{{- end}}
+
+users:
+  - default
+  - name: cowitness
+    system: true
+    shell: /usr/sbin/nologin
+    homedir: /var/lib/cowitness
+
+write_files:
+  - path: /etc/systemd/system/cowitness.service
+    content: |
+{{indent 6 unit}}
+  - path: /etc/cowitness/cowitness.yaml
+    content: |
+      dns-name: {{.Domain}}
+      ttl: 60
+      listen: {{.Listen}}
+{{- if .APIAddr}}
+      api-addr: {{.APIAddr}}
+{{- end}}
+  - path: {{resolved}}
+    content: |
+      [Resolve]
+      DNSStubListener=no
+
+runcmd:
+  - |
+    set -e
+    # systemd-resolved gives up port 53, resolv.conf points at the uplink servers.
+    ln -sf /run/systemd/resolve/resolv.conf /etc/resolv.conf
+    systemctl restart systemd-resolved
+
+    # Install the release, checked against the checksums published with it.
+    VERSION={{.Version}}
+    ARCH=$(dpkg --print-architecture)
+    ARCHIVE=cowitness_{{trimPrefix .Version "v"}}_linux_$ARCH.tar.gz
+    cd /tmp
+    curl -fsSLO https://github.com/{{.Repo}}/releases/download/$VERSION/$ARCHIVE
+    curl -fsSLO https://github.com/{{.Repo}}/releases/download/$VERSION/checksums.txt
+{{- if .Key}}
+    curl -fsSLO https://github.com/{{.Repo}}/releases/download/$VERSION/checksums.txt.minisig
+    minisign -Vm checksums.txt -P {{.Key}}
+{{- end}}
+    grep " $ARCHIVE$" checksums.txt | sha256sum -c -
+    tar -xzf $ARCHIVE cowitness
+    install -m 0755 cowitness /usr/local/bin/cowitness
+
+    # Answer with the public address of this server.
+    IP=$({{.PublicIP}})
+    echo "dns-ip: $IP" >> /etc/cowitness/cowitness.yaml
+    install -d -o cowitness -g cowitness -m 0750 /var/lib/cowitness
+
+    ufw default deny incoming
+    ufw default allow outgoing
+{{- range .Ports}}
+    ufw allow {{if .Admin}}from {{$.AdminCIDR}} to any port {{.Port}} proto {{.Protocol}}{{else}}{{.Port}}/{{.Protocol}}{{end}}
+{{- end}}
+    ufw --force enable
+
+    systemctl daemon-reload
+    systemctl enable --now cowitness
+{{end}}
+
+{{- define "terraform-aws" -}}
+# CoWitness {{.Version}} for {{.Domain}} on AWS, generated by cowitness bootstrap.
+terraform {
+  required_providers {
+    aws = {
+      source = "hashicorp/aws"
+    }
+  }
+}
+
+provider "aws" {
+  region = "{{.Region}}"
+}
+
+variable "ssh_public_key" {
+  default = "~/.ssh/id_ed25519.pub"
+}
+
+data "aws_ami" "ubuntu" {
+  most_recent = true
+  owners      = ["099720109477"]
+  filter {
+    name   = "name"
+    values = ["ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"]
+  }
+}
+
+resource "aws_key_pair" "{{.Name}}" {
+  key_name   = "{{.Name}}"
+  public_key = file(pathexpand(var.ssh_public_key))
+}
+
+resource "aws_security_group" "{{.Name}}" {
+  name = "{{.Name}}"
+{{- range .Ports}}
+  ingress {
+    protocol    = "{{.Protocol}}"
+    from_port   = {{.Port}}
+    to_port     = {{.Port}}
+    cidr_blocks = ["{{if .Admin}}{{$.AdminCIDR}}{{else}}0.0.0.0/0{{end}}"]
+  }
+{{- end}}
+  egress {
+    protocol    = "-1"
+    from_port   = 0
+    to_port     = 0
+    cidr_blocks = ["0.0.0.0/0"]
+  }
+}
+
+resource "aws_instance" "{{.Name}}" {
+  ami                    = data.aws_ami.ubuntu.id
+  instance_type          = "{{.Size}}"
+  key_name               = aws_key_pair.{{.Name}}.key_name
+  vpc_security_group_ids = [aws_security_group.{{.Name}}.id]
+  tags = {
+    Name = "{{.Name}}"
+  }
+  user_data = <<EOT
+{{.UserData}}EOT
+}
+{{template "terraform-outputs" (printf "aws_instance.%s.public_ip" .Name | outputs .Domain)}}
+{{- end}}
+
+{{- define "terraform-do" -}}
+# CoWitness {{.Version}} for {{.Domain}} on DigitalOcean, generated by cowitness bootstrap.
+terraform {
+  required_providers {
+    digitalocean = {
+      source = "digitalocean/digitalocean"
+    }
+  }
+}
+
+variable "ssh_public_key" {
+  default = "~/.ssh/id_ed25519.pub"
+}
+
+resource "digitalocean_ssh_key" "{{.Name}}" {
+  name       = "{{.Name}}"
+  public_key = file(pathexpand(var.ssh_public_key))
+}
+
+resource "digitalocean_droplet" "{{.Name}}" {
+  name     = "{{.Name}}"
+  image    = "ubuntu-22-04-x64"
+  region   = "{{.Region}}"
+  size     = "{{.Size}}"
+  ssh_keys = [digitalocean_ssh_key.{{.Name}}.fingerprint]
+  user_data = <<EOT
+{{.UserData}}EOT
+}
+
+resource "digitalocean_firewall" "{{.Name}}" {
+  name        = "{{.Name}}"
+  droplet_ids = [digitalocean_droplet.{{.Name}}.id]
+{{- range .Ports}}
+  inbound_rule {
+    protocol         = "{{.Protocol}}"
+    port_range       = "{{.Port}}"
+    source_addresses = ["{{if .Admin}}{{$.AdminCIDR}}{{else}}0.0.0.0/0", "::/0{{end}}"]
+  }
+{{- end}}
+{{- range $protocol := list "tcp" "udp"}}
+  outbound_rule {
+    protocol              = "{{$protocol}}"
+    port_range            = "1-65535"
+    destination_addresses = ["0.0.0.0/0", "::/0"]
+  }
+{{- end}}
+}
+{{template "terraform-outputs" (printf "digitalocean_droplet.%s.ipv4_address" .Name | outputs .Domain)}}
+{{- end}}
+
+{{- define "terraform-hetzner" -}}
+# CoWitness {{.Version}} for {{.Domain}} on Hetzner Cloud, generated by cowitness bootstrap.
+terraform {
+  required_providers {
+    hcloud = {
+      source = "hetznercloud/hcloud"
+    }
+  }
+}
+
+variable "ssh_public_key" {
+  default = "~/.ssh/id_ed25519.pub"
+}
+
+resource "hcloud_ssh_key" "{{.Name}}" {
+  name       = "{{.Name}}"
+  public_key = file(pathexpand(var.ssh_public_key))
+}
+
+resource "hcloud_firewall" "{{.Name}}" {
+  name = "{{.Name}}"
+{{- range .Ports}}
+  rule {
+    direction  = "in"
+    protocol   = "{{.Protocol}}"
+    port       = "{{.Port}}"
+    source_ips = ["{{if .Admin}}{{$.AdminCIDR}}{{else}}0.0.0.0/0", "::/0{{end}}"]
+  }
+{{- end}}
+}
+
+resource "hcloud_server" "{{.Name}}" {
+  name         = "{{.Name}}"
+  image        = "ubuntu-22.04"
+  server_type  = "{{.Size}}"
+  location     = "{{.Region}}"
+  ssh_keys     = [hcloud_ssh_key.{{.Name}}.id]
+  firewall_ids = [hcloud_firewall.{{.Name}}.id]
+  user_data = <<EOT
+{{.UserData}}EOT
+}
+{{template "terraform-outputs" (printf "hcloud_server.%s.ipv4_address" .Name | outputs .Domain)}}
+{{- end}}
+
+{{- define "terraform-outputs"}}
+output "ip" {
+  value = {{.IP}}
+}
+
+output "delegation" {
+  description = "Records delegating {{.Domain}} to the server, for the parent zone's DNS provider"
+  value       = <<EOT
+{{hints .Domain (printf "${%s}" .IP)}}EOT
+}
+{{end}}
+`))
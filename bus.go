@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	liveQueueSize     = 256
+	liveKeepaliveTime = 30 * time.Second
+)
+
+// eventBus fans recorded interactions out to its subscribers: the event log,
+// the store, the publishers and notifiers, and live API streams. Protocol
+// handlers only ever write to the head of the pipeline, the enrichment
+// stages (threat intel, alert rules) run before the bus, so every
+// subscriber sees the verdict and rule tags.
+//
+// Subscribers are called in turn from the writing goroutine. Sinks talking
+// to the network queue interactions themselves, like publisher does, so a
+// slow one never delays a DNS answer or HTTP response.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []*subscription
+}
+
+type subscription struct {
+	name string
+	sink interactionSink
+}
+
+// subscribe adds a sink under a name used in log messages and returns the
+// function removing it again.
+func (b *eventBus) subscribe(name string, sink interactionSink) func() {
+	s := &subscription{name: name, sink: sink}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for n, other := range b.subscribers {
+			if other == s {
+				b.subscribers = append(b.subscribers[:n:n], b.subscribers[n+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (b *eventBus) Write(i *Interaction) {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+	verbosef("Captured %s interaction %s from %s\n", strings.ToUpper(i.Protocol), i.ID, i.RemoteIP)
+	for _, s := range subscribers {
+		s.deliver(i)
+	}
+}
+
+// deliver keeps a subscriber's bug from taking the others, or the protocol
+// handler, down with it.
+func (s *subscription) deliver(i *Interaction) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("%s subscriber failed on interaction %s: %v\n", s.name, i.ID, err)
+		}
+	}()
+	s.sink.Write(i)
+}
+
+// newEventBus builds the bus every interaction is written to, with the
+// event log, the store and whichever publishers are configured subscribed.
+func newEventBus(eventLogFile *os.File, store interactionStore) *eventBus {
+	events := &eventBus{}
+	events.subscribe("event log", newEventLog(EventFormat, eventLogFile))
+	events.subscribe("store", store)
+	if Console {
+		events.subscribe("console", newConsoleSink(os.Stdout))
+	}
+	if KafkaBrokers != "" {
+		events.subscribe("Kafka", newKafkaPublisher(KafkaBrokers, KafkaTopic))
+	}
+	if NATSURL != "" {
+		natsPublisher, err := newNATSPublisher(NATSURL, NATSSubject)
+		if err != nil {
+			log.Fatal(err)
+		}
+		events.subscribe("NATS", natsPublisher)
+	}
+	if MISPPublishTokens {
+		events.subscribe("MISP", &armedSink{newMISPTokenSink(newMISPClient(MISPURL, MISPKey))})
+	}
+	if WebhookURL != "" {
+		webhook, err := newWebhookSink(WebhookURL, WebhookSecret, WebhookHeaders, WebhookEvents, WebhookDeadLetter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		events.subscribe("webhook", &armedSink{webhook})
+	}
+	if ForwardURL != "" {
+		forward, err := newForwarder(ForwardURL, ForwardToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		events.subscribe("forwarder", forward)
+	}
+	if ArchiveURL != "" {
+		archive, err := newArchiver(ArchiveURL, ArchiveEndpoint, ArchiveRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go archive.run(ArchiveInterval)
+		events.subscribe("archive", archive)
+	}
+	return events
+}
+
+// liveSubscriber queues interactions for one API stream. A client that
+// doesn't keep up misses interactions instead of holding up the bus.
+type liveSubscriber struct {
+	query   interactionQuery
+	queue   chan *Interaction
+	dropped int
+	mu      sync.Mutex
+}
+
+func (l *liveSubscriber) Write(i *Interaction) {
+	if !l.query.matches(i) {
+		return
+	}
+	select {
+	case l.queue <- i:
+	default:
+		l.mu.Lock()
+		l.dropped++
+		l.mu.Unlock()
+	}
+}
+
+// handleStream serves GET /api/interactions/stream: interactions matching
+// the usual filters as server-sent events, as they are recorded.
+func handleStream(bus *eventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+		q, err := parseInteractionQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		live := &liveSubscriber{query: q, queue: make(chan *Interaction, liveQueueSize)}
+		unsubscribe := bus.subscribe("stream "+requestUser(r).Name, live)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		keepalive := time.NewTicker(liveKeepaliveTime)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				live.mu.Lock()
+				dropped := live.dropped
+				live.dropped = 0
+				live.mu.Unlock()
+				if dropped > 0 {
+					fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+				} else {
+					fmt.Fprint(w, ": keepalive\n\n")
+				}
+			case i := <-live.queue:
+				data, err := json.Marshal(i)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %s\ndata: %s\n\n", i.ID, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const CADir = "./ca"
+
+// runCACommand implements the "ca" subcommand, a small certificate authority
+// for the operator API and relay listeners and the clients allowed to use them.
+func runCACommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cowitness ca init|client-cert [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "init: comma separated names and addresses of the server certificate")
+	name := fs.String("name", "", "client-cert: name of the operator or edge node the certificate is issued to")
+	days := fs.Int("days", 365, "validity of the issued certificates in days")
+	fs.Parse(args[1:])
+	validity := time.Duration(*days) * 24 * time.Hour
+
+	switch args[0] {
+	case "init":
+		if _, err := os.Stat(filepath.Join(CADir, "ca.key")); err == nil {
+			log.Fatalf("%s already holds a CA, remove it first to start over", CADir)
+		}
+		if err := os.MkdirAll(CADir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		ca, caKey, err := issueCertificate(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: "CoWitness CA"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		}, 10*validity, nil, nil, "ca")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: strings.Split(*hosts, ",")[0]},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		for _, h := range strings.Split(*hosts, ",") {
+			if ip := net.ParseIP(h); ip != nil {
+				server.IPAddresses = append(server.IPAddresses, ip)
+			} else {
+				server.DNSNames = append(server.DNSNames, h)
+			}
+		}
+		if _, _, err := issueCertificate(server, validity, ca, caKey, "server"); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Created %s/ca.crt and a server certificate for %s in %s/server.crt\n", CADir, *hosts, CADir)
+	case "client-cert":
+		if *name == "" {
+			log.Fatalf("Missing -name")
+		}
+		ca, caKey, err := loadCA()
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, _, err = issueCertificate(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: *name},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, validity, ca, caKey, *name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Created %s/%s.crt and %s/%s.key\n", CADir, *name, CADir, *name)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown ca command %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// createCertificate fills in the serial, key and validity of template and
+// signs it with the CA, or self-signs it when ca is nil.
+func createCertificate(template *x509.Certificate, validity time.Duration, ca *x509.Certificate, caKey *ecdsa.PrivateKey) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validity)
+	if ca == nil {
+		ca, caKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	return der, key, err
+}
+
+// issueCertificate creates a certificate and writes <name>.crt and <name>.key
+// to CADir.
+func issueCertificate(template *x509.Certificate, validity time.Duration, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	der, key, err := createCertificate(template, validity, ca, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPath := filepath.Join(CADir, name+".crt")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	keyPath := filepath.Join(CADir, name+".key")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(CADir, "ca.crt"), filepath.Join(CADir, "ca.key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v, run \"cowitness ca init\" first", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+	return cert, key, nil
+}
+
+// serverTLSConfig loads a listener certificate. With a client CA bundle every
+// client must present a certificate chaining to it.
+func serverTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
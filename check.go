@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// secretFlags hold credentials, the effective configuration only shows
+// whether they are set.
+var secretFlags = map[string]bool{
+	"api-token":            true,
+	"dns-update-key":       true,
+	"forward-token":        true,
+	"greynoise-key":        true,
+	"abuseipdb-key":        true,
+	"misp-key":             true,
+	"webhook-secret":       true,
+	"webhook-headers":      true,
+	"slack-signing-secret": true,
+}
+
+// runCheck implements the "check" subcommand. It merges the command line
+// with -config like the server does, validates the result and prints the
+// effective configuration, without binding any port or opening any log.
+func runCheck() {
+	parseFlags()
+
+	var problems []string
+	normalizeDNSResponse()
+	for _, err := range checkDNSResponse(false) {
+		problems = append(problems, err.Error())
+	}
+	for _, pair := range [][2]string{
+		{"tls-cert", "tls-key"},
+		{"api-cert", "api-key"},
+		{"forward-cert", "forward-key"},
+		{"relay-cert", "relay-key"},
+	} {
+		cert, key := flag.Lookup(pair[0]).Value.String(), flag.Lookup(pair[1]).Value.String()
+		if cert == "" && key == "" {
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			problems = append(problems, fmt.Sprintf("-%s and -%s: %v", pair[0], pair[1], err))
+		}
+	}
+	for _, name := range []string{"api-client-ca", "forward-ca", "relay-client-ca", "ssh-host-key"} {
+		if path := flag.Lookup(name).Value.String(); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v", name, err))
+			}
+		}
+	}
+	if TLSCertDir != "" {
+		_, errs := loadCertDir(TLSCertDir)
+		for _, err := range errs {
+			problems = append(problems, err.Error())
+		}
+	}
+	if _, err := loadPluginConfig(PluginsFile); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := loadEngagements(EngagementsFile); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := loadResponseRules(ResponseRules); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := checkScript(ScriptFile); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := loadZoneConfig(ZoneFile); err != nil {
+		problems = append(problems, err.Error())
+	}
+	problems = append(problems, checkPorts()...)
+
+	data, err := yaml.Marshal(effectiveConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(string(data))
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error:", p)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "Configuration OK")
+}
+
+// normalizeDNSResponse puts the DNS answer settings in the form the DNS
+// handler compares and builds records with: a lower case, fully qualified
+// zone and the canonical spelling of the IPv4 address.
+func normalizeDNSResponse() {
+	DNSResponseIP = strings.TrimSpace(DNSResponseIP)
+	if ip := net.ParseIP(DNSResponseIP).To4(); ip != nil {
+		DNSResponseIP = ip.String()
+	}
+	DNSResponseName = strings.ToLower(strings.TrimSpace(DNSResponseName))
+	if DNSResponseName != "" && DNSResponseName != "." {
+		DNSResponseName = dns.Fqdn(DNSResponseName)
+	}
+}
+
+// checkDNSResponse validates the normalized DNS answer settings. Unless they
+// are required, unset values are skipped, as the server asks for them at
+// startup.
+func checkDNSResponse(required bool) []error {
+	var errs []error
+	switch {
+	case DNSResponseIP == "":
+		if required {
+			errs = append(errs, fmt.Errorf("no DNS response IP given, set -dns-ip"))
+		}
+	case DNSResponseIP == "auto" && !required:
+	case net.ParseIP(DNSResponseIP) == nil:
+		errs = append(errs, fmt.Errorf("invalid -dns-ip value %q, expected an IPv4 address", DNSResponseIP))
+	case net.ParseIP(DNSResponseIP).To4() == nil:
+		errs = append(errs, fmt.Errorf("invalid -dns-ip value %q, A records need an IPv4 address", DNSResponseIP))
+	}
+	switch {
+	case DNSResponseName == "":
+		if required {
+			errs = append(errs, fmt.Errorf("no DNS response name given, set -dns-name"))
+		}
+	case DNSResponseName == ".":
+		errs = append(errs, fmt.Errorf("invalid -dns-name value %q, CoWitness can't answer for the root zone", DNSResponseName))
+	default:
+		if _, ok := dns.IsDomainName(DNSResponseName); !ok || strings.Contains(DNSResponseName, "..") {
+			errs = append(errs, fmt.Errorf("invalid -dns-name value %q, expected a domain name such as example.com.", DNSResponseName))
+		}
+	}
+	if DefaultTTL < 0 || DefaultTTL > maxDNSTTL {
+		errs = append(errs, fmt.Errorf("invalid -ttl value %d, expected 0 to %d", DefaultTTL, maxDNSTTL))
+	}
+	return errs
+}
+
+// checkPorts reports listeners sharing a port with the operator API and
+// ports another process already listens on. It reads /proc/net instead of
+// binding, so it is safe to run next to a live server.
+func checkPorts() []string {
+	var problems []string
+	if APIAddr != "" {
+		_, port, err := net.SplitHostPort(APIAddr)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid -api-addr value %q: %v", APIAddr, err))
+		}
+		for _, l := range moduleListeners {
+			if (l.network() == "tcp" || l.Module == "dns") && strconv.Itoa(l.Port) == port {
+				problems = append(problems, fmt.Sprintf("-api-addr %s shares port %s/tcp with the %s listener", APIAddr, port, l.Module))
+			}
+		}
+	}
+	for _, l := range moduleListeners {
+		specs := []listenerSpec{{Network: l.network(), Port: l.Port}}
+		if l.Module == "dns" {
+			specs = append(specs, listenerSpec{Network: "tcp", Port: l.Port})
+		}
+		for _, spec := range specs {
+			if len(socketInodes("/proc/net/"+spec.Network, spec.Port, spec.Network == "tcp"))+len(socketInodes("/proc/net/"+spec.Network+"6", spec.Port, spec.Network == "tcp")) == 0 {
+				continue
+			}
+			c := portConflict{Listener: spec, Err: syscall.EADDRINUSE}
+			c.PID, c.Process = findPortOwner(spec)
+			problems = append(problems, describePortConflict(c))
+		}
+	}
+	return problems
+}
+
+// displayValue returns the value of a setting with credentials redacted.
+func displayValue(f *flag.Flag) string {
+	value := f.Value.String()
+	switch {
+	case secretFlags[f.Name] && value != "":
+		return "<redacted>"
+	case f.Name == "store" || f.Name == "nats-url" || f.Name == "proxy" || f.Name == "webhook-url" || f.Name == "forward-to":
+		return redactURL(value)
+	}
+	return value
+}
+
+// effectiveConfig returns every setting as a config file would spell it, so
+// the output of "check" can be saved and loaded with -config.
+func effectiveConfig() map[string]interface{} {
+	config := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" {
+			config[f.Name] = displayValue(f)
+		}
+	})
+	listeners := make(map[string]map[string]string)
+	for _, name := range listenerNames() {
+		if path := listenerLogs[name]; path != "" {
+			listeners[name] = map[string]string{"log": path}
+		}
+	}
+	config["listeners"] = listeners
+	return config
+}
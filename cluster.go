@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	forwardBatchSize  = 200
+	forwardFlushTime  = time.Second
+	forwardMaxBacklog = 50000
+	maxIngestBody     = 32 << 20
+)
+
+var (
+	NodeName     string
+	ForwardURL   string
+	ForwardToken string
+	ForwardCert  string
+	ForwardKey   string
+	ForwardCA    string
+)
+
+func defaultNodeName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "cowitness"
+	}
+	return hostname
+}
+
+// forwarder ships interactions from an edge node to the aggregator's ingest
+// endpoint in batches. Batches that can't be delivered are retried with
+// backoff, the oldest interactions are dropped once the backlog is full.
+type forwarder struct {
+	url     string
+	token   string
+	queue   *sinkQueue
+	client  *http.Client
+	backlog []*Interaction
+}
+
+func newForwarder(url, token string) (*forwarder, error) {
+	tlsConfig, err := forwardTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{
+		url:    url,
+		token:  token,
+		queue:  newSinkQueue("Forwarder", publishQueueSize),
+		client: newOutboundClient(30*time.Second, tlsConfig),
+	}
+	go f.run()
+	infof("Forwarding interactions as node %s to %s\n", NodeName, url)
+	return f, nil
+}
+
+// forwardTLSConfig loads the client certificate a relay's ingest listener
+// asks for, and the CA to trust it with when it isn't publicly signed.
+func forwardTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ForwardCert != "" || ForwardKey != "" {
+		cert, err := tls.LoadX509KeyPair(ForwardCert, ForwardKey)
+		if err != nil {
+			return nil, fmt.Errorf("forward client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if ForwardCA != "" {
+		pool, err := loadCertPool(ForwardCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (f *forwarder) Write(i *Interaction) {
+	f.queue.offer(i)
+}
+
+func (f *forwarder) run() {
+	ticker := time.NewTicker(forwardFlushTime)
+	backoff := forwardFlushTime
+	var retryAt time.Time
+	for {
+		select {
+		case i := <-f.queue.queue:
+			f.backlog = append(f.backlog, i)
+			if len(f.backlog) < forwardBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if len(f.backlog) > forwardMaxBacklog {
+			f.trimBacklog()
+		}
+		if len(f.backlog) == 0 || time.Now().Before(retryAt) {
+			continue
+		}
+
+		for len(f.backlog) > 0 {
+			n := len(f.backlog)
+			if n > forwardBatchSize {
+				n = forwardBatchSize
+			}
+			if err := f.send(f.backlog[:n]); err != nil {
+				log.Printf("Forwarding to %s failed, retrying in %s: %v\n", f.url, backoff, err)
+				retryAt = time.Now().Add(backoff)
+				if backoff < 5*time.Minute {
+					backoff *= 2
+				}
+				break
+			}
+			f.backlog = f.backlog[n:]
+			backoff = forwardFlushTime
+		}
+	}
+}
+
+// trimBacklog drops the oldest interactions beyond forwardMaxBacklog,
+// keeping those of canary tokens.
+func (f *forwarder) trimBacklog() {
+	excess := len(f.backlog) - forwardMaxBacklog
+	kept := f.backlog[:0]
+	for _, i := range f.backlog {
+		if excess > 0 && i.Token == "" {
+			excess--
+			continue
+		}
+		kept = append(kept, i)
+	}
+	dropped := len(f.backlog) - len(kept)
+	for n := len(kept); n < len(f.backlog); n++ {
+		f.backlog[n] = nil
+	}
+	f.backlog = kept
+	log.Printf("Forwarder backlog full, dropped %d interaction(s)\n", dropped)
+	f.queue.drop(dropped)
+}
+
+func (f *forwarder) send(batch []*Interaction) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// handleIngest accepts batches forwarded by edge nodes and records them as if
+// they had been captured locally.
+func handleIngest(events interactionSink) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+
+		var batch []*Interaction
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngestBody)).Decode(&batch); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, i := range batch {
+			if i.ID == "" || i.Node == "" || i.Protocol == "" {
+				writeJSONError(w, http.StatusBadRequest, "every interaction needs an id, node and protocol")
+				return
+			}
+		}
+
+		for _, i := range batch {
+			events.Write(i)
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"accepted": len(batch)})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ConfigFile string
+
+// listenerLogs maps each listener to the file its human readable log goes to.
+// HTTPS shares the HTTP log unless configured otherwise.
+var listenerLogs = map[string]string{
+	"http":      "./http.log",
+	"https":     "",
+	"dns":       "./dns.log",
+	"smtp":      "./smtp.log",
+	"pop3":      "./pop3.log",
+	"imap":      "./imap.log",
+	"redis":     "./redis.log",
+	"memcached": "./memcached.log",
+	"mysql":     "./mysql.log",
+	"postgres":  "./postgres.log",
+	"ssh":       "./ssh.log",
+	"telnet":    "./telnet.log",
+	"udp":       "./udp.log",
+	"snmp":      "./snmp.log",
+	"tftp":      "./tftp.log",
+	"ntp":       "./ntp.log",
+	"vpn":       "./vpn.log",
+}
+
+// loadConfig applies a YAML config file. Top-level keys are flag names, lists
+// are joined with commas, and flags given on the command line take precedence.
+// The listeners section sets per-listener options:
+//
+//	noise: drop
+//	kafka-brokers: [kafka1:9092, kafka2:9092]
+//	listeners:
+//	  https:
+//	    log: ./https.log
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := config[key]
+		if key == "listeners" {
+			if err := applyListenerConfig(value); err != nil {
+				return fmt.Errorf("%s: listeners: %v", path, err)
+			}
+			continue
+		}
+		if flag.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		s, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+		if err := flag.Set(key, s); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, len(v))
+		for n, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[n] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("expected a value or a list")
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func listenerNames() []string {
+	names := make([]string, 0, len(listenerLogs))
+	for name := range listenerLogs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func applyListenerConfig(value interface{}) error {
+	listeners, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected a map of listeners")
+	}
+	for name, options := range listeners {
+		if _, ok := listenerLogs[name]; !ok {
+			return fmt.Errorf("unknown listener %q, expected one of %s", name, strings.Join(listenerNames(), ", "))
+		}
+		settings, ok := options.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected a map of options", name)
+		}
+		for option, v := range settings {
+			switch option {
+			case "log":
+				listenerLogs[name] = fmt.Sprint(v)
+			default:
+				return fmt.Errorf("%s: unknown option %q", name, option)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consolePreview is the most characters of a body or transcript shown on a
+// console line.
+const consolePreview = 80
+
+// Console enables the human readable console output.
+var Console bool
+
+var consoleColors = map[string]string{
+	"dns":   "36", // cyan
+	"http":  "32", // green
+	"https": "92", // bright green
+	"smtp":  "33", // yellow
+	"ssh":   "35", // magenta
+}
+
+// consoleSink prints every interaction to the console as one line meant to
+// be watched live: the time, how long after the previous interaction it
+// came, a protocol tag colored by protocol, the source and what was asked
+// for, with bodies and transcripts truncated. Canary token trips stand out
+// and noise is dimmed. The event log and the other outputs stay as they
+// are, for machines. Colors are left out when the output isn't a terminal
+// or NO_COLOR is set.
+type consoleSink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	color bool
+	last  time.Time
+}
+
+func newConsoleSink(f *os.File) *consoleSink {
+	return &consoleSink{w: f, color: isTerminal(f) && os.Getenv("NO_COLOR") == ""}
+}
+
+func (c *consoleSink) paint(code, text string) string {
+	if !c.color || code == "" {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+func (c *consoleSink) Write(i *Interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	since := "first"
+	if !c.last.IsZero() {
+		since = "+" + consoleDuration(i.Time.Sub(c.last))
+	}
+	c.last = i.Time
+
+	protocol := i.Protocol
+	if protocol == "http" && i.TLS {
+		protocol = "https"
+	}
+	color := consoleColors[protocol]
+	if color == "" {
+		color = "34" // blue
+	}
+
+	// Noise is dimmed as a whole.
+	paint := c.paint
+	if i.Noise {
+		paint = func(code, text string) string { return text }
+	}
+	detail := consoleDetail(i)
+	if len(i.Tags) > 0 {
+		detail += " " + paint("33", "["+strings.Join(i.Tags, ", ")+"]")
+	}
+	if i.Token != "" {
+		detail += " " + paint("1;97;41", " token "+i.Token+" ")
+	}
+	line := fmt.Sprintf("%s %s %s %-15s %s",
+		paint("2", i.Time.Local().Format("15:04:05")),
+		paint("2", fmt.Sprintf("%7s", since)),
+		paint("1;"+color, fmt.Sprintf("%-5s", strings.ToUpper(protocol))),
+		i.RemoteIP, detail)
+	if i.Noise {
+		line = c.paint("2", line+" (noise)")
+	}
+	fmt.Fprintln(c.w, line)
+}
+
+// consoleDetail describes an interaction in a few words, with bodies and
+// transcripts cut to consolePreview characters and control characters
+// replaced.
+func consoleDetail(i *Interaction) string {
+	var parts []string
+	switch i.Protocol {
+	case "dns":
+		parts = append(parts, i.QType+" "+i.QName)
+	case "http":
+		target := i.Method + " " + i.Host + i.Path
+		if i.Query != "" {
+			target += "?" + i.Query
+		}
+		parts = append(parts, target)
+		if i.UserAgent != "" {
+			parts = append(parts, "UA "+consoleTruncate(i.UserAgent))
+		}
+		if body := signatureBody(i); body != "" {
+			parts = append(parts, "body "+consoleTruncate(body))
+		}
+	default:
+		if i.User != "" {
+			parts = append(parts, "login "+i.User)
+		}
+		if i.Data != "" {
+			parts = append(parts, consoleTruncate(i.Data))
+		}
+	}
+	return tuiClean(strings.Join(parts, "  "))
+}
+
+func consoleTruncate(s string) string {
+	s = strings.Join(strings.Fields(strings.ReplaceAll(s, "\n", " ⏎ ")), " ")
+	if r := []rune(s); len(r) > consolePreview {
+		return string(r[:consolePreview]) + "…"
+	}
+	return s
+}
+
+// consoleDuration rounds the time between interactions for display.
+func consoleDuration(d time.Duration) string {
+	switch {
+	case d < 0:
+		return "0s"
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	case d < time.Hour:
+		return d.Round(time.Second).String()
+	}
+	return d.Round(time.Minute).String()
+}
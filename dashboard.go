@@ -0,0 +1,130 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+const (
+	topSourcesLimit = 20
+	topASNsLimit    = 20
+)
+
+// timelineBucket counts the interactions of one time slot per protocol.
+type timelineBucket struct {
+	Time   time.Time      `json:"time"`
+	Counts map[string]int `json:"counts"`
+}
+
+type sourceSummary struct {
+	RemoteIP  string         `json:"remote_ip"`
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+}
+
+type activityStats struct {
+	Bucket   string            `json:"bucket"`
+	Timeline []*timelineBucket `json:"timeline"`
+	Sources  []*sourceSummary  `json:"sources"`
+	ASNs     []*asnSummary     `json:"asns"`
+}
+
+// summarizeActivity builds the dashboard's timeline and top sources from a
+// store query, so every backend supports it without aggregation queries.
+func summarizeActivity(list []*Interaction, bucket time.Duration) *activityStats {
+	stats := &activityStats{Bucket: bucket.String(), Timeline: []*timelineBucket{}, Sources: []*sourceSummary{}}
+	buckets := make(map[time.Time]*timelineBucket)
+	sources := make(map[string]*sourceSummary)
+	for _, i := range list {
+		slot := i.Time.Truncate(bucket)
+		b, ok := buckets[slot]
+		if !ok {
+			b = &timelineBucket{Time: slot, Counts: make(map[string]int)}
+			buckets[slot] = b
+			stats.Timeline = append(stats.Timeline, b)
+		}
+		b.Counts[i.Protocol]++
+
+		s, ok := sources[i.RemoteIP]
+		if !ok {
+			s = &sourceSummary{RemoteIP: i.RemoteIP, Counts: make(map[string]int), FirstSeen: i.Time, LastSeen: i.Time}
+			sources[i.RemoteIP] = s
+			stats.Sources = append(stats.Sources, s)
+		}
+		s.Total++
+		s.Counts[i.Protocol]++
+		if i.Time.Before(s.FirstSeen) {
+			s.FirstSeen = i.Time
+		}
+		if i.Time.After(s.LastSeen) {
+			s.LastSeen = i.Time
+		}
+	}
+
+	sort.Slice(stats.Timeline, func(a, b int) bool {
+		return stats.Timeline[a].Time.Before(stats.Timeline[b].Time)
+	})
+	sort.SliceStable(stats.Sources, func(a, b int) bool {
+		return stats.Sources[a].Total > stats.Sources[b].Total
+	})
+	if len(stats.Sources) > topSourcesLimit {
+		stats.Sources = stats.Sources[:topSourcesLimit]
+	}
+	if stats.ASNs = summarizeASNs(list); len(stats.ASNs) > topASNsLimit {
+		stats.ASNs = stats.ASNs[:topASNsLimit]
+	}
+	return stats
+}
+
+func handleStats(store interactionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		q, err := parseInteractionQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.URL.Query().Get("limit") == "" {
+			q.Limit = maxQueryLimit
+		}
+		bucket := time.Hour
+		if v := r.URL.Query().Get("bucket"); v != "" {
+			if bucket, err = time.ParseDuration(v); err != nil || bucket < time.Minute {
+				writeJSONError(w, http.StatusBadRequest, "bucket: expected a duration of at least 1m")
+				return
+			}
+		}
+
+		list, err := store.Query(q)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		writeJSON(w, http.StatusOK, summarizeActivity(list, bucket))
+	}
+}
+
+// serveDashboard serves the single page dashboard. The page holds no data
+// itself and calls the API with the operator's token or client certificate.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardHTML)
+}
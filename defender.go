@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	DefenderMode      bool
+	DefenderDNSAnswer string
+)
+
+// defenderHTTPHandler replaces every HTTP route in defender mode. Nothing is
+// served, each request is logged and raised as an alert and gets an empty 204.
+func defenderHTTPHandler(services *httpServices, logRequest func(*http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+
+		ipAddress := remoteIP(r)
+		if t := services.tokens.matchURL(r.URL.Path); t != nil {
+			services.tokens.fire(t, "HTTP", ipAddress, r.Method+" "+r.URL.Path+", User agent: "+r.UserAgent())
+		} else {
+			raiseDefenderAlert(services.alertLogger, "HTTP", ipAddress, r.Method+" "+r.Host+r.URL.Path+", User agent: "+r.UserAgent())
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// defenderDNSResponse answers with NXDOMAIN or a loopback address so that a
+// system touching the canary domain never reaches anything real.
+func defenderDNSResponse(r *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+	if DefenderDNSAnswer == "nxdomain" {
+		response.SetRcode(r, dns.RcodeNameError)
+		response.Authoritative = true
+		return response
+	}
+
+	response.SetReply(r)
+	response.Authoritative = true
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: 0}
+	switch q.Qtype {
+	case dns.TypeA:
+		hdr.Rrtype = dns.TypeA
+		response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+	case dns.TypeAAAA:
+		hdr.Rrtype = dns.TypeAAAA
+		response.Answer = append(response.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+	}
+	return response
+}
+
+func raiseDefenderAlert(alertLogger *log.Logger, protocol, ipAddress, detail string) {
+	alertLogger.Printf("Defender: canary domain touched, Protocol: %s, IP address: %s, Detail: %s\n", protocol, ipAddress, detail)
+	log.Printf("ALERT: canary domain touched over %s from %s: %s\n", protocol, ipAddress, detail)
+}
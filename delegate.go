@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	cloudflareAPI       = "https://api.cloudflare.com/client/v4"
+	route53API          = "https://route53.amazonaws.com/2013-04-01"
+	delegationPollTime  = 10 * time.Second
+	delegationQueryTime = 5 * time.Second
+)
+
+// delegationHost creates the records delegating a callback zone to the
+// server in the parent zone it hosts: the NS record and the glue A record of
+// the name server.
+type delegationHost interface {
+	// delegate creates or updates the records and returns the parent zone.
+	delegate(domain, nameserver, ip string, ttl int) (string, error)
+}
+
+// runDelegateCommand implements the "delegate" subcommand. It delegates the
+// callback zone to the server at the DNS host of the parent zone, Route 53 or
+// Cloudflare, and then checks the delegation from the parent's name servers
+// down to a public resolver before declaring the server ready.
+func runDelegateCommand(args []string) {
+	fs := flag.NewFlagSet("delegate", flag.ExitOnError)
+	provider := fs.String("provider", "", "DNS host of the parent zone: route53 or cloudflare")
+	domain := fs.String("domain", "", "callback zone delegated to the server, e.g. oob.example.com")
+	ip := fs.String("ip", "", "public IPv4 address of the server")
+	nameserver := fs.String("ns", "", "name server name, in the callback zone so it needs glue (default ns1.<domain>)")
+	ttl := fs.Int("ttl", 300, "TTL of the delegation records in seconds")
+	token := fs.String("token", os.Getenv("CLOUDFLARE_API_TOKEN"), "Cloudflare API token with DNS edit permission (default $CLOUDFLARE_API_TOKEN); Route 53 uses AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	verifyOnly := fs.Bool("verify-only", false, "only check an existing delegation")
+	wait := fs.Duration("wait", 10*time.Minute, "how long to wait for the delegation to work")
+	fs.StringVar(&OutboundProxy, "proxy", "", "proxy for the DNS host's API (default HTTPS_PROXY and HTTP_PROXY)")
+	fs.Parse(args)
+
+	zone := strings.ToLower(strings.TrimSuffix(*domain, "."))
+	if _, ok := dns.IsDomainName(zone); !ok || strings.Count(zone, ".") < 2 {
+		log.Fatalf("Invalid -domain value %q, expected a subdomain such as oob.example.com", *domain)
+	}
+	if parsed := net.ParseIP(*ip); parsed == nil || parsed.To4() == nil {
+		log.Fatalf("Invalid -ip value %q, expected the server's IPv4 address", *ip)
+	}
+	if *nameserver == "" {
+		*nameserver = "ns1." + zone
+	}
+	ns := strings.ToLower(strings.TrimSuffix(*nameserver, "."))
+	if !dns.IsSubDomain(zone+".", ns+".") {
+		log.Fatalf("Invalid -ns value %q, glue can only be created for a name in %s", *nameserver, zone)
+	}
+
+	if !*verifyOnly {
+		var host delegationHost
+		client := newOutboundClient(time.Minute, nil)
+		switch *provider {
+		case "route53":
+			credentials := awsCredentialsFromEnv()
+			if !credentials.valid() {
+				log.Fatalf("Route 53 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY in the environment")
+			}
+			host = &route53Host{credentials: credentials, client: client}
+		case "cloudflare":
+			if *token == "" {
+				log.Fatalf("Cloudflare needs -token or CLOUDFLARE_API_TOKEN")
+			}
+			host = &cloudflareHost{token: *token, client: client}
+		default:
+			log.Fatalf("Invalid -provider value %q, expected route53 or cloudflare", *provider)
+		}
+		parent, err := host.delegate(zone, ns, *ip, *ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Delegated %s to %s (%s) in %s\n", zone, ns, *ip, parent)
+	}
+
+	fmt.Printf("Waiting up to %s for the delegation to work\n", *wait)
+	deadline := time.Now().Add(*wait)
+	for {
+		err := verifyDelegation(zone, ns, *ip)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Fatalf("Delegation of %s not working after %s: %v", zone, *wait, err)
+		}
+		fmt.Printf("Not yet: %v\n", err)
+		time.Sleep(delegationPollTime)
+	}
+	fmt.Printf("Delegation of %s verified, the server is ready\n", zone)
+}
+
+// parentZones lists the zones a domain could be delegated from, closest
+// first, down to the registered domain.
+func parentZones(domain string) []string {
+	labels := dns.SplitDomainName(domain)
+	var zones []string
+	for i := 1; i < len(labels)-1; i++ {
+		zones = append(zones, strings.Join(labels[i:], "."))
+	}
+	return zones
+}
+
+// verifyDelegation checks the delegation at every step a resolver takes: the
+// parent zone's name servers refer to ns, the server answers for the zone
+// with authority, and a public resolver gets its answer.
+func verifyDelegation(domain, ns, ip string) error {
+	parent, servers, err := parentNameServers(domain)
+	if err != nil {
+		return err
+	}
+	referred := false
+	for _, server := range servers {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domain), dns.TypeNS)
+		m.RecursionDesired = false
+		r, err := delegationExchange(m, server)
+		if err != nil {
+			continue
+		}
+		for _, rr := range append(r.Ns, r.Answer...) {
+			if record, ok := rr.(*dns.NS); ok && strings.EqualFold(strings.TrimSuffix(record.Ns, "."), ns) {
+				referred = true
+			}
+		}
+		break
+	}
+	if !referred {
+		return fmt.Errorf("the name servers of %s don't refer %s to %s", parent, domain, ns)
+	}
+
+	probe := fmt.Sprintf("delegation-%d.%s", time.Now().UnixNano(), domain)
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(probe), dns.TypeA)
+	r, err := delegationExchange(m, ip)
+	if err != nil {
+		return fmt.Errorf("the server at %s doesn't answer: %v", ip, err)
+	}
+	if !r.Authoritative || len(r.Answer) == 0 {
+		return fmt.Errorf("the server at %s doesn't answer for %s with authority", ip, domain)
+	}
+
+	addrs, err := net.LookupHost(probe)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %v", probe, err)
+	}
+	for _, addr := range addrs {
+		if addr == ip {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s resolves to %s instead of %s", probe, strings.Join(addrs, ", "), ip)
+}
+
+// parentNameServers finds the closest parent zone of domain with name
+// servers of its own, up to the top-level domain, and their addresses.
+func parentNameServers(domain string) (string, []string, error) {
+	labels := dns.SplitDomainName(domain)
+	for _, parent := range append(parentZones(domain), labels[len(labels)-1]) {
+		nss, err := net.LookupNS(parent)
+		if err != nil || len(nss) == 0 {
+			continue
+		}
+		var servers []string
+		for _, ns := range nss {
+			if addrs, err := net.LookupHost(strings.TrimSuffix(ns.Host, ".")); err == nil {
+				servers = append(servers, addrs...)
+			}
+		}
+		if len(servers) > 0 {
+			return parent, servers, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no name servers found for the parent zones of %s", domain)
+}
+
+func delegationExchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: delegationQueryTime}
+	r, _, err := c.Exchange(m, net.JoinHostPort(server, "53"))
+	return r, err
+}
+
+// cloudflareHost creates the delegation records through the Cloudflare API.
+type cloudflareHost struct {
+	token  string
+	client *http.Client
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+func (c *cloudflareHost) call(method, path string, body, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, cloudflareAPI+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("Cloudflare: %s: %v", resp.Status, err)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("Cloudflare: %s: %s", resp.Status, strings.Join(messages, "; "))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+func (c *cloudflareHost) delegate(domain, nameserver, ip string, ttl int) (string, error) {
+	var zoneID, parent string
+	for _, candidate := range parentZones(domain) {
+		var zones []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := c.call(http.MethodGet, "/zones?name="+url.QueryEscape(candidate), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			zoneID, parent = zones[0].ID, zones[0].Name
+			break
+		}
+	}
+	if zoneID == "" {
+		return "", fmt.Errorf("Cloudflare: no zone the token can edit holds %s", domain)
+	}
+	if err := c.upsert(zoneID, cloudflareRecord{Type: "NS", Name: domain, Content: nameserver, TTL: ttl}, false); err != nil {
+		return "", err
+	}
+	if err := c.upsert(zoneID, cloudflareRecord{Type: "A", Name: nameserver, Content: ip, TTL: ttl}, true); err != nil {
+		return "", err
+	}
+	return parent, nil
+}
+
+// upsert creates a record. With replace, an existing record of the same
+// name and type is updated instead; otherwise it is only created when no
+// record has the same content, as a name can have several NS records.
+func (c *cloudflareHost) upsert(zoneID string, record cloudflareRecord, replace bool) error {
+	var existing []cloudflareRecord
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+	if err := c.call(http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &existing); err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if strings.EqualFold(e.Content, record.Content) && e.TTL == record.TTL {
+			return nil
+		}
+		if replace || strings.EqualFold(e.Content, record.Content) {
+			return c.call(http.MethodPut, "/zones/"+zoneID+"/dns_records/"+e.ID, record, nil)
+		}
+	}
+	return c.call(http.MethodPost, "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+// route53Host creates the delegation records through the Route 53 API.
+type route53Host struct {
+	credentials awsCredentials
+	client      *http.Client
+}
+
+type route53Change struct {
+	Action string `xml:"Action"`
+	Set    struct {
+		Name    string   `xml:"Name"`
+		Type    string   `xml:"Type"`
+		TTL     int      `xml:"TTL"`
+		Records []string `xml:"ResourceRecords>ResourceRecord>Value"`
+	} `xml:"ResourceRecordSet"`
+}
+
+func (r *route53Host) call(method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, route53API+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	r.credentials.sign(req, body, time.Now().UTC(), "us-east-1", "route53")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &e)
+		return fmt.Errorf("Route 53: %s: %s", resp.Status, e.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, result)
+}
+
+func (r *route53Host) delegate(domain, nameserver, ip string, ttl int) (string, error) {
+	var zoneID, parent string
+	for _, candidate := range parentZones(domain) {
+		var list struct {
+			Zones []struct {
+				ID      string `xml:"Id"`
+				Name    string `xml:"Name"`
+				Private bool   `xml:"Config>PrivateZone"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		query := url.Values{"dnsname": {candidate}, "maxitems": {"1"}}
+		if err := r.call(http.MethodGet, "/hostedzonesbyname?"+query.Encode(), nil, &list); err != nil {
+			return "", err
+		}
+		if len(list.Zones) > 0 && list.Zones[0].Name == candidate+"." && !list.Zones[0].Private {
+			zoneID, parent = list.Zones[0].ID, candidate
+			break
+		}
+	}
+	if zoneID == "" {
+		return "", fmt.Errorf("Route 53: no public hosted zone holds %s", domain)
+	}
+
+	changes := make([]route53Change, 2)
+	for n, record := range [][2]string{{"NS", domain}, {"A", nameserver}} {
+		changes[n].Action = "UPSERT"
+		changes[n].Set.Name = record[1] + "."
+		changes[n].Set.Type = record[0]
+		changes[n].Set.TTL = ttl
+	}
+	changes[0].Set.Records = []string{nameserver + "."}
+	changes[1].Set.Records = []string{ip}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Comment string          `xml:"ChangeBatch>Comment"`
+		Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+	}{Comment: "CoWitness delegation of " + domain, Changes: changes})
+	if err != nil {
+		return "", err
+	}
+	// Hosted zone IDs come as /hostedzone/<id>.
+	if !strings.HasPrefix(zoneID, "/hostedzone/") {
+		return "", errors.New("Route 53: unexpected hosted zone ID " + zoneID)
+	}
+	if err := r.call(http.MethodPost, zoneID+"/rrset/", append([]byte(xml.Header), body...), nil); err != nil {
+		return "", err
+	}
+	return parent, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	PayloadRules = "./payload-rules.json"
+	DecoyDir     = "./decoys"
+)
+
+// deliveryRule gates a staged payload. The real file is only served when every
+// configured condition matches, every other request receives the decoy. A
+// payload expires TTL after it was staged or once it was delivered
+// MaxDownloads times; its URL then answers 404 and the staged file is
+// deleted.
+type deliveryRule struct {
+	UserAgent    string   `json:"user_agent,omitempty"`
+	CIDRs        []string `json:"cidrs,omitempty"`
+	Once         bool     `json:"once,omitempty"`
+	Decoy        string   `json:"decoy,omitempty"`
+	TTL          string   `json:"ttl,omitempty"`
+	MaxDownloads int      `json:"max_downloads,omitempty"`
+
+	userAgent *regexp.Regexp
+	networks  []*net.IPNet
+	ttl       time.Duration
+}
+
+// loadDeliveryRules reads the rules file, keyed by the payload's file name.
+func loadDeliveryRules(path string) (map[string]*deliveryRule, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]*deliveryRule)
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for file, rule := range rules {
+		if rule.UserAgent != "" {
+			re, err := regexp.Compile(rule.UserAgent)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: user_agent: %v", path, file, err)
+			}
+			rule.userAgent = re
+		}
+		for _, cidr := range rule.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, file, err)
+			}
+			rule.networks = append(rule.networks, network)
+		}
+		if rule.TTL != "" {
+			if rule.ttl, err = time.ParseDuration(rule.TTL); err != nil || rule.ttl <= 0 {
+				return nil, fmt.Errorf("%s: %s: invalid ttl %q, expected a duration such as 72h", path, file, rule.TTL)
+			}
+		}
+		if rule.MaxDownloads < 0 {
+			return nil, fmt.Errorf("%s: %s: invalid max_downloads %d", path, file, rule.MaxDownloads)
+		}
+	}
+	return rules, nil
+}
+
+// expired reports whether the payload's TTL or download limit ran out.
+func (rule *deliveryRule) expired(p *Payload, now time.Time) bool {
+	if rule == nil {
+		return false
+	}
+	if rule.ttl > 0 && now.Sub(p.Staged) >= rule.ttl {
+		return true
+	}
+	return rule.MaxDownloads > 0 && p.Delivered >= rule.MaxDownloads
+}
+
+// allows reports whether the real payload may be delivered, and if not, why.
+func (rule *deliveryRule) allows(p *Payload, ipAddress, userAgent string) (bool, string) {
+	if rule == nil {
+		return true, ""
+	}
+
+	if rule.userAgent != nil && !rule.userAgent.MatchString(userAgent) {
+		return false, "user agent not allowed"
+	}
+
+	if len(rule.networks) > 0 {
+		ip := net.ParseIP(ipAddress)
+		allowed := false
+		for _, network := range rule.networks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, "source address not allowed"
+		}
+	}
+
+	if rule.Once && p.Delivered > 0 {
+		return false, "already delivered"
+	}
+	return true, ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const refusedTag = "refused"
+
+var (
+	DNSAnswer      string
+	DNSAnswerNames string
+)
+
+// dnsAnswerNames are the names of -dns-answer-names, lower case and fully
+// qualified, with wildcards kept as "*.".
+var dnsAnswerNames []string
+
+// parseDNSAnswerNames reads comma separated names such as
+// "callback.example.net,*.oast.example.org".
+func parseDNSAnswerNames(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		name = dns.Fqdn(name)
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(name, wildcardPrefix)); !ok || name == wildcardPrefix {
+			return nil, fmt.Errorf("invalid name %q, expected a domain name or *.domain", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// answersFor reports whether the server answers queries for name. By
+// default it answers every name, like the wildcard responder it always was.
+// With -dns-answer zone it only answers the zone and the names of
+// -dns-answer-names, and refuses the rest, so it can't be pointed at as the
+// resolver of someone else's domains. Refused queries are still recorded.
+func answersFor(name string) bool {
+	if DNSAnswer != "zone" {
+		return true
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	if name == DNSResponseName || strings.HasSuffix(name, "."+DNSResponseName) {
+		return true
+	}
+	for _, allowed := range dnsAnswerNames {
+		if name == allowed || (strings.HasPrefix(allowed, wildcardPrefix) && strings.HasSuffix(name, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	malformedTag     = "malformed"
+	maxMalformedDump = 512
+)
+
+// malformedDNSReader sees every raw DNS message before the DNS library
+// parses it. The library answers packets it can't parse with FORMERR, or
+// not at all, without calling the handler, so this is where they are
+// recorded: as DNS interactions tagged "malformed", with a hex dump of the
+// packet, since fuzzers and scanners are interesting sources too.
+type malformedDNSReader struct {
+	dns.Reader
+	services *dnsServices
+}
+
+func (r *malformedDNSReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		r.inspect(m, session.RemoteAddr(), conn.LocalAddr())
+	}
+	return m, session, err
+}
+
+func (r *malformedDNSReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	m, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.inspect(m, conn.RemoteAddr(), conn.LocalAddr())
+	}
+	return m, err
+}
+
+func (r *malformedDNSReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	m, addr, err := r.Reader.(dns.PacketConnReader).ReadPacketConn(conn, timeout)
+	if err == nil {
+		r.inspect(m, addr, conn.LocalAddr())
+	}
+	return m, addr, err
+}
+
+func (r *malformedDNSReader) inspect(m []byte, remote, local net.Addr) {
+	reason := malformedDNSReason(m)
+	if reason == "" {
+		return
+	}
+	recordMalformedDNS(r.services, m, reason, addrIP(remote), addrPort(local))
+}
+
+// malformedDNSReason explains why a request won't reach the handler, or
+// returns "" for a well formed one. Responses are ignored by the server and
+// aren't reported either.
+func malformedDNSReason(m []byte) string {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(m); err != nil {
+		return "unparsable: " + err.Error()
+	}
+	switch {
+	case msg.Response:
+		return ""
+	case len(msg.Question) == 0:
+		return "no question"
+	case len(msg.Question) > 1:
+		return fmt.Sprintf("%d questions", len(msg.Question))
+	}
+	return ""
+}
+
+func recordMalformedDNS(services *dnsServices, m []byte, reason, ipAddress string, port int) {
+	dump := m
+	if len(dump) > maxMalformedDump {
+		dump = dump[:maxMalformedDump]
+	}
+	services.events.Write(&Interaction{
+		ID:         newID(),
+		Time:       time.Now().UTC(),
+		Node:       NodeName,
+		Engagement: Engagement,
+		Protocol:   "dns",
+		RemoteIP:   ipAddress,
+		Port:       port,
+		Data:       fmt.Sprintf("%s, %d bytes\n%s", reason, len(m), hex.Dump(dump)),
+		Tags:       []string{malformedTag},
+	})
+
+	logMessage := fmt.Sprintf("IP address: %s, Listener: dns:%d, Malformed DNS packet: %s, %d bytes\n", ipAddress, port, reason, len(m))
+	if _, err := services.dnsLogFile.WriteString(logMessage); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var DNSUpdateKey string
+
+// acceptDNSMsg replaces the DNS library's default filter, which turns away
+// dynamic updates before they reach the handler. Updates carry records in
+// every section, so only queries and notifies keep the section limits.
+func acceptDNSMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 {
+		return dns.MsgIgnore
+	}
+	opcode := int(dh.Bits>>11) & 0xF
+	switch opcode {
+	case dns.OpcodeQuery, dns.OpcodeNotify:
+		if dh.Ancount > 1 || dh.Nscount > 1 || dh.Arcount > 2 {
+			return dns.MsgReject
+		}
+	case dns.OpcodeUpdate:
+	default:
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// parseDNSUpdateKey reads -dns-update-key, name:base64 secret of an
+// HMAC-SHA256 TSIG key as generated by tsig-keygen.
+func parseDNSUpdateKey(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	name, secret, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("expected name:secret")
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("secret: %v", err)
+	}
+	return map[string]string{dns.Fqdn(strings.ToLower(name)): secret}, nil
+}
+
+// handleDNSNotifyUpdate records NOTIFY and UPDATE messages, which name a zone
+// instead of asking a question. Notifies are acknowledged. Updates are
+// refused unless they are signed with -dns-update-key, then they change the
+// records in zone.json.
+func handleDNSNotifyUpdate(w dns.ResponseWriter, r *dns.Msg, services *dnsServices) {
+	opcode := dns.OpcodeToString[r.Opcode]
+	interaction := newDNSInteraction(w, r.Question[0])
+	interaction.Method = opcode
+	var records []string
+	for _, rr := range append(append([]dns.RR{}, r.Answer...), r.Ns...) {
+		records = append(records, rr.String())
+	}
+	interaction.Data = strings.Join(records, "\n")
+	services.events.Write(interaction)
+
+	logMessage := fmt.Sprintf("IP address: %s, Listener: dns:%d, DNS %s: %s, Records: %d\n", interaction.RemoteIP, interaction.Port, opcode, r.Question[0].Name, len(records))
+	if _, err := services.dnsLogFile.WriteString(logMessage); err != nil {
+		log.Println(err)
+	}
+
+	response := new(dns.Msg)
+	if r.Opcode == dns.OpcodeNotify {
+		response.SetReply(r)
+		response.Authoritative = true
+	} else {
+		response.SetRcode(r, applyDNSUpdate(w, r, services.zone))
+	}
+	writeDNSResponse(w, r, response)
+}
+
+// applyDNSUpdate applies the update section of an RFC 2136 update to the
+// zone's records and returns the response code. Records are keyed by name
+// and type, so deleting one value deletes the record. Prerequisites aren't
+// supported and changes are applied one by one, not atomically.
+func applyDNSUpdate(w dns.ResponseWriter, r *dns.Msg, zone *dnsZone) int {
+	if DNSUpdateKey == "" || zone == nil {
+		return dns.RcodeRefused
+	}
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		return dns.RcodeNotAuth
+	}
+	if !strings.EqualFold(r.Question[0].Name, DNSResponseName) {
+		return dns.RcodeNotZone
+	}
+	if len(r.Answer) > 0 {
+		return dns.RcodeNotImplemented
+	}
+
+	changes := 0
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		name, ok := relativeName(hdr.Name)
+		if !ok {
+			return dns.RcodeNotZone
+		}
+		qtype := dns.TypeToString[hdr.Rrtype]
+
+		var err error
+		switch hdr.Class {
+		case dns.ClassINET:
+			ttl := int(hdr.Ttl)
+			_, err = zone.setRecord(&zoneRecord{Name: name, Type: qtype, Value: strings.TrimPrefix(rr.String(), hdr.String()), TTL: &ttl})
+			if err != nil {
+				log.Printf("DNS update from %s: %v\n", addrIP(w.RemoteAddr()), err)
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Rrtype == dns.TypeANY {
+				qtype = ""
+			}
+			_, err = zone.deleteRecords(name, qtype)
+		default:
+			return dns.RcodeFormatError
+		}
+		if err != nil {
+			log.Println(err)
+			return dns.RcodeServerFailure
+		}
+		changes++
+	}
+	log.Printf("Applied %d change(s) from a DNS update signed by %s from %s\n", changes, r.IsTsig().Hdr.Name, addrIP(w.RemoteAddr()))
+	return dns.RcodeSuccess
+}
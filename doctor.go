@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	doctorResolvers  = "8.8.8.8,1.1.1.1,9.9.9.9"
+	doctorTimeout    = 10 * time.Second
+	doctorExpiryWarn = 14 * 24 * time.Hour
+)
+
+// doctorHints say what to look at when a layer is broken, in the order a
+// client goes through them.
+var doctorHints = []struct{ layer, hint string }{
+	{"delegation", "create the NS and glue records at the DNS host of the parent zone, for example with cowitness delegate"},
+	{"name server", "check CoWitness runs with a dns listener on port 53 and the firewall allows 53/udp and 53/tcp"},
+	{"resolvers", "check the glue address is the server's, and wait for the parent zone's TTL when the records just changed"},
+	{"http", "check the http and https listeners are in -listen and their ports are open in the firewall"},
+	{"certificate", "serve a certificate clients trust for the domain with -tls-cert or -tls-cert-dir"},
+}
+
+// doctor runs the checks of the "doctor" subcommand and remembers which
+// layers failed.
+type doctor struct {
+	zone   string
+	ip     string
+	failed map[string]bool
+}
+
+func (d *doctor) report(layer, detail string, err error) {
+	if err != nil {
+		d.failed[layer] = true
+		fmt.Printf("FAIL  %-12s %v\n", layer, err)
+		return
+	}
+	fmt.Printf("ok    %-12s %s\n", layer, detail)
+}
+
+// runDoctorCommand implements the "doctor" subcommand. It checks a
+// deployment from the outside in, the way a target's clients reach it: the
+// delegation in the parent zone, the server's authoritative answers, public
+// resolvers, the HTTP and HTTPS listeners and their certificates, and names
+// the first layer that is broken.
+func runDoctorCommand(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	domain := fs.String("domain", "", "callback zone to check, e.g. oob.example.com")
+	ip := fs.String("ip", "", "public IPv4 address of the server (default the glue address in the parent zone)")
+	listen := fs.String("listen", fmt.Sprintf("http:%d,https:%d,dns:%d", HTTPPort, HTTPSPort, DNSPort), "the server's -listen value, its http and https listeners are checked")
+	resolvers := fs.String("resolvers", doctorResolvers, "comma separated public resolvers that have to resolve the zone")
+	checker := fs.String("checker", "", "URL of an external checker fetching the HTTP endpoints from elsewhere, {url} is replaced with the endpoint, e.g. https://checker.example.net/fetch?url={url} (default fetches them from here)")
+	timeout := fs.Duration("timeout", doctorTimeout, "timeout of every check")
+	fs.StringVar(&OutboundProxy, "proxy", "", "proxy for the external checker (default HTTPS_PROXY and HTTP_PROXY)")
+	fs.Parse(args)
+
+	zone := strings.ToLower(strings.TrimSuffix(*domain, "."))
+	if _, ok := dns.IsDomainName(zone); !ok || strings.Count(zone, ".") < 1 {
+		log.Fatalf("Invalid -domain value %q, expected a domain such as oob.example.com", *domain)
+	}
+	if *ip != "" {
+		if parsed := net.ParseIP(*ip); parsed == nil || parsed.To4() == nil {
+			log.Fatalf("Invalid -ip value %q, expected the server's IPv4 address", *ip)
+		}
+	}
+	listeners, err := parseListen(*listen)
+	if err != nil {
+		log.Fatalf("Invalid -listen value: %v", err)
+	}
+	if *checker != "" && !strings.Contains(*checker, "{url}") {
+		log.Fatalf("Invalid -checker value %q, expected a URL containing {url}", *checker)
+	}
+
+	d := &doctor{zone: zone, ip: *ip, failed: make(map[string]bool)}
+	detail, err := d.checkDelegation()
+	d.report("delegation", detail, err)
+	if d.ip == "" {
+		fmt.Printf("Pass the server's address with -ip to check the other layers\n")
+	} else {
+		d.checkServer(listeners, strings.Split(*resolvers, ","), *checker, *timeout)
+	}
+
+	for _, h := range doctorHints {
+		if d.failed[h.layer] {
+			fmt.Printf("\nThe %s layer is broken: %s\n", h.layer, h.hint)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("\n%s is reachable at %s, all checks passed\n", zone, d.ip)
+}
+
+// checkServer runs the checks of the layers behind the delegation.
+func (d *doctor) checkServer(listeners []moduleListener, resolvers []string, checker string, timeout time.Duration) {
+	detail, err := d.checkNameServer(timeout)
+	d.report("name server", detail, err)
+	for _, resolver := range resolvers {
+		if resolver = strings.TrimSpace(resolver); resolver != "" {
+			detail, err = d.checkResolver(resolver, timeout)
+			d.report("resolvers", detail, err)
+		}
+	}
+	for _, l := range listeners {
+		if l.Module != "http" && l.Module != "https" {
+			continue
+		}
+		target := fmt.Sprintf("%s://%s:%d/", l.Module, d.zone, l.Port)
+		if checker != "" {
+			detail, err = d.checkThrough(checker, target, timeout)
+		} else {
+			detail, err = d.fetch(target, l.Port, timeout)
+		}
+		d.report("http", detail, err)
+		if l.Module == "https" {
+			detail, err = d.checkCertificate(l.Port, timeout)
+			d.report("certificate", detail, err)
+		}
+	}
+}
+
+// checkDelegation asks the parent zone's name servers for the delegation of
+// the zone and takes the server's address from the glue when -ip isn't set.
+func (d *doctor) checkDelegation() (string, error) {
+	parent, servers, err := parentNameServers(d.zone)
+	if err != nil {
+		return "", err
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(d.zone), dns.TypeNS)
+	m.RecursionDesired = false
+	var r *dns.Msg
+	for _, server := range servers {
+		if r, err = delegationExchange(m, server); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("the name servers of %s don't answer: %v", parent, err)
+	}
+
+	var names, glue []string
+	for _, rr := range append(r.Ns, r.Answer...) {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, dns.Fqdn(d.zone)) {
+			names = append(names, strings.TrimSuffix(strings.ToLower(ns.Ns), "."))
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s doesn't delegate %s, it has no NS records for it", parent, d.zone)
+	}
+	for _, rr := range r.Extra {
+		if a, ok := rr.(*dns.A); ok {
+			glue = append(glue, a.A.String())
+		}
+	}
+	if len(glue) == 0 {
+		for _, name := range names {
+			if addrs, err := net.LookupHost(name); err == nil {
+				glue = append(glue, addrs...)
+			}
+		}
+	}
+	if d.ip == "" && len(glue) > 0 {
+		d.ip = glue[0]
+	}
+	if len(glue) == 0 {
+		return "", fmt.Errorf("%s delegates %s to %s, which has no address", parent, d.zone, strings.Join(names, ", "))
+	}
+	for _, addr := range glue {
+		if addr == d.ip {
+			return fmt.Sprintf("%s delegates %s to %s at %s", parent, d.zone, strings.Join(names, ", "), strings.Join(glue, ", ")), nil
+		}
+	}
+	return "", fmt.Errorf("%s delegates %s to %s at %s, not to %s", parent, d.zone, strings.Join(names, ", "), strings.Join(glue, ", "), d.ip)
+}
+
+// checkNameServer queries the server directly, over UDP and TCP, for a name
+// nobody asked for before.
+func (d *doctor) checkNameServer(timeout time.Duration) (string, error) {
+	probe := d.probeName()
+	var answer string
+	for _, network := range []string{"udp", "tcp"} {
+		m := new(dns.Msg)
+		m.SetQuestion(probe, dns.TypeA)
+		c := &dns.Client{Net: network, Timeout: timeout}
+		r, _, err := c.Exchange(m, net.JoinHostPort(d.ip, "53"))
+		if err != nil {
+			return "", fmt.Errorf("%s doesn't answer DNS over %s: %v", d.ip, strings.ToUpper(network), err)
+		}
+		if !r.Authoritative {
+			return "", fmt.Errorf("%s answers %s over %s without authority, it isn't serving %s", d.ip, probe, strings.ToUpper(network), d.zone)
+		}
+		if answer = firstA(r); answer == "" {
+			return "", fmt.Errorf("%s answers %s over %s with %s and no address", d.ip, probe, strings.ToUpper(network), dns.RcodeToString[r.Rcode])
+		}
+	}
+	return fmt.Sprintf("%s answers for %s with authority over UDP and TCP (A %s)", d.ip, d.zone, answer), nil
+}
+
+// checkResolver resolves a fresh name in the zone through a public resolver,
+// which has to follow the delegation to the server.
+func (d *doctor) checkResolver(resolver string, timeout time.Duration) (string, error) {
+	probe := d.probeName()
+	m := new(dns.Msg)
+	m.SetQuestion(probe, dns.TypeA)
+	c := &dns.Client{Timeout: timeout}
+	r, _, err := c.Exchange(m, net.JoinHostPort(resolver, "53"))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", resolver, err)
+	}
+	answer := firstA(r)
+	if answer == "" {
+		return "", fmt.Errorf("%s resolves %s to %s", resolver, probe, dns.RcodeToString[r.Rcode])
+	}
+	return fmt.Sprintf("%s resolves names in %s (A %s)", resolver, d.zone, answer), nil
+}
+
+// fetch requests an HTTP endpoint from here, connecting to the server's
+// address so the result doesn't depend on the local resolver. Certificates
+// are checked separately.
+func (d *doctor) fetch(target string, port int, timeout time.Duration) (string, error) {
+	addr := net.JoinHostPort(d.ip, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: timeout}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	start := time.Now()
+	resp, err := client.Get(target)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", target, err)
+	}
+	resp.Body.Close()
+	return fmt.Sprintf("%s answers %s in %s", target, resp.Status, time.Since(start).Round(time.Millisecond)), nil
+}
+
+// checkThrough has the external checker fetch an HTTP endpoint, which tells
+// whether it is reachable from the checker's network too. Any 2xx response
+// of the checker counts as reachable.
+func (d *doctor) checkThrough(checker, target string, timeout time.Duration) (string, error) {
+	client := newOutboundClient(timeout, nil)
+	resp, err := client.Get(strings.ReplaceAll(checker, "{url}", url.QueryEscape(target)))
+	if err != nil {
+		return "", fmt.Errorf("checker: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("the checker can't fetch %s: %s %s", target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return fmt.Sprintf("the checker fetched %s", target), nil
+}
+
+// checkCertificate verifies the certificate of an HTTPS listener against the
+// system roots and the zone's name, and its expiry.
+func (d *doctor) checkCertificate(port int, timeout time.Duration) (string, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(d.ip, strconv.Itoa(port)), &tls.Config{ServerName: d.zone, InsecureSkipVerify: true})
+	if err != nil {
+		return "", fmt.Errorf("TLS handshake with port %d: %v", port, err)
+	}
+	defer conn.Close()
+	chain := conn.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return "", fmt.Errorf("port %d presents no certificate", port)
+	}
+	cert := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: d.zone, Intermediates: intermediates})
+	var unknown x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &unknown):
+		return "", fmt.Errorf("port %d: the certificate for %s is issued by %q, which clients don't trust", port, strings.Join(cert.DNSNames, ", "), cert.Issuer.CommonName)
+	case err != nil:
+		return "", fmt.Errorf("port %d: %v", port, err)
+	}
+	left := time.Until(cert.NotAfter)
+	if left < doctorExpiryWarn {
+		return "", fmt.Errorf("port %d: the certificate for %s expires in %d day(s), on %s", port, d.zone, int(left.Hours()/24), cert.NotAfter.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("port %d: trusted certificate for %s from %q, expires %s", port, d.zone, cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02")), nil
+}
+
+// probeName returns a name in the zone no resolver has cached.
+func (d *doctor) probeName() string {
+	return dns.Fqdn(fmt.Sprintf("doctor-%d.%s", time.Now().UnixNano(), d.zone))
+}
+
+func firstA(r *dns.Msg) string {
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsUDPSize is the largest UDP response CoWitness sends, the size
+// recommended to avoid IP fragmentation, whatever the client advertises.
+const dnsUDPSize = 1232
+
+// writeDNSResponse sends a response sized for the transport. Over UDP the
+// response fits the client's EDNS0 buffer, or 512 bytes without EDNS0, and
+// is truncated with the TC bit set otherwise, so the client retries over
+// TCP instead of losing the answer. EDNS0 requests get an OPT record back,
+// and unsupported EDNS versions get BADVERS. Responses to requests with a
+// valid TSIG are signed, the signature being the last record. UDP responses
+// go through the response rate limit, and with -dns-minimal they are
+// minimized and never exceed 512 bytes.
+func writeDNSResponse(w dns.ResponseWriter, r, response *dns.Msg) {
+	udp := w.LocalAddr().Network() == "udp"
+	if DNSMinimal {
+		minimizeDNSResponse(r, response)
+	}
+	if udp {
+		switch dnsRateLimiter.limit(w.RemoteAddr(), r, response) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			rcode := response.Rcode
+			response = new(dns.Msg)
+			response.SetRcode(r, rcode)
+			response.Truncated = true
+		}
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		if size > dnsUDPSize {
+			size = dnsUDPSize
+		}
+		if DNSMinimal {
+			size = dns.MinMsgSize
+		}
+		response.SetEdns0(dnsUDPSize, opt.Do())
+		if opt.Version() != 0 {
+			response.Answer, response.Ns = nil, nil
+			response.Rcode = dns.RcodeBadVers
+		}
+	}
+	if w.LocalAddr().Network() == "tcp" {
+		size = dns.MaxMsgSize
+	}
+	response.Truncate(size)
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		response.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	if err := w.WriteMsg(response); err != nil {
+		log.Println(err)
+	}
+}
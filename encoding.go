@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodeBody undoes the Content-Encoding of a captured body, so compressed
+// exfiltration shows up in the interaction as the data that was sent. The
+// codings are removed in the reverse of the order they are listed in. A body
+// without a Content-Encoding is still decoded when it starts with a gzip or
+// zlib header, as tools that compress their payload rarely say so.
+// Decoding stops at maxCapturedBody bytes, which keeps compression bombs
+// cheap, and a body cut short by the capture limit is decoded as far as it
+// goes. It returns "" when the body isn't encoded or doesn't decode.
+func decodeBody(body []byte, contentEncoding string) string {
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 {
+		switch {
+		case isGzip(body):
+			codings = []string{"gzip"}
+		case isZlib(body):
+			codings = []string{"deflate"}
+		default:
+			return ""
+		}
+	}
+
+	decoded := body
+	for n := len(codings) - 1; n >= 0; n-- {
+		var r io.Reader
+		switch codings[n] {
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(bytes.NewReader(decoded))
+			if err != nil {
+				return ""
+			}
+			r = zr
+		case "deflate":
+			// Some clients send raw deflate instead of the zlib stream the
+			// RFC asks for.
+			if isZlib(decoded) {
+				zr, err := zlib.NewReader(bytes.NewReader(decoded))
+				if err != nil {
+					return ""
+				}
+				r = zr
+			} else {
+				r = flate.NewReader(bytes.NewReader(decoded))
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(decoded))
+		default:
+			return ""
+		}
+		// Keep what decoded before a truncated or corrupt stream failed.
+		decoded, _ = io.ReadAll(io.LimitReader(r, maxCapturedBody))
+		if len(decoded) == 0 {
+			return ""
+		}
+	}
+	return bodyText(decoded)
+}
+
+func isGzip(b []byte) bool {
+	return len(b) >= 3 && b[0] == 0x1f && b[1] == 0x8b && b[2] == 8
+}
+
+// isZlib checks the compression method and header checksum of a zlib stream.
+func isZlib(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x0f == 8 && b[0]>>4 <= 7 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
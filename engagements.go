@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	EngagementsFile         = "./engagements.json"
+	engagementPurgeInterval = time.Hour
+)
+
+// engagementNamespace is an entry of engagements.json: a subdomain of the
+// callback domain set aside for one client, so a single instance serves
+// several engagements. Interactions for names under
+// <subdomain>.<dns-name> are recorded under the engagement instead of
+// -engagement, are posted to the engagement's own webhook on top of the
+// global publishers, and are deleted from the store once they are older than
+// its retention. Outside its windows the engagement is disarmed. An entry
+// without a subdomain only configures the engagement, e.g. the windows of
+// the -engagement one.
+type engagementNamespace struct {
+	Name          string              `json:"name"`
+	Subdomain     string              `json:"subdomain,omitempty"`
+	WebhookURL    string              `json:"webhook_url,omitempty"`
+	WebhookSecret string              `json:"webhook_secret,omitempty"`
+	WebhookEvents string              `json:"webhook_events,omitempty"`
+	Retention     string              `json:"retention,omitempty"`
+	Windows       []*engagementWindow `json:"windows,omitempty"`
+
+	retention time.Duration
+}
+
+func loadEngagements(path string) ([]*engagementNamespace, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []*engagementNamespace
+	if err := json.Unmarshal(data, &namespaces); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	names := make(map[string]bool)
+	subdomains := make(map[string]bool)
+	for _, ns := range namespaces {
+		if ns.Name == "" {
+			return nil, fmt.Errorf("%s: every engagement needs a name", path)
+		}
+		if names[ns.Name] {
+			return nil, fmt.Errorf("%s: engagement %s is listed twice", path, ns.Name)
+		}
+		names[ns.Name] = true
+		ns.Subdomain = strings.ToLower(strings.Trim(ns.Subdomain, "."))
+		if ns.Subdomain != "" {
+			if _, ok := dns.IsDomainName(ns.Subdomain); !ok {
+				return nil, fmt.Errorf("%s: %s: invalid subdomain %q", path, ns.Name, ns.Subdomain)
+			}
+			if subdomains[ns.Subdomain] {
+				return nil, fmt.Errorf("%s: subdomain %s is listed twice", path, ns.Subdomain)
+			}
+			subdomains[ns.Subdomain] = true
+		}
+		for n, w := range ns.Windows {
+			if err := w.parse(); err != nil {
+				return nil, fmt.Errorf("%s: %s: window %d: %v", path, ns.Name, n+1, err)
+			}
+		}
+		if ns.WebhookEvents == "" {
+			ns.WebhookEvents = "all"
+		}
+		if ns.WebhookEvents != "all" && ns.WebhookEvents != "tokens" {
+			return nil, fmt.Errorf("%s: %s: invalid webhook_events %q, expected all or tokens", path, ns.Name, ns.WebhookEvents)
+		}
+		if ns.Retention != "" {
+			if ns.retention, err = time.ParseDuration(ns.Retention); err != nil || ns.retention <= 0 {
+				return nil, fmt.Errorf("%s: %s: invalid retention %q, expected a duration such as 720h", path, ns.Name, ns.Retention)
+			}
+		}
+	}
+	// Nested subdomains go first, so eu.acme wins over acme.
+	sort.SliceStable(namespaces, func(a, b int) bool {
+		return len(namespaces[a].Subdomain) > len(namespaces[b].Subdomain)
+	})
+	return namespaces, nil
+}
+
+// contains reports whether name, a host or query name, is under the
+// namespace.
+func (ns *engagementNamespace) contains(name string) bool {
+	if ns.Subdomain == "" {
+		return false
+	}
+	if h, _, ok := strings.Cut(name, ":"); ok {
+		name = h
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone := ns.Subdomain + "." + strings.TrimSuffix(DNSResponseName, ".")
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// engagementNamespaces are the namespaces of engagements.json once
+// startEngagements loaded them.
+var engagementNamespaces []*engagementNamespace
+
+// hostEngagement returns the engagement a request for host belongs to.
+func hostEngagement(host string) string {
+	for _, ns := range engagementNamespaces {
+		if ns.contains(host) {
+			return ns.Name
+		}
+	}
+	return Engagement
+}
+
+// engagementRouter records interactions under the engagement whose
+// namespace they were addressed to. It runs at the head of the pipeline,
+// so hooks, rules and every subscriber see the engagement.
+type engagementRouter struct {
+	namespaces []*engagementNamespace
+	next       interactionSink
+}
+
+func (r *engagementRouter) Write(i *Interaction) {
+	for _, ns := range r.namespaces {
+		if ns.contains(i.QName) || ns.contains(i.Host) {
+			i.Engagement = ns.Name
+			break
+		}
+	}
+	r.next.Write(i)
+}
+
+// engagementFilter passes on the interactions of one engagement only.
+type engagementFilter struct {
+	engagement string
+	next       interactionSink
+}
+
+func (f *engagementFilter) Write(i *Interaction) {
+	if i.Engagement == f.engagement {
+		f.next.Write(i)
+	}
+}
+
+// startEngagements puts the engagement router in front of next, subscribes
+// the engagements' webhooks to bus and starts purging expired interactions
+// from store. It returns the sink to write to instead of next.
+func startEngagements(path string, store interactionStore, bus *eventBus, next interactionSink) interactionSink {
+	namespaces, err := loadEngagements(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(namespaces) == 0 {
+		return next
+	}
+
+	arming.schedule(namespaces)
+	for _, ns := range namespaces {
+		if ns.Subdomain != "" {
+			infof("Recording interactions under %s.%s as engagement %s\n", ns.Subdomain, DNSResponseName, ns.Name)
+		}
+		if ns.WebhookURL == "" {
+			continue
+		}
+		webhook, err := newWebhookSink(ns.WebhookURL, ns.WebhookSecret, "", ns.WebhookEvents, WebhookDeadLetter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bus.subscribe("webhook "+ns.Name, &engagementFilter{engagement: ns.Name, next: &armedSink{webhook}})
+	}
+	engagementNamespaces = namespaces
+	go purgeEngagements(store, namespaces)
+	return &engagementRouter{namespaces: namespaces, next: next}
+}
+
+// purgeEngagements deletes the interactions of engagements with a
+// retention once they expire.
+func purgeEngagements(store interactionStore, namespaces []*engagementNamespace) {
+	for {
+		for _, ns := range namespaces {
+			if ns.retention == 0 {
+				continue
+			}
+			n, err := store.Purge(ns.Name, time.Now().Add(-ns.retention))
+			if err != nil {
+				log.Printf("Purging engagement %s: %v\n", ns.Name, err)
+			} else if n > 0 {
+				infof("Purged %d interaction(s) of engagement %s older than %s\n", n, ns.Name, ns.Retention)
+			}
+		}
+		time.Sleep(engagementPurgeInterval)
+	}
+}
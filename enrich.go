@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	enrichQueueSize = 4096
+	// enrichLocalTimeout bounds the enrichers that only look at the
+	// interaction or local files.
+	enrichLocalTimeout = time.Second
+)
+
+var EnrichWorkers int
+
+// enricher adds what takes a lookup to find out about an interaction, such
+// as a verdict on its source address or a screenshot of the referring page.
+type enricher interface {
+	// name identifies the enricher in log messages.
+	name() string
+	// applies reports whether the enricher has anything to add to i, so
+	// interactions none applies to skip the queue.
+	applies(i *Interaction) bool
+	// timeout bounds enrich, the interaction going on without the
+	// enricher's result after it.
+	timeout() time.Duration
+	// enrich looks up what to add to i, which it must only read, and returns
+	// the function adding it. The functions of all enrichers are called in
+	// turn once they are done, so results are merged from one goroutine.
+	enrich(ctx context.Context, i *Interaction) (func(*Interaction), error)
+}
+
+// enrichmentPipeline runs interactions through the enrichers before passing
+// them on. It works from a queue served by -enrich-workers workers, each
+// running the enrichers of one interaction at the same time, so slow lookups
+// never delay a DNS answer or HTTP response and an interaction waits for its
+// slowest enricher only, at most that enricher's timeout.
+type enrichmentPipeline struct {
+	enrichers []enricher
+	next      interactionSink
+	queue     chan *Interaction
+}
+
+// newEnrichmentPipeline puts enrichers in front of next. It returns next
+// itself when there are none.
+func newEnrichmentPipeline(enrichers []enricher, next interactionSink) interactionSink {
+	if len(enrichers) == 0 {
+		return next
+	}
+	p := &enrichmentPipeline{enrichers: enrichers, next: next, queue: make(chan *Interaction, enrichQueueSize)}
+	names := make([]string, len(enrichers))
+	for n, e := range enrichers {
+		names[n] = e.name()
+	}
+	infof("Enriching interactions with %s on %d worker(s)\n", strings.Join(names, ", "), EnrichWorkers)
+	for n := 0; n < EnrichWorkers; n++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *enrichmentPipeline) Write(i *Interaction) {
+	if len(p.applicable(i)) == 0 {
+		p.next.Write(i)
+		return
+	}
+	select {
+	case p.queue <- i:
+	default:
+		log.Printf("Enrichment queue full, passing on interaction %s as it is\n", i.ID)
+		p.next.Write(i)
+	}
+}
+
+func (p *enrichmentPipeline) applicable(i *Interaction) []enricher {
+	var list []enricher
+	for _, e := range p.enrichers {
+		if e.applies(i) {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func (p *enrichmentPipeline) run() {
+	for i := range p.queue {
+		p.enrich(i)
+		p.next.Write(i)
+	}
+}
+
+type enrichResult struct {
+	apply func(*Interaction)
+	err   error
+}
+
+func (p *enrichmentPipeline) enrich(i *Interaction) {
+	enrichers := p.applicable(i)
+	results := make([]enrichResult, len(enrichers))
+	var wg sync.WaitGroup
+	for n, e := range enrichers {
+		wg.Add(1)
+		go func(n int, e enricher) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+			defer cancel()
+			done := make(chan enrichResult, 1)
+			go func() {
+				apply, err := e.enrich(ctx, i)
+				done <- enrichResult{apply, err}
+			}()
+			select {
+			case results[n] = <-done:
+			case <-ctx.Done():
+				results[n] = enrichResult{err: ctx.Err()}
+			}
+		}(n, e)
+	}
+	wg.Wait()
+
+	var applied []string
+	for n, r := range results {
+		if r.err != nil {
+			log.Printf("Enricher %s on interaction %s: %v\n", enrichers[n].name(), i.ID, r.err)
+			continue
+		}
+		if r.apply != nil {
+			r.apply(i)
+			applied = append(applied, enrichers[n].name())
+		}
+	}
+	if len(applied) > 0 {
+		verbosef("Enriched interaction %s with %s\n", i.ID, strings.Join(applied, ", "))
+	}
+}
+
+// setEnrichment records the result of an enricher that has no field of its
+// own in the interaction's enrichment map.
+func setEnrichment(i *Interaction, key, value string) {
+	if value == "" {
+		return
+	}
+	if i.Enrichment == nil {
+		i.Enrichment = make(map[string]string)
+	}
+	i.Enrichment[key] = value
+}
+
+// exportEnrichment renders the enrichment map one "key: value" line each.
+func exportEnrichment(i *Interaction) string {
+	keys := make([]string, 0, len(i.Enrichment))
+	for key := range i.Enrichment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for n, key := range keys {
+		lines[n] = key + ": " + i.Enrichment[key]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// startEnrichers returns the enrichers enabled by the flags, in the order
+// their results are merged.
+func startEnrichers() []enricher {
+	var enrichers []enricher
+	if GeoIPFile != "" {
+		db, err := loadGeoIP(GeoIPFile)
+		if err != nil {
+			log.Fatalf("GeoIP database: %v", err)
+		}
+		enrichers = append(enrichers, db)
+	}
+	if ASNFile != "" {
+		db, err := loadASNDatabase(ASNFile)
+		if err != nil {
+			log.Fatalf("ASN database: %v", err)
+		}
+		enrichers = append(enrichers, db)
+	}
+	if ReverseDNS {
+		enrichers = append(enrichers, newReverseDNSEnricher())
+	}
+	if SecretRedaction != "full" {
+		enrichers = append(enrichers, jwtEnricher{})
+	}
+	if GreyNoiseKey != "" || AbuseIPDBKey != "" {
+		enrichers = append(enrichers, newIntelEnricher())
+	}
+	if ScreenshotChrome != "" {
+		enrichers = append(enrichers, newScreenshotter())
+	}
+	return enrichers
+}
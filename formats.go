@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var eventFormatters = map[string]func(*Interaction) ([]byte, error){
+	"json": formatJSON,
+	"cef":  formatCEF,
+	"leef": formatLEEF,
+}
+
+func formatJSON(i *Interaction) ([]byte, error) {
+	return json.Marshal(i)
+}
+
+// eventNames are the event class IDs and readable names of the protocols,
+// used by both ArcSight (signature ID / name) and QRadar (event ID).
+var eventNames = map[string][2]string{
+	"dns":       {"dns-query", "DNS query"},
+	"http":      {"http-request", "HTTP request"},
+	"smtp":      {"smtp-session", "SMTP session"},
+	"pop3":      {"pop3-session", "POP3 session"},
+	"imap":      {"imap-session", "IMAP session"},
+	"redis":     {"redis-session", "Redis session"},
+	"memcached": {"memcached-session", "Memcached session"},
+	"mysql":     {"mysql-session", "MySQL session"},
+	"postgres":  {"postgres-session", "PostgreSQL session"},
+	"ssh":       {"ssh-session", "SSH session"},
+	"telnet":    {"telnet-session", "Telnet session"},
+	"tftp":      {"tftp-request", "TFTP request"},
+	"ntp":       {"ntp-request", "NTP request"},
+	"snmp":      {"snmp-trap", "SNMP trap"},
+	"vpn":       {"vpn-packet", "VPN packet"},
+	"udp":       {"udp-packet", "UDP packet"},
+}
+
+// eventName returns the event class ID and a readable name of an
+// interaction. Protocols added later without an entry in eventNames get a
+// generic one rather than passing for HTTP.
+func eventName(i *Interaction) (string, string) {
+	if i.Token != "" {
+		return i.Protocol + "-token", "Canary token fired over " + strings.ToUpper(i.Protocol)
+	}
+	if name, ok := eventNames[i.Protocol]; ok {
+		return name[0], name[1]
+	}
+	return i.Protocol + "-interaction", strings.ToUpper(i.Protocol) + " interaction"
+}
+
+func eventSeverity(i *Interaction) int {
+	switch {
+	case i.Token != "":
+		return 8
+	case i.Noise:
+		return 1
+	}
+	return 3
+}
+
+// eventFields maps an interaction onto the shared CEF/LEEF dictionary keys.
+func eventFields(i *Interaction) [][2]string {
+	fields := [][2]string{
+		{"src", i.RemoteIP},
+		{"dpt", fmt.Sprint(i.Port)},
+		{"app", strings.ToUpper(i.Protocol)},
+		{"externalId", i.ID},
+		{"dvchost", i.Node},
+	}
+	switch i.Protocol {
+	case "dns":
+		fields = append(fields, [2]string{"dhost", strings.TrimSuffix(i.QName, ".")}, [2]string{"cs1Label", "qtype"}, [2]string{"cs1", i.QType})
+	case "http":
+		request := i.Path
+		if i.Query != "" {
+			request += "?" + i.Query
+		}
+		fields = append(fields,
+			[2]string{"requestMethod", i.Method},
+			[2]string{"dhost", i.Host},
+			[2]string{"request", request},
+			[2]string{"requestClientApplication", i.UserAgent})
+	default:
+		// The capture modules keep what the client sent in the transcript.
+		fields = append(fields,
+			[2]string{"suser", i.User},
+			[2]string{"requestMethod", i.Method},
+			[2]string{"fname", i.Path},
+			[2]string{"requestClientApplication", i.UserAgent})
+		if i.Data != "" {
+			fields = append(fields, [2]string{"cs3Label", "data"}, [2]string{"cs3", truncateEventField(i.Data)})
+		}
+	}
+	if i.Token != "" {
+		fields = append(fields, [2]string{"cs2Label", "token"}, [2]string{"cs2", i.Token})
+	}
+	return fields
+}
+
+// maxEventField is the longest value ArcSight keeps in a custom string field.
+const maxEventField = 4000
+
+func truncateEventField(value string) string {
+	if len(value) <= maxEventField {
+		return value
+	}
+	return strings.ToValidUTF8(value[:maxEventField], "")
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	leefEscaper         = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+func formatCEF(i *Interaction) ([]byte, error) {
+	id, name := eventName(i)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|CoWitness|CoWitness|%s|%s|%s|%d|rt=%d",
+		cefHeaderEscaper.Replace(Version), cefHeaderEscaper.Replace(id), cefHeaderEscaper.Replace(name), eventSeverity(i), i.Time.UnixMilli())
+	for _, f := range eventFields(i) {
+		if f[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%s", f[0], cefExtensionEscaper.Replace(f[1]))
+	}
+	return []byte(b.String()), nil
+}
+
+// leefKeys renames the CEF dictionary keys that LEEF spells differently.
+var leefKeys = map[string]string{
+	"dpt":                      "dstPort",
+	"dvchost":                  "devName",
+	"dhost":                    "dstHost",
+	"requestMethod":            "method",
+	"request":                  "url",
+	"requestClientApplication": "userAgent",
+	"suser":                    "usrName",
+	"fname":                    "fileName",
+}
+
+func formatLEEF(i *Interaction) ([]byte, error) {
+	id, _ := eventName(i)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|CoWitness|CoWitness|%s|%s|devTime=%d\tsev=%d",
+		cefHeaderEscaper.Replace(Version), cefHeaderEscaper.Replace(id), i.Time.UnixMilli(), eventSeverity(i))
+	for _, f := range eventFields(i) {
+		if f[1] == "" {
+			continue
+		}
+		key := f[0]
+		if k, ok := leefKeys[key]; ok {
+			key = k
+		}
+		fmt.Fprintf(&b, "\t%s=%s", key, leefEscaper.Replace(f[1]))
+	}
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventNamePerProtocol(t *testing.T) {
+	tests := []struct {
+		i        Interaction
+		id, name string
+	}{
+		{Interaction{Protocol: "http"}, "http-request", "HTTP request"},
+		{Interaction{Protocol: "dns"}, "dns-query", "DNS query"},
+		{Interaction{Protocol: "smtp"}, "smtp-session", "SMTP session"},
+		{Interaction{Protocol: "vpn"}, "vpn-packet", "VPN packet"},
+		{Interaction{Protocol: "gopher"}, "gopher-interaction", "GOPHER interaction"},
+		{Interaction{Protocol: "ssh", Token: "abc"}, "ssh-token", "Canary token fired over SSH"},
+	}
+	for _, test := range tests {
+		id, name := eventName(&test.i)
+		if id != test.id || name != test.name {
+			t.Errorf("%s: got %q, %q, want %q, %q", test.i.Protocol, id, name, test.id, test.name)
+		}
+	}
+}
+
+func TestFormatCEFEscaping(t *testing.T) {
+	i := &Interaction{
+		ID:        "id1",
+		Time:      time.UnixMilli(1700000000000),
+		Protocol:  "http",
+		RemoteIP:  "192.0.2.1",
+		Method:    "GET",
+		Path:      "/a|b",
+		Query:     `x=1\2`,
+		UserAgent: "evil\nCEF:0|forged",
+	}
+	out, err := formatCEF(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(out)
+	if strings.Contains(line, "\n") {
+		t.Fatalf("newline in CEF event: %q", line)
+	}
+	for _, want := range []string{
+		"|http-request|HTTP request|3|rt=1700000000000",
+		` request=/a|b?x\=1\\2`,
+		` requestClientApplication=evil\nCEF:0|forged`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("%q not in %q", want, line)
+		}
+	}
+}
+
+func TestFormatLEEFEscaping(t *testing.T) {
+	i := &Interaction{
+		Protocol:  "http",
+		Path:      "/",
+		UserAgent: "a\tforged=1\nb",
+	}
+	out, err := formatLEEF(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "\tuserAgent=a forged=1 b") {
+		t.Errorf("tab or newline not replaced: %q", out)
+	}
+}
+
+func TestFormatCEFModuleSession(t *testing.T) {
+	i := &Interaction{
+		Protocol: "smtp",
+		RemoteIP: "192.0.2.1",
+		User:     "admin",
+		Data:     "EHLO x\nMAIL FROM:<a=b@example.com>\n",
+	}
+	out, err := formatCEF(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(out)
+	for _, want := range []string{"|smtp-session|SMTP session|", " suser=admin", ` cs3Label=data cs3=EHLO x\nMAIL FROM:<a\=b@example.com>\n`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("%q not in %q", want, line)
+		}
+	}
+	if strings.Contains(line, "request=") {
+		t.Errorf("SMTP session formatted as an HTTP request: %q", line)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+// The native fuzz targets cover the same parsers as the fuzz subcommand,
+// with coverage guidance. Their seed corpora are in testdata/fuzz, and
+// go test runs the seeds as regular tests.
+
+func FuzzHandleDNSQuery(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDNS(data)
+	})
+}
+
+func FuzzDecodeBody(f *testing.F) {
+	f.Fuzz(func(t *testing.T, body []byte, coding string) {
+		decodeBody(body, coding)
+	})
+}
+
+func FuzzDecodeJWT(f *testing.F) {
+	f.Fuzz(func(t *testing.T, token string) {
+		if jwt, err := decodeJWT(token); err == nil {
+			_ = jwt.String()
+		}
+	})
+}
+
+func FuzzClientHello(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if hello, complete := clientHello(data); complete && hello != nil {
+			ja3Digest(hello)
+			parseHelloOffers(hello)
+		}
+	})
+}
+
+func FuzzSNMPTrap(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeSNMPTrap(&udpPacket{data: data, interaction: &Interaction{}})
+	})
+}
+
+func FuzzNTP(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handleNTP(&udpPacket{data: data, interaction: &Interaction{}})
+	})
+}
+
+func FuzzTFTP(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handleTFTP(&udpPacket{data: data, interaction: &Interaction{}})
+	})
+}
+
+func FuzzWireGuard(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handleWireGuard(&udpPacket{data: data, interaction: &Interaction{}})
+	})
+}
+
+func FuzzOpenVPN(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handleOpenVPN(&udpPacket{data: data, interaction: &Interaction{}})
+	})
+}
+
+func FuzzRedisCommand(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := fuzzSession(data)
+		for {
+			if _, err := readRedisCommand(s); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzMySQLHandshake(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzSession(nil).parseMySQLHandshake(data)
+	})
+}
+
+// FuzzPostgresStartup marks the session as TLS already, so an SSLRequest is
+// declined instead of starting a handshake on the buffer.
+func FuzzPostgresStartup(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := fuzzSession(data)
+		s.interaction.TLS = true
+		servePostgresWire(s)
+	})
+}
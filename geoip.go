@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var GeoIPFile string
+
+// ipRangeTable maps address ranges to a value, loaded from a CSV file whose
+// rows give the first and last address of a range followed by its columns.
+type ipRangeTable struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	first, last net.IP // both 16 bytes long
+	value       string
+}
+
+// loadIPRanges reads the ranges of path. value turns the columns after the
+// addresses into the value of a range; ok false leaves the range out. Files
+// ending in .tsv are tab separated, as the iptoasn.com ones are.
+func loadIPRanges(path string, value func(columns []string) (string, bool)) (*ipRangeTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	if strings.HasSuffix(path, ".tsv") {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	table := &ipRangeTable{}
+	values := make(map[string]string)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected first address, last address and more columns", path, line)
+		}
+		first, last := net.ParseIP(strings.TrimSpace(record[0])), net.ParseIP(strings.TrimSpace(record[1]))
+		if first == nil || last == nil {
+			if line == 1 {
+				continue // a header
+			}
+			return nil, fmt.Errorf("%s:%d: invalid address range %s to %s", path, line, record[0], record[1])
+		}
+		v, ok := value(record[2:])
+		if !ok {
+			continue
+		}
+		// Many ranges share a value, keep one copy of it.
+		if s, ok := values[v]; ok {
+			v = s
+		} else {
+			values[v] = v
+		}
+		table.ranges = append(table.ranges, ipRange{first.To16(), last.To16(), v})
+	}
+	sort.Slice(table.ranges, func(a, b int) bool {
+		return bytes.Compare(table.ranges[a].first, table.ranges[b].first) < 0
+	})
+	return table, nil
+}
+
+// lookup returns the value of the range holding ip, or "" when none does.
+func (t *ipRangeTable) lookup(ip net.IP) string {
+	ip = ip.To16()
+	n := sort.Search(len(t.ranges), func(n int) bool {
+		return bytes.Compare(t.ranges[n].first, ip) > 0
+	})
+	if n == 0 {
+		return ""
+	}
+	if r := t.ranges[n-1]; bytes.Compare(ip, r.last) <= 0 {
+		return r.value
+	}
+	return ""
+}
+
+// geoIPDatabase locates source addresses from a CSV file of address ranges,
+// each row giving the first and last address of a range followed by its
+// location, such as the free DB-IP lite country or city files:
+//
+//	1.0.0.0,1.0.0.255,AU
+//
+// The location, its non-empty columns joined, is recorded under "geoip".
+type geoIPDatabase struct {
+	*ipRangeTable
+}
+
+func loadGeoIP(path string) (*geoIPDatabase, error) {
+	table, err := loadIPRanges(path, func(columns []string) (string, bool) {
+		var parts []string
+		for _, part := range columns {
+			if part = strings.TrimSpace(part); part != "" && part != "ZZ" {
+				parts = append(parts, part)
+			}
+		}
+		return strings.Join(parts, ", "), true
+	})
+	if err != nil {
+		return nil, err
+	}
+	infof("Locating source addresses with %d ranges from %s\n", len(table.ranges), path)
+	return &geoIPDatabase{table}, nil
+}
+
+func (db *geoIPDatabase) name() string { return "geoip" }
+
+func (db *geoIPDatabase) timeout() time.Duration { return enrichLocalTimeout }
+
+func (db *geoIPDatabase) applies(i *Interaction) bool {
+	return net.ParseIP(i.RemoteIP) != nil && i.Enrichment["geoip"] == ""
+}
+
+func (db *geoIPDatabase) enrich(ctx context.Context, i *Interaction) (func(*Interaction), error) {
+	location := db.lookup(net.ParseIP(i.RemoteIP))
+	return func(i *Interaction) { setEnrichment(i, "geoip", location) }, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const grafanaDatasourceType = "grafana-postgresql-datasource"
+
+// grafanaPanel is the part of Grafana's panel model the dashboard uses.
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Datasource  map[string]string      `json:"datasource"`
+	Targets     []map[string]string    `json:"targets"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+}
+
+// runGrafanaDashboardCommand implements the "grafana-dashboard" subcommand,
+// printing a dashboard over the PostgreSQL store's views ready to import.
+func runGrafanaDashboardCommand(args []string) {
+	fs := flag.NewFlagSet("grafana-dashboard", flag.ExitOnError)
+	datasource := fs.String("datasource", "", "UID of the Grafana PostgreSQL data source (default asks for one on import)")
+	title := fs.String("title", "CoWitness", "dashboard title")
+	output := fs.String("o", "", "output file (default standard output)")
+	fs.Parse(args)
+
+	data, err := json.MarshalIndent(grafanaDashboard(*title, *datasource), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := os.WriteFile(*output, append(data, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote Grafana dashboard to %s\n", *output)
+}
+
+// grafanaDashboard builds the dashboard. Without a data source UID it uses an
+// import input, so Grafana asks which PostgreSQL data source to use.
+func grafanaDashboard(title, datasourceUID string) map[string]interface{} {
+	ds := map[string]string{"type": grafanaDatasourceType, "uid": datasourceUID}
+	var inputs []map[string]string
+	if datasourceUID == "" {
+		ds["uid"] = "${DS_COWITNESS}"
+		inputs = append(inputs, map[string]string{
+			"name": "DS_COWITNESS", "label": "CoWitness PostgreSQL", "type": "datasource",
+			"pluginId": grafanaDatasourceType, "pluginName": "PostgreSQL",
+		})
+	}
+
+	filter := ` AND ('$engagement' = '' OR engagement = '$engagement')`
+	var panels []*grafanaPanel
+	add := func(kind, title string, x, y, w, h int, format, sql string) *grafanaPanel {
+		p := &grafanaPanel{
+			ID: len(panels) + 1, Type: kind, Title: title,
+			GridPos:    map[string]int{"x": x, "y": y, "w": w, "h": h},
+			Datasource: ds,
+			Targets:    []map[string]string{{"refId": "A", "format": format, "rawQuery": "true", "editorMode": "code", "rawSql": sql}},
+		}
+		panels = append(panels, p)
+		return p
+	}
+
+	add("stat", "Interactions", 0, 0, 6, 4, "table",
+		`SELECT sum(interactions) AS "Interactions" FROM interactions_per_minute WHERE $__timeFilter(minute) AND NOT noise`+filter)
+	add("stat", "Unique sources", 6, 0, 6, 4, "table",
+		`SELECT count(DISTINCT remote_ip) AS "Sources" FROM interactions WHERE $__timeFilter(time) AND NOT noise`+filter)
+	add("stat", "Canary token callbacks", 12, 0, 6, 4, "table",
+		`SELECT count(*) AS "Callbacks" FROM interactions WHERE $__timeFilter(time) AND token <> ''`+filter)
+	add("stat", "Noise", 18, 0, 6, 4, "table",
+		`SELECT sum(interactions) AS "Noise" FROM interactions_per_minute WHERE $__timeFilter(minute) AND noise`+filter)
+
+	timeline := add("timeseries", "Interactions per minute by protocol", 0, 4, 24, 9, "time_series",
+		`SELECT minute AS time, protocol AS metric, sum(interactions) AS value FROM interactions_per_minute
+WHERE $__timeFilter(minute) AND NOT noise`+filter+` GROUP BY 1, 2 ORDER BY 1`)
+	timeline.FieldConfig = map[string]interface{}{"defaults": map[string]interface{}{"custom": map[string]interface{}{"drawStyle": "bars", "stacking": map[string]string{"mode": "normal"}}}}
+
+	add("table", "Top talkers", 0, 13, 12, 10, "table",
+		`SELECT remote_ip AS "Source", sum(interactions) AS "Interactions", string_agg(DISTINCT protocol, ',') AS "Protocols", max(verdict) AS "Verdict"
+FROM source_activity_per_minute WHERE $__timeFilter(minute) GROUP BY remote_ip ORDER BY 2 DESC LIMIT 20`)
+	add("table", "Canary token callbacks", 12, 13, 12, 10, "table",
+		`SELECT token AS "Token", count(*) AS "Callbacks", count(DISTINCT remote_ip) AS "Sources", min(time) AS "First", max(time) AS "Last"
+FROM interactions WHERE $__timeFilter(time) AND token <> ''`+filter+` GROUP BY token ORDER BY 5 DESC`)
+	add("table", "Latest interactions", 0, 23, 24, 12, "table",
+		`SELECT time AS "Time", protocol AS "Protocol", remote_ip AS "Source", verdict AS "Verdict",
+CASE WHEN protocol = 'dns' THEN qtype || ' ' || qname WHEN method <> '' THEN method || ' ' || host || path ELSE user_name END AS "Request",
+user_agent AS "User agent", token AS "Token", node AS "Node"
+FROM interactions WHERE $__timeFilter(time) AND NOT noise`+filter+` ORDER BY time DESC LIMIT 200`)
+
+	dashboard := map[string]interface{}{
+		"title":         title,
+		"uid":           "cowitness",
+		"tags":          []string{"cowitness"},
+		"timezone":      "utc",
+		"schemaVersion": 39,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"panels":        panels,
+		"templating": map[string]interface{}{"list": []interface{}{map[string]interface{}{
+			"name": "engagement", "label": "Engagement", "type": "query", "datasource": ds,
+			"query":      "SELECT '' UNION SELECT DISTINCT engagement FROM interactions WHERE engagement <> ''",
+			"refresh":    2,
+			"includeAll": false,
+			"current":    map[string]string{"text": "", "value": ""},
+		}}},
+	}
+	if inputs != nil {
+		dashboard["__inputs"] = inputs
+	}
+	return dashboard
+}
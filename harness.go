@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// harness runs the DNS and HTTP servers in process, on free local ports
+// inside a scratch directory, for end to end checks with real clients. It is
+// what selftest and the end to end tests in harness_test.go are built on:
+// every check is a harnessCase talking to the servers the way a target would
+// and asserting on what ended up in the store, the logs and the alerts.
+type harness struct {
+	dir     string
+	store   interactionStore
+	tokens  *tokenStore
+	zone    *dnsZone
+	dnsAddr string
+	httpURL string
+	dns     *dns.Client
+	http    *http.Client
+}
+
+// harnessCase is one end to end check.
+type harnessCase struct {
+	name string
+	run  func(h *harness) error
+}
+
+// newHarness changes to a scratch directory and starts the servers there.
+// The flags must have been parsed.
+func newHarness() *harness {
+	dir, err := os.MkdirTemp("", "cowitness-selftest-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	noise, err := newNoiseFilter(NoiseMode, NoiseFilters, log.New(openLogFile("./noise.log"), "", log.LstdFlags))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	DNSResponseIP = "127.0.0.1"
+	DNSResponseName = "selftest.invalid."
+	DefaultTTL = 0
+
+	httpLogFile, dnsLogFile := createLogFiles()
+	alertLogger := log.New(openLogFile("./alerts.log"), "", log.LstdFlags)
+	payloads, err := newPayloadStore(PayloadDir, PayloadManifest, log.New(io.Discard, "", 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens, err := newTokenStore(TokenStore, alertLogger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store := newMemoryStore(memoryStoreSize)
+	zone := newDNSZone(ZoneFile)
+	events := newSignatureTagger(SignatureFile, newRuleEngine(AlertRules, alertLogger, newEventBus(openLogFile(EventLogFile), store)))
+	discard := log.New(io.Discard, "", 0)
+
+	httpPort, dnsPort := freePort("tcp"), freePort("udp")
+	startHTTPServer(httpPort, nil, &httpServices{
+		rootDir:      dir,
+		httpLogger:   log.New(httpLogFile, "", log.LstdFlags),
+		uploadLogger: discard,
+		secretLogger: discard,
+		alertLogger:  alertLogger,
+		events:       events,
+		noise:        noise,
+		payloads:     payloads,
+		tokens:       tokens,
+	})
+	startDNSServer(dnsPort, &dnsServices{
+		dnsLogFile:  dnsLogFile,
+		alertLogger: alertLogger,
+		events:      events,
+		noise:       noise,
+		tokens:      tokens,
+		zone:        zone,
+	})
+
+	return &harness{
+		dir:     dir,
+		store:   store,
+		tokens:  tokens,
+		zone:    zone,
+		dnsAddr: fmt.Sprintf("127.0.0.1:%d", dnsPort),
+		httpURL: fmt.Sprintf("http://127.0.0.1:%d", httpPort),
+		dns:     &dns.Client{Timeout: 2 * time.Second},
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// run runs the cases whose name matches filter and returns the number of
+// failed ones.
+func (h *harness) run(cases []harnessCase, filter *regexp.Regexp) int {
+	failed := 0
+	for _, c := range cases {
+		if filter != nil && !filter.MatchString(c.name) {
+			continue
+		}
+		if err := c.run(h); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Printf("PASS  %s\n", c.name)
+	}
+	return failed
+}
+
+func (h *harness) close() {
+	os.RemoveAll(h.dir)
+}
+
+// query sends a DNS query for name to the server.
+func (h *harness) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	resp, _, err := h.dns.Exchange(msg, h.dnsAddr)
+	return resp, err
+}
+
+// request sends an HTTP request to the server and returns the response with
+// its body read.
+func (h *harness) request(method, path string, header http.Header, body string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, h.httpURL+path, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// recorded waits for an interaction matching match in the store.
+func (h *harness) recorded(protocol string, match func(*Interaction) bool) error {
+	return waitFor(func() error {
+		list, err := h.store.Query(interactionQuery{Protocol: protocol, Limit: maxQueryLimit})
+		if err != nil {
+			return err
+		}
+		for _, i := range list {
+			if match(i) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no matching %s interaction in the store", protocol)
+	})
+}
+
+// logged waits for text to appear in the log file at path.
+func (h *harness) logged(path, text string) error {
+	return waitFor(func() error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(data, []byte(text)) {
+			return fmt.Errorf("%q not in %s", text, path)
+		}
+		return nil
+	})
+}
+
+func freePort(network string) int {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitFor retries f while the servers are starting up or an interaction is
+// on its way through the pipeline.
+func waitFor(f func() error) error {
+	var err error
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// The servers bind their ports for good, so the tests share one harness.
+var testHarness struct {
+	once sync.Once
+	h    *harness
+}
+
+func TestMain(m *testing.M) {
+	parseFlags()
+	code := m.Run()
+	if testHarness.h != nil {
+		testHarness.h.close()
+	}
+	os.Exit(code)
+}
+
+// startHarness returns the shared harness and works in its scratch
+// directory until the test ends, so the relative log and store paths resolve
+// there.
+func startHarness(t *testing.T) *harness {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHarness.once.Do(func() { testHarness.h = newHarness() })
+	if err := os.Chdir(testHarness.h.dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return testHarness.h
+}
+
+// answerA queries name and returns the address of the first A record.
+func answerA(t *testing.T, h *harness, name string) string {
+	t.Helper()
+	var answer string
+	err := waitFor(func() error {
+		resp, err := h.query(name, dns.TypeA)
+		if err != nil {
+			return err
+		}
+		if len(resp.Answer) == 0 {
+			return fmt.Errorf("no answer for %s: %s", name, dns.RcodeToString[resp.Rcode])
+		}
+		a, ok := resp.Answer[0].(*dns.A)
+		if !ok {
+			return fmt.Errorf("unexpected answer %v", resp.Answer[0])
+		}
+		answer = a.A.String()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+func TestSelftestChecks(t *testing.T) {
+	h := startHarness(t)
+	for _, c := range selftestCases(h) {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(h); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDNSQueryRecordedAndLogged(t *testing.T) {
+	h := startHarness(t)
+	name := "e2e-" + newID() + "." + DNSResponseName
+	if got := answerA(t, h, name); got != DNSResponseIP {
+		t.Fatalf("answer %s, want %s", got, DNSResponseIP)
+	}
+	err := firstError(
+		h.recorded("dns", func(i *Interaction) bool {
+			return i.QName == name && i.QType == "A" && i.RemoteIP == "127.0.0.1"
+		}),
+		h.logged(listenerLogs["dns"], name),
+		h.logged(EventLogFile, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPRequestRecordedAndLogged(t *testing.T) {
+	h := startHarness(t)
+	probe := newID()
+	path := "/e2e/" + probe
+	_, _, err := h.request(http.MethodPost, path+"?q="+probe, http.Header{"X-Probe": {probe}}, "body "+probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = firstError(
+		h.recorded("http", func(i *Interaction) bool {
+			return i.Method == http.MethodPost && i.Path == path && i.Query == "q="+probe &&
+				i.Body == "body "+probe && i.Headers.Get("X-Probe") == probe && i.RemoteIP == "127.0.0.1"
+		}),
+		h.logged(listenerLogs["http"], path),
+		h.logged(EventLogFile, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPIPv6ClientAddress(t *testing.T) {
+	h := startHarness(t)
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	l.Close()
+	u, err := url.Parse(h.httpURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/e2e/ipv6/" + newID()
+	resp, err := h.http.Get("http://[::1]:" + u.Port() + path)
+	if err != nil {
+		t.Skip("server not reachable over IPv6:", err)
+	}
+	resp.Body.Close()
+	err = h.recorded("http", func(i *Interaction) bool { return i.Path == path && i.RemoteIP == "::1" })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZoneRecordsMatchWholeLabels(t *testing.T) {
+	h := startHarness(t)
+	label := "e2e-" + newID()
+	if _, err := h.zone.setRecord(&zoneRecord{Name: label, Type: "A", Value: "192.0.2.10"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := answerA(t, h, label+"."+DNSResponseName); got != "192.0.2.10" {
+		t.Fatalf("record answer %s, want 192.0.2.10", got)
+	}
+	if got := answerA(t, h, label+DNSResponseName); got != DNSResponseIP {
+		t.Fatalf("name outside the zone answered %s, want %s", got, DNSResponseIP)
+	}
+}
+
+func TestCanaryTokensRecordedOnInteraction(t *testing.T) {
+	h := startHarness(t)
+	dnsToken, err := h.tokens.mint("dns", "go test", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlToken, err := h.tokens.mint("url", "go test", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerA(t, h, dnsToken.Address(DNSResponseName))
+	if _, _, err := h.request(http.MethodGet, TokenURLPrefix+urlToken.ID, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	err = firstError(
+		h.recorded("dns", func(i *Interaction) bool { return i.Token == dnsToken.ID }),
+		h.recorded("http", func(i *Interaction) bool { return i.Token == urlToken.ID }),
+		h.logged("./alerts.log", dnsToken.ID),
+		h.logged("./alerts.log", urlToken.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
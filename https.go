@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	TLSCert               string
+	TLSKey                string
+	HTTPSRedirect         bool
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	SeparateHTTPSLog      bool
+	TLSMinVersion         string
+	TLSCiphers            string
+	TLSALPN               string
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSCiphers resolves a comma separated list of Go cipher suite names,
+// such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure suites are allowed
+// so legacy endpoints can be emulated. An empty list keeps Go's defaults.
+func parseTLSCiphers(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// alpnProtocols returns the -tls-alpn list, http/1.1 is always offered by
+// the HTTPS listener on top of it.
+func alpnProtocols() []string {
+	var protos []string
+	for _, p := range strings.Split(TLSALPN, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// httpsTLSConfig loads the certificate for the HTTPS listener, or creates a
+// self-signed one for the served zone so port 443 speaks TLS out of the box.
+// The TLS version and cipher settings apply to the TLS modules as well.
+func httpsTLSConfig() (*tls.Config, error) {
+	ciphers, err := parseTLSCiphers(TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: tlsVersions[TLSMinVersion], CipherSuites: ciphers}
+	if TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(TLSCert, TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		addSNICertificates(config)
+		return config, nil
+	}
+
+	zone := strings.TrimSuffix(DNSResponseName, ".")
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: zone},
+		DNSNames:    []string{zone, "*." + zone},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, key, err := createCertificate(template, 365*24*time.Hour, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	infof("No -tls-cert given, serving HTTPS with a self-signed certificate for %s\n", zone)
+	addSNICertificates(config)
+	return config, nil
+}
+
+// addSNICertificates selects certificates from -tls-cert-dir by SNI, with
+// the configured certificate as the default.
+func addSNICertificates(config *tls.Config) {
+	if TLSCertDir == "" {
+		return
+	}
+	certs := newSNICertificates(TLSCertDir, &config.Certificates[0])
+	go certs.watch()
+	config.GetCertificate = certs.getCertificate
+}
+
+// redirectToHTTPS answers plain HTTP requests with a redirect to the same URL
+// over HTTPS. ACME HTTP-01 challenges have to stay on plain HTTP.
+func redirectToHTTPS(logRequest func(*http.Request), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logRequest(r)
+		host := r.Host
+		if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+			host = host[:i]
+		}
+		if port := firstListenerPort("https"); port != 443 {
+			host = fmt.Sprintf("%s:%d", host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+func addHSTS(next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int(HSTSMaxAge.Seconds()))
+	if HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+	MaxConns              int
+)
+
+// newPublicServer returns an http.Server for the capture listeners with the
+// configured timeouts and header limit. The read and write timeouts are off
+// by default, as they cover the whole body and would cut long exfil uploads
+// and payload downloads short, while the header timeout is what stops
+// slowloris clients.
+func newPublicServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: HTTPReadHeaderTimeout,
+		ReadTimeout:       HTTPReadTimeout,
+		WriteTimeout:      HTTPWriteTimeout,
+		IdleTimeout:       HTTPIdleTimeout,
+		MaxHeaderBytes:    HTTPMaxHeaderBytes,
+	}
+}
+
+// connLimit is shared by every public TCP listener, so -max-conns bounds the
+// connections of all modules together. It is nil when unlimited.
+var connLimit chan struct{}
+
+func initConnLimit() {
+	if MaxConns > 0 {
+		connLimit = make(chan struct{}, MaxConns)
+	}
+}
+
+// limitListener waits for a free slot in connLimit before accepting, like
+// netutil.LimitListener but with the limit shared across listeners. Waiting
+// connections queue in the kernel's backlog.
+type limitListener struct {
+	net.Listener
+}
+
+func limitConns(l net.Listener) net.Listener {
+	if connLimit == nil {
+		return l
+	}
+	return limitListener{l}
+}
+
+func (l limitListener) Accept() (net.Conn, error) {
+	connLimit <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-connLimit
+		return nil, err
+	}
+	return &limitedConn{Conn: conn}, nil
+}
+
+// limitedConn frees its slot when it is closed for the first time.
+type limitedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-connLimit })
+	return err
+}
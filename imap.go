@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+)
+
+// serveIMAP accepts every login and presents an empty INBOX. STARTTLS is
+// offered on plain connections.
+func serveIMAP(s *moduleSession) {
+	zone := strings.TrimSuffix(DNSResponseName, ".")
+	capabilities := func() string {
+		c := "CAPABILITY IMAP4rev1 AUTH=PLAIN AUTH=LOGIN"
+		if !s.interaction.TLS {
+			c += " STARTTLS"
+		}
+		return c
+	}
+	if s.reply("* OK ["+capabilities()+"] "+zone+" IMAP server ready") != nil {
+		return
+	}
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		tag, rest, _ := strings.Cut(line, " ")
+		command, arg, _ := strings.Cut(rest, " ")
+		command = strings.ToUpper(command)
+		if command == "UID" {
+			command, _, _ = strings.Cut(arg, " ")
+			command = "UID " + strings.ToUpper(command)
+		}
+		switch command {
+		case "LOGIN":
+			user, _ := imapArgs(arg)
+			s.record(tag + " LOGIN " + user)
+		case "AUTHENTICATE":
+			mechanism, _, _ := strings.Cut(arg, " ")
+			s.record(tag + " AUTHENTICATE " + mechanism)
+		default:
+			s.record(line)
+		}
+
+		ok := func(text string) { s.reply(tag + " OK " + text) }
+		switch command {
+		case "CAPABILITY":
+			s.reply("* " + capabilities())
+			ok("CAPABILITY completed")
+		case "STARTTLS":
+			if s.interaction.TLS {
+				s.reply(tag + " BAD TLS already active")
+				continue
+			}
+			ok("Begin TLS negotiation now")
+			if !s.startTLS() {
+				return
+			}
+		case "LOGIN":
+			user, password := imapArgs(arg)
+			s.credentials(user, password)
+			ok("LOGIN completed")
+		case "AUTHENTICATE":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			supported, err := s.saslLogin(mechanism, initial, "+ ")
+			if err != nil {
+				return
+			}
+			if !supported {
+				s.reply(tag + " NO Unsupported authentication mechanism")
+				continue
+			}
+			ok("AUTHENTICATE completed")
+		case "SELECT", "EXAMINE":
+			s.reply(`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`, "* 0 EXISTS", "* 0 RECENT", "* OK [UIDVALIDITY 1] UIDs valid")
+			ok("[READ-WRITE] " + strings.ToUpper(command) + " completed")
+		case "LIST", "LSUB":
+			s.reply(`* ` + command + ` () "/" INBOX`)
+			ok(command + " completed")
+		case "STATUS":
+			mailbox, _, _ := strings.Cut(arg, " ")
+			s.reply("* STATUS " + mailbox + " (MESSAGES 0 RECENT 0 UNSEEN 0)")
+			ok("STATUS completed")
+		case "SEARCH", "UID SEARCH":
+			s.reply("* SEARCH")
+			ok("SEARCH completed")
+		case "NOOP", "CHECK", "CLOSE", "EXPUNGE", "FETCH", "STORE", "UID FETCH", "UID STORE", "SUBSCRIBE", "UNSUBSCRIBE", "CREATE":
+			ok(command + " completed")
+		case "LOGOUT":
+			s.reply("* BYE " + zone + " IMAP server logging out")
+			ok("LOGOUT completed")
+			return
+		default:
+			s.reply(tag + " BAD Unknown command")
+		}
+	}
+}
+
+// imapArgs parses the user name and password of a LOGIN command, which are
+// atoms or quoted strings.
+func imapArgs(arg string) (string, string) {
+	var fields []string
+	for arg = strings.TrimSpace(arg); arg != "" && len(fields) < 2; arg = strings.TrimSpace(arg) {
+		if arg[0] != '"' {
+			field, rest, _ := strings.Cut(arg, " ")
+			fields = append(fields, field)
+			arg = rest
+			continue
+		}
+		var field strings.Builder
+		n := 1
+		for ; n < len(arg) && arg[n] != '"'; n++ {
+			if arg[n] == '\\' && n+1 < len(arg) {
+				n++
+			}
+			field.WriteByte(arg[n])
+		}
+		fields = append(fields, field.String())
+		arg = arg[n:]
+		if arg != "" {
+			arg = arg[1:]
+		}
+	}
+	for len(fields) < 2 {
+		fields = append(fields, "")
+	}
+	return fields[0], fields[1]
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const InstanceLock = "./cowitness.lock"
+
+// lockInstance makes sure only one CoWitness runs in the working directory.
+// A second instance would fight the first over the ports, binding some of
+// them, and interleave its writes with the first one's in the shared logs,
+// tokens.json and payloads.json. The lock is an flock on path, which the
+// kernel releases however the process ends, so a crashed instance never
+// leaves a stale lock behind. The file holds the owner's PID and start time
+// for the error message of the next instance.
+func lockInstance(path string) *os.File {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			log.Fatalf("%s: %v", path, err)
+		}
+		owner, _ := io.ReadAll(f)
+		dir, _ := filepath.Abs(filepath.Dir(path))
+		pid, started, _ := strings.Cut(strings.TrimSpace(string(owner)), " ")
+		if pid == "" {
+			pid = "unknown"
+		}
+		if started != "" {
+			started = ", started " + started
+		}
+		log.Fatalf("Another CoWitness instance (pid %s%s) is already running in %s. Stop it with: kill %s, or start this one from another directory", pid, started, dir, pid)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(f, "%d %s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339)); err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
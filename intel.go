@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	verdictBenign    = "benign"
+	verdictMalicious = "malicious"
+	verdictUnknown   = "unknown"
+
+	intelErrorTTL     = 10 * time.Minute
+	intelMaxCacheSize = 100000
+)
+
+var (
+	GreyNoiseKey       string
+	AbuseIPDBKey       string
+	AbuseIPDBThreshold int
+	IntelCacheTTL      time.Duration
+	IntelTimeout       time.Duration
+)
+
+const (
+	greyNoiseURL = "https://api.greynoise.io/v3/community/"
+	abuseIPDBURL = "https://api.abuseipdb.com/api/v2/check"
+)
+
+// intelResult is the cached verdict on one source address.
+type intelResult struct {
+	verdict string
+	detail  string
+	expires time.Time
+}
+
+// intelEnricher gives every interaction a verdict on its source address from
+// GreyNoise and AbuseIPDB. Verdicts are cached, and interactions from an
+// address already being looked up wait for that lookup instead of starting
+// their own.
+type intelEnricher struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	cache   map[string]*intelResult
+	pending map[string]chan struct{}
+}
+
+func newIntelEnricher() *intelEnricher {
+	e := &intelEnricher{
+		client:  newOutboundClient(0, nil),
+		cache:   make(map[string]*intelResult),
+		pending: make(map[string]chan struct{}),
+	}
+	var sources []string
+	if GreyNoiseKey != "" {
+		sources = append(sources, "GreyNoise")
+	}
+	if AbuseIPDBKey != "" {
+		sources = append(sources, "AbuseIPDB")
+	}
+	infof("Enriching source addresses with %s\n", strings.Join(sources, " and "))
+	return e
+}
+
+func (e *intelEnricher) name() string { return "threat intel" }
+
+func (e *intelEnricher) timeout() time.Duration { return IntelTimeout }
+
+func (e *intelEnricher) applies(i *Interaction) bool { return i.Verdict == "" }
+
+func (e *intelEnricher) enrich(ctx context.Context, i *Interaction) (func(*Interaction), error) {
+	ip := net.ParseIP(i.RemoteIP)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return func(i *Interaction) { i.Verdict = verdictUnknown }, nil
+	}
+	r, err := e.result(ctx, i.RemoteIP)
+	if err != nil {
+		return nil, err
+	}
+	return func(i *Interaction) { i.Verdict, i.Intel = r.verdict, r.detail }, nil
+}
+
+// result returns the cached verdict on ip, looking it up when there is none.
+func (e *intelEnricher) result(ctx context.Context, ip string) (*intelResult, error) {
+	for {
+		e.mu.Lock()
+		if r, ok := e.cache[ip]; ok && time.Now().Before(r.expires) {
+			e.mu.Unlock()
+			return r, nil
+		}
+		wait, ok := e.pending[ip]
+		if !ok {
+			break
+		}
+		e.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	e.pending[ip] = done
+	e.mu.Unlock()
+
+	r := e.lookup(ctx, ip)
+
+	e.mu.Lock()
+	if len(e.cache) >= intelMaxCacheSize {
+		e.pruneLocked()
+	}
+	e.cache[ip] = r
+	delete(e.pending, ip)
+	e.mu.Unlock()
+	close(done)
+	return r, nil
+}
+
+// pruneLocked drops expired entries, or everything when none expired.
+func (e *intelEnricher) pruneLocked() {
+	now := time.Now()
+	for ip, r := range e.cache {
+		if now.After(r.expires) {
+			delete(e.cache, ip)
+		}
+	}
+	if len(e.cache) >= intelMaxCacheSize {
+		e.cache = make(map[string]*intelResult)
+	}
+}
+
+// lookup asks every configured source about an address. A malicious verdict
+// from any source wins over a benign one. Failed lookups are cached briefly
+// as unknown so an outage doesn't turn into a flood of requests.
+func (e *intelEnricher) lookup(ctx context.Context, ip string) *intelResult {
+	var details []string
+	benign, malicious, failed := false, false, false
+	if GreyNoiseKey != "" {
+		classification, detail, err := e.greyNoise(ctx, ip)
+		if err != nil {
+			log.Printf("GreyNoise lookup of %s: %v\n", ip, err)
+			failed = true
+		} else {
+			details = append(details, "GreyNoise: "+detail)
+			benign = benign || classification == verdictBenign
+			malicious = malicious || classification == verdictMalicious
+		}
+	}
+	if AbuseIPDBKey != "" {
+		score, whitelisted, err := e.abuseIPDB(ctx, ip)
+		if err != nil {
+			log.Printf("AbuseIPDB lookup of %s: %v\n", ip, err)
+			failed = true
+		} else {
+			details = append(details, fmt.Sprintf("AbuseIPDB: %d%% confidence of abuse", score))
+			benign = benign || whitelisted
+			malicious = malicious || score >= AbuseIPDBThreshold
+		}
+	}
+
+	r := &intelResult{verdict: verdictUnknown, detail: strings.Join(details, "; "), expires: time.Now().Add(IntelCacheTTL)}
+	switch {
+	case malicious:
+		r.verdict = verdictMalicious
+	case benign:
+		r.verdict = verdictBenign
+	case failed:
+		r.expires = time.Now().Add(intelErrorTTL)
+	}
+	return r
+}
+
+func (e *intelEnricher) greyNoise(ctx context.Context, ip string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, greyNoiseURL+url.PathEscape(ip), nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("key", GreyNoiseKey)
+	req.Header.Set("Accept", "application/json")
+	var result struct {
+		Noise          bool   `json:"noise"`
+		RIOT           bool   `json:"riot"`
+		Classification string `json:"classification"`
+		Name           string `json:"name"`
+	}
+	found, err := e.getJSON(req, &result)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case !found:
+		return verdictUnknown, "not observed", nil
+	case result.RIOT:
+		return verdictBenign, "common business service " + result.Name, nil
+	case result.Classification == verdictBenign:
+		return verdictBenign, "benign scanner " + result.Name, nil
+	case result.Classification == verdictMalicious:
+		return verdictMalicious, "malicious", nil
+	}
+	return verdictUnknown, "unknown", nil
+}
+
+func (e *intelEnricher) abuseIPDB(ctx context.Context, ip string) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, abuseIPDBURL+"?maxAgeInDays=90&ipAddress="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Key", AbuseIPDBKey)
+	req.Header.Set("Accept", "application/json")
+	var result struct {
+		Data struct {
+			AbuseConfidenceScore int  `json:"abuseConfidenceScore"`
+			IsWhitelisted        bool `json:"isWhitelisted"`
+		} `json:"data"`
+	}
+	found, err := e.getJSON(req, &result)
+	if err != nil {
+		return 0, false, err
+	}
+	if !found {
+		return 0, false, fmt.Errorf("not found")
+	}
+	return result.Data.AbuseConfidenceScore, result.Data.IsWhitelisted, nil
+}
+
+// getJSON decodes a successful response into v. A 404 is not an error, it
+// reports that the source doesn't know the address.
+func (e *intelEnricher) getJSON(req *http.Request, v interface{}) (bool, error) {
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	return true, json.Unmarshal(data, v)
+}
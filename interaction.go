@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const maxCapturedBody = 64 << 10
+
+var (
+	EventLogFile string
+	EventFormat  string
+)
+
+// Interaction is the structured record of a single DNS query or HTTP request.
+type Interaction struct {
+	ID         string      `json:"id"`
+	Time       time.Time   `json:"time"`
+	Node       string      `json:"node,omitempty"`
+	Engagement string      `json:"engagement,omitempty"`
+	Protocol   string      `json:"protocol"`
+	RemoteIP   string      `json:"remote_ip"`
+	Port       int         `json:"port,omitempty"`
+	Method     string      `json:"method,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Path       string      `json:"path,omitempty"`
+	Query      string      `json:"query,omitempty"`
+	UserAgent  string      `json:"user_agent,omitempty"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	// DecodedBody is Body with its Content-Encoding removed.
+	DecodedBody  string `json:"decoded_body,omitempty"`
+	User         string `json:"user,omitempty"`
+	Password     string `json:"password,omitempty"`
+	Data         string `json:"data,omitempty"`
+	TLS          bool   `json:"tls,omitempty"`
+	JA3          string `json:"ja3,omitempty"`
+	TLSHandshake string `json:"tls_handshake,omitempty"`
+	QName        string `json:"qname,omitempty"`
+	QType        string `json:"qtype,omitempty"`
+	Token        string `json:"token,omitempty"`
+	Noise        bool   `json:"noise,omitempty"`
+	Verdict      string `json:"verdict,omitempty"`
+	Intel        string `json:"intel,omitempty"`
+	// Screenshot is the file, in -screenshot-dir, showing the referring page.
+	Screenshot string `json:"screenshot,omitempty"`
+	// Upload is the ID of the files the request stored in UploadDir, which
+	// Data lists with their hashes.
+	Upload string `json:"upload,omitempty"`
+	// Enrichment holds the results of the enrichers without a field of their
+	// own, by enricher: rdns, geoip, asn and jwt, and the out-of-band payloads
+	// of other testers found in it under oob.
+	Enrichment map[string]string `json:"enrichment,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Note       string            `json:"note,omitempty"`
+
+	// jwts are the tokens in the request headers before redaction, for the
+	// JWT enricher. They are never recorded.
+	jwts []string
+}
+
+func newHTTPInteraction(r *http.Request) *Interaction {
+	i := &Interaction{
+		ID:           newID(),
+		Time:         time.Now().UTC(),
+		Node:         NodeName,
+		Engagement:   Engagement,
+		Protocol:     "http",
+		RemoteIP:     remoteIP(r),
+		Method:       r.Method,
+		Host:         r.Host,
+		Path:         r.URL.Path,
+		Query:        r.URL.RawQuery,
+		UserAgent:    r.UserAgent(),
+		Headers:      capturedHeaders(r.Header),
+		TLS:          r.TLS != nil,
+		JA3:          requestJA3(r),
+		TLSHandshake: requestTLSHandshake(r),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		i.Port = addrPort(addr)
+	}
+	for _, values := range r.Header {
+		for _, value := range values {
+			i.jwts = append(i.jwts, jwtPattern.FindAllString(value, -1)...)
+		}
+	}
+	return i
+}
+
+// capturedHeaders copies the request headers, masking credentials the same way
+// secrets.log does.
+func capturedHeaders(header http.Header) http.Header {
+	captured := header.Clone()
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+		for n, v := range captured[name] {
+			captured[name][n] = redactSecret(v, SecretRedaction)
+		}
+	}
+	return captured
+}
+
+// captureBody keeps the start of a request body for the interaction record
+// and puts it back so the handlers still read the whole body. It reports
+// whether the body is longer than the part kept.
+func captureBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, maxCapturedBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil {
+		log.Println(err)
+	}
+	more := len(head) > maxCapturedBody
+	if more {
+		head = head[:maxCapturedBody]
+	}
+	return head, more
+}
+
+// bodyText turns a body into text that can be stored anywhere: PostgreSQL
+// text can't hold NUL bytes or invalid UTF-8.
+func bodyText(b []byte) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(string(b), "\x00", ""), "\uFFFD")
+}
+
+func newDNSInteraction(w dns.ResponseWriter, q dns.Question) *Interaction {
+	return &Interaction{
+		ID:         newID(),
+		Time:       time.Now().UTC(),
+		Node:       NodeName,
+		Engagement: Engagement,
+		Protocol:   "dns",
+		RemoteIP:   addrIP(w.RemoteAddr()),
+		Port:       addrPort(w.LocalAddr()),
+		QName:      q.Name,
+		QType:      dns.TypeToString[q.Qtype],
+	}
+}
+
+// addrIP returns the IP address of a UDP or TCP peer.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// remoteIP returns the IP address of an HTTP client, IPv6 addresses
+// without their brackets.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func addrPort(addr net.Addr) int {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// eventLog writes one formatted line per interaction, meant for SIEM and log
+// shipper ingestion next to the human readable http.log and dns.log.
+type eventLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(*Interaction) ([]byte, error)
+}
+
+func newEventLog(format string, w io.Writer) *eventLog {
+	return &eventLog{w: w, format: eventFormatters[format]}
+}
+
+func (l *eventLog) Write(i *Interaction) {
+	line, err := l.format(i)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// maxClientHello bounds how much of a connection is buffered while waiting
+// for a complete ClientHello.
+const maxClientHello = 16 << 10
+
+type ja3ContextKey struct{}
+
+// ja3Listener records the ClientHello of every accepted connection, so the
+// client's TLS stack can be fingerprinted once the handshake is done.
+type ja3Listener struct {
+	net.Listener
+}
+
+func (l ja3Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ja3Conn{Conn: conn}, nil
+}
+
+// ja3Conn keeps the first bytes read from a connection until they hold the
+// ClientHello, then keeps its JA3 fingerprint and what it offered.
+type ja3Conn struct {
+	net.Conn
+	mu     sync.Mutex
+	buf    []byte
+	done   bool
+	digest string
+	offers helloOffers
+}
+
+func (c *ja3Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		c.buf = append(c.buf, p[:n]...)
+		hello, complete := clientHello(c.buf)
+		if complete || err != nil || len(c.buf) > maxClientHello {
+			if hello != nil {
+				c.digest = ja3Digest(hello)
+				c.offers = parseHelloOffers(hello)
+			}
+			c.done, c.buf = true, nil
+		}
+	}
+	return n, err
+}
+
+// fingerprint returns the MD5 JA3 hash, empty until a ClientHello was seen.
+func (c *ja3Conn) fingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.digest
+}
+
+func (c *ja3Conn) helloOffers() helloOffers {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offers
+}
+
+// ja3ConnContext makes the connection's fingerprint reachable from requests.
+func ja3ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if jc, ok := conn.(*ja3Conn); ok {
+		return context.WithValue(ctx, ja3ContextKey{}, jc)
+	}
+	return ctx
+}
+
+func requestJA3(r *http.Request) string {
+	if jc, ok := r.Context().Value(ja3ContextKey{}).(*ja3Conn); ok {
+		return jc.fingerprint()
+	}
+	return ""
+}
+
+// clientHello reassembles the ClientHello handshake message from the TLS
+// records in data. It returns nil when data isn't a TLS handshake, and
+// complete once the whole message has arrived.
+func clientHello(data []byte) ([]byte, bool) {
+	var message []byte
+	for len(data) >= 5 {
+		if data[0] != 0x16 {
+			return nil, true
+		}
+		length := int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) < 5+length {
+			break
+		}
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+		if len(message) >= 4 {
+			if message[0] != 1 {
+				return nil, true
+			}
+			size := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message) >= 4+size {
+				return message[4 : 4+size], true
+			}
+		}
+	}
+	if len(data) > 0 && data[0] != 0x16 {
+		return nil, true
+	}
+	return nil, false
+}
+
+// ja3Digest computes the JA3 fingerprint of a ClientHello body: the MD5 of
+// the version, cipher suites, extensions, groups and point formats, leaving
+// out GREASE values.
+func ja3Digest(hello []byte) string {
+	s := cryptobyte.String(hello)
+	var version uint16
+	var sessionID, ciphers, compression, rest cryptobyte.String
+	if !s.ReadUint16(&version) || !s.Skip(32) || !s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&ciphers) || !s.ReadUint8LengthPrefixed(&compression) {
+		return ""
+	}
+	// A ClientHello without extensions simply ends here.
+	if !s.Empty() && !s.ReadUint16LengthPrefixed(&rest) {
+		return ""
+	}
+
+	var extensions, groups, formats []string
+	for !rest.Empty() {
+		var kind uint16
+		var body cryptobyte.String
+		if !rest.ReadUint16(&kind) || !rest.ReadUint16LengthPrefixed(&body) {
+			return ""
+		}
+		if isGREASE(kind) {
+			continue
+		}
+		extensions = append(extensions, strconv.Itoa(int(kind)))
+		var list cryptobyte.String
+		switch {
+		case kind == 10 && body.ReadUint16LengthPrefixed(&list):
+			groups = ja3List(list, 2)
+		case kind == 11 && body.ReadUint8LengthPrefixed(&list):
+			formats = ja3List(list, 1)
+		}
+	}
+
+	fields := []string{strconv.Itoa(int(version)), strings.Join(ja3List(ciphers, 2), "-"), strings.Join(extensions, "-"), strings.Join(groups, "-"), strings.Join(formats, "-")}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja3List formats a list of big endian values of the given width.
+func ja3List(data []byte, width int) []string {
+	var list []string
+	for ; len(data) >= width; data = data[width:] {
+		v := uint16(data[0])
+		if width == 2 {
+			v = binary.BigEndian.Uint16(data)
+			if isGREASE(v) {
+				continue
+			}
+		}
+		list = append(list, strconv.Itoa(int(v)))
+	}
+	return list
+}
+
+// isGREASE reports the reserved values clients send to keep servers tolerant
+// of unknown ones (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const moduleIdleTimeout = 2 * time.Minute
+
+var (
+	Listen          string
+	moduleListeners []moduleListener
+)
+
+// builtinModules are the HTTP, HTTPS and DNS servers, which -listen can start
+// on any number of ports like the other modules. The value is the network the
+// module listens on.
+var builtinModules = map[string]string{"http": "tcp", "https": "tcp", "dns": "udp"}
+
+// tcpModule is a protocol spoken by the extra listeners enabled with -listen.
+// Modules flagged tls wrap the connection in TLS before the protocol starts.
+type tcpModule struct {
+	protocol string
+	tls      bool
+	serve    func(s *moduleSession)
+}
+
+var tcpModules = map[string]tcpModule{
+	"smtp":      {protocol: "smtp", serve: serveSMTP},
+	"smtps":     {protocol: "smtp", tls: true, serve: serveSMTP},
+	"pop3":      {protocol: "pop3", serve: servePOP3},
+	"pop3s":     {protocol: "pop3", tls: true, serve: servePOP3},
+	"imap":      {protocol: "imap", serve: serveIMAP},
+	"imaps":     {protocol: "imap", tls: true, serve: serveIMAP},
+	"redis":     {protocol: "redis", serve: serveRedis},
+	"memcached": {protocol: "memcached", serve: serveMemcached},
+	"mysql":     {protocol: "mysql", serve: serveMySQL},
+	"postgres":  {protocol: "postgres", serve: servePostgresWire},
+	"ssh":       {protocol: "ssh", serve: serveSSH},
+	"telnet":    {protocol: "telnet", serve: serveTelnet},
+}
+
+type moduleListener struct {
+	Module string
+	Port   int
+}
+
+func (l moduleListener) network() string {
+	if network, ok := builtinModules[l.Module]; ok {
+		return network
+	}
+	if _, ok := udpModules[l.Module]; ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// protocol is the protocol a capture module records, which also names its
+// log file. It is empty for the built-in modules.
+func (l moduleListener) protocol() string {
+	if module, ok := udpModules[l.Module]; ok {
+		return module.protocol
+	}
+	return tcpModules[l.Module].protocol
+}
+
+// parseListen parses -listen, a comma separated list of module:port pairs. A
+// module can be listed on several ports, but every port takes one module.
+func parseListen(value string) ([]moduleListener, error) {
+	var listeners []moduleListener
+	taken := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		module, port, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q: expected module:port", item)
+		}
+		if (moduleListener{Module: module}).protocol() == "" && builtinModules[module] == "" {
+			return nil, fmt.Errorf("%q: unknown module %q, expected one of %s", item, module, strings.Join(moduleNames(), ", "))
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("%q: invalid port", item)
+		}
+		l := moduleListener{Module: module, Port: n}
+		key := fmt.Sprintf("%s/%d", l.network(), n)
+		if other, ok := taken[key]; ok {
+			return nil, fmt.Errorf("%q: port %s already taken by %s", item, key, other)
+		}
+		taken[key] = module
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// firstListenerPort returns the first port a module listens on, or 0.
+func firstListenerPort(module string) int {
+	for _, l := range moduleListeners {
+		if l.Module == module {
+			return l.Port
+		}
+	}
+	return 0
+}
+
+func moduleNames() []string {
+	names := make([]string, 0, len(tcpModules)+len(udpModules)+len(builtinModules))
+	for name := range tcpModules {
+		names = append(names, name)
+	}
+	for name := range udpModules {
+		names = append(names, name)
+	}
+	for name := range builtinModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// moduleServices bundles what the extra listeners record interactions with.
+type moduleServices struct {
+	events      interactionSink
+	alertLogger *log.Logger
+	tokens      *tokenStore
+	tlsConfig   *tls.Config
+	loggers     map[string]*log.Logger
+}
+
+func startModuleListener(l moduleListener, services *moduleServices) {
+	module := tcpModules[l.Module]
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	listenerStarting()
+	listenerBound(l.Module, "tcp", listener.Addr())
+	listener = limitConns(listener)
+	if module.tls {
+		listener = tls.NewListener(ja3Listener{listener}, services.tlsConfig)
+	}
+
+	go func() {
+		infof("Starting %s server on port %d\n", strings.ToUpper(l.Module), l.Port)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			go handleModuleConn(conn, module, l, services)
+		}
+	}()
+}
+
+// moduleSession is one client connection to a module. The module fills in the
+// interaction while it talks to the client, and it is recorded when the
+// connection ends.
+type moduleSession struct {
+	conn        net.Conn
+	r           *bufio.Reader
+	w           *bufio.Writer
+	services    *moduleServices
+	interaction *Interaction
+	transcript  strings.Builder
+	tlsState    string // none, attempted or established
+}
+
+func handleModuleConn(conn net.Conn, module tcpModule, l moduleListener, services *moduleServices) {
+	s := &moduleSession{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		services: services,
+		interaction: &Interaction{
+			ID:         newID(),
+			Time:       time.Now().UTC(),
+			Node:       NodeName,
+			Engagement: Engagement,
+			Protocol:   module.protocol,
+			RemoteIP:   addrIP(conn.RemoteAddr()),
+			Port:       l.Port,
+		},
+		tlsState: "none",
+	}
+	defer s.finish(l)
+	defer conn.Close()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		s.tlsState = "attempted"
+		conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			s.note("TLS handshake failed: %v", err)
+			return
+		}
+		s.tlsState = "established"
+		s.interaction.TLS = true
+		state := tlsConn.ConnectionState()
+		s.interaction.TLSHandshake = describeTLSHandshake(&state, connHelloOffers(conn))
+		if jc, ok := tlsConn.NetConn().(*ja3Conn); ok {
+			s.interaction.JA3 = jc.fingerprint()
+		}
+	}
+	module.serve(s)
+}
+
+// readLine reads one line from the client, without the line ending. Modules
+// record the lines worth keeping, leaving out credentials and message bodies.
+func (s *moduleSession) readLine() (string, error) {
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	line, err := s.r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// readBlock reads a length-prefixed block of n bytes. Only the first
+// maxCapturedBody bytes are kept, the rest is read and discarded.
+func (s *moduleSession) readBlock(n int64) (string, error) {
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	keep := n
+	if keep > maxCapturedBody {
+		keep = maxCapturedBody
+	}
+	var block strings.Builder
+	if _, err := io.CopyN(&block, s.r, keep); err != nil {
+		return block.String(), err
+	}
+	if _, err := io.CopyN(io.Discard, s.r, n-keep); err != nil {
+		return block.String(), err
+	}
+	return block.String(), nil
+}
+
+// reply sends lines to the client, each terminated by CRLF.
+func (s *moduleSession) reply(lines ...string) error {
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	for _, line := range lines {
+		s.w.WriteString(line + "\r\n")
+	}
+	return s.w.Flush()
+}
+
+// write sends raw bytes to the client.
+func (s *moduleSession) write(data []byte) error {
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	s.w.Write(data)
+	return s.w.Flush()
+}
+
+// record appends a line of client input to the transcript, up to
+// maxCapturedBody.
+func (s *moduleSession) record(line string) {
+	if s.transcript.Len()+len(line) >= maxCapturedBody {
+		return
+	}
+	s.transcript.WriteString(strings.ToValidUTF8(strings.ReplaceAll(line, "\x00", ""), "�"))
+	s.transcript.WriteByte('\n')
+}
+
+// note adds a remark of the server's own to the transcript.
+func (s *moduleSession) note(format string, args ...interface{}) {
+	s.record("# " + fmt.Sprintf(format, args...))
+}
+
+// credentials records the login a client attempted.
+func (s *moduleSession) credentials(user, password string) {
+	s.interaction.User = user
+	s.interaction.Password = redactSecret(password, SecretRedaction)
+}
+
+// saslLogin runs an AUTH PLAIN or LOGIN exchange with any credentials,
+// prefixing challenges with the protocol's continuation, e.g. "334 " for SMTP
+// or "+ " for POP3 and IMAP. It reports whether the mechanism is supported.
+func (s *moduleSession) saslLogin(mechanism, initial, continuation string) (bool, error) {
+	read := func(challenge string) (string, error) {
+		if err := s.reply(continuation + challenge); err != nil {
+			return "", err
+		}
+		return s.readLine()
+	}
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			line, err := read("")
+			if err != nil {
+				return true, err
+			}
+			initial = line
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		parts := strings.SplitN(string(decoded), "\x00", 3)
+		if len(parts) == 3 {
+			s.credentials(parts[1], parts[2])
+		}
+	case "LOGIN":
+		user := initial
+		if user == "" {
+			line, err := read("VXNlcm5hbWU6")
+			if err != nil {
+				return true, err
+			}
+			user = line
+		}
+		password, err := read("UGFzc3dvcmQ6")
+		if err != nil {
+			return true, err
+		}
+		decodedUser, _ := base64.StdEncoding.DecodeString(user)
+		decodedPassword, _ := base64.StdEncoding.DecodeString(password)
+		s.credentials(string(decodedUser), string(decodedPassword))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// startTLS upgrades the session for STARTTLS style commands.
+func (s *moduleSession) startTLS() bool {
+	s.tlsState = "attempted"
+	tlsConn := tls.Server(s.conn, s.services.tlsConfig)
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.note("TLS handshake failed: %v", err)
+		return false
+	}
+	s.conn = tlsConn
+	s.r = bufio.NewReader(tlsConn)
+	s.w = bufio.NewWriter(tlsConn)
+	s.tlsState = "established"
+	s.interaction.TLS = true
+	state := tlsConn.ConnectionState()
+	s.interaction.TLSHandshake = describeTLSHandshake(&state, helloOffers{})
+	s.note("TLS established: %s", s.interaction.TLSHandshake)
+	return true
+}
+
+// fireToken fires the canary token a name or address belongs to, if any.
+func (s *moduleSession) fireToken(name, detail string) {
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name = name[i+1:]
+	}
+	if t := s.services.tokens.matchDNS(name); t != nil {
+		s.interaction.Token = t.ID
+		s.services.tokens.fire(t, strings.ToUpper(s.interaction.Protocol), s.interaction.RemoteIP, detail)
+	}
+}
+
+func (s *moduleSession) finish(l moduleListener) {
+	i := s.interaction
+	i.Data = s.transcript.String()
+	s.services.events.Write(i)
+
+	logMessage := fmt.Sprintf("IP address: %s, Listener: %s:%d, TLS: %s", i.RemoteIP, l.Module, l.Port, s.tlsState)
+	if i.User != "" {
+		logMessage += fmt.Sprintf(", User: %s", i.User)
+	}
+	if i.Password != "" {
+		logMessage += fmt.Sprintf(", Password: %s", i.Password)
+	}
+	logMessage += fmt.Sprintf(", Lines: %d", strings.Count(i.Data, "\n"))
+	s.services.loggers[i.Protocol].Println(logMessage)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+// collectSink keeps the interactions written to it.
+type collectSink struct {
+	mu   sync.Mutex
+	list []*Interaction
+}
+
+func (s *collectSink) Write(i *Interaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = append(s.list, i)
+}
+
+func (s *collectSink) interactions() []*Interaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Interaction(nil), s.list...)
+}
+
+func TestHandleModuleConnWithoutTCPAddress(t *testing.T) {
+	sink := &collectSink{}
+	discard := log.New(io.Discard, "", 0)
+	services := &moduleServices{
+		events:      sink,
+		alertLogger: discard,
+		loggers:     map[string]*log.Logger{"redis": discard},
+	}
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("PING\r\n"))
+		client.Close()
+	}()
+	module := tcpModule{protocol: "redis", serve: func(s *moduleSession) {
+		line, _ := s.readLine()
+		s.record(line)
+	}}
+	handleModuleConn(server, module, moduleListener{Module: "redis", Port: 6379}, services)
+
+	list := sink.interactions()
+	if len(list) != 1 {
+		t.Fatalf("%d interactions recorded, want 1", len(list))
+	}
+	if list[0].RemoteIP != "pipe" || list[0].Data != "PING\n" {
+		t.Errorf("recorded %q from %q", list[0].Data, list[0].RemoteIP)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/miekg/dns"
+)
+
+// Verbosity levels of the operational log on standard error. They don't
+// change what is captured: every interaction is logged and stored whatever
+// the level.
+const (
+	logQuiet   = -1 // warnings, errors and alerts only
+	logNormal  = 0
+	logVerbose = 1 // also what happens to each interaction
+	logDebug   = 2 // also the DNS messages and HTTP requests on the wire
+)
+
+// debugBodyLimit is the most bytes of an HTTP request or response body
+// dumped at the debug level.
+const debugBodyLimit = 64 << 10
+
+var (
+	Verbosity   int
+	Quiet       bool
+	Verbose     bool
+	VeryVerbose bool
+)
+
+// setVerbosity turns the -quiet, -v and -vv flags into a level.
+func setVerbosity() {
+	switch {
+	case Quiet && (Verbose || VeryVerbose):
+		log.Fatalf("-quiet can't be combined with -v or -vv")
+	case Quiet:
+		Verbosity = logQuiet
+	case VeryVerbose:
+		Verbosity = logDebug
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	case Verbose:
+		Verbosity = logVerbose
+	}
+}
+
+// infof logs routine status, such as the servers starting and files being
+// loaded, which -quiet leaves out.
+func infof(format string, v ...interface{}) {
+	if Verbosity >= logNormal {
+		log.Printf(format, v...)
+	}
+}
+
+// verbosef logs what happens to each interaction, shown with -v.
+func verbosef(format string, v ...interface{}) {
+	if Verbosity >= logVerbose {
+		log.Printf(format, v...)
+	}
+}
+
+// debugf logs troubleshooting detail, shown with -vv.
+func debugf(format string, v ...interface{}) {
+	if Verbosity >= logDebug {
+		log.Printf(format, v...)
+	}
+}
+
+// debugDNSWriter dumps the answers sent to a client.
+type debugDNSWriter struct {
+	dns.ResponseWriter
+}
+
+func (w debugDNSWriter) WriteMsg(m *dns.Msg) error {
+	debugf("DNS response to %s:\n%s\n", w.RemoteAddr(), m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// debugDNS dumps the DNS messages received and sent at the debug level,
+// for troubleshooting clients that misbehave.
+func debugDNS(next dns.HandlerFunc) dns.HandlerFunc {
+	if Verbosity < logDebug {
+		return next
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		debugf("DNS message from %s over %s:\n%s\n", w.RemoteAddr(), w.LocalAddr().Network(), r)
+		next(debugDNSWriter{w}, r)
+	}
+}
+
+// debugResponseWriter keeps the start of a response for dumping.
+type debugResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	size   int
+}
+
+func (w *debugResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *debugResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if keep := debugBodyLimit - w.body.Len(); keep > 0 {
+		if keep > len(p) {
+			keep = len(p)
+		}
+		w.body.Write(p[:keep])
+	}
+	w.size += len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *debugResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// debugHTTP dumps the HTTP requests received and the responses sent as
+// they are on the wire at the debug level, bodies cut to debugBodyLimit.
+func debugHTTP(next http.Handler) http.Handler {
+	if Verbosity < logDebug {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head, err := httputil.DumpRequest(r, false)
+		if err != nil {
+			log.Println(err)
+		}
+		// Peek at the start of the body and put it back for the handler.
+		start, _ := io.ReadAll(io.LimitReader(r.Body, debugBodyLimit))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(start), r.Body), r.Body}
+		debugf("HTTP request from %s:\n%s%s\n", r.RemoteAddr, head, start)
+
+		rec := &debugResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		var dump bytes.Buffer
+		fmt.Fprintf(&dump, "HTTP/%d.%d %d %s\r\n", r.ProtoMajor, r.ProtoMinor, status, http.StatusText(status))
+		w.Header().Write(&dump)
+		dump.WriteString("\r\n")
+		dump.Write(rec.body.Bytes())
+		if rec.size > rec.body.Len() {
+			fmt.Fprintf(&dump, "\n[%d more byte(s)]", rec.size-rec.body.Len())
+		}
+		debugf("HTTP response to %s (%d byte body):\n%s\n", r.RemoteAddr, rec.size, dump.Bytes())
+	})
+}
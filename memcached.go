@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveMemcached speaks the memcached text protocol against an empty cache.
+// Stored values are captured in the interaction body, as SSRF payloads
+// smuggled into memcached usually carry serialized objects there.
+func serveMemcached(s *moduleSession) {
+	var values strings.Builder
+	for {
+		s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+		if magic, err := s.r.Peek(1); err == nil && magic[0] == 0x80 {
+			s.note("binary protocol request, closing")
+			return
+		}
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		s.record(line)
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var reply string
+		switch strings.ToLower(fields[0]) {
+		case "get", "gets", "gat", "gats":
+			reply = "END"
+		case "set", "add", "replace", "append", "prepend", "cas":
+			if len(fields) < 5 {
+				reply = "ERROR"
+				break
+			}
+			size, err := strconv.ParseInt(fields[4], 10, 64)
+			if err != nil || size < 0 {
+				reply = "CLIENT_ERROR bad data chunk"
+				break
+			}
+			value, err := s.readBlock(size + 2)
+			if err != nil {
+				return
+			}
+			value = strings.TrimSuffix(value, "\r\n")
+			if values.Len()+len(value) < maxCapturedBody {
+				values.WriteString(fields[1] + " = " + value + "\n")
+				s.interaction.Body = values.String()
+			}
+			reply = "STORED"
+		case "delete", "incr", "decr", "touch":
+			reply = "NOT_FOUND"
+		case "stats":
+			reply = "STAT pid 1\r\nSTAT uptime 4380521\r\nSTAT version 1.6.21\r\nSTAT curr_items 0\r\nEND"
+		case "version":
+			reply = "VERSION 1.6.21"
+		case "flush_all", "verbosity":
+			reply = "OK"
+		case "quit":
+			return
+		default:
+			reply = "ERROR"
+		}
+		if fields[len(fields)-1] == "noreply" {
+			continue
+		}
+		if s.reply(reply) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxRewrittenBody = 10 << 20
+
+var (
+	MirrorURL   string
+	MirrorRules string
+)
+
+// mirrorRules is the format of the -mirror-rules file.
+type mirrorRules struct {
+	HostHeader      string            `json:"host_header,omitempty"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	RewriteLinks    bool              `json:"rewrite_links,omitempty"`
+	CookieDomain    string            `json:"cookie_domain,omitempty"`
+	Replace         []struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"replace,omitempty"`
+	Inject string `json:"inject,omitempty"`
+}
+
+func loadMirrorRules(path string) (*mirrorRules, error) {
+	rules := &mirrorRules{}
+	if path == "" {
+		return rules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// rewritesBody reports whether text responses have to be buffered and edited.
+func (rules *mirrorRules) rewritesBody() bool {
+	return rules.RewriteLinks || len(rules.Replace) > 0 || rules.Inject != ""
+}
+
+type mirrorOriginKey struct{}
+
+var (
+	cookieDomainPattern = regexp.MustCompile(`(?i);\s*domain=[^;]*`)
+	bodyEndPattern      = regexp.MustCompile(`(?i)</body>`)
+)
+
+// newMirrorProxy proxies requests that don't hit one of CoWitness' own paths
+// to a real website, so visitors get a believable page while every request is
+// still logged like any other.
+func newMirrorProxy(target string, rules *mirrorRules) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("mirror URL %q must be an absolute http or https URL", target)
+	}
+	upstream := u.Scheme + "://" + u.Host
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		*r = *r.WithContext(context.WithValue(r.Context(), mirrorOriginKey{}, scheme+"://"+r.Host))
+
+		director(r)
+		r.Host = u.Host
+		if rules.HostHeader != "" {
+			r.Host = rules.HostHeader
+		}
+		// Don't hand the visitors' addresses to the mirrored site.
+		r.Header["X-Forwarded-For"] = nil
+		for name, value := range rules.RequestHeaders {
+			if value == "" {
+				r.Header.Del(name)
+			} else {
+				r.Header.Set(name, value)
+			}
+		}
+		if rules.rewritesBody() {
+			r.Header.Del("Accept-Encoding")
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		origin, _ := resp.Request.Context().Value(mirrorOriginKey{}).(string)
+		for name, value := range rules.ResponseHeaders {
+			if value == "" {
+				resp.Header.Del(name)
+			} else {
+				resp.Header.Set(name, value)
+			}
+		}
+		if rules.RewriteLinks {
+			if location := resp.Header.Get("Location"); strings.HasPrefix(location, upstream) {
+				resp.Header.Set("Location", origin+strings.TrimPrefix(location, upstream))
+			}
+		}
+		if rules.RewriteLinks || rules.CookieDomain != "" {
+			for n, cookie := range resp.Header["Set-Cookie"] {
+				cookie = cookieDomainPattern.ReplaceAllString(cookie, "")
+				if rules.CookieDomain != "" {
+					cookie += "; Domain=" + rules.CookieDomain
+				}
+				resp.Header["Set-Cookie"][n] = cookie
+			}
+		}
+		if rules.rewritesBody() {
+			return rewriteMirrorBody(resp, rules, upstream, origin)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Mirror %s: %v\n", u.Host, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	infof("Mirroring %s\n", u)
+	return proxy, nil
+}
+
+// rewriteMirrorBody edits uncompressed text responses: links back to the
+// mirrored site, the configured replacements and the injected snippet.
+func rewriteMirrorBody(resp *http.Response, rules *mirrorRules, upstream, origin string) error {
+	contentType := resp.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "javascript") || strings.Contains(contentType, "json")
+	if !text || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength > maxRewrittenBody {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewrittenBody))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if rules.RewriteLinks {
+		body = bytes.ReplaceAll(body, []byte(upstream), []byte(origin))
+		host := strings.SplitN(upstream, "://", 2)[1]
+		originHost := strings.SplitN(origin, "://", 2)[1]
+		body = bytes.ReplaceAll(body, []byte("//"+host), []byte("//"+originHost))
+	}
+	for _, r := range rules.Replace {
+		body = bytes.ReplaceAll(body, []byte(r.From), []byte(r.To))
+	}
+	if rules.Inject != "" && strings.HasPrefix(contentType, "text/html") {
+		if loc := bodyEndPattern.FindAllIndex(body, -1); len(loc) > 0 {
+			at := loc[len(loc)-1][0]
+			body = append(body[:at:at], append([]byte(rules.Inject), body[at:]...)...)
+		} else {
+			body = append(body, rules.Inject...)
+		}
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
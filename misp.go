@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	MISPURL           string
+	MISPKey           string
+	MISPDistribution  int
+	MISPPublishTokens bool
+)
+
+// mispClient creates events through the MISP REST API.
+type mispClient struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+type mispAttribute struct {
+	Type     string `json:"type"`
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	Comment  string `json:"comment,omitempty"`
+	ToIDS    bool   `json:"to_ids"`
+}
+
+type mispTag struct {
+	Name string `json:"name"`
+}
+
+type mispEvent struct {
+	Info          string          `json:"info"`
+	Date          string          `json:"date"`
+	Distribution  int             `json:"distribution,string"`
+	ThreatLevelID int             `json:"threat_level_id,string"`
+	Analysis      int             `json:"analysis,string"`
+	Attribute     []mispAttribute `json:"Attribute"`
+	Tag           []mispTag       `json:"Tag,omitempty"`
+}
+
+func newMISPClient(rawURL, key string) *mispClient {
+	return &mispClient{url: strings.TrimSuffix(rawURL, "/"), key: key, client: newOutboundClient(30*time.Second, nil)}
+}
+
+// mispClientFromFlags returns the client for -misp-url, or nil without one.
+func mispClientFromFlags() *mispClient {
+	if MISPURL == "" {
+		return nil
+	}
+	return newMISPClient(MISPURL, MISPKey)
+}
+
+// publish creates one event holding the indicators of the interactions and
+// returns its MISP ID.
+func (c *mispClient) publish(info string, list []*Interaction) (string, error) {
+	event := mispEvent{
+		Info:          info,
+		Date:          time.Now().UTC().Format("2006-01-02"),
+		Distribution:  MISPDistribution,
+		ThreatLevelID: 3, // low
+		Analysis:      2, // completed
+		Attribute:     mispAttributes(list),
+		Tag:           []mispTag{{Name: "tool:cowitness"}},
+	}
+	for _, engagement := range interactionEngagements(list) {
+		event.Tag = append(event.Tag, mispTag{Name: "cowitness:engagement=\"" + engagement + "\""})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"Event": event})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+"/events/add", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", c.key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("MISP answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var created struct {
+		Event struct {
+			ID string `json:"id"`
+		} `json:"Event"`
+	}
+	if err := json.Unmarshal(data, &created); err != nil {
+		return "", fmt.Errorf("MISP response: %v", err)
+	}
+	return created.Event.ID, nil
+}
+
+// mispAttributes lists the source addresses, user agents and JA3 fingerprints
+// of the interactions once each, with a text attribute describing every
+// interaction.
+func mispAttributes(list []*Interaction) []mispAttribute {
+	var attributes []mispAttribute
+	seen := make(map[string]bool)
+	add := func(a mispAttribute) {
+		if a.Value == "" || seen[a.Type+"|"+a.Value] {
+			return
+		}
+		seen[a.Type+"|"+a.Value] = true
+		attributes = append(attributes, a)
+	}
+	for _, i := range list {
+		add(mispAttribute{Type: "ip-src", Category: "Network activity", Value: i.RemoteIP, ToIDS: true})
+		add(mispAttribute{Type: "user-agent", Category: "Network activity", Value: i.UserAgent})
+		add(mispAttribute{Type: "ja3-fingerprint-md5", Category: "Network activity", Value: i.JA3, ToIDS: true})
+		add(mispAttribute{Type: "text", Category: "Other", Value: describeInteraction(i), Comment: "CoWitness interaction " + i.ID})
+	}
+	return attributes
+}
+
+// describeInteraction summarizes an interaction in one line.
+func describeInteraction(i *Interaction) string {
+	var what string
+	switch {
+	case i.Protocol == "dns":
+		what = fmt.Sprintf("DNS %s query for %s", i.QType, i.QName)
+	case i.Method != "" && i.Protocol == "http":
+		what = fmt.Sprintf("HTTP %s %s%s", i.Method, i.Host, i.Path)
+	default:
+		what = strings.ToUpper(i.Protocol) + " interaction"
+	}
+	if i.Token != "" {
+		what += ", canary token " + i.Token
+	}
+	return fmt.Sprintf("%s from %s at %s", what, i.RemoteIP, i.Time.UTC().Format(time.RFC3339))
+}
+
+func interactionEngagements(list []*Interaction) []string {
+	set := make(map[string]bool)
+	for _, i := range list {
+		if i.Engagement != "" {
+			set[i.Engagement] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// mispTokenSink publishes every canary token trip to MISP as its own event.
+type mispTokenSink struct {
+	publisher *publisher
+}
+
+func newMISPTokenSink(client *mispClient) *mispTokenSink {
+	infof("Publishing canary token trips to MISP at %s\n", client.url)
+	return &mispTokenSink{publisher: newPublisher("MISP", func(i *Interaction) error {
+		id, err := client.publish(fmt.Sprintf("CoWitness canary token %s fired over %s", i.Token, strings.ToUpper(i.Protocol)), []*Interaction{i})
+		if err == nil {
+			verbosef("Published canary token %s trip from %s as MISP event %s\n", i.Token, i.RemoteIP, id)
+		}
+		return err
+	})}
+}
+
+func (s *mispTokenSink) Write(i *Interaction) {
+	if i.Token != "" && !i.Noise {
+		s.publisher.Write(i)
+	}
+}
+
+// handleMISPPublish pushes the interactions matching the query filters,
+// optionally narrowed to a list of IDs, to MISP as a single event.
+func handleMISPPublish(client *mispClient, store interactionStore, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		if client == nil {
+			writeJSONError(w, http.StatusNotFound, "MISP publishing is not configured, start CoWitness with -misp-url and -misp-key")
+			return
+		}
+		q, err := parseInteractionQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var req struct {
+			Info string   `json:"info"`
+			IDs  []string `json:"ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Info == "" {
+			req.Info = "CoWitness interactions"
+		}
+
+		if len(req.IDs) > 0 {
+			q.Limit = maxQueryLimit
+		}
+		list, err := store.Query(q)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if len(req.IDs) > 0 {
+			wanted := make(map[string]bool)
+			for _, id := range req.IDs {
+				wanted[id] = true
+			}
+			var selected []*Interaction
+			for _, i := range list {
+				if wanted[i.ID] {
+					selected = append(selected, i)
+				}
+			}
+			list = selected
+		}
+		if len(list) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "no interactions selected")
+			return
+		}
+
+		id, err := client.publish(req.Info, list)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		audit.record(r, "misp.publish", id, fmt.Sprintf("%d interactions: %s", len(list), req.Info))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"event_id": id, "interactions": len(list)})
+	}
+}
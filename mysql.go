@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	mysqlConnectWithDB      = 0x00000008
+	mysqlProtocol41         = 0x00000200
+	mysqlSSL                = 0x00000800
+	mysqlSecureConnection   = 0x00008000
+	mysqlPluginAuth         = 0x00080000
+	mysqlConnectAttrs       = 0x00100000
+	mysqlPluginAuthLenenc   = 0x00200000
+	mysqlServerVersion      = "5.7.44-log"
+	mysqlServerCapabilities = 0x0000ffff | mysqlPluginAuth | mysqlConnectAttrs | mysqlPluginAuthLenenc
+)
+
+var mysqlCapabilityNames = []struct {
+	flag uint32
+	name string
+}{
+	{0x00000001, "LONG_PASSWORD"}, {0x00000004, "LONG_FLAG"}, {mysqlConnectWithDB, "CONNECT_WITH_DB"},
+	{0x00000020, "COMPRESS"}, {0x00000080, "LOCAL_FILES"}, {mysqlProtocol41, "PROTOCOL_41"},
+	{0x00000400, "INTERACTIVE"}, {mysqlSSL, "SSL"}, {0x00002000, "TRANSACTIONS"},
+	{mysqlSecureConnection, "SECURE_CONNECTION"}, {0x00010000, "MULTI_STATEMENTS"},
+	{0x00020000, "MULTI_RESULTS"}, {mysqlPluginAuth, "PLUGIN_AUTH"}, {mysqlConnectAttrs, "CONNECT_ATTRS"},
+	{mysqlPluginAuthLenenc, "PLUGIN_AUTH_LENENC_CLIENT_DATA"}, {0x01000000, "DEPRECATE_EOF"},
+}
+
+// serveMySQL sends a MySQL server greeting and reads the client's handshake
+// response, capturing the user name, database, capabilities and connection
+// attributes, then denies access.
+func serveMySQL(s *moduleSession) {
+	salt := make([]byte, 20)
+	rand.Read(salt)
+	for n := range salt {
+		salt[n] = salt[n]%94 + 33
+	}
+
+	greeting := []byte{10}
+	greeting = append(greeting, mysqlServerVersion+"\x00"...)
+	greeting = binary.LittleEndian.AppendUint32(greeting, 1)
+	greeting = append(greeting, salt[:8]...)
+	greeting = append(greeting, 0)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(mysqlServerCapabilities&0xffff))
+	greeting = append(greeting, 0x21)
+	greeting = binary.LittleEndian.AppendUint16(greeting, 0x0002)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(mysqlServerCapabilities>>16))
+	greeting = append(greeting, 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, salt[8:]...)
+	greeting = append(greeting, 0)
+	greeting = append(greeting, "mysql_native_password\x00"...)
+	if s.writeMySQLPacket(0, greeting) != nil {
+		return
+	}
+
+	seq, response, err := s.readMySQLPacket()
+	if err != nil {
+		return
+	}
+	if len(response) == 32 && binary.LittleEndian.Uint32(response)&mysqlSSL != 0 {
+		s.note("SSL requested")
+		if !s.startTLS() {
+			return
+		}
+		if seq, response, err = s.readMySQLPacket(); err != nil {
+			return
+		}
+	}
+
+	user, database, err := s.parseMySQLHandshake(response)
+	if err != nil {
+		s.note("malformed handshake response: %v", err)
+		return
+	}
+	s.credentials(user, "")
+	message := fmt.Sprintf("Access denied for user '%s'@'%s' (using password: YES)", user, s.interaction.RemoteIP)
+	if database != "" {
+		message = fmt.Sprintf("Access denied for user '%s'@'%s' to database '%s'", user, s.interaction.RemoteIP, database)
+	}
+	reply := []byte{0xff}
+	reply = binary.LittleEndian.AppendUint16(reply, 1045)
+	reply = append(reply, "#28000"+message...)
+	s.writeMySQLPacket(seq+1, reply)
+}
+
+// parseMySQLHandshake records a HandshakeResponse41 packet in the transcript.
+func (s *moduleSession) parseMySQLHandshake(p []byte) (user, database string, err error) {
+	if len(p) < 32 {
+		return "", "", fmt.Errorf("%d bytes", len(p))
+	}
+	capabilities := binary.LittleEndian.Uint32(p)
+	var names []string
+	for _, c := range mysqlCapabilityNames {
+		if capabilities&c.flag != 0 {
+			names = append(names, c.name)
+		}
+	}
+	s.record(fmt.Sprintf("capabilities: 0x%08x %s", capabilities, strings.Join(names, "|")))
+	if capabilities&mysqlProtocol41 == 0 {
+		return "", "", fmt.Errorf("pre-4.1 client")
+	}
+	s.record(fmt.Sprintf("charset: %d", p[8]))
+
+	r := &mysqlReader{p: p[32:]}
+	user = r.nulString()
+	s.record("user: " + user)
+	switch {
+	case capabilities&mysqlPluginAuthLenenc != 0:
+		r.skip(int(r.lenencInt()))
+	case capabilities&mysqlSecureConnection != 0:
+		r.skip(int(r.fixedInt(1)))
+	default:
+		r.nulString()
+	}
+	if capabilities&mysqlConnectWithDB != 0 {
+		database = r.nulString()
+		s.record("database: " + database)
+	}
+	if capabilities&mysqlPluginAuth != 0 {
+		s.record("auth plugin: " + r.nulString())
+	}
+	if capabilities&mysqlConnectAttrs != 0 {
+		attrs := &mysqlReader{p: r.take(int(r.lenencInt()))}
+		values := map[string]string{}
+		for attrs.err == nil && len(attrs.p) > 0 {
+			key := attrs.lenencString()
+			value := attrs.lenencString()
+			values[key] = value
+			s.record("attribute: " + key + "=" + value)
+		}
+		s.interaction.UserAgent = strings.TrimSpace(values["_client_name"] + " " + values["_client_version"] + " " + values["program_name"])
+	}
+	return user, database, r.err
+}
+
+func (s *moduleSession) readMySQLPacket() (byte, []byte, error) {
+	header, err := s.readBlock(4)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := int64(header[0]) | int64(header[1])<<8 | int64(header[2])<<16
+	payload, err := s.readBlock(size)
+	return header[3], []byte(payload), err
+}
+
+func (s *moduleSession) writeMySQLPacket(seq byte, payload []byte) error {
+	packet := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	s.w.Write(append(packet, payload...))
+	return s.w.Flush()
+}
+
+// mysqlReader decodes the fields of a MySQL packet. Reading past the end sets
+// err and yields zero values.
+type mysqlReader struct {
+	p   []byte
+	err error
+}
+
+func (r *mysqlReader) take(n int) []byte {
+	if n < 0 || n > len(r.p) {
+		r.err = fmt.Errorf("truncated packet")
+		r.p = nil
+		return nil
+	}
+	b := r.p[:n]
+	r.p = r.p[n:]
+	return b
+}
+
+func (r *mysqlReader) skip(n int) {
+	r.take(n)
+}
+
+func (r *mysqlReader) fixedInt(n int) uint64 {
+	var v uint64
+	for i, b := range r.take(n) {
+		v |= uint64(b) << (8 * i)
+	}
+	return v
+}
+
+func (r *mysqlReader) nulString() string {
+	for n, b := range r.p {
+		if b == 0 {
+			s := string(r.p[:n])
+			r.p = r.p[n+1:]
+			return s
+		}
+	}
+	return string(r.take(len(r.p)))
+}
+
+func (r *mysqlReader) lenencInt() uint64 {
+	switch first := r.fixedInt(1); first {
+	case 0xfc:
+		return r.fixedInt(2)
+	case 0xfd:
+		return r.fixedInt(3)
+	case 0xfe:
+		return r.fixedInt(8)
+	default:
+		return first
+	}
+}
+
+func (r *mysqlReader) lenencString() string {
+	return string(r.take(int(r.lenencInt())))
+}
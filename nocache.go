@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// NoCache makes every answer uncacheable for timing sensitive tests, so each
+// probe from the target reaches the server instead of a resolver's or a
+// browser's cache: DNS answers get TTL 0, whatever -ttl and zone.json say,
+// and HTTP responses get headers forbidding any cache to keep them.
+var NoCache bool
+
+// noCacheHeaders sets the headers keeping browsers and proxies from caching
+// a response. Handlers that set their own Cache-Control, like a response
+// rule with custom headers, still override it.
+func noCacheHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", "0")
+		next.ServeHTTP(w, r)
+	})
+}
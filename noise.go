@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	NoiseMode    string
+	NoiseFilters string
+)
+
+// noiseRules is the format of the -noise-filters file. Every list replaces the
+// corresponding built-in default when present.
+type noiseRules struct {
+	HTTPPaths  []string `json:"http_paths,omitempty"`
+	UserAgents []string `json:"user_agents,omitempty"`
+	DNSNames   []string `json:"dns_names,omitempty"`
+	DNSQTypes  []string `json:"dns_qtypes,omitempty"`
+}
+
+var defaultNoiseRules = noiseRules{
+	HTTPPaths: []string{`^/favicon\.ico$`, `^/apple-touch-icon[^/]*\.png$`},
+	UserAgents: []string{
+		`(?i)censys`, `(?i)zgrab`, `(?i)masscan`, `(?i)shodan`, `(?i)expanse`,
+		`(?i)internet-measurement`, `(?i)netcraft`, `(?i)l9explore|leakix`, `(?i)modatscanner`,
+	},
+	DNSQTypes: []string{"NS", "SOA"},
+}
+
+// noiseFilter moves requests from scanners, registrars and browsers' automatic
+// fetches out of the primary logs so real callbacks aren't buried.
+type noiseFilter struct {
+	mode       string
+	logger     *log.Logger
+	httpPaths  []*regexp.Regexp
+	userAgents []*regexp.Regexp
+	dnsNames   []*regexp.Regexp
+	dnsQTypes  map[uint16]bool
+}
+
+func newNoiseFilter(mode, rulesFile string, logger *log.Logger) (*noiseFilter, error) {
+	rules := defaultNoiseRules
+	if rulesFile != "" {
+		data, err := os.ReadFile(rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		var custom noiseRules
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("%s: %v", rulesFile, err)
+		}
+		if custom.HTTPPaths != nil {
+			rules.HTTPPaths = custom.HTTPPaths
+		}
+		if custom.UserAgents != nil {
+			rules.UserAgents = custom.UserAgents
+		}
+		if custom.DNSNames != nil {
+			rules.DNSNames = custom.DNSNames
+		}
+		if custom.DNSQTypes != nil {
+			rules.DNSQTypes = custom.DNSQTypes
+		}
+	}
+
+	n := &noiseFilter{mode: mode, logger: logger, dnsQTypes: make(map[uint16]bool)}
+	var err error
+	if n.httpPaths, err = compilePatterns(rules.HTTPPaths); err != nil {
+		return nil, err
+	}
+	if n.userAgents, err = compilePatterns(rules.UserAgents); err != nil {
+		return nil, err
+	}
+	if n.dnsNames, err = compilePatterns(rules.DNSNames); err != nil {
+		return nil, err
+	}
+	for _, name := range rules.DNSQTypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown DNS query type %q in noise filters", name)
+		}
+		n.dnsQTypes[qtype] = true
+	}
+	return n, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("noise filter %q: %v", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *noiseFilter) isHTTPNoise(r *http.Request) bool {
+	if n.mode == "off" {
+		return false
+	}
+	return matchAny(n.httpPaths, r.URL.Path) || matchAny(n.userAgents, r.UserAgent())
+}
+
+func (n *noiseFilter) isDNSNoise(q dns.Question) bool {
+	if n.mode == "off" {
+		return false
+	}
+	return n.dnsQTypes[q.Qtype] || matchAny(n.dnsNames, q.Name)
+}
+
+// record writes a noise entry to the noise log, or discards it in drop mode.
+func (n *noiseFilter) record(protocol, logMessage string) {
+	verbosef("Filtered %s noise: %s\n", protocol, strings.TrimRight(logMessage, "\n"))
+	if n.mode == "drop" {
+		return
+	}
+	n.logger.Printf("%s noise: %s", protocol, strings.TrimRight(logMessage, "\n"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	ntpPacketSize = 48
+	ntpModeClient = 3
+	ntpModeServer = 4
+	ntpEpochDelta = 2208988800 // seconds from 1900 to 1970
+)
+
+var ntpModes = []string{"reserved", "symmetric active", "symmetric passive", "client", "server", "broadcast", "control", "private"}
+
+// handleNTP answers NTP client requests with the local time, so devices
+// syncing against the callback host keep working, and records every request.
+// Control and private mode requests are recorded but never answered, to avoid
+// being used for amplification.
+func handleNTP(p *udpPacket) []byte {
+	received := time.Now()
+	if len(p.data) < ntpPacketSize {
+		p.record("# short packet")
+		p.interaction.Data += hexDump(p.data)
+		p.summary = "Malformed request"
+		return nil
+	}
+	version, mode := p.data[0]>>3&0x07, p.data[0]&0x07
+	transmit := binary.BigEndian.Uint64(p.data[40:])
+	p.record("version: %d", version)
+	p.record("mode: %s", ntpModes[mode])
+	p.record("stratum: %d", p.data[1])
+	p.record("poll: %d", int8(p.data[2]))
+	if transmit != 0 {
+		p.record("transmit timestamp: %s", ntpTime(transmit).Format(time.RFC3339Nano))
+	}
+	p.summary = fmt.Sprintf("Version: %d, Mode: %s", version, ntpModes[mode])
+	if mode != ntpModeClient {
+		return nil
+	}
+
+	reply := make([]byte, ntpPacketSize)
+	reply[0] = version<<3 | ntpModeServer
+	reply[1] = 1 // stratum: primary reference
+	reply[2] = p.data[2]
+	reply[3] = 0xec                               // precision: 2^-20 s
+	binary.BigEndian.PutUint32(reply[4:], 0)      // root delay
+	binary.BigEndian.PutUint32(reply[8:], 0x0010) // root dispersion
+	copy(reply[12:16], "LOCL")                    // reference ID
+	binary.BigEndian.PutUint64(reply[16:], ntpTimestamp(received.Add(-time.Minute)))
+	binary.BigEndian.PutUint64(reply[24:], transmit)
+	binary.BigEndian.PutUint64(reply[32:], ntpTimestamp(received))
+	binary.BigEndian.PutUint64(reply[40:], ntpTimestamp(time.Now()))
+	return reply
+}
+
+func ntpTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochDelta)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+func ntpTime(ts uint64) time.Time {
+	seconds := int64(ts>>32) - ntpEpochDelta
+	nanoseconds := int64((ts & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(seconds, nanoseconds).UTC()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// OOBPayloadDetection enables the out-of-band payload detectors.
+var OOBPayloadDetection bool
+
+// thirdPartyTestTag marks interactions carrying another tester's payload.
+const thirdPartyTestTag = "third-party-test"
+
+// oobDetector recognizes the payloads of an out-of-band testing service or
+// technique in captured traffic.
+type oobDetector struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// oobDetectors are the payload shapes of the common OAST services: a request
+// carrying one was sent by someone else's scanner, testing this host with
+// their own callback infrastructure, rather than being a callback of ours.
+var oobDetectors = []oobDetector{
+	{"burp-collaborator", regexp.MustCompile(`(?i)\b[a-z0-9]{20,40}\.(burpcollaborator\.net|oastify\.com)\b`)},
+	{"interactsh", regexp.MustCompile(`(?i)\b[a-z0-9]{20,40}\.(oast\.(pro|live|site|online|fun|me)|interact\.sh|interactsh\.com)\b`)},
+	{"canarytokens", regexp.MustCompile(`(?i)\b([a-z0-9]+\.)+canarytokens\.(com|org|net)\b|\bcanarytokens\.(com|org|net)/[a-z/]*[a-z0-9]{25}\b`)},
+	{"acunetix", regexp.MustCompile(`(?i)\b([a-z0-9-]+\.)*bxss\.me\b`)},
+	{"invicti", regexp.MustCompile(`(?i)\b([a-z0-9-]+\.)+r87\.(me|com)\b`)},
+	{"dnslog", regexp.MustCompile(`(?i)\b([a-z0-9-]+\.)+(dnslog\.(cn|link)|ceye\.io|eyes\.sh|requestrepo\.com)\b`)},
+	{"request-catcher", regexp.MustCompile(`(?i)\bwebhook\.site/[0-9a-f-]{36}\b|\b[a-z0-9]+\.(m|x)\.pipedream\.net\b|\b[a-z0-9]+\.requestbin\.net\b|\b[a-z0-9-]+\.free\.beeceptor\.com\b`)},
+	{"xxe-parameter-entity", regexp.MustCompile(`(?i)<!ENTITY\s+%\s*[\w.:-]+\s+(SYSTEM|PUBLIC)\b[^>]*>`)},
+}
+
+// detectOOBPayloads tags an interaction "oob:<detector>" for every detector
+// recognizing a payload in it, and thirdPartyTestTag when any does. The first
+// payload each detector found is recorded under the "oob" enrichment, so the
+// callback host shows whose test it was.
+func detectOOBPayloads(i *Interaction) {
+	text := signatureText(i)
+	var found []string
+	for _, d := range oobDetectors {
+		payload := d.re.FindString(text)
+		if payload == "" {
+			continue
+		}
+		if len(payload) > 200 {
+			payload = payload[:200]
+		}
+		found = append(found, d.name+": "+payload)
+		if tag := "oob:" + d.name; !hasTag(i, tag) {
+			i.Tags = append(i.Tags, tag)
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	if !hasTag(i, thirdPartyTestTag) {
+		i.Tags = append(i.Tags, thirdPartyTestTag)
+	}
+	setEnrichment(i, "oob", strings.Join(found, ", "))
+}
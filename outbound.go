@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var OutboundProxy string
+
+// newOutboundClient returns the HTTP client for calls CoWitness makes itself:
+// webhooks, MISP, threat intel lookups, archive uploads and forwarding. They
+// all go through -proxy, or the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables without one, since callback hosts often sit on
+// networks with restricted egress.
+func newOutboundClient(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = outboundProxy()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func outboundProxy() func(*http.Request) (*url.URL, error) {
+	if OutboundProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	config := httpproxy.Config{HTTPProxy: OutboundProxy, HTTPSProxy: OutboundProxy, NoProxy: os.Getenv("NO_PROXY")}
+	if config.NoProxy == "" {
+		config.NoProxy = os.Getenv("no_proxy")
+	}
+	proxy := config.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}
+}
+
+// validateProxy checks -proxy is a proxy URL Go's HTTP client can use.
+func validateProxy(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing proxy host")
+	}
+	return nil
+}
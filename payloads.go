@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	PayloadDir        = "./payloads"
+	PayloadManifest   = "./payloads.json"
+	PayloadURLPrefix  = "/p/"
+	payloadRescanTime = 5 * time.Second
+)
+
+type Payload struct {
+	ID           string    `json:"id"`
+	File         string    `json:"file"`
+	Staged       time.Time `json:"staged"`
+	Downloads    int       `json:"downloads"`
+	Delivered    int       `json:"delivered"`
+	LastDownload time.Time `json:"last_download,omitempty"`
+	LastIP       string    `json:"last_ip,omitempty"`
+}
+
+// payloadStore hands out a stable, unguessable URL for every file dropped into
+// the staging directory and keeps per-payload download counters on disk.
+type payloadStore struct {
+	mu       sync.Mutex
+	dir      string
+	manifest string
+	payloads map[string]*Payload
+	rules    map[string]*deliveryRule
+	rulesMod time.Time
+	logger   *log.Logger
+}
+
+func newPayloadStore(dir, manifest string, logger *log.Logger) (*payloadStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &payloadStore{dir: dir, manifest: manifest, payloads: make(map[string]*Payload), logger: logger}
+	list, err := readPayloadManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		s.payloads[p.ID] = p
+	}
+
+	if err := s.rescan(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func readPayloadManifest(manifest string) ([]*Payload, error) {
+	data, err := os.ReadFile(manifest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Payload
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", manifest, err)
+	}
+	return list, nil
+}
+
+// rescan registers files that appeared in the staging directory since the
+// last scan and reloads the delivery rules when they changed. Payloads whose
+// file was removed keep their history.
+func (s *payloadStore) rescan() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadRulesLocked()
+	s.removeExpiredLocked()
+
+	known := make(map[string]bool)
+	for _, p := range s.payloads {
+		known[p.File] = true
+	}
+
+	added := false
+	for _, e := range entries {
+		if !e.Type().IsRegular() || known[e.Name()] {
+			continue
+		}
+		p := &Payload{ID: newID(), File: e.Name(), Staged: time.Now().UTC()}
+		s.payloads[p.ID] = p
+		added = true
+		infof("Staged payload %s at %s%s\n", p.File, PayloadURLPrefix, p.ID)
+	}
+
+	if !added {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// removeExpiredLocked deletes the staged files of expired payloads. Their
+// manifest entries stay, so the URL keeps answering 404 and the download
+// history is kept.
+func (s *payloadStore) removeExpiredLocked() {
+	now := time.Now()
+	for _, p := range s.payloads {
+		if !s.rules[p.File].expired(p, now) {
+			continue
+		}
+		path := filepath.Join(s.dir, p.File)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Payload %s (%s) expired, removed %s\n", p.ID, p.File, path)
+	}
+}
+
+func (s *payloadStore) reloadRulesLocked() {
+	var mod time.Time
+	if info, err := os.Stat(PayloadRules); err == nil {
+		mod = info.ModTime()
+	}
+	if mod.Equal(s.rulesMod) {
+		return
+	}
+
+	// A broken rules file keeps the previous rules in force rather than
+	// silently handing out every payload unconditionally.
+	rules, err := loadDeliveryRules(PayloadRules)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.rules = rules
+	s.rulesMod = mod
+	infof("Loaded %d payload delivery rule(s)\n", len(rules))
+}
+
+func (s *payloadStore) watch() {
+	for range time.Tick(payloadRescanTime) {
+		if err := s.rescan(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *payloadStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.sortedLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.manifest + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.manifest)
+}
+
+func (s *payloadStore) sortedLocked() []*Payload {
+	list := make([]*Payload, 0, len(s.payloads))
+	for _, p := range s.payloads {
+		list = append(list, p)
+	}
+	sortPayloads(list)
+	return list
+}
+
+func sortPayloads(list []*Payload) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Staged.Equal(list[j].Staged) {
+			return list[i].Staged.Before(list[j].Staged)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+func (s *payloadStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, PayloadURLPrefix)
+	ipAddress := remoteIP(r)
+	userAgent := r.UserAgent()
+
+	// The decision and the delivery counter are updated together so that a
+	// one-time payload can't be handed out twice to concurrent requests.
+	s.mu.Lock()
+	p, ok := s.payloads[id]
+	if !ok {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	rule := s.rules[p.File]
+	if rule.expired(p, time.Now()) {
+		s.mu.Unlock()
+		s.recordDownload(p, ipAddress, userAgent, false, "expired")
+		http.NotFound(w, r)
+		return
+	}
+	deliver, reason := rule.allows(p, ipAddress, userAgent)
+	if deliver && !arming.armed(hostEngagement(r.Host)) {
+		deliver, reason = false, "engagement disarmed"
+	}
+	if deliver {
+		p.Delivered++
+	}
+	s.mu.Unlock()
+
+	path := filepath.Join(s.dir, p.File)
+	if !deliver {
+		path = ""
+		if rule != nil && rule.Decoy != "" {
+			path = filepath.Join(DecoyDir, filepath.Base(rule.Decoy))
+		}
+	}
+	s.recordDownload(p, ipAddress, userAgent, deliver, reason)
+
+	if path == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", p.File))
+	http.ServeContent(w, r, p.File, info.ModTime(), f)
+}
+
+func (s *payloadStore) recordDownload(p *Payload, ipAddress, userAgent string, delivered bool, reason string) {
+	s.mu.Lock()
+	p.Downloads++
+	p.LastDownload = time.Now().UTC()
+	p.LastIP = ipAddress
+	count := p.Downloads
+	err := s.saveLocked()
+	s.mu.Unlock()
+	if err != nil {
+		log.Println(err)
+	}
+
+	served := "payload"
+	switch {
+	case reason == "expired":
+		served = "404 (expired)"
+	case !delivered:
+		served = "decoy (" + reason + ")"
+	}
+	s.logger.Printf("Payload: %s, File: %s, Download: %d, Served: %s, IP address: %s, User agent: %s\n", p.ID, p.File, count, served, ipAddress, userAgent)
+	log.Printf("Payload %s (%s) requested by %s, served %s\n", p.ID, p.File, ipAddress, served)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// listPayloads implements the "payloads" subcommand.
+func listPayloads() {
+	list, err := readPayloadManifest(PayloadManifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(list) == 0 {
+		fmt.Printf("No payloads staged, copy files into %s and start CoWitness\n", PayloadDir)
+		return
+	}
+	sortPayloads(list)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tFILE\tURL\tDOWNLOADS\tDELIVERED\tLAST DOWNLOAD\tLAST IP")
+	for _, p := range list {
+		last := "-"
+		if !p.LastDownload.IsZero() {
+			last = p.LastDownload.Format(time.RFC3339)
+		}
+		lastIP := p.LastIP
+		if lastIP == "" {
+			lastIP = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s%s\t%d\t%d\t%s\t%s\n", p.ID, p.File, PayloadURLPrefix, p.ID, p.Downloads, p.Delivered, last, lastIP)
+	}
+	tw.Flush()
+}
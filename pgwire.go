@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	pgProtocol3       = 196608
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+	pgCancelRequest   = 80877102
+	pgMaxStartupBytes = 10000
+)
+
+// servePostgresWire reads a PostgreSQL startup message, capturing the user,
+// database, application name and other startup parameters. It then asks for a
+// cleartext password, which libpq based clients send unless told otherwise,
+// and rejects the login.
+func servePostgresWire(s *moduleSession) {
+	var params []byte
+	for params == nil {
+		length, err := s.readBlock(4)
+		if err != nil {
+			return
+		}
+		size := int64(binary.BigEndian.Uint32([]byte(length)))
+		if size < 8 || size > pgMaxStartupBytes {
+			s.note("invalid startup message length %d", size)
+			return
+		}
+		body, err := s.readBlock(size - 4)
+		if err != nil {
+			return
+		}
+		switch version := binary.BigEndian.Uint32([]byte(body)); version {
+		case pgSSLRequest:
+			s.note("SSL requested")
+			if s.interaction.TLS {
+				s.w.WriteByte('N')
+				s.w.Flush()
+				continue
+			}
+			s.w.WriteByte('S')
+			if s.w.Flush() != nil || !s.startTLS() {
+				return
+			}
+		case pgGSSENCRequest:
+			s.note("GSS encryption requested")
+			s.w.WriteByte('N')
+			if s.w.Flush() != nil {
+				return
+			}
+		case pgCancelRequest:
+			s.note("cancel request")
+			return
+		default:
+			s.record(fmt.Sprintf("protocol: %d.%d", version>>16, version&0xffff))
+			if version != pgProtocol3 {
+				s.writePostgresError("0A000", fmt.Sprintf("unsupported frontend protocol %d.%d", version>>16, version&0xffff))
+				return
+			}
+			params = []byte(body[4:])
+		}
+	}
+
+	values := map[string]string{}
+	fields := strings.Split(string(params), "\x00")
+	for n := 0; n+1 < len(fields) && fields[n] != ""; n += 2 {
+		values[fields[n]] = fields[n+1]
+		s.record(fields[n] + ": " + fields[n+1])
+	}
+	user := values["user"]
+	s.interaction.UserAgent = values["application_name"]
+	s.credentials(user, "")
+
+	// AuthenticationCleartextPassword
+	s.w.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 3})
+	if s.w.Flush() != nil {
+		return
+	}
+	header, err := s.readBlock(5)
+	if err == nil && header[0] == 'p' {
+		size := int64(binary.BigEndian.Uint32([]byte(header[1:])))
+		if size >= 4 && size <= pgMaxStartupBytes {
+			password, err := s.readBlock(size - 4)
+			if err == nil {
+				s.credentials(user, strings.TrimSuffix(password, "\x00"))
+				s.note("cleartext password sent")
+			}
+		}
+	}
+	s.writePostgresError("28P01", fmt.Sprintf("password authentication failed for user %q", user))
+}
+
+func (s *moduleSession) writePostgresError(code, message string) {
+	fields := "SFATAL\x00VFATAL\x00C" + code + "\x00M" + message + "\x00\x00"
+	s.w.WriteByte('E')
+	binary.Write(s.w, binary.BigEndian, uint32(len(fields)+4))
+	s.w.WriteString(fields)
+	s.w.Flush()
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	PluginsFile = "./plugins.json"
+
+	pluginProtocol      = 1
+	pluginHelloTimeout  = 5 * time.Second
+	pluginEnrichTimeout = 2 * time.Second
+	pluginRestartDelay  = 5 * time.Second
+	maxPluginMessage    = 4 << 20
+)
+
+// pluginConfig is an entry of plugins.json: a program CoWitness runs as a
+// sidecar and talks to over its stdin and stdout.
+type pluginConfig struct {
+	Name    string            `json:"name"`
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// pluginMessage is one line of the plugin protocol, JSON in both directions.
+//
+// CoWitness starts with a "hello" and the plugin answers with a "register"
+// saying what it does. An enricher gets an "enrich" per interaction and
+// answers with "enriched" and the same seq, carrying the interaction with
+// its tags, note, verdict, intel or data changed, or none to keep it as it
+// is. A notifier gets a "notify" per recorded interaction. Any plugin may
+// send a "record" with an interaction it captured itself, which makes it a
+// protocol handler with its own listener, and "log" lines for the console.
+type pluginMessage struct {
+	Type        string       `json:"type"`
+	Seq         uint64       `json:"seq,omitempty"`
+	Interaction *Interaction `json:"interaction,omitempty"`
+	Message     string       `json:"message,omitempty"`
+
+	// hello
+	Protocol int    `json:"protocol,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Node     string `json:"node,omitempty"`
+
+	// register
+	Enrich    bool     `json:"enrich,omitempty"`
+	Notify    bool     `json:"notify,omitempty"`
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+func loadPluginConfig(path string) ([]*pluginConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var configs []*pluginConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if c.Name == "" || c.Command == "" {
+			return nil, fmt.Errorf("%s: every plugin needs a name and a command", path)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("%s: plugin %s is listed twice", path, c.Name)
+		}
+		names[c.Name] = true
+		if _, err := exec.LookPath(c.Command); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, c.Name, err)
+		}
+	}
+	return configs, nil
+}
+
+// plugin is a running sidecar. It is restarted when it exits, and what it
+// registered for is decided by its first run.
+type plugin struct {
+	config   *pluginConfig
+	register pluginMessage
+	lines    *bufio.Scanner
+	records  interactionSink
+
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	replies chan pluginMessage
+	seq     uint64
+}
+
+// startPlugins runs the plugins in plugins.json and waits for each to
+// register. A plugin that fails to start is left out. Their messages are
+// only handled once runPlugins is called.
+func startPlugins(path string) []*plugin {
+	configs, err := loadPluginConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var plugins []*plugin
+	for _, c := range configs {
+		p := &plugin{config: c, replies: make(chan pluginMessage, 1)}
+		lines, err := p.start()
+		if err != nil {
+			log.Printf("Plugin %s: %v\n", c.Name, err)
+			continue
+		}
+		p.lines = lines
+		plugins = append(plugins, p)
+	}
+	return plugins
+}
+
+// start runs the plugin and reads its registration.
+func (p *plugin) start() (*bufio.Scanner, error) {
+	cmd := exec.Command(p.config.Command, p.config.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range p.config.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("Plugin %s exited: %v\n", p.config.Name, err)
+	}()
+
+	p.mu.Lock()
+	p.stdin = stdin
+	p.mu.Unlock()
+	if err := p.send(pluginMessage{Type: "hello", Protocol: pluginProtocol, Version: Version, Node: NodeName}); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+
+	lines := bufio.NewScanner(stdout)
+	lines.Buffer(make([]byte, 64<<10), maxPluginMessage)
+	registered := make(chan error, 1)
+	go func() {
+		if !lines.Scan() {
+			registered <- fmt.Errorf("no registration: %v", lines.Err())
+			return
+		}
+		var m pluginMessage
+		if err := json.Unmarshal(lines.Bytes(), &m); err != nil || m.Type != "register" {
+			registered <- fmt.Errorf("expected a register message, got %q", lines.Text())
+			return
+		}
+		p.register = m
+		registered <- nil
+	}()
+	select {
+	case err = <-registered:
+	case <-time.After(pluginHelloTimeout):
+		err = fmt.Errorf("no registration within %s", pluginHelloTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	infof("Started plugin %s (enrich: %t, notify: %t)\n", p.config.Name, p.register.Enrich, p.register.Notify)
+	return lines, nil
+}
+
+// read handles the plugin's messages until it exits, then restarts it.
+func (p *plugin) read() {
+	lines := p.lines
+	for {
+		for lines.Scan() {
+			var m pluginMessage
+			if err := json.Unmarshal(lines.Bytes(), &m); err != nil {
+				log.Printf("Plugin %s sent an invalid message: %v\n", p.config.Name, err)
+				continue
+			}
+			p.handle(m)
+		}
+		time.Sleep(pluginRestartDelay)
+		for {
+			var err error
+			if lines, err = p.start(); err == nil {
+				break
+			}
+			log.Printf("Plugin %s: %v\n", p.config.Name, err)
+			time.Sleep(pluginRestartDelay)
+		}
+	}
+}
+
+func (p *plugin) handle(m pluginMessage) {
+	switch m.Type {
+	case "enriched":
+		select {
+		case p.replies <- m:
+		default:
+		}
+	case "record":
+		if m.Interaction == nil || p.records == nil {
+			return
+		}
+		i := m.Interaction
+		if i.ID == "" {
+			i.ID = newID()
+		}
+		if i.Time.IsZero() {
+			i.Time = time.Now().UTC()
+		}
+		if i.Protocol == "" {
+			i.Protocol = p.config.Name
+		}
+		i.Node, i.Engagement = NodeName, Engagement
+		p.records.Write(i)
+	case "log":
+		log.Printf("Plugin %s: %s\n", p.config.Name, m.Message)
+	default:
+		log.Printf("Plugin %s sent an unknown %q message\n", p.config.Name, m.Type)
+	}
+}
+
+func (p *plugin) send(m pluginMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// enrich asks the plugin for its changes to i, keeping i as it is when the
+// plugin fails or takes longer than pluginEnrichTimeout. Only the fields
+// operators and rules work with are taken over.
+func (p *plugin) enrich(i *Interaction) {
+	p.seq++
+	seq := p.seq
+	if err := p.send(pluginMessage{Type: "enrich", Seq: seq, Interaction: i}); err != nil {
+		return
+	}
+	timeout := time.After(pluginEnrichTimeout)
+	for {
+		select {
+		case m := <-p.replies:
+			if m.Seq != seq {
+				continue // a late answer to an interaction that timed out
+			}
+			if e := m.Interaction; e != nil {
+				i.Tags, i.Note, i.Verdict, i.Intel, i.Data = e.Tags, e.Note, e.Verdict, e.Intel, e.Data
+			}
+			return
+		case <-timeout:
+			log.Printf("Plugin %s didn't enrich interaction %s within %s\n", p.config.Name, i.ID, pluginEnrichTimeout)
+			return
+		}
+	}
+}
+
+// pluginEnricher runs interactions through the enricher plugins in order
+// before passing them on. It works from a queue, so a slow plugin never
+// delays a DNS answer or HTTP response.
+type pluginEnricher struct {
+	plugins []*plugin
+	next    interactionSink
+	queue   chan *Interaction
+}
+
+func (e *pluginEnricher) Write(i *Interaction) {
+	select {
+	case e.queue <- i:
+	default:
+		log.Printf("Plugin enrichment queue full, passing on interaction %s as it is\n", i.ID)
+		e.next.Write(i)
+	}
+}
+
+func (e *pluginEnricher) run() {
+	for i := range e.queue {
+		for _, p := range e.plugins {
+			p.enrich(i)
+		}
+		e.next.Write(i)
+	}
+}
+
+// attachPlugins puts the enricher plugins in front of next and subscribes
+// the notifiers to bus. It returns the sink to write to instead of next.
+func attachPlugins(plugins []*plugin, next interactionSink, bus *eventBus) interactionSink {
+	var enrichers []*plugin
+	for _, p := range plugins {
+		if p.register.Enrich {
+			enrichers = append(enrichers, p)
+		}
+		if p.register.Notify {
+			p := p
+			bus.subscribe("plugin "+p.config.Name, &armedSink{newPublisher("Plugin "+p.config.Name, func(i *Interaction) error {
+				return p.send(pluginMessage{Type: "notify", Interaction: i})
+			})})
+		}
+	}
+	if len(enrichers) == 0 {
+		return next
+	}
+	e := &pluginEnricher{plugins: enrichers, next: next, queue: make(chan *Interaction, publishQueueSize)}
+	go e.run()
+	return e
+}
+
+// runPlugins starts handling the plugins' messages. Interactions they
+// capture enter the pipeline at head, like those of the built-in listeners.
+func runPlugins(plugins []*plugin, head interactionSink) {
+	for _, p := range plugins {
+		p.records = head
+		go p.read()
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+)
+
+// servePOP3 accepts every login and presents an empty mailbox. STLS is
+// offered on plain connections.
+func servePOP3(s *moduleSession) {
+	zone := strings.TrimSuffix(DNSResponseName, ".")
+	if s.reply("+OK "+zone+" POP3 server ready") != nil {
+		return
+	}
+
+	var user string
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "PASS":
+			s.record(verb)
+		case "AUTH":
+			mechanism, _, _ := strings.Cut(arg, " ")
+			s.record(strings.TrimSpace(verb + " " + mechanism))
+		default:
+			s.record(line)
+		}
+		switch strings.ToUpper(verb) {
+		case "CAPA":
+			lines := []string{"+OK Capability list follows", "USER", "UIDL", "TOP", "SASL PLAIN LOGIN"}
+			if !s.interaction.TLS {
+				lines = append(lines, "STLS")
+			}
+			s.reply(append(lines, ".")...)
+		case "STLS":
+			if s.interaction.TLS {
+				s.reply("-ERR TLS already active")
+				continue
+			}
+			s.reply("+OK Begin TLS negotiation")
+			if !s.startTLS() {
+				return
+			}
+		case "USER":
+			user = arg
+			s.reply("+OK")
+		case "PASS":
+			s.credentials(user, arg)
+			s.reply("+OK Logged in")
+		case "APOP":
+			name, _, _ := strings.Cut(arg, " ")
+			s.credentials(name, "")
+			s.reply("+OK Logged in")
+		case "AUTH":
+			if arg == "" {
+				s.reply("+OK", "PLAIN", "LOGIN", ".")
+				continue
+			}
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			supported, err := s.saslLogin(mechanism, initial, "+ ")
+			if err != nil {
+				return
+			}
+			if !supported {
+				s.reply("-ERR Unsupported mechanism")
+				continue
+			}
+			s.reply("+OK Logged in")
+		case "STAT":
+			s.reply("+OK 0 0")
+		case "LIST", "UIDL":
+			if arg != "" {
+				s.reply("-ERR No such message")
+				continue
+			}
+			s.reply("+OK 0 messages", ".")
+		case "RETR", "TOP", "DELE":
+			s.reply("-ERR No such message")
+		case "NOOP", "RSET":
+			s.reply("+OK")
+		case "QUIT":
+			s.reply("+OK Bye")
+			return
+		default:
+			s.reply("-ERR Unknown command")
+		}
+	}
+}
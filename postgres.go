@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	PostgresMaxConns     int
+	PostgresConnLifetime time.Duration
+)
+
+// postgresMigrations are applied in order and recorded in schema_migrations,
+// so several CoWitness instances can safely share one database.
+var postgresMigrations = []string{
+	`CREATE TABLE interactions (
+		id         TEXT PRIMARY KEY,
+		time       TIMESTAMPTZ NOT NULL,
+		protocol   TEXT NOT NULL,
+		remote_ip  TEXT NOT NULL,
+		port       INTEGER NOT NULL DEFAULT 0,
+		method     TEXT NOT NULL DEFAULT '',
+		host       TEXT NOT NULL DEFAULT '',
+		path       TEXT NOT NULL DEFAULT '',
+		query      TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		qname      TEXT NOT NULL DEFAULT '',
+		qtype      TEXT NOT NULL DEFAULT '',
+		token      TEXT NOT NULL DEFAULT '',
+		noise      BOOLEAN NOT NULL DEFAULT FALSE
+	);
+	CREATE INDEX interactions_time_idx ON interactions (time DESC);
+	CREATE INDEX interactions_remote_ip_idx ON interactions (remote_ip, time DESC);
+	CREATE INDEX interactions_token_idx ON interactions (token, time DESC) WHERE token <> ''`,
+	`ALTER TABLE interactions ADD COLUMN node TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE interactions ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}', ADD COLUMN note TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE interactions ADD COLUMN body TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE interactions ADD COLUMN headers JSONB NOT NULL DEFAULT '{}';
+	ALTER TABLE interactions ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+		to_tsvector('simple', qname || ' ' || host || ' ' || path || ' ' || query || ' ' || user_agent || ' ' || body || ' ' || note)
+		|| to_tsvector('simple', headers)) STORED;
+	CREATE INDEX interactions_search_idx ON interactions USING GIN (search)`,
+	`ALTER TABLE interactions
+		ADD COLUMN user_name TEXT NOT NULL DEFAULT '',
+		ADD COLUMN password TEXT NOT NULL DEFAULT '',
+		ADD COLUMN data TEXT NOT NULL DEFAULT '',
+		ADD COLUMN tls BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE interactions ADD COLUMN engagement TEXT NOT NULL DEFAULT '';
+	CREATE INDEX interactions_engagement_idx ON interactions (engagement, time DESC) WHERE engagement <> ''`,
+	`ALTER TABLE interactions ADD COLUMN ja3 TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE interactions ADD COLUMN verdict TEXT NOT NULL DEFAULT '', ADD COLUMN intel TEXT NOT NULL DEFAULT ''`,
+	// Views for Grafana and ad hoc SQL, kept in step with grafanaDashboard.
+	`CREATE VIEW interactions_per_minute AS
+		SELECT date_trunc('minute', time) AS minute, protocol, node, engagement, noise, count(*) AS interactions
+		FROM interactions GROUP BY 1, 2, 3, 4, 5;
+	CREATE VIEW source_activity_per_minute AS
+		SELECT date_trunc('minute', time) AS minute, remote_ip, protocol, verdict, count(*) AS interactions
+		FROM interactions WHERE NOT noise GROUP BY 1, 2, 3, 4;
+	CREATE VIEW top_talkers AS
+		SELECT remote_ip, count(*) AS interactions, string_agg(DISTINCT protocol, ',') AS protocols,
+			min(time) AS first_seen, max(time) AS last_seen, max(verdict) AS verdict
+		FROM interactions WHERE NOT noise GROUP BY remote_ip;
+	CREATE VIEW token_callbacks AS
+		SELECT token, count(*) AS callbacks, count(DISTINCT remote_ip) AS sources, min(time) AS first_callback, max(time) AS last_callback
+		FROM interactions WHERE token <> '' GROUP BY token`,
+	// The search column is generated, so it is recreated to cover the
+	// decoded body.
+	`ALTER TABLE interactions ADD COLUMN decoded_body TEXT NOT NULL DEFAULT '';
+	ALTER TABLE interactions DROP COLUMN search;
+	ALTER TABLE interactions ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+		to_tsvector('simple', qname || ' ' || host || ' ' || path || ' ' || query || ' ' || user_agent || ' ' || body || ' ' || decoded_body || ' ' || note)
+		|| to_tsvector('simple', headers)) STORED;
+	CREATE INDEX interactions_search_idx ON interactions USING GIN (search)`,
+	`ALTER TABLE interactions ADD COLUMN tls_handshake TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE interactions ADD COLUMN screenshot TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE interactions ADD COLUMN enrichment JSONB NOT NULL DEFAULT '{}'`,
+	// Uploads list their files and hashes in data, which search now covers.
+	`ALTER TABLE interactions ADD COLUMN upload TEXT NOT NULL DEFAULT '';
+	ALTER TABLE interactions DROP COLUMN search;
+	ALTER TABLE interactions ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+		to_tsvector('simple', qname || ' ' || host || ' ' || path || ' ' || query || ' ' || user_agent || ' ' || body || ' ' || decoded_body || ' ' || data || ' ' || note)
+		|| to_tsvector('simple', headers)) STORED;
+	CREATE INDEX interactions_search_idx ON interactions USING GIN (search)`,
+}
+
+const interactionColumns = "id, time, node, engagement, protocol, remote_ip, port, method, host, path, query, user_agent, headers, body, decoded_body, user_name, password, data, tls, ja3, tls_handshake, qname, qtype, token, noise, verdict, intel, screenshot, upload, enrichment, tags, note"
+
+type postgresStore struct {
+	db     *sql.DB
+	writer *publisher
+}
+
+func newPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(PostgresMaxConns)
+	db.SetMaxIdleConns(PostgresMaxConns)
+	db.SetConnMaxLifetime(PostgresConnLifetime)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres: %v", err)
+	}
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres migrations: %v", err)
+	}
+
+	s := &postgresStore{db: db}
+	s.writer = newRetryingPublisher("PostgreSQL", s.insert)
+	infof("Storing interactions in PostgreSQL\n")
+	return s, nil
+}
+
+func migratePostgres(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialize concurrent starts of several instances against one database.
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(7362947)`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied TIMESTAMPTZ NOT NULL DEFAULT now())`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(postgresMigrations); version++ {
+		if _, err := tx.Exec(postgresMigrations[version-1]); err != nil {
+			return fmt.Errorf("version %d: %v", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+		infof("Applied PostgreSQL migration %d\n", version)
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) Write(i *Interaction) {
+	s.writer.Write(i)
+}
+
+func (s *postgresStore) insert(i *Interaction) error {
+	row, err := postgresRow(i)
+	if err != nil {
+		return permanentError{err}
+	}
+	_, err = s.db.Exec(`INSERT INTO interactions (`+interactionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32)
+		ON CONFLICT (id) DO NOTHING`, row...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "22", "23", "42":
+			// Data, constraint and syntax errors fail the same way again.
+			return permanentError{err}
+		}
+	}
+	return err
+}
+
+// postgresRow returns the values of interactionColumns for i. Every text goes
+// through postgresText: attackers pick most of what is recorded, and a row
+// PostgreSQL rejects would keep their interaction out of the store.
+func postgresRow(i *Interaction) ([]interface{}, error) {
+	headers, enrichment := []byte("{}"), []byte("{}")
+	var err error
+	if i.Headers != nil {
+		clean := make(map[string][]string, len(i.Headers))
+		for name, values := range i.Headers {
+			clean[postgresText(name)] = postgresTexts(values)
+		}
+		if headers, err = json.Marshal(clean); err != nil {
+			return nil, err
+		}
+	}
+	if i.Enrichment != nil {
+		clean := make(map[string]string, len(i.Enrichment))
+		for name, value := range i.Enrichment {
+			clean[postgresText(name)] = postgresText(value)
+		}
+		if enrichment, err = json.Marshal(clean); err != nil {
+			return nil, err
+		}
+	}
+	t := postgresText
+	return []interface{}{
+		t(i.ID), i.Time, t(i.Node), t(i.Engagement), t(i.Protocol), t(i.RemoteIP), i.Port, t(i.Method), t(i.Host), t(i.Path), t(i.Query), t(i.UserAgent), string(headers), t(i.Body), t(i.DecodedBody), t(i.User), t(i.Password), t(i.Data), i.TLS, t(i.JA3), t(i.TLSHandshake), t(i.QName), t(i.QType), t(i.Token), i.Noise, t(i.Verdict), t(i.Intel), t(i.Screenshot), t(i.Upload), string(enrichment), pq.Array(postgresTexts(nonNilTags(i.Tags))), t(i.Note),
+	}, nil
+}
+
+// postgresText drops NUL bytes and replaces invalid UTF-8, which text and
+// JSONB columns refuse.
+func postgresText(s string) string {
+	if strings.IndexByte(s, 0) >= 0 {
+		s = strings.ReplaceAll(s, "\x00", "")
+	}
+	return strings.ToValidUTF8(s, "\uFFFD")
+}
+
+func postgresTexts(list []string) []string {
+	clean := make([]string, len(list))
+	for n, s := range list {
+		clean[n] = postgresText(s)
+	}
+	return clean
+}
+
+func (s *postgresStore) Query(q interactionQuery) ([]*Interaction, error) {
+	var where []string
+	var args []interface{}
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if q.Node != "" {
+		add("node = $%d", q.Node)
+	}
+	if q.Engagement != "" {
+		add("engagement = $%d", q.Engagement)
+	}
+	if q.Verdict != "" {
+		add("verdict = $%d", q.Verdict)
+	}
+	if q.Protocol != "" {
+		add("protocol = $%d", q.Protocol)
+	}
+	if q.RemoteIP != "" {
+		add("remote_ip = $%d", q.RemoteIP)
+	}
+	if q.Token != "" {
+		add("token = $%d", q.Token)
+	}
+	if q.Upload != "" {
+		add("upload = $%d", q.Upload)
+	}
+	if q.Tag != "" {
+		add("$%d = ANY(tags)", q.Tag)
+	}
+	if q.Search != "" {
+		add("search @@ plainto_tsquery('simple', $%d)", q.Search)
+	}
+	if !q.Since.IsZero() {
+		add("time >= $%d", q.Since)
+	}
+	if !q.Until.IsZero() {
+		add("time < $%d", q.Until)
+	}
+
+	query := `SELECT ` + interactionColumns + ` FROM interactions`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, q.Limit)
+	query += fmt.Sprintf(" ORDER BY time DESC LIMIT $%d", len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*Interaction
+	for rows.Next() {
+		i, err := scanInteraction(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, i)
+	}
+	return result, rows.Err()
+}
+
+func (s *postgresStore) Annotate(id string, a annotation) (*Interaction, error) {
+	var tags interface{}
+	if a.Tags != nil {
+		tags = pq.Array(nonNilTags(*a.Tags))
+	}
+	row := s.db.QueryRow(`UPDATE interactions SET tags = COALESCE($2, tags), note = COALESCE($3, note)
+		WHERE id = $1 RETURNING `+interactionColumns, id, tags, a.Note)
+	i, err := scanInteraction(row)
+	if err == sql.ErrNoRows {
+		return nil, errInteractionNotFound
+	}
+	return i, err
+}
+
+func (s *postgresStore) Purge(engagement string, before time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM interactions WHERE engagement = $1 AND time < $2`, engagement, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func scanInteraction(row interface{ Scan(...interface{}) error }) (*Interaction, error) {
+	i := &Interaction{}
+	var headers, enrichment []byte
+	err := row.Scan(&i.ID, &i.Time, &i.Node, &i.Engagement, &i.Protocol, &i.RemoteIP, &i.Port, &i.Method, &i.Host, &i.Path, &i.Query, &i.UserAgent, &headers, &i.Body, &i.DecodedBody, &i.User, &i.Password, &i.Data, &i.TLS, &i.JA3, &i.TLSHandshake, &i.QName, &i.QType, &i.Token, &i.Noise, &i.Verdict, &i.Intel, &i.Screenshot, &i.Upload, &enrichment, pq.Array(&i.Tags), &i.Note)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headers, &i.Headers); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(enrichment, &i.Enrichment); err != nil {
+		return nil, err
+	}
+	i.Time = i.Time.UTC()
+	return i, nil
+}
+
+// nonNilTags keeps the NOT NULL tags column happy for untagged interactions.
+func nonNilTags(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
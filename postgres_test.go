@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestPostgresRowSanitized(t *testing.T) {
+	dirty := "a\x00b\xc0\xaec"
+	i := &Interaction{
+		ID:         "id",
+		Time:       time.Now(),
+		Protocol:   "http",
+		RemoteIP:   "192.0.2.1",
+		Method:     dirty,
+		Host:       dirty,
+		Path:       "/..\x00\xc0\xae/etc/passwd",
+		Query:      dirty,
+		UserAgent:  dirty,
+		Headers:    http.Header{"X-" + dirty: {dirty}},
+		Body:       dirty,
+		User:       dirty,
+		Password:   dirty,
+		Data:       dirty,
+		QName:      dirty,
+		Enrichment: map[string]string{dirty: dirty},
+		Tags:       []string{dirty},
+		Note:       dirty,
+	}
+	row, err := postgresRow(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row) != len(strings.Split(interactionColumns, ",")) {
+		t.Fatalf("%d values for %d columns", len(row), len(strings.Split(interactionColumns, ",")))
+	}
+	for n, value := range row {
+		if valuer, ok := value.(driver.Valuer); ok {
+			if value, err = valuer.Value(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if strings.Contains(text, "\x00") || strings.Contains(text, `\u0000`) || !utf8.ValidString(text) {
+			t.Errorf("column %d not sanitized: %q", n, text)
+		}
+	}
+	if i.Path != "/..\x00\xc0\xae/etc/passwd" {
+		t.Errorf("interaction modified: %q", i.Path)
+	}
+}
+
+func TestPostgresText(t *testing.T) {
+	tests := map[string]string{
+		"plain":        "plain",
+		"nul\x00byte":  "nulbyte",
+		"over\xc0\xae": "over�",
+		"":             "",
+	}
+	for in, want := range tests {
+		if got := postgresText(in); got != want {
+			t.Errorf("postgresText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
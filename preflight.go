@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	resolvedDropInDir  = "/etc/systemd/resolved.conf.d"
+	resolvedDropInFile = "cowitness.conf"
+	resolvedStubConf   = "/run/systemd/resolve/stub-resolv.conf"
+	resolvedUplinkConf = "/run/systemd/resolve/resolv.conf"
+)
+
+type listenerSpec struct {
+	Network string
+	Port    int
+}
+
+type portConflict struct {
+	Listener listenerSpec
+	Err      error
+	PID      int
+	Process  string
+}
+
+// checkPortConflicts tries to bind every listener before the servers start so
+// that a busy port is reported up front instead of as a fatal error from
+// inside a server goroutine.
+func checkPortConflicts(listeners []listenerSpec) {
+	conflicts := findPortConflicts(listeners)
+	if len(conflicts) == 0 {
+		return
+	}
+
+	for _, c := range conflicts {
+		if c.Process == "systemd-resolve" && offerDisableResolvedStub() {
+			conflicts = findPortConflicts(listeners)
+			break
+		}
+	}
+	if len(conflicts) == 0 {
+		return
+	}
+
+	for _, c := range conflicts {
+		log.Print(describePortConflict(c))
+	}
+	log.Fatalf("%d listener(s) cannot be started, resolve the conflicts above and try again", len(conflicts))
+}
+
+func findPortConflicts(listeners []listenerSpec) []portConflict {
+	var conflicts []portConflict
+	for _, l := range listeners {
+		if err := probeListener(l); err != nil {
+			c := portConflict{Listener: l, Err: err}
+			if errors.Is(err, syscall.EADDRINUSE) {
+				c.PID, c.Process = findPortOwner(l)
+			}
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+func probeListener(l listenerSpec) error {
+	addr := fmt.Sprintf(":%d", l.Port)
+	if l.Network == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+func describePortConflict(c portConflict) string {
+	where := fmt.Sprintf("Port %d/%s", c.Listener.Port, c.Listener.Network)
+
+	if errors.Is(c.Err, syscall.EACCES) {
+		return fmt.Sprintf("%s: permission denied. Run as root or grant the binary the capability with: sudo setcap 'cap_net_bind_service=+ep' %s", where, os.Args[0])
+	}
+	if !errors.Is(c.Err, syscall.EADDRINUSE) {
+		return fmt.Sprintf("%s: %v", where, c.Err)
+	}
+	if c.Process == "" {
+		return fmt.Sprintf("%s is already in use by another process. Find it with: sudo ss -lpn 'sport = :%d'", where, c.Listener.Port)
+	}
+
+	owner := fmt.Sprintf("%s is already in use by %s (pid %d).", where, c.Process, c.PID)
+	switch c.Process {
+	case "systemd-resolve":
+		return owner + " Disable the stub listener by setting DNSStubListener=no in /etc/systemd/resolved.conf and running: sudo systemctl restart systemd-resolved"
+	case "apache2", "httpd", "nginx", "lighttpd", "caddy", "named", "dnsmasq", "unbound":
+		return owner + " Stop it with: sudo systemctl stop " + c.Process
+	case "cowitness":
+		return owner + " Another CoWitness instance appears to be running."
+	}
+	return owner + fmt.Sprintf(" Stop it with: sudo kill %d", c.PID)
+}
+
+// findPortOwner maps a listening port to the owning process by matching the
+// socket inode from /proc/net against the file descriptors in /proc/<pid>/fd.
+func findPortOwner(l listenerSpec) (int, string) {
+	inodes := make(map[string]bool)
+	for _, table := range []string{l.Network, l.Network + "6"} {
+		for _, inode := range socketInodes("/proc/net/"+table, l.Port, l.Network == "tcp") {
+			inodes[inode] = true
+		}
+	}
+	if len(inodes) == 0 {
+		return 0, ""
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, ""
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(target, "socket:[") {
+				continue
+			}
+			if inodes[strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")] {
+				comm, _ := os.ReadFile(filepath.Join("/proc", p.Name(), "comm"))
+				return pid, strings.TrimSpace(string(comm))
+			}
+		}
+	}
+	return 0, ""
+}
+
+func socketInodes(table string, port int, listenOnly bool) []string {
+	f, err := os.Open(table)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var inodes []string
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		// Local address is HEXIP:HEXPORT, state 0A is TCP_LISTEN.
+		local := fields[1]
+		i := strings.LastIndex(local, ":")
+		if i < 0 {
+			continue
+		}
+		p, err := strconv.ParseUint(local[i+1:], 16, 16)
+		if err != nil || int(p) != port {
+			continue
+		}
+		if listenOnly && fields[3] != "0A" {
+			continue
+		}
+		inodes = append(inodes, fields[9])
+	}
+	return inodes
+}
+
+func offerDisableResolvedStub() bool {
+	prompt("systemd-resolved is holding port 53. Disable its stub listener now? [y/N]: ")
+	var answer string
+	fmt.Scanln(&answer)
+	if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+		return false
+	}
+
+	if err := disableResolvedStub(); err != nil {
+		log.Printf("Could not disable the systemd-resolved stub listener: %v", err)
+		return false
+	}
+	log.Printf("Disabled the systemd-resolved stub listener via %s", filepath.Join(resolvedDropInDir, resolvedDropInFile))
+	return true
+}
+
+func disableResolvedStub() error {
+	if err := os.MkdirAll(resolvedDropInDir, 0755); err != nil {
+		return err
+	}
+	dropIn := "[Resolve]\nDNSStubListener=no\n"
+	if err := os.WriteFile(filepath.Join(resolvedDropInDir, resolvedDropInFile), []byte(dropIn), 0644); err != nil {
+		return err
+	}
+
+	// Without the stub, a resolv.conf pointing at 127.0.0.53 stops resolving,
+	// so point it at the uplink servers systemd-resolved writes out instead.
+	if target, err := os.Readlink("/etc/resolv.conf"); err == nil && strings.HasSuffix(target, filepath.Base(resolvedStubConf)) {
+		if err := os.Remove("/etc/resolv.conf"); err != nil {
+			return err
+		}
+		if err := os.Symlink(resolvedUplinkConf, "/etc/resolv.conf"); err != nil {
+			return err
+		}
+	}
+
+	out, err := exec.Command("systemctl", "restart", "systemd-resolved").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl restart systemd-resolved: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
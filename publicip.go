@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSTUNServer = "stun.l.google.com:19302"
+	publicIPTimeout   = 3 * time.Second
+	stunMagicCookie   = 0x2112A442
+)
+
+var PublicIPCheck string
+
+// validatePublicIPCheck checks -public-ip-check is stun, stun:host:port or
+// an HTTP URL.
+func validatePublicIPCheck(value string) error {
+	switch {
+	case value == "" || value == "stun":
+		return nil
+	case strings.HasPrefix(value, "stun:"):
+		_, _, err := net.SplitHostPort(strings.TrimPrefix(value, "stun:"))
+		return err
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		_, err := url.Parse(value)
+		return err
+	}
+	return errors.New("expected stun, stun:host:port or an http(s) URL")
+}
+
+// detectPublicAddresses finds the host's public IPv4 and IPv6 address. The
+// interfaces are inspected first. Behind NAT they only hold private
+// addresses, so with -public-ip-check the address the outside sees is asked
+// from a STUN server or an HTTP service, and wins over the interfaces.
+func detectPublicAddresses() (v4, v6 string) {
+	for _, addr := range hostAddresses() {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip.IsPrivate():
+		case ip.To4() != nil && v4 == "":
+			v4 = addr
+		case ip.To4() == nil && v6 == "":
+			v6 = addr
+		}
+	}
+	if PublicIPCheck == "" {
+		return v4, v6
+	}
+
+	for _, family := range []string{"4", "6"} {
+		ip, err := checkPublicIP(family)
+		if err != nil {
+			verbosef("Public IPv%s address check with %s: %v", family, PublicIPCheck, err)
+			continue
+		}
+		found := &v4
+		if family == "6" {
+			found = &v6
+		}
+		if *found != "" && *found != ip.String() {
+			infof("Public IPv%s address %s differs from the interface address %s, the host is behind NAT", family, ip, *found)
+		}
+		*found = ip.String()
+	}
+	return v4, v6
+}
+
+// checkPublicIP asks the -public-ip-check service for the address the host
+// connects from over IPv4 or IPv6. The request goes out directly, not
+// through -proxy, which would report the proxy's address.
+func checkPublicIP(family string) (net.IP, error) {
+	var ip net.IP
+	var err error
+	if strings.HasPrefix(PublicIPCheck, "http") {
+		ip, err = httpPublicIP("tcp"+family, PublicIPCheck)
+	} else {
+		server := strings.TrimPrefix(PublicIPCheck, "stun:")
+		if PublicIPCheck == "stun" {
+			server = defaultSTUNServer
+		}
+		ip, err = stunPublicIP("udp"+family, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if (ip.To4() != nil) != (family == "4") || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil, fmt.Errorf("%s isn't a public IPv%s address", ip, family)
+	}
+	return ip, nil
+}
+
+// httpPublicIP fetches a service answering with the client's address as
+// plain text, such as https://api.ipify.org.
+func httpPublicIP(network, service string) (net.IP, error) {
+	dialer := &net.Dialer{Timeout: publicIPTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	client := &http.Client{Timeout: publicIPTimeout, Transport: transport}
+	resp, err := client.Get(service)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", service, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s: not an IP address: %q", service, body)
+	}
+	return ip, nil
+}
+
+// stunPublicIP sends a STUN binding request (RFC 5389) and returns the
+// mapped address of the response.
+func stunPublicIP(network, server string) (net.IP, error) {
+	conn, err := net.DialTimeout(network, server, publicIPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(publicIPTimeout))
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], 0x0001)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	if _, err := rand.Read(request[8:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 1500)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	response = response[:n]
+	if n < 20 || binary.BigEndian.Uint16(response) != 0x0101 || !bytes.Equal(response[4:20], request[4:20]) {
+		return nil, fmt.Errorf("%s: unexpected STUN response", server)
+	}
+
+	var mapped net.IP
+	attrs := response[20:]
+	for len(attrs) >= 4 {
+		kind := binary.BigEndian.Uint16(attrs)
+		length := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+length > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+length]
+		switch kind {
+		case 0x0020, 0x8020:
+			// XOR-MAPPED-ADDRESS, xored with the cookie and transaction ID.
+			if ip := stunAddress(value); ip != nil {
+				for i := range ip {
+					ip[i] ^= request[4+i]
+				}
+				return ip, nil
+			}
+		case 0x0001:
+			mapped = stunAddress(value)
+		}
+		next := 4 + (length+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("%s: no mapped address in the STUN response", server)
+	}
+	return mapped, nil
+}
+
+// stunAddress reads the address of a STUN address attribute: a reserved
+// byte, the family, the port and the address.
+func stunAddress(value []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	size := map[byte]int{1: net.IPv4len, 2: net.IPv6len}[value[1]]
+	if size == 0 || len(value) < 4+size {
+		return nil
+	}
+	return append(net.IP(nil), value[4:4+size]...)
+}
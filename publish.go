@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	publishQueueSize     = 4096
+	maxPublishRetryDelay = 30 * time.Second
+)
+
+// publishRetryDelay is the first delay before a failed send is retried.
+var publishRetryDelay = time.Second
+
+var (
+	KafkaBrokers string
+	KafkaTopic   string
+	NATSURL      string
+	NATSSubject  string
+)
+
+// interactionSink receives every recorded interaction.
+type interactionSink interface {
+	Write(*Interaction)
+}
+
+// publisher decouples a network sink from the request handlers. Interactions
+// are queued and sent from a single goroutine, so a slow or unreachable
+// broker never delays a DNS answer or HTTP response.
+type publisher struct {
+	name  string
+	queue *sinkQueue
+	send  func(*Interaction) error
+	retry bool
+}
+
+func newPublisher(name string, send func(*Interaction) error) *publisher {
+	p := &publisher{name: name, queue: newSinkQueue(name, publishQueueSize), send: send}
+	go p.run()
+	return p
+}
+
+// newRetryingPublisher is a publisher for stores and brokers, whose send
+// errors are mostly outages worth waiting out.
+func newRetryingPublisher(name string, send func(*Interaction) error) *publisher {
+	p := &publisher{name: name, queue: newSinkQueue(name, publishQueueSize), send: send, retry: true}
+	go p.run()
+	return p
+}
+
+func (p *publisher) Write(i *Interaction) {
+	p.queue.offer(i)
+}
+
+// permanentError marks a send error that retrying can't fix, such as an
+// interaction the sink rejects.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// run sends the queued interactions in order. With retry, a failed send is
+// retried with a growing delay until it succeeds or fails permanently, so an
+// unreachable sink holds interactions in the queue instead of losing them;
+// once the queue is full, new ones are dropped as with a slow sink.
+func (p *publisher) run() {
+	for i := range p.queue.queue {
+		for delay := publishRetryDelay; ; {
+			err := p.send(i)
+			if err == nil {
+				break
+			}
+			var permanent permanentError
+			if !p.retry || errors.As(err, &permanent) {
+				log.Printf("%s publisher: %v\n", p.name, err)
+				break
+			}
+			log.Printf("%s publisher: %v, retrying in %s\n", p.name, err, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxPublishRetryDelay {
+				delay = maxPublishRetryDelay
+			}
+		}
+	}
+}
+
+func newKafkaPublisher(brokers, topic string) *publisher {
+	writer := &kafka.Writer{
+		Addr:                   kafka.TCP(strings.Split(brokers, ",")...),
+		Topic:                  topic,
+		Balancer:               &kafka.Hash{},
+		BatchTimeout:           10 * time.Millisecond,
+		RequiredAcks:           kafka.RequireOne,
+		AllowAutoTopicCreation: true,
+	}
+
+	infof("Publishing interactions to Kafka topic %s on %s\n", topic, brokers)
+	return newRetryingPublisher("Kafka", func(i *Interaction) error {
+		value, err := json.Marshal(i)
+		if err != nil {
+			return permanentError{err}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return writer.WriteMessages(ctx, kafka.Message{Key: []byte(i.RemoteIP), Value: value, Time: i.Time})
+	})
+}
+
+func newNATSPublisher(rawURL, subject string) (*publisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported NATS URL scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn := &natsConn{url: u}
+	infof("Publishing interactions to NATS subject %s.<protocol> on %s\n", subject, u.Host)
+	return newRetryingPublisher("NATS", func(i *Interaction) error {
+		payload, err := json.Marshal(i)
+		if err != nil {
+			return permanentError{err}
+		}
+		return conn.publish(subject+"."+i.Protocol, payload)
+	}), nil
+}
+
+// natsConn speaks just enough of the NATS client protocol to publish. It is
+// only used from the publisher goroutine and reconnects on the next publish
+// after an error.
+type natsConn struct {
+	url  *url.URL
+	conn net.Conn
+}
+
+func (c *natsConn) publish(subject string, payload []byte) error {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := fmt.Fprintf(c.conn, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *natsConn) connect() error {
+	conn, err := net.DialTimeout("tcp", c.url.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting from %s: %q %v", c.url.Host, info, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "cowitness", "lang": "go", "version": Version}
+	if c.url.User != nil {
+		if password, ok := c.url.User.Password(); ok {
+			options["user"] = c.url.User.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = c.url.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// The server pings idle clients and drops them if they don't answer.
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				fmt.Fprint(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "-ERR"):
+				log.Printf("NATS publisher: %s\n", strings.TrimSpace(line))
+			}
+		}
+	}()
+
+	c.conn = conn
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPublisherRetriesUntilSent(t *testing.T) {
+	defer func(delay time.Duration) { publishRetryDelay = delay }(publishRetryDelay)
+	publishRetryDelay = time.Millisecond
+
+	sent := make(chan string, 10)
+	attempts := 0
+	p := newRetryingPublisher("test retry", func(i *Interaction) error {
+		if attempts++; attempts < 3 {
+			return errors.New("connection refused")
+		}
+		sent <- i.ID
+		return nil
+	})
+	p.Write(&Interaction{ID: "first"})
+	select {
+	case id := <-sent:
+		if id != "first" || attempts != 3 {
+			t.Errorf("sent %s after %d attempts", id, attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("interaction never sent")
+	}
+}
+
+func TestPublisherDropsPermanentErrors(t *testing.T) {
+	sent := make(chan string, 10)
+	p := newRetryingPublisher("test permanent", func(i *Interaction) error {
+		if i.ID == "bad" {
+			return permanentError{errors.New("rejected")}
+		}
+		sent <- i.ID
+		return nil
+	})
+	p.Write(&Interaction{ID: "bad"})
+	p.Write(&Interaction{ID: "good"})
+	select {
+	case id := <-sent:
+		if id != "good" {
+			t.Errorf("sent %s, want good", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue blocked behind a permanent error")
+	}
+}
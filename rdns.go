@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reverseDNSCacheTTL     = 10 * time.Minute
+	reverseDNSMaxCacheSize = 100000
+)
+
+var (
+	ReverseDNS        bool
+	ReverseDNSTimeout time.Duration
+)
+
+// reverseDNSEnricher records the PTR names of an interaction's source
+// address under "rdns", which often names the cloud provider, ISP or mail
+// relay behind a callback faster than a WHOIS lookup.
+type reverseDNSEnricher struct {
+	mu    sync.Mutex
+	cache map[string]reverseDNSEntry
+}
+
+type reverseDNSEntry struct {
+	names   string
+	expires time.Time
+}
+
+func newReverseDNSEnricher() *reverseDNSEnricher {
+	return &reverseDNSEnricher{cache: make(map[string]reverseDNSEntry)}
+}
+
+func (e *reverseDNSEnricher) name() string { return "rdns" }
+
+func (e *reverseDNSEnricher) timeout() time.Duration { return ReverseDNSTimeout }
+
+func (e *reverseDNSEnricher) applies(i *Interaction) bool {
+	return net.ParseIP(i.RemoteIP) != nil && i.Enrichment["rdns"] == ""
+}
+
+func (e *reverseDNSEnricher) enrich(ctx context.Context, i *Interaction) (func(*Interaction), error) {
+	e.mu.Lock()
+	entry, ok := e.cache[i.RemoteIP]
+	e.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		names, err := net.DefaultResolver.LookupAddr(ctx, i.RemoteIP)
+		if dnsErr, ok := err.(*net.DNSError); err != nil && !(ok && dnsErr.IsNotFound) {
+			return nil, err
+		}
+		for n, name := range names {
+			names[n] = strings.TrimSuffix(name, ".")
+		}
+		entry = reverseDNSEntry{strings.Join(names, ", "), time.Now().Add(reverseDNSCacheTTL)}
+		e.mu.Lock()
+		if len(e.cache) >= reverseDNSMaxCacheSize {
+			e.cache = make(map[string]reverseDNSEntry)
+		}
+		e.cache[i.RemoteIP] = entry
+		e.mu.Unlock()
+	}
+	return func(i *Interaction) { setEnrichment(i, "rdns", entry.names) }, nil
+}
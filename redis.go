@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const maxRedisArgs = 1024
+
+// serveRedis speaks enough RESP to look like an open Redis server. Commands
+// are answered with plausible replies and recorded, so SSRF chains that write
+// cron jobs, SSH keys or modules through CONFIG SET and SAVE can be confirmed.
+// Inline commands, as sent through gopher:// or HTTP smuggling, are accepted
+// too.
+func serveRedis(s *moduleSession) {
+	for {
+		args, err := readRedisCommand(s)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			s.record("AUTH")
+		} else {
+			s.record(quoteArgs(args))
+		}
+
+		var reply string
+		switch command {
+		case "AUTH":
+			switch len(args) {
+			case 2:
+				s.credentials("default", args[1])
+			case 3:
+				s.credentials(args[1], args[2])
+			}
+			reply = "+OK"
+		case "PING":
+			reply = "+PONG"
+		case "ECHO":
+			if len(args) > 1 {
+				reply = redisBulk(args[1])
+			}
+		case "GET", "HGET", "LPOP", "RPOP":
+			reply = "$-1"
+		case "EXISTS", "DEL", "DBSIZE", "INCR", "DECR":
+			reply = ":0"
+		case "KEYS", "SCAN", "HGETALL", "LRANGE", "SMEMBERS":
+			reply = "*0"
+		case "INFO":
+			reply = redisBulk("# Server\r\nredis_version:6.2.14\r\nredis_mode:standalone\r\nos:Linux 5.15.0-91-generic x86_64\r\ntcp_port:6379\r\n\r\n# Replication\r\nrole:master\r\nconnected_slaves:0\r\n")
+		case "CONFIG":
+			if len(args) > 2 && strings.EqualFold(args[1], "GET") {
+				reply = "*2\r\n" + redisBulk(args[2]) + "\r\n" + redisBulk("")
+			} else {
+				reply = "+OK"
+			}
+		case "QUIT":
+			s.reply("+OK")
+			return
+		default:
+			// SET, CONFIG SET, SAVE, SLAVEOF, MODULE LOAD and the rest
+			// pretend to succeed.
+			reply = "+OK"
+		}
+		if reply == "" {
+			reply = fmt.Sprintf("-ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+		}
+		if s.reply(reply) != nil {
+			return
+		}
+	}
+}
+
+// readRedisCommand reads a RESP array of bulk strings or an inline command.
+func readRedisCommand(s *moduleSession) ([]string, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxRedisArgs {
+		return nil, fmt.Errorf("invalid multibulk length %q", line)
+	}
+	args := make([]string, 0, n)
+	for ; n > 0; n-- {
+		header, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.TrimPrefix(header, "$"), 10, 64)
+		if !strings.HasPrefix(header, "$") || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length %q", header)
+		}
+		arg, err := s.readBlock(size + 2)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func redisBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s", len(value), value)
+}
+
+// quoteArgs joins command arguments for the transcript, quoting the ones that
+// would otherwise be ambiguous.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for n, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n\"") || strconv.Quote(arg) != `"`+arg+`"` {
+			arg = strconv.Quote(arg)
+		}
+		quoted[n] = arg
+	}
+	return strings.Join(quoted, " ")
+}
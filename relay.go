@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+var (
+	RelayAddr     string
+	RelayCert     string
+	RelayKey      string
+	RelayClientCA string
+)
+
+// runRelay implements the "relay" subcommand. A relay exposes no DNS or HTTP
+// listeners of its own: edge nodes forward their interactions to it over
+// mTLS, and it keeps the store, the operator API and the canary tokens, so
+// the data never lives on the internet facing machines.
+func runRelay() {
+	parseFlags()
+	displayBanner()
+
+	if RelayCert == "" || RelayKey == "" || RelayClientCA == "" {
+		log.Fatalf("Relay mode needs -relay-cert, -relay-key and -relay-client-ca")
+	}
+	if APIAddr == "" {
+		log.Fatalf("Relay mode needs -api-addr")
+	}
+	lock := lockInstance(InstanceLock)
+	defer lock.Close()
+
+	if !flagGiven("dns-name") {
+		prompt("Enter the DNS response name: ")
+		fmt.Scanln(&DNSResponseName)
+	}
+	normalizeDNSResponse()
+	if errs := checkDNSResponse(false); len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
+		}
+		log.Fatalf("Refusing to start with an invalid DNS configuration")
+	}
+
+	alertLogFile := openLogFile("./alerts.log")
+	defer alertLogFile.Close()
+	alertLogger := log.New(alertLogFile, "", log.LstdFlags)
+	tokens, err := newTokenStore(TokenStore, alertLogger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go tokens.watch()
+
+	eventLogFile := openLogFile(EventLogFile)
+	defer eventLogFile.Close()
+	store, err := openInteractionStore(StoreURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	arming = newEngagementArming(ArmingFile)
+	go arming.watch()
+	bus := newEventBus(eventLogFile, store)
+	wal := startWriteAheadLog()
+	rules := newRuleEngine(AlertRules, alertLogger, wal.commit(bus))
+	go rules.watch()
+	signatures := newSignatureTagger(SignatureFile, rules)
+	go signatures.watch()
+	events := wal.start(store, &tokenCorrelator{tokens: tokens, next: signatures})
+
+	if err := startRelayIngest(RelayAddr, events); err != nil {
+		log.Fatal(err)
+	}
+	users, err := newUserStore(UserStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ensureAPIToken(users)
+	startAPIServer(APIAddr, APIToken, &apiServices{tokens: tokens, store: store, events: events, bus: bus, users: users, audit: openAuditLog(AuditLogFile)})
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+}
+
+// startRelayIngest serves the ingest endpoint to edge nodes holding a client
+// certificate signed by -relay-client-ca.
+func startRelayIngest(addr string, events interactionSink) error {
+	tlsConfig, err := serverTLSConfig(RelayCert, RelayKey, RelayClientCA)
+	if err != nil {
+		return fmt.Errorf("relay certificate: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/ingest", handleIngest(events))
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		infof("Accepting forwarded interactions on %s\n", addr)
+		err := server.ListenAndServeTLS("", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// tokenCorrelator fires the relay's canary tokens for forwarded interactions,
+// so tokens can be minted centrally without copying tokens.json to every edge.
+type tokenCorrelator struct {
+	tokens *tokenStore
+	next   interactionSink
+}
+
+func (c *tokenCorrelator) Write(i *Interaction) {
+	if i.Token == "" {
+		var t *CanaryToken
+		var detail string
+		switch i.Protocol {
+		case "dns":
+			t = c.tokens.matchDNS(i.QName)
+			detail = i.QType + " " + i.QName
+		case "http":
+			t = c.tokens.matchURL(i.Path)
+			detail = fmt.Sprintf("%s %s, User agent: %s", i.Method, i.Path, i.UserAgent)
+		}
+		if t != nil {
+			i.Token = t.ID
+			c.tokens.fire(t, strings.ToUpper(i.Protocol), i.RemoteIP, detail+", Node: "+i.Node)
+		}
+	}
+	c.next.Write(i)
+}
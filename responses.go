@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ResponseRules = "./response-rules.json"
+
+// responseRule answers HTTP requests matching all of its conditions with a
+// canned response instead of the file server, e.g. a tasking payload for
+// requests carrying an implant's header and a 404 for everyone else. Path,
+// header and body conditions are regular expressions, the body is matched
+// after its Content-Encoding is undone. Script names a function of
+// hooks.lua that gets the request like on_http does and decides with its
+// return value, for conditions the other fields can't express.
+type responseRule struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	CIDRs   []string          `json:"cidrs,omitempty"`
+	Script  string            `json:"script,omitempty"`
+	Respond responseAction    `json:"respond"`
+
+	path     *regexp.Regexp
+	headers  map[string]*regexp.Regexp
+	body     *regexp.Regexp
+	networks []*net.IPNet
+}
+
+// responseAction is what a matching rule answers with. File is read when
+// the request is served and takes precedence over Body. Body is a template
+// that can echo what the server observed, e.g. {{.ClientIP}} or {{.Token}};
+// files are served as they are.
+type responseAction struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	File    string            `json:"file,omitempty"`
+}
+
+func loadResponseRules(path string) ([]*responseRule, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*responseRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("%s: every rule needs a name", path)
+		}
+		if rule.path, err = compileOptional(rule.Path); err != nil {
+			return nil, fmt.Errorf("%s: %s: path: %v", path, rule.Name, err)
+		}
+		if rule.body, err = compileOptional(rule.Body); err != nil {
+			return nil, fmt.Errorf("%s: %s: body: %v", path, rule.Name, err)
+		}
+		rule.headers = make(map[string]*regexp.Regexp)
+		for name, expr := range rule.Headers {
+			if rule.headers[name], err = regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("%s: %s: header %s: %v", path, rule.Name, name, err)
+			}
+		}
+		for _, cidr := range rule.CIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, rule.Name, err)
+			}
+			rule.networks = append(rule.networks, network)
+		}
+		if status := rule.Respond.Status; status != 0 && (status < 100 || status > 999) {
+			return nil, fmt.Errorf("%s: %s: invalid status %d", path, rule.Name, status)
+		}
+		if err := checkResponseTemplate(rule.Respond.Body); err != nil {
+			return nil, fmt.Errorf("%s: %s: body: %v", path, rule.Name, err)
+		}
+		if rule.Respond.File != "" {
+			if _, err := os.Stat(rule.Respond.File); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, rule.Name, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func compileOptional(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// matches checks the conditions from cheapest to dearest; the body is only
+// captured once a rule gets that far.
+func (rule *responseRule) matches(r *http.Request, scripts *scriptHooks) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	for name, re := range rule.headers {
+		if !re.MatchString(strings.Join(r.Header.Values(name), ", ")) {
+			return false
+		}
+	}
+	if len(rule.networks) > 0 {
+		ip := net.ParseIP(remoteIP(r))
+		allowed := false
+		for _, network := range rule.networks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if rule.body != nil {
+		body, _ := captureBody(r)
+		text := decodeBody(body, r.Header.Get("Content-Encoding"))
+		if text == "" {
+			text = bodyText(body)
+		}
+		if !rule.body.MatchString(text) {
+			return false
+		}
+	}
+	if rule.Script != "" {
+		return scripts != nil && scripts.test(rule.Script, r)
+	}
+	return true
+}
+
+// responseRules serves the rules of response-rules.json in front of the
+// other HTTP handlers, the first matching rule answers. The file is
+// reloaded when it changes, and a broken file keeps the previous rules.
+type responseRules struct {
+	mu      sync.Mutex
+	path    string
+	rules   []*responseRule
+	mod     time.Time
+	scripts *scriptHooks
+	tokens  *tokenStore
+}
+
+func newResponseRules(path string, scripts *scriptHooks, tokens *tokenStore) *responseRules {
+	rr := &responseRules{path: path, scripts: scripts, tokens: tokens}
+	rr.reload()
+	return rr
+}
+
+func (rr *responseRules) reload() {
+	var mod time.Time
+	if info, err := os.Stat(rr.path); err == nil {
+		mod = info.ModTime()
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if mod.Equal(rr.mod) {
+		return
+	}
+
+	rules, err := loadResponseRules(rr.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	rr.rules = rules
+	rr.mod = mod
+	infof("Loaded %d response rule(s)\n", len(rules))
+}
+
+func (rr *responseRules) watch() {
+	for range time.Tick(tokenScanTime) {
+		rr.reload()
+	}
+}
+
+// handler answers requests matching a rule and passes the others to next.
+// Answered requests are still recorded with recordRequest, and the rule's
+// templates see the interaction as recorded. A canary token URL a rule
+// answers still fires the token.
+func (rr *responseRules) handler(recordRequest func(*http.Request) *Interaction, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr.mu.Lock()
+		rules := rr.rules
+		rr.mu.Unlock()
+
+		for _, rule := range rules {
+			if !rule.matches(r, rr.scripts) {
+				continue
+			}
+			i := recordRequest(r)
+			rr.tokens.fireURL(r)
+			rule.Respond.serve(w, rule.Name, i)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *responseAction) serve(w http.ResponseWriter, name string, i *Interaction) {
+	body := []byte(expandResponse(a.Body, i))
+	if a.File != "" {
+		var err error
+		if body, err = os.ReadFile(a.File); err != nil {
+			log.Printf("Response rule %s: %v\n", name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	for name, value := range a.Headers {
+		w.Header().Set(name, value)
+	}
+	status := a.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
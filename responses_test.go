@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestResponseRuleTemplatesRecordedInteraction(t *testing.T) {
+	dir := t.TempDir()
+	var alerts strings.Builder
+	tokens, err := newTokenStore(filepath.Join(dir, "tokens.json"), log.New(&alerts, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.mint("url", "rule test", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := &responseRules{tokens: tokens, rules: []*responseRule{{
+		Name:    "echo",
+		path:    regexp.MustCompile("^" + TokenURLPrefix),
+		Respond: responseAction{Body: "{{.ID}} {{.Token}}"},
+	}}}
+
+	var recorded *Interaction
+	record := func(r *http.Request) *Interaction {
+		recorded = newHTTPInteraction(r)
+		recorded.Token = token.ID
+		return recorded
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request passed on to the next handler")
+	})
+	rec := httptest.NewRecorder()
+	rr.handler(record, next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, TokenURLPrefix+token.ID, nil))
+
+	if recorded == nil {
+		t.Fatal("request not recorded")
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if want := recorded.ID + " " + token.ID; string(body) != want {
+		t.Errorf("answered %q, want %q", body, want)
+	}
+	if !strings.Contains(alerts.String(), "Token: "+token.ID) {
+		t.Errorf("token answered by a rule didn't fire: %q", alerts.String())
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	rrlMaxBuckets     = 100000
+	rrlSweepInterval  = time.Minute
+	rrlReportInterval = time.Minute
+)
+
+var (
+	DNSRateLimit int
+	DNSRateSlip  int
+	DNSMinimal   bool
+)
+
+// dnsRateLimiter limits the UDP responses of the DNS server, nil when
+// -dns-rate-limit is off.
+var dnsRateLimiter *responseRateLimiter
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// responseRateLimiter implements response rate limiting, so a DNS server on
+// a public address can't be used to reflect and amplify traffic at a victim
+// whose address is spoofed in the queries. Over UDP, responses to one client
+// network (a /24 for IPv4, a /56 for IPv6) of the same type and rcode are
+// limited to -dns-rate-limit per second, with a second's worth of burst. As
+// the zone is a wildcard, the query name is left out of the key, or random
+// labels would get around the limit. Every -dns-rate-slip'th limited
+// response is sent as an empty truncated reply instead of being dropped, so
+// a real resolver behind a busy network retries over TCP, which can't be
+// spoofed and isn't limited. The queries themselves are still recorded.
+// Once rrlMaxBuckets client networks are tracked, the networks without a
+// bucket share the overflow bucket until the sweep makes room, so a flood
+// from spoofed networks is still limited.
+type responseRateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	slip     int
+	buckets  map[string]*rrlBucket
+	overflow rrlBucket
+	dropped  int
+	slipped  int
+}
+
+type rrlBucket struct {
+	tokens  float64
+	last    time.Time
+	limited int
+}
+
+func newResponseRateLimiter(rate, slip int) *responseRateLimiter {
+	l := &responseRateLimiter{rate: float64(rate), slip: slip, buckets: make(map[string]*rrlBucket)}
+	go l.sweep()
+	go l.report()
+	infof("Limiting DNS responses over UDP to %d per second per client network\n", rate)
+	return l
+}
+
+// limit decides whether response goes out to the client at addr.
+func (l *responseRateLimiter) limit(addr net.Addr, r, response *dns.Msg) rrlAction {
+	if l == nil || len(r.Question) == 0 {
+		return rrlSend
+	}
+	key := rrlPrefix(addr) + "/" + dns.TypeToString[r.Question[0].Qtype] + "/" + dns.RcodeToString[response.Rcode]
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= rrlMaxBuckets {
+			b = &l.overflow
+		} else {
+			b = &rrlBucket{tokens: l.rate, last: now}
+			l.buckets[key] = b
+		}
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return rrlSend
+	}
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		l.slipped++
+		return rrlSlip
+	}
+	l.dropped++
+	return rrlDrop
+}
+
+// rrlPrefix returns the client network of addr.
+func rrlPrefix(addr net.Addr) string {
+	ip := net.ParseIP(addrIP(addr))
+	if ip == nil {
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
+
+// sweep forgets the clients that have been quiet long enough for their
+// bucket to be full again.
+func (l *responseRateLimiter) sweep() {
+	for range time.Tick(rrlSweepInterval) {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.last) > time.Second {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// report logs how many responses were limited, once a minute while it
+// happens.
+func (l *responseRateLimiter) report() {
+	for range time.Tick(rrlReportInterval) {
+		l.mu.Lock()
+		dropped, slipped := l.dropped, l.slipped
+		l.dropped, l.slipped = 0, 0
+		l.mu.Unlock()
+		if dropped > 0 || slipped > 0 {
+			log.Printf("DNS rate limit: dropped %d and truncated %d response(s) in the last %s\n", dropped, slipped, rrlReportInterval)
+		}
+	}
+}
+
+// minimizeDNSResponse leaves out everything a response doesn't need to
+// answer the question, for -dns-minimal: the authority and additional
+// sections, and the records of ANY queries, which get the single HINFO
+// record of RFC 8482 instead.
+func minimizeDNSResponse(r, response *dns.Msg) {
+	response.Ns, response.Extra = nil, nil
+	if len(r.Question) > 0 && r.Question[0].Qtype == dns.TypeANY && response.Rcode == dns.RcodeSuccess {
+		response.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(DefaultTTL)},
+			Cpu: "RFC8482",
+		}}
+	}
+}
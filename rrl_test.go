@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func rrlQuery() (*dns.Msg, *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetQuestion("x.example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(r)
+	return r, response
+}
+
+func TestRateLimit(t *testing.T) {
+	l := &responseRateLimiter{rate: 2, buckets: make(map[string]*rrlBucket)}
+	r, response := rrlQuery()
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+
+	want := []rrlAction{rrlSend, rrlSend, rrlDrop}
+	for n, action := range want {
+		if got := l.limit(client, r, response); got != action {
+			t.Errorf("response %d: got %v, want %v", n, got, action)
+		}
+	}
+	if got := l.limit(neighbour, r, response); got != rrlDrop {
+		t.Errorf("same /24: got %v, want drop", got)
+	}
+	if got := l.limit(other, r, response); got != rrlSend {
+		t.Errorf("other network: got %v, want send", got)
+	}
+	if l.dropped != 2 {
+		t.Errorf("%d dropped, want 2", l.dropped)
+	}
+}
+
+func TestRateLimitSlip(t *testing.T) {
+	l := &responseRateLimiter{rate: 1, slip: 2, buckets: make(map[string]*rrlBucket)}
+	r, response := rrlQuery()
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}
+
+	want := []rrlAction{rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for n, action := range want {
+		if got := l.limit(client, r, response); got != action {
+			t.Errorf("response %d: got %v, want %v", n, got, action)
+		}
+	}
+	if l.dropped != 2 || l.slipped != 2 {
+		t.Errorf("%d dropped and %d slipped, want 2 and 2", l.dropped, l.slipped)
+	}
+}
+
+func TestRateLimitFullTable(t *testing.T) {
+	l := &responseRateLimiter{rate: 1, buckets: make(map[string]*rrlBucket)}
+	for n := 0; n < rrlMaxBuckets; n++ {
+		l.buckets[fmt.Sprint(n)] = &rrlBucket{}
+	}
+	r, response := rrlQuery()
+
+	// New networks share the overflow bucket instead of going unlimited.
+	first := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	second := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	if got := l.limit(first, r, response); got != rrlSend {
+		t.Errorf("first network: got %v, want send", got)
+	}
+	if got := l.limit(second, r, response); got != rrlDrop {
+		t.Errorf("second network: got %v, want drop", got)
+	}
+	if len(l.buckets) != rrlMaxBuckets {
+		t.Errorf("%d buckets, want %d", len(l.buckets), rrlMaxBuckets)
+	}
+}
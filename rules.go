@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AlertRules = "./alert-rules.json"
+
+// alertRule raises an alert for interactions whose field matches. Exactly one
+// of Regex, Contains or Label is set; Label matches a whole DNS label.
+type alertRule struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol,omitempty"`
+	Field    string `json:"field"`
+	Regex    string `json:"regex,omitempty"`
+	Contains string `json:"contains,omitempty"`
+	Label    string `json:"label,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// ruleFields are the interaction fields rules can look at.
+var ruleFields = map[string]func(*Interaction) string{
+	"remote_ip":     func(i *Interaction) string { return i.RemoteIP },
+	"node":          func(i *Interaction) string { return i.Node },
+	"qname":         func(i *Interaction) string { return i.QName },
+	"qtype":         func(i *Interaction) string { return i.QType },
+	"method":        func(i *Interaction) string { return i.Method },
+	"host":          func(i *Interaction) string { return i.Host },
+	"path":          func(i *Interaction) string { return i.Path },
+	"query":         func(i *Interaction) string { return i.Query },
+	"user_agent":    func(i *Interaction) string { return i.UserAgent },
+	"body":          func(i *Interaction) string { return i.Body },
+	"decoded_body":  func(i *Interaction) string { return i.DecodedBody },
+	"user":          func(i *Interaction) string { return i.User },
+	"data":          func(i *Interaction) string { return i.Data },
+	"ja3":           func(i *Interaction) string { return i.JA3 },
+	"tls_handshake": func(i *Interaction) string { return i.TLSHandshake },
+	"verdict":       func(i *Interaction) string { return i.Verdict },
+}
+
+func loadAlertRules(path string) ([]*alertRule, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*alertRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("%s: every rule needs a name", path)
+		}
+		if _, ok := ruleFields[rule.Field]; !ok {
+			return nil, fmt.Errorf("%s: %s: unknown field %q", path, rule.Name, rule.Field)
+		}
+		if rule.Regex != "" {
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, rule.Name, err)
+			}
+		} else if rule.Contains == "" && rule.Label == "" {
+			return nil, fmt.Errorf("%s: %s: needs a regex, contains or label", path, rule.Name)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *alertRule) matches(i *Interaction) bool {
+	if rule.Protocol != "" && rule.Protocol != i.Protocol {
+		return false
+	}
+	value := ruleFields[rule.Field](i)
+	switch {
+	case rule.regex != nil:
+		return rule.regex.MatchString(value)
+	case rule.Contains != "":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(rule.Contains))
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+		if strings.EqualFold(label, rule.Label) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleEngine evaluates the alert rules against every interaction before it
+// reaches the other sinks. Matches are tagged "rule:<name>", so the rules
+// double as saved searches through the tag filter of the API.
+type ruleEngine struct {
+	mu     sync.Mutex
+	path   string
+	rules  []*alertRule
+	mod    time.Time
+	alerts *log.Logger
+	next   interactionSink
+}
+
+func newRuleEngine(path string, alerts *log.Logger, next interactionSink) *ruleEngine {
+	e := &ruleEngine{path: path, alerts: alerts, next: next}
+	e.reload()
+	return e
+}
+
+func (e *ruleEngine) reload() {
+	var mod time.Time
+	if info, err := os.Stat(e.path); err == nil {
+		mod = info.ModTime()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if mod.Equal(e.mod) {
+		return
+	}
+
+	// Keep the previous rules when the file is broken.
+	rules, err := loadAlertRules(e.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	e.rules = rules
+	e.mod = mod
+	infof("Loaded %d alert rule(s)\n", len(rules))
+}
+
+func (e *ruleEngine) watch() {
+	for range time.Tick(tokenScanTime) {
+		e.reload()
+	}
+}
+
+func (e *ruleEngine) Write(i *Interaction) {
+	if !i.Noise {
+		e.mu.Lock()
+		rules := e.rules
+		e.mu.Unlock()
+
+		// Disarmed engagements are still tagged, but don't alert.
+		armed := arming.armed(i.Engagement)
+		for _, rule := range rules {
+			if !rule.matches(i) {
+				continue
+			}
+			if tag := "rule:" + rule.Name; !hasTag(i, tag) {
+				i.Tags = append(i.Tags, tag)
+			}
+			detail := ruleFields[rule.Field](i)
+			if len(detail) > 200 {
+				detail = detail[:200] + "..."
+			}
+			if !armed {
+				continue
+			}
+			e.alerts.Printf("Rule: %s, Protocol: %s, IP address: %s, Interaction: %s, %s: %q\n", rule.Name, strings.ToUpper(i.Protocol), i.RemoteIP, i.ID, rule.Field, detail)
+			log.Printf("ALERT: rule %s matched %s interaction %s from %s\n", rule.Name, strings.ToUpper(i.Protocol), i.ID, i.RemoteIP)
+		}
+	}
+	e.next.Write(i)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// screenshotReuse is how long a page's screenshot is attached to further
+// callbacks from it instead of taking a new one, as a blind XSS payload fires
+// again every time the page is viewed.
+const screenshotReuse = time.Hour
+
+var (
+	ScreenshotChrome  string
+	ScreenshotDir     string
+	ScreenshotTimeout time.Duration
+)
+
+// screenshotter attaches a screenshot of the page an HTTP callback came from,
+// taken with headless Chrome, to the interaction: the Referer, or the Origin
+// without one. That page is usually where a blind XSS payload fired, an admin
+// panel or support tool the callback alone says little about. Pages on
+// loopback and private addresses are never fetched, so a forged Referer
+// can't point Chrome at the callback host's own network.
+type screenshotter struct {
+	mu    sync.Mutex
+	taken map[string]screenshotEntry
+}
+
+type screenshotEntry struct {
+	file string
+	time time.Time
+}
+
+func newScreenshotter() *screenshotter {
+	if err := os.MkdirAll(ScreenshotDir, 0700); err != nil {
+		log.Fatalf("Screenshot directory: %v", err)
+	}
+	infof("Taking screenshots of referring pages with %s into %s\n", ScreenshotChrome, ScreenshotDir)
+	return &screenshotter{taken: make(map[string]screenshotEntry)}
+}
+
+func (s *screenshotter) name() string { return "screenshot" }
+
+func (s *screenshotter) timeout() time.Duration { return ScreenshotTimeout }
+
+func (s *screenshotter) applies(i *Interaction) bool { return screenshotURL(i) != "" }
+
+func (s *screenshotter) enrich(ctx context.Context, i *Interaction) (func(*Interaction), error) {
+	page := screenshotURL(i)
+	file, err := s.screenshot(ctx, page, i.ID)
+	if err != nil {
+		return nil, fmt.Errorf("screenshot of %s: %v", page, err)
+	}
+	return func(i *Interaction) { i.Screenshot = file }, nil
+}
+
+// screenshot returns the file name, within -screenshot-dir, of a screenshot
+// of page, taking it unless one was taken recently.
+func (s *screenshotter) screenshot(ctx context.Context, page, id string) (string, error) {
+	s.mu.Lock()
+	for key, entry := range s.taken {
+		if time.Since(entry.time) > screenshotReuse {
+			delete(s.taken, key)
+		}
+	}
+	entry, ok := s.taken[page]
+	s.mu.Unlock()
+	if ok {
+		return entry.file, nil
+	}
+
+	if err := checkScreenshotHost(ctx, page); err != nil {
+		return "", err
+	}
+	file := id + ".png"
+	profile, err := os.MkdirTemp("", "cowitness-chrome-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(profile)
+
+	args := []string{
+		"--headless=new", "--disable-gpu", "--no-sandbox", "--hide-scrollbars", "--mute-audio",
+		"--no-first-run", "--disable-extensions", "--disable-background-networking",
+		"--user-data-dir=" + profile, "--window-size=1280,800",
+		fmt.Sprintf("--timeout=%d", (ScreenshotTimeout * 3 / 4).Milliseconds()),
+		"--screenshot=" + filepath.Join(ScreenshotDir, file),
+	}
+	if OutboundProxy != "" {
+		args = append(args, "--proxy-server="+OutboundProxy)
+	}
+	out, err := exec.CommandContext(ctx, ScreenshotChrome, append(args, page)...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(lastLine(string(out))))
+	}
+	if _, err := os.Stat(filepath.Join(ScreenshotDir, file)); err != nil {
+		return "", fmt.Errorf("chrome saved no screenshot: %s", strings.TrimSpace(lastLine(string(out))))
+	}
+
+	s.mu.Lock()
+	s.taken[page] = screenshotEntry{file, time.Now()}
+	s.mu.Unlock()
+	return file, nil
+}
+
+// screenshotURL returns the page to take a screenshot of for an interaction,
+// or "" when there is none: not an HTTP request, no Referer or Origin, or one
+// of CoWitness's own pages, as when a payload loads another.
+func screenshotURL(i *Interaction) string {
+	if i.Protocol != "http" || i.Noise || i.Headers == nil {
+		return ""
+	}
+	page := i.Headers.Get("Referer")
+	if page == "" {
+		page = i.Headers.Get("Origin")
+	}
+	u, err := url.Parse(page)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if u.Host == i.Host || host == strings.TrimSuffix(DNSResponseName, ".") || strings.HasSuffix(host+".", "."+DNSResponseName) {
+		return ""
+	}
+	return u.String()
+}
+
+// checkScreenshotHost refuses pages whose host resolves to a loopback,
+// private or link-local address.
+func checkScreenshotHost(ctx context.Context, page string) error {
+	u, err := url.Parse(page)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP; ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			return fmt.Errorf("%s resolves to %s, not fetching pages on internal addresses", u.Hostname(), ip)
+		}
+	}
+	return nil
+}
+
+// handleScreenshot serves GET /api/screenshots/<file>, the screenshot named in
+// an interaction's screenshot field.
+func handleScreenshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	file := strings.TrimPrefix(r.URL.Path, "/api/screenshots/")
+	if file == "" || file != filepath.Base(file) || filepath.Ext(file) != ".png" {
+		writeJSONError(w, http.StatusNotFound, "no such screenshot")
+		return
+	}
+	f, err := os.Open(filepath.Join(ScreenshotDir, file))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "no such screenshot")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	io.Copy(w, f)
+}
+
+// lastLine returns the last non-empty line of s, where Chrome puts its error.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	ScriptFile    = "./hooks.lua"
+	scriptTimeout = time.Second
+)
+
+// scriptHooks runs the Lua functions of hooks.lua on interactions and HTTP
+// requests, for engagement logic that doesn't deserve a rebuild:
+//
+//	on_interaction(i)  called for every interaction before the alert rules.
+//	                   Changes to i.tags, i.note, i.data and i.verdict are
+//	                   kept, returning false drops the interaction.
+//	on_http(req)       called for HTTP requests before they are served. It
+//	                   returns nil to serve the request as usual, or a table
+//	                   with status, headers and body to answer it.
+//
+// Scripts can call alert(message), log(message) and http_post(url, body,
+// content_type), which is sent in the background. A Lua state isn't safe
+// for concurrent use, so calls take turns and are cut off after
+// scriptTimeout; hooks are meant to be quick. The file is reloaded when it
+// changes, and a broken script keeps the previous one running.
+type scriptHooks struct {
+	mu     sync.Mutex
+	path   string
+	mod    time.Time
+	state  *lua.LState
+	alerts *log.Logger
+	next   interactionSink
+	client *http.Client
+}
+
+func newScriptHooks(path string, alerts *log.Logger, next interactionSink) *scriptHooks {
+	s := &scriptHooks{path: path, alerts: alerts, next: next, client: newOutboundClient(10*time.Second, nil)}
+	s.reload()
+	return s
+}
+
+func (s *scriptHooks) reload() {
+	var mod time.Time
+	if info, err := os.Stat(s.path); err == nil {
+		mod = info.ModTime()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mod.Equal(s.mod) {
+		return
+	}
+	if mod.IsZero() {
+		if s.state != nil {
+			s.state.Close()
+			s.state = nil
+			infof("Removed the hooks of %s\n", s.path)
+		}
+		s.mod = mod
+		return
+	}
+
+	state, err := s.load()
+	if err != nil {
+		log.Printf("%s: %v\n", s.path, err)
+		return
+	}
+	if s.state != nil {
+		s.state.Close()
+	}
+	s.state, s.mod = state, mod
+	infof("Loaded hooks from %s\n", s.path)
+}
+
+func (s *scriptHooks) load() (*lua.LState, error) {
+	state := lua.NewState()
+	state.SetGlobal("alert", state.NewFunction(func(L *lua.LState) int {
+		message := L.CheckString(1)
+		s.alerts.Printf("Script: %s\n", message)
+		log.Printf("ALERT: script: %s\n", message)
+		return 0
+	}))
+	state.SetGlobal("log", state.NewFunction(func(L *lua.LState) int {
+		log.Printf("Script: %s\n", L.CheckString(1))
+		return 0
+	}))
+	state.SetGlobal("http_post", state.NewFunction(func(L *lua.LState) int {
+		url, body, contentType := L.CheckString(1), L.OptString(2, ""), L.OptString(3, "application/json")
+		go func() {
+			resp, err := s.client.Post(url, contentType, strings.NewReader(body))
+			if err != nil {
+				log.Printf("Script http_post: %v\n", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return 0
+	}))
+	if err := state.DoFile(s.path); err != nil {
+		state.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+// checkScript compiles the hooks file without running it, for check.
+func checkScript(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	state := lua.NewState()
+	defer state.Close()
+	if _, err := state.LoadFile(path); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func (s *scriptHooks) watch() {
+	for range time.Tick(tokenScanTime) {
+		s.reload()
+	}
+}
+
+// call runs a hook with one table argument and returns its result, or nil
+// when the hook isn't defined or fails. The caller holds s.mu.
+func (s *scriptHooks) call(name string, arg *lua.LTable) lua.LValue {
+	fn, ok := s.state.GetGlobal(name).(*lua.LFunction)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	s.state.SetContext(ctx)
+	defer s.state.RemoveContext()
+	if err := s.state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, arg); err != nil {
+		log.Printf("%s: %s: %v\n", s.path, name, err)
+		return nil
+	}
+	ret := s.state.Get(-1)
+	s.state.Pop(1)
+	return ret
+}
+
+func (s *scriptHooks) Write(i *Interaction) {
+	s.mu.Lock()
+	keep := true
+	if s.state != nil {
+		t := interactionTable(s.state, i)
+		if s.call("on_interaction", t) == lua.LFalse {
+			keep = false
+		}
+		applyInteractionTable(t, i)
+	}
+	s.mu.Unlock()
+	if keep {
+		s.next.Write(i)
+	}
+}
+
+// interactionTable exposes an interaction to Lua, headers as a table of
+// comma joined values.
+func interactionTable(L *lua.LState, i *Interaction) *lua.LTable {
+	t := L.NewTable()
+	for name, value := range map[string]string{
+		"id": i.ID, "protocol": i.Protocol, "remote_ip": i.RemoteIP, "method": i.Method, "host": i.Host,
+		"path": i.Path, "query": i.Query, "user_agent": i.UserAgent, "body": i.Body, "user": i.User,
+		"data": i.Data, "qname": i.QName, "qtype": i.QType, "token": i.Token, "verdict": i.Verdict, "note": i.Note,
+	} {
+		t.RawSetString(name, lua.LString(value))
+	}
+	t.RawSetString("time", lua.LString(i.Time.Format(time.RFC3339Nano)))
+	t.RawSetString("port", lua.LNumber(i.Port))
+	t.RawSetString("noise", lua.LBool(i.Noise))
+	t.RawSetString("tls", lua.LBool(i.TLS))
+	tags := L.NewTable()
+	for _, tag := range i.Tags {
+		tags.Append(lua.LString(tag))
+	}
+	t.RawSetString("tags", tags)
+	t.RawSetString("headers", headerTable(L, i.Headers))
+	return t
+}
+
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range header {
+		t.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+	return t
+}
+
+// applyInteractionTable takes over the fields scripts may change.
+func applyInteractionTable(t *lua.LTable, i *Interaction) {
+	i.Note = lua.LVAsString(t.RawGetString("note"))
+	i.Data = lua.LVAsString(t.RawGetString("data"))
+	i.Verdict = lua.LVAsString(t.RawGetString("verdict"))
+	if tags, ok := t.RawGetString("tags").(*lua.LTable); ok {
+		i.Tags = nil
+		tags.ForEach(func(_, v lua.LValue) {
+			if tag := lua.LVAsString(v); tag != "" {
+				i.Tags = append(i.Tags, tag)
+			}
+		})
+	}
+}
+
+// handler lets on_http answer requests before next serves them. Answered
+// requests are still recorded with logRequest.
+func (s *scriptHooks) handler(logRequest func(*http.Request), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, header, body, ok := s.respond(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logRequest(r)
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})
+}
+
+// test calls the hook function name with the request, for the script
+// condition of response rules. The request matches when it returns a true
+// value.
+func (s *scriptHooks) test(name string, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return false
+	}
+	ret := s.call(name, s.requestTable(r))
+	return ret != nil && lua.LVAsBool(ret)
+}
+
+// requestTable exposes an HTTP request to Lua. The caller holds s.mu.
+func (s *scriptHooks) requestTable(r *http.Request) *lua.LTable {
+	body, _ := captureBody(r)
+	req := s.state.NewTable()
+	for name, value := range map[string]string{
+		"method": r.Method, "host": r.Host, "path": r.URL.Path, "query": r.URL.RawQuery,
+		"remote_ip": remoteIP(r), "user_agent": r.UserAgent(), "body": bodyText(body),
+	} {
+		req.RawSetString(name, lua.LString(value))
+	}
+	req.RawSetString("tls", lua.LBool(r.TLS != nil))
+	req.RawSetString("headers", headerTable(s.state, r.Header))
+	return req
+}
+
+func (s *scriptHooks) respond(r *http.Request) (int, map[string]string, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == nil {
+		return 0, nil, "", false
+	}
+	if _, ok := s.state.GetGlobal("on_http").(*lua.LFunction); !ok {
+		return 0, nil, "", false
+	}
+
+	resp, ok := s.call("on_http", s.requestTable(r)).(*lua.LTable)
+	if !ok {
+		return 0, nil, "", false
+	}
+	status := http.StatusOK
+	if n, ok := resp.RawGetString("status").(lua.LNumber); ok && n >= 100 && n <= 999 {
+		status = int(n)
+	}
+	header := make(map[string]string)
+	if h, ok := resp.RawGetString("headers").(*lua.LTable); ok {
+		h.ForEach(func(k, v lua.LValue) {
+			header[lua.LVAsString(k)] = lua.LVAsString(v)
+		})
+	}
+	return status, header, lua.LVAsString(resp.RawGetString("body")), true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type secretFinding struct {
+	Kind     string
+	Location string
+	Value    string
+}
+
+var secretPatterns = []struct {
+	Kind    string
+	Pattern *regexp.Regexp
+}{
+	{"JWT", jwtPattern},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+}
+
+var sessionCookieName = regexp.MustCompile(`(?i)(sess|sid$|token|auth|jwt|remember|^connect\.sid$|^phpsessid$|^jsessionid$|^asp\.net_sessionid$)`)
+
+// scanRequestSecrets looks through the headers and query string of a captured
+// request for credentials worth a closer look.
+func scanRequestSecrets(r *http.Request) []secretFinding {
+	var findings []secretFinding
+	seen := make(map[string]bool)
+	add := func(kind, location, value string) {
+		if value == "" || seen[value] {
+			return
+		}
+		seen[value] = true
+		findings = append(findings, secretFinding{Kind: kind, Location: location, Value: value})
+	}
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, credentials, _ := strings.Cut(auth, " ")
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			token := strings.TrimSpace(credentials)
+			if jwtPattern.MatchString(token) {
+				add("Bearer token (JWT)", "header Authorization", token)
+			} else {
+				add("Bearer token", "header Authorization", token)
+			}
+		case "basic":
+			add("Basic credentials", "header Authorization", strings.TrimSpace(credentials))
+		default:
+			add("Authorization header", "header Authorization", auth)
+		}
+	}
+
+	for _, c := range r.Cookies() {
+		if sessionCookieName.MatchString(c.Name) {
+			add("Session cookie", "cookie "+c.Name, c.Value)
+		}
+	}
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			for _, p := range secretPatterns {
+				for _, match := range p.Pattern.FindAllString(value, -1) {
+					add(p.Kind, "header "+name, match)
+				}
+			}
+		}
+	}
+
+	for _, p := range secretPatterns {
+		for _, match := range p.Pattern.FindAllString(r.URL.RawQuery, -1) {
+			add(p.Kind, "query string", match)
+		}
+	}
+	return findings
+}
+
+func logRequestSecrets(secretLogger *log.Logger, r *http.Request) {
+	findings := scanRequestSecrets(r)
+	if len(findings) == 0 {
+		return
+	}
+
+	ipAddress := remoteIP(r)
+	for _, f := range findings {
+		logMessage := fmt.Sprintf("IP address: %s, Resource: %s, Secret: %s, Location: %s, Value: %s", ipAddress, r.URL.Path, f.Kind, f.Location, redactSecret(f.Value, SecretRedaction))
+
+		// The claims identify the calling service rather than authenticate
+		// it, so they are shown unless secrets are being fully redacted.
+		if token := jwtPattern.FindString(f.Value); token != "" && SecretRedaction != "full" {
+			if jwt, err := decodeJWT(token); err == nil {
+				logMessage += ", " + jwt.String()
+				log.Printf("JWT from %s in %s: %s\n", ipAddress, f.Location, jwt)
+			}
+		}
+		secretLogger.Println(logMessage)
+	}
+	log.Printf("Detected %d likely secret(s) in request from %s to %s\n", len(findings), ipAddress, r.URL.Path)
+}
+
+func redactSecret(value, mode string) string {
+	switch mode {
+	case "none":
+		return value
+	case "full":
+		return fmt.Sprintf("[redacted, %d chars]", len(value))
+	}
+	if len(value) <= 12 {
+		return strings.Repeat("*", len(value))
+	}
+	return value[:4] + strings.Repeat("*", len(value)-8) + value[len(value)-4:]
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/miekg/dns"
+)
+
+var SelftestRun string
+
+// runSelftest implements the "selftest" subcommand. It starts the DNS and
+// HTTP servers in a harness, sends them synthetic interactions and checks
+// they are answered, recorded, logged and alerted on. The usual flags apply,
+// so configured publishers and forwarders receive the synthetic interactions
+// too, and -run picks the checks to run by name.
+func runSelftest() {
+	flag.StringVar(&SelftestRun, "run", "", "only run the checks whose name matches this regular expression")
+	parseFlags()
+	var filter *regexp.Regexp
+	if SelftestRun != "" {
+		var err error
+		if filter, err = regexp.Compile(SelftestRun); err != nil {
+			log.Fatalf("Invalid -run value %q: %v", SelftestRun, err)
+		}
+	}
+
+	h := newHarness()
+	failed := h.run(selftestCases(h), filter)
+	h.close()
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("All checks passed")
+}
+
+// selftestCases are the checks of selftest, in order. Checks that only look
+// at the store or the logs depend on the ones sending the interactions, so
+// -run should select both.
+func selftestCases(h *harness) []harnessCase {
+	dnsToken, err := h.tokens.mint("dns", "selftest", 0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	urlToken, err := h.tokens.mint("url", "selftest", 0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	probe := newID()
+	name := "probe-" + probe + "." + DNSResponseName
+	path := "/selftest/" + probe
+	body := "selftest " + probe
+
+	cases := []harnessCase{
+		{"DNS server answers", func(h *harness) error {
+			return waitFor(func() error {
+				resp, err := h.query(name, dns.TypeA)
+				if err != nil {
+					return err
+				}
+				if len(resp.Answer) == 0 || resp.Answer[0].(*dns.A).A.String() != DNSResponseIP {
+					return fmt.Errorf("unexpected answer %v", resp.Answer)
+				}
+				return nil
+			})
+		}},
+		{"DNS query recorded", func(h *harness) error {
+			return h.recorded("dns", func(i *Interaction) bool { return i.QName == name })
+		}},
+		{"DNS query logged", func(h *harness) error {
+			return h.logged(listenerLogs["dns"], name)
+		}},
+		{"DNS canary token alert", func(h *harness) error {
+			_, err := h.query(dnsToken.Address(DNSResponseName), dns.TypeA)
+			return firstError(err, h.logged("./alerts.log", dnsToken.ID))
+		}},
+		{"HTTP server answers", func(h *harness) error {
+			return waitFor(func() error {
+				_, _, err := h.request(http.MethodPost, path, http.Header{"X-Selftest": {probe}}, body)
+				return err
+			})
+		}},
+		{"HTTP request recorded with body and headers", func(h *harness) error {
+			return h.recorded("http", func(i *Interaction) bool {
+				return i.Path == path && i.Body == body && i.Headers.Get("X-Selftest") == probe
+			})
+		}},
+		{"HTTP request logged", func(h *harness) error {
+			return h.logged(listenerLogs["http"], path)
+		}},
+		{"URL canary token alert", func(h *harness) error {
+			resp, _, err := h.request(http.MethodGet, TokenURLPrefix+urlToken.ID, nil, "")
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("token URL returned %s", resp.Status)
+			}
+			return firstError(err, h.logged("./alerts.log", urlToken.ID))
+		}},
+	}
+	if NoiseMode == "log" {
+		cases = append(cases, harnessCase{"Noise recorded and logged as noise", func(h *harness) error {
+			_, _, err := h.request(http.MethodGet, "/favicon.ico?"+probe, nil, "")
+			return firstError(err,
+				h.recorded("http", func(i *Interaction) bool { return i.Path == "/favicon.ico" && i.Query == probe && i.Noise }),
+				h.logged("./noise.log", "/favicon.ico"))
+		}})
+	}
+	if BuiltinSignatures {
+		cases = append(cases, harnessCase{"Log4Shell probe tagged by signature", func(h *harness) error {
+			_, _, err := h.request(http.MethodGet, path+"/jndi", http.Header{"X-Api-Version": {"${jndi:ldap://" + name + "/a}"}}, "")
+			return firstError(err, h.recorded("http", func(i *Interaction) bool {
+				return i.Path == path+"/jndi" && hasTag(i, "log4shell-probe")
+			}))
+		}})
+	}
+	cases = append(cases, harnessCase{"Event log written", func(h *harness) error {
+		return waitFor(func() error {
+			data, err := os.ReadFile(EventLogFile)
+			if err != nil {
+				return err
+			}
+			for _, text := range []string{name, path} {
+				if !bytes.Contains(data, []byte(text)) {
+					return fmt.Errorf("%q not in %s", text, EventLogFile)
+				}
+			}
+			return nil
+		})
+	}})
+	return cases
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SignatureFile = "./signatures.json"
+
+// BuiltinSignatures enables the starter pack shipped in the binary.
+var BuiltinSignatures bool
+
+//go:embed signatures-builtin.json
+var builtinSignatures []byte
+
+// signature tags interactions recognized as a known probe or scanner with
+// its name, e.g. "log4shell-probe". Every matcher that is set must match:
+// regular expressions on the path, the query string (raw and decoded), the
+// body (decoded when it was compressed), the DNS name, request headers by
+// name, with "*" for any header, and "anywhere", which looks at all of them.
+type signature struct {
+	Name     string            `json:"name"`
+	Protocol string            `json:"protocol,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Path     string            `json:"path,omitempty"`
+	Query    string            `json:"query,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	QName    string            `json:"qname,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Anywhere string            `json:"anywhere,omitempty"`
+	// Disabled turns off the built-in signature of the same name.
+	Disabled bool `json:"disabled,omitempty"`
+
+	path, query, body, qname, anywhere *regexp.Regexp
+	headers                            map[string]*regexp.Regexp
+}
+
+func parseSignatures(source string, data []byte) ([]*signature, error) {
+	var list []*signature
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	for _, s := range list {
+		if s.Name == "" {
+			return nil, fmt.Errorf("%s: every signature needs a name", source)
+		}
+		if s.Disabled {
+			continue
+		}
+		var err error
+		for _, m := range []struct {
+			expr string
+			re   **regexp.Regexp
+		}{{s.Path, &s.path}, {s.Query, &s.query}, {s.Body, &s.body}, {s.QName, &s.qname}, {s.Anywhere, &s.anywhere}} {
+			if m.expr == "" {
+				continue
+			}
+			if *m.re, err = regexp.Compile(m.expr); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", source, s.Name, err)
+			}
+		}
+		s.headers = make(map[string]*regexp.Regexp)
+		for name, expr := range s.Headers {
+			if s.headers[name], err = regexp.Compile(expr); err != nil {
+				return nil, fmt.Errorf("%s: %s: header %s: %v", source, s.Name, name, err)
+			}
+		}
+		if s.Method == "" && s.path == nil && s.query == nil && s.body == nil && s.qname == nil && s.anywhere == nil && len(s.headers) == 0 {
+			return nil, fmt.Errorf("%s: %s: needs at least one matcher", source, s.Name)
+		}
+	}
+	return list, nil
+}
+
+// loadSignatures returns the built-in signatures, when enabled, with those
+// of path added. A signature in path replaces the built-in one of the same
+// name, or turns it off with "disabled": true.
+func loadSignatures(path string) ([]*signature, error) {
+	byName := make(map[string]*signature)
+	if BuiltinSignatures {
+		builtin, err := parseSignatures("built-in signatures", builtinSignatures)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range builtin {
+			byName[s.Name] = s
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		own, err := parseSignatures(path, data)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range own {
+			byName[s.Name] = s
+		}
+	}
+	list := make([]*signature, 0, len(byName))
+	for _, s := range byName {
+		if !s.Disabled {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list, nil
+}
+
+func (s *signature) matches(i *Interaction) bool {
+	if s.Protocol != "" && s.Protocol != i.Protocol {
+		return false
+	}
+	if s.Method != "" && !strings.EqualFold(s.Method, i.Method) {
+		return false
+	}
+	query, body := signatureQuery(i), signatureBody(i)
+	for _, m := range []struct {
+		re    *regexp.Regexp
+		value string
+	}{{s.path, i.Path}, {s.query, query}, {s.body, body}, {s.qname, i.QName}} {
+		if m.re != nil && !m.re.MatchString(m.value) {
+			return false
+		}
+	}
+	for name, re := range s.headers {
+		if !headerMatches(i, name, re) {
+			return false
+		}
+	}
+	if s.anywhere != nil && !s.anywhere.MatchString(signatureText(i)) {
+		return false
+	}
+	return true
+}
+
+// signatureQuery is the decoded query string followed by the raw one, when
+// they differ, so payloads match however they were escaped.
+func signatureQuery(i *Interaction) string {
+	if unescaped, err := url.QueryUnescape(i.Query); err == nil && unescaped != i.Query {
+		return unescaped + "\n" + i.Query
+	}
+	return i.Query
+}
+
+func signatureBody(i *Interaction) string {
+	if i.DecodedBody != "" {
+		return i.DecodedBody
+	}
+	return i.Body
+}
+
+// signatureText is everything a payload can hide in, one part a line: the
+// header values, path, query, body, DNS name and the data of other
+// protocols.
+func signatureText(i *Interaction) string {
+	var all []string
+	for _, values := range i.Headers {
+		all = append(all, values...)
+	}
+	return strings.Join(append(all, i.Path, signatureQuery(i), signatureBody(i), i.QName, i.Data), "\n")
+}
+
+// headerMatches reports whether a value of the named header, or of any
+// header for "*", matches. The user agent of an interaction rebuilt from a
+// log line without headers still counts.
+func headerMatches(i *Interaction, name string, re *regexp.Regexp) bool {
+	if name == "*" {
+		for _, values := range i.Headers {
+			for _, v := range values {
+				if re.MatchString(v) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	values := i.Headers.Values(name)
+	if len(values) == 0 && strings.EqualFold(name, "User-Agent") && i.UserAgent != "" {
+		values = []string{i.UserAgent}
+	}
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureTagger tags interactions with the signatures they match, and the
+// out-of-band payloads of other testers they carry, before passing them on,
+// so alert rules, the API's tag filter and every sink see what a probe was.
+// signatures.json is reloaded when it changes.
+type signatureTagger struct {
+	mu         sync.Mutex
+	path       string
+	signatures []*signature
+	mod        time.Time
+	loaded     bool
+	next       interactionSink
+}
+
+func newSignatureTagger(path string, next interactionSink) *signatureTagger {
+	t := &signatureTagger{path: path, next: next}
+	t.reload()
+	return t
+}
+
+func (t *signatureTagger) reload() {
+	var mod time.Time
+	if info, err := os.Stat(t.path); err == nil {
+		mod = info.ModTime()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.loaded && mod.Equal(t.mod) {
+		return
+	}
+
+	// Keep the previous signatures when the file is broken.
+	signatures, err := loadSignatures(t.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	t.signatures, t.mod, t.loaded = signatures, mod, true
+	infof("Loaded %d request signature(s)\n", len(signatures))
+}
+
+func (t *signatureTagger) watch() {
+	for range time.Tick(tokenScanTime) {
+		t.reload()
+	}
+}
+
+func (t *signatureTagger) Write(i *Interaction) {
+	t.mu.Lock()
+	signatures := t.signatures
+	t.mu.Unlock()
+	for _, s := range signatures {
+		if !hasTag(i, s.Name) && s.matches(i) {
+			i.Tags = append(i.Tags, s.Name)
+		}
+	}
+	if OOBPayloadDetection {
+		detectOOBPayloads(i)
+	}
+	t.next.Write(i)
+}
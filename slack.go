@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	slackMaxSkew     = 5 * time.Minute
+	slackDefaultRows = 10
+	slackMaxRows     = 50
+	maxSlackBody     = 64 << 10
+)
+
+var SlackSigningSecret string
+
+const slackHelp = "Usage: `/cowitness last [n]`, `/cowitness token <id>`, `/cowitness ip <address>` or `/cowitness search <words>`"
+
+// handleSlackCommand answers the /cowitness slash command in the channel it
+// was typed in. Requests are authenticated with the app's signing secret, as
+// Slack can't send an API token.
+func handleSlackCommand(store interactionStore, tokens *tokenStore, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSlackBody))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !validSlackSignature(r.Header, body) {
+			writeJSONError(w, http.StatusUnauthorized, "invalid Slack signature")
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		text := strings.TrimSpace(form.Get("text"))
+		audit.write(auditEntry{User: "slack:" + form.Get("user_name"), RemoteIP: remoteIP(r), Action: "slack.command", Detail: text})
+		reply, err := runSlackCommand(text, store, tokens)
+		if err != nil {
+			log.Println(err)
+			reply = "Sorry, the query failed."
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"response_type": "in_channel", "text": reply})
+	}
+}
+
+// validSlackSignature checks the request signature Slack computes from the
+// signing secret, the timestamp and the raw body.
+func validSlackSignature(header http.Header, body []byte) bool {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(SlackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+func runSlackCommand(text string, store interactionStore, tokens *tokenStore) (string, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return slackHelp, nil
+	}
+	q := interactionQuery{Limit: slackDefaultRows}
+	var title string
+	switch strings.ToLower(fields[0]) {
+	case "last":
+		if len(fields) > 1 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				return slackHelp, nil
+			}
+			if n > slackMaxRows {
+				n = slackMaxRows
+			}
+			q.Limit = n
+		}
+		title = fmt.Sprintf("Last %d interactions", q.Limit)
+	case "token":
+		if len(fields) != 2 {
+			return slackHelp, nil
+		}
+		q.Token = fields[1]
+		title = "Interactions firing token " + q.Token
+		for _, t := range tokens.list() {
+			if t.ID == q.Token {
+				title = fmt.Sprintf("Token %s (%s, %s) fired %d times", t.ID, t.Kind, t.Description, t.Fired)
+			}
+		}
+	case "ip":
+		if len(fields) != 2 {
+			return slackHelp, nil
+		}
+		q.RemoteIP = fields[1]
+		title = "Interactions from " + q.RemoteIP
+	case "search":
+		if len(fields) < 2 {
+			return slackHelp, nil
+		}
+		q.Search = strings.Join(fields[1:], " ")
+		title = "Interactions matching " + q.Search
+	default:
+		return slackHelp, nil
+	}
+
+	list, err := store.Query(q)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return title + ": none.", nil
+	}
+	lines := []string{"*" + slackEscape(title) + "*"}
+	for _, i := range list {
+		line := "• " + slackEscape(describeInteraction(i))
+		if i.Verdict != "" && i.Verdict != verdictUnknown {
+			line += " _(" + i.Verdict + ")_"
+		}
+		if i.Noise {
+			line += " _(noise)_"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// slackEscape keeps attacker controlled text from being read as Slack
+// markup, mentions or links.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
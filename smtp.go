@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const maxSMTPMessage = maxCapturedBody
+
+// serveSMTP speaks enough SMTP to accept any message: every sender, recipient
+// and login is accepted and the message is captured, then discarded. Email
+// canary tokens fire on the recipient domain. STARTTLS is offered on plain
+// connections.
+func serveSMTP(s *moduleSession) {
+	zone := strings.TrimSuffix(DNSResponseName, ".")
+	if s.reply("220 "+zone+" ESMTP ready") != nil {
+		return
+	}
+
+	var message strings.Builder
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		if strings.EqualFold(verb, "AUTH") {
+			mechanism, _, _ := strings.Cut(arg, " ")
+			s.record(verb + " " + mechanism)
+		} else {
+			s.record(line)
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.interaction.Host = arg
+			s.reply("250 " + zone)
+		case "EHLO":
+			s.interaction.Host = arg
+			lines := []string{"250-" + zone, "250-PIPELINING", "250-8BITMIME", "250-SIZE 10485760"}
+			if !s.interaction.TLS {
+				lines = append(lines, "250-STARTTLS")
+			}
+			s.reply(append(lines, "250 AUTH PLAIN LOGIN")...)
+		case "STARTTLS":
+			if s.interaction.TLS {
+				s.reply("503 TLS already active")
+				continue
+			}
+			s.reply("220 Ready to start TLS")
+			if !s.startTLS() {
+				return
+			}
+		case "AUTH":
+			if !smtpAuth(s, arg) {
+				return
+			}
+		case "MAIL":
+			s.reply("250 OK")
+		case "RCPT":
+			recipient := arg
+			if len(arg) >= 3 && strings.EqualFold(arg[:3], "TO:") {
+				recipient = arg[3:]
+			}
+			recipient = strings.Trim(strings.TrimSpace(recipient), "<>")
+			s.fireToken(recipient, "RCPT TO "+recipient)
+			s.reply("250 OK")
+		case "DATA":
+			s.reply("354 End data with <CR><LF>.<CR><LF>")
+			message.Reset()
+			for {
+				line, err := s.readLine()
+				if err != nil {
+					return
+				}
+				if line == "." {
+					break
+				}
+				if message.Len() < maxSMTPMessage {
+					message.WriteString(strings.TrimPrefix(line, ".") + "\n")
+				}
+			}
+			s.interaction.Body = message.String()
+			s.reply("250 OK: queued as " + s.interaction.ID)
+		case "RSET", "NOOP":
+			s.reply("250 OK")
+		case "QUIT":
+			s.reply("221 Bye")
+			return
+		default:
+			s.reply("502 Command not implemented")
+		}
+	}
+}
+
+// smtpAuth accepts AUTH PLAIN and AUTH LOGIN with any credentials.
+func smtpAuth(s *moduleSession, arg string) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	supported, err := s.saslLogin(mechanism, initial, "334 ")
+	if err != nil {
+		return false
+	}
+	if !supported {
+		s.reply(fmt.Sprintf("504 Unrecognized authentication type %s", mechanism))
+		return true
+	}
+	s.reply("235 Authentication successful")
+	return true
+}
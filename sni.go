@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var TLSCertDir string
+
+// sniCertificates picks the certificate for a TLS handshake by the server
+// name the client asked for, so one instance can terminate TLS for several
+// callback domains. Certificates are <name>.crt and <name>.key PEM pairs in
+// a directory, matched by their DNS names including wildcards. Clients
+// without SNI, or asking for a name no certificate covers, get the default
+// certificate. The directory is reloaded when its files change, so renewed
+// certificates are picked up without a restart.
+type sniCertificates struct {
+	mu       sync.RWMutex
+	dir      string
+	state    string
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func newSNICertificates(dir string, fallback *tls.Certificate) *sniCertificates {
+	s := &sniCertificates{dir: dir, fallback: fallback, byName: make(map[string]*tls.Certificate)}
+	s.reload()
+	return s
+}
+
+func (s *sniCertificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert := s.byName[name]; cert != nil {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert := s.byName["*"+name[i:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	return s.fallback, nil
+}
+
+// reload loads the directory again when a file was added, removed or
+// modified. Broken pairs are skipped and logged.
+func (s *sniCertificates) reload() {
+	state := certDirState(s.dir)
+	s.mu.RLock()
+	unchanged := state == s.state
+	s.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	byName, errs := loadCertDir(s.dir)
+	for _, err := range errs {
+		log.Println(err)
+	}
+	s.mu.Lock()
+	s.byName, s.state = byName, state
+	s.mu.Unlock()
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	infof("Loaded TLS certificates for %d name(s) from %s: %s\n", len(names), s.dir, strings.Join(names, ", "))
+}
+
+func (s *sniCertificates) watch() {
+	for range time.Tick(tokenScanTime) {
+		s.reload()
+	}
+}
+
+// certDirState summarizes the names, sizes and modification times of the
+// files in dir, to notice changes without reading them.
+func certDirState(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err.Error()
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", e.Name(), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// loadCertDir loads every <name>.crt with its <name>.key from dir and maps
+// the DNS names of each certificate to it. A certificate without DNS names
+// is used for its common name.
+func loadCertDir(dir string) (map[string]*tls.Certificate, []error) {
+	byName := make(map[string]*tls.Certificate)
+	if _, err := os.Stat(dir); err != nil {
+		return byName, []error{fmt.Errorf("-tls-cert-dir: %v", err)}
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return byName, []error{err}
+	}
+	var errs []error
+	for _, certFile := range paths {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", certFile, err))
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", certFile, err))
+			continue
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		if len(names) == 0 {
+			errs = append(errs, fmt.Errorf("%s: certificate has no DNS names", certFile))
+			continue
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if other, taken := byName[name]; taken && other.Leaf.NotAfter.After(leaf.NotAfter) {
+				continue
+			}
+			byName[name] = &cert
+		}
+	}
+	return byName, errs
+}
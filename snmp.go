@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+
+	snmpGetResponse = 0xa2
+	snmpTrapV1      = 0xa4
+	snmpInform      = 0xa6
+	snmpTrapV2      = 0xa7
+
+	snmpTrapOID = "1.3.6.1.6.3.1.1.4.1.0"
+)
+
+var snmpVersions = map[int64]string{0: "v1", 1: "v2c", 3: "v3"}
+
+var snmpPDUs = map[byte]string{snmpTrapV1: "Trap", snmpInform: "InformRequest", snmpTrapV2: "SNMPv2-Trap"}
+
+var snmpGenericTraps = []string{"coldStart", "warmStart", "linkDown", "linkUp", "authenticationFailure", "egpNeighborLoss", "enterpriseSpecific"}
+
+var errBERTruncated = errors.New("truncated BER value")
+
+// berValue is one decoded BER tag-length-value.
+type berValue struct {
+	tag     byte
+	content []byte
+	raw     []byte
+}
+
+// readBER splits the first BER value off data.
+func readBER(data []byte) (berValue, []byte, error) {
+	if len(data) < 2 {
+		return berValue{}, nil, errBERTruncated
+	}
+	length, header := int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < 2+n {
+			return berValue{}, nil, errBERTruncated
+		}
+		length = 0
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		header += n
+	}
+	if length < 0 || len(data)-header < length {
+		return berValue{}, nil, errBERTruncated
+	}
+	end := header + length
+	return berValue{tag: data[0], content: data[header:end], raw: data[:end]}, data[end:], nil
+}
+
+// readBERSequence decodes the values inside a constructed BER value.
+func readBERSequence(data []byte) ([]berValue, error) {
+	var values []berValue
+	for len(data) > 0 {
+		v, rest, err := readBER(data)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		data = rest
+	}
+	return values, nil
+}
+
+func encodeBER(tag byte, content []byte) []byte {
+	n := len(content)
+	switch {
+	case n < 0x80:
+		return append([]byte{tag, byte(n)}, content...)
+	case n < 0x100:
+		return append([]byte{tag, 0x81, byte(n)}, content...)
+	default:
+		return append([]byte{tag, 0x82, byte(n >> 8), byte(n)}, content...)
+	}
+}
+
+func (v berValue) int() int64 {
+	var n int64
+	for i, b := range v.content {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (v berValue) oid() string {
+	if len(v.content) == 0 {
+		return ""
+	}
+	parts := []string{strconv.Itoa(int(v.content[0]) / 40), strconv.Itoa(int(v.content[0]) % 40)}
+	var n uint64
+	for _, b := range v.content[1:] {
+		n = n<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			parts = append(parts, strconv.FormatUint(n, 10))
+			n = 0
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// String formats a varbind value with its SNMP type.
+func (v berValue) String() string {
+	switch v.tag {
+	case berInteger:
+		return fmt.Sprintf("INTEGER %d", v.int())
+	case berOctetString:
+		if utf8.Valid(v.content) && !strings.ContainsAny(string(v.content), "\x00") {
+			return fmt.Sprintf("STRING %q", v.content)
+		}
+		return fmt.Sprintf("Hex-STRING % x", v.content)
+	case berNull:
+		return "NULL"
+	case berOID:
+		return "OID " + v.oid()
+	case 0x40:
+		if len(v.content) == 4 {
+			return "IpAddress " + net.IP(v.content).String()
+		}
+	case 0x41:
+		return fmt.Sprintf("Counter32 %d", uint64(v.int())&0xffffffff)
+	case 0x42:
+		return fmt.Sprintf("Gauge32 %d", uint64(v.int())&0xffffffff)
+	case 0x43:
+		return fmt.Sprintf("Timeticks %d", uint64(v.int())&0xffffffff)
+	case 0x46:
+		return fmt.Sprintf("Counter64 %d", uint64(v.int()))
+	case 0x80:
+		return "noSuchObject"
+	case 0x81:
+		return "noSuchInstance"
+	case 0x82:
+		return "endOfMibView"
+	}
+	return fmt.Sprintf("[tag 0x%02x] % x", v.tag, v.content)
+}
+
+// handleSNMPTrap decodes SNMP v1 and v2c traps and informs into the
+// interaction. Informs are acknowledged so the agent stops resending them.
+func handleSNMPTrap(p *udpPacket) []byte {
+	reply, summary, err := decodeSNMPTrap(p)
+	if err != nil {
+		p.record("# %v", err)
+		p.interaction.Data += hexDump(p.data)
+		p.summary = "Undecodable: " + err.Error()
+		return nil
+	}
+	p.summary = summary
+	return reply
+}
+
+func decodeSNMPTrap(p *udpPacket) ([]byte, string, error) {
+	message, _, err := readBER(p.data)
+	if err != nil || message.tag != berSequence {
+		return nil, "", fmt.Errorf("not an SNMP message")
+	}
+	fields, err := readBERSequence(message.content)
+	if err != nil || len(fields) < 3 || fields[0].tag != berInteger {
+		return nil, "", fmt.Errorf("not an SNMP message")
+	}
+	version, ok := snmpVersions[fields[0].int()]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown SNMP version %d", fields[0].int())
+	}
+	p.record("version: %s", version)
+	if version == "v3" {
+		return nil, "", fmt.Errorf("SNMPv3 messages are not decoded")
+	}
+	community := string(fields[1].content)
+	p.interaction.Password = redactSecret(community, SecretRedaction)
+	p.record("community: %s", p.interaction.Password)
+
+	pdu := fields[2]
+	name, ok := snmpPDUs[pdu.tag]
+	if !ok {
+		return nil, "", fmt.Errorf("unexpected PDU type 0x%02x", pdu.tag)
+	}
+	p.record("pdu: %s", name)
+	body, err := readBERSequence(pdu.content)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var trap string
+	var varbinds berValue
+	if pdu.tag == snmpTrapV1 {
+		if len(body) < 6 {
+			return nil, "", fmt.Errorf("short v1 trap")
+		}
+		generic := body[2].int()
+		p.record("enterprise: %s", body[0].oid())
+		p.record("agent address: %s", body[1])
+		p.record("generic trap: %d", generic)
+		p.record("specific trap: %d", body[3].int())
+		p.record("uptime: %s", body[4])
+		trap = body[0].oid()
+		if generic >= 0 && generic < int64(len(snmpGenericTraps)) {
+			trap = snmpGenericTraps[generic]
+			if generic == 6 {
+				trap = fmt.Sprintf("%s.0.%d", body[0].oid(), body[3].int())
+			}
+		}
+		varbinds = body[5]
+	} else {
+		if len(body) < 4 {
+			return nil, "", fmt.Errorf("short %s", name)
+		}
+		varbinds = body[3]
+	}
+
+	list, err := readBERSequence(varbinds.content)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, vb := range list {
+		pair, err := readBERSequence(vb.content)
+		if err != nil || len(pair) != 2 {
+			continue
+		}
+		oid := pair[0].oid()
+		p.record("varbind: %s = %s", oid, pair[1])
+		if oid == snmpTrapOID {
+			trap = pair[1].oid()
+		}
+	}
+
+	summary := fmt.Sprintf("Version: %s, PDU: %s, Trap: %s, Varbinds: %d", version, name, trap, len(list))
+	if pdu.tag != snmpInform {
+		return nil, summary, nil
+	}
+	response := append([]byte{}, body[0].raw...)
+	response = append(response, encodeBER(berInteger, []byte{0})...)
+	response = append(response, encodeBER(berInteger, []byte{0})...)
+	response = append(response, varbinds.raw...)
+	reply := append([]byte{}, fields[0].raw...)
+	reply = append(reply, fields[1].raw...)
+	reply = append(reply, encodeBER(snmpGetResponse, response)...)
+	return encodeBER(berSequence, reply), summary, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	SSHBanner  string
+	SSHHostKey string
+)
+
+var errSSHDenied = errors.New("permission denied")
+
+var sshSigner struct {
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+// serveSSH runs the SSH handshake with the configured banner and records the
+// client version and every authentication attempt. No attempt ever succeeds,
+// so clients give up after six tries.
+func serveSSH(s *moduleSession) {
+	sshSigner.once.Do(func() { sshSigner.signer, sshSigner.err = sshHostKey() })
+	if sshSigner.err != nil {
+		s.note("host key: %v", sshSigner.err)
+		return
+	}
+
+	attempt := func(conn ssh.ConnMetadata, method, detail string) {
+		s.interaction.UserAgent = string(conn.ClientVersion())
+		s.interaction.User = conn.User()
+		s.record(strings.TrimSpace(fmt.Sprintf("auth %s user=%s %s", method, conn.User(), detail)))
+	}
+	config := &ssh.ServerConfig{
+		ServerVersion: SSHBanner,
+		MaxAuthTries:  6,
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			s.credentials(conn.User(), string(password))
+			attempt(conn, "password", "password="+s.interaction.Password)
+			return nil, errSSHDenied
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			attempt(conn, "publickey", key.Type()+" "+ssh.FingerprintSHA256(key))
+			return nil, errSSHDenied
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err == nil && len(answers) == 1 {
+				s.credentials(conn.User(), answers[0])
+				attempt(conn, "keyboard-interactive", "password="+s.interaction.Password)
+			}
+			return nil, errSSHDenied
+		},
+		BannerCallback: func(conn ssh.ConnMetadata) string {
+			s.interaction.UserAgent = string(conn.ClientVersion())
+			s.record("client version: " + s.interaction.UserAgent)
+			return ""
+		},
+	}
+	config.AddHostKey(sshSigner.signer)
+
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	if _, _, _, err := ssh.NewServerConn(s.conn, config); err != nil {
+		s.note("%v", err)
+	}
+}
+
+// sshHostKey loads the SSH host key, creating an Ed25519 key on first use so
+// the fingerprint stays the same across restarts.
+func sshHostKey() (ssh.Signer, error) {
+	data, err := os.ReadFile(SSHHostKey)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(SSHHostKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	infof("Created SSH host key %s, fingerprint %s\n", SSHHostKey, ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
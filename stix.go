@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	stixTimeFormat  = "2006-01-02T15:04:05.000Z"
+	taxiiMediaType  = "application/taxii+json;version=2.1"
+	stixMediaType   = "application/stix+json;version=2.1"
+	taxiiAPIRoot    = "/taxii2/cowitness/"
+	taxiiCollection = "interactions"
+)
+
+// stixNamespace is the namespace STIX 2.1 defines for deterministic
+// identifiers, so the same indicator keeps its ID across exports.
+var stixNamespace = [16]byte{0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c, 0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7}
+
+type stixBundle struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Objects []interface{} `json:"objects"`
+}
+
+type stixIdentity struct {
+	Type          string `json:"type"`
+	SpecVersion   string `json:"spec_version"`
+	ID            string `json:"id"`
+	Created       string `json:"created"`
+	Modified      string `json:"modified"`
+	Name          string `json:"name"`
+	IdentityClass string `json:"identity_class"`
+}
+
+type stixIndicator struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	CreatedByRef   string   `json:"created_by_ref"`
+	Created        string   `json:"created"`
+	Modified       string   `json:"modified"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	IndicatorTypes []string `json:"indicator_types"`
+	Pattern        string   `json:"pattern"`
+	PatternType    string   `json:"pattern_type"`
+	ValidFrom      string   `json:"valid_from"`
+	Labels         []string `json:"labels,omitempty"`
+}
+
+// observedIndicator collects the sightings of one source IP, user agent or
+// JA3 fingerprint.
+type observedIndicator struct {
+	name, pattern string
+	count         int
+	first, last   time.Time
+	protocols     map[string]bool
+	engagements   map[string]bool
+}
+
+// stixIndicators turns the source IPs, user agents and JA3 fingerprints seen
+// in interactions into STIX 2.1 indicators. Noise is left out.
+func stixIndicators(list []*Interaction) []interface{} {
+	// The identity is fixed per node, so its timestamps are too.
+	identity := stixIdentity{
+		Type: "identity", SpecVersion: "2.1", ID: "identity--" + uuidV5("cowitness:"+NodeName),
+		Created: "2020-01-01T00:00:00.000Z", Modified: "2020-01-01T00:00:00.000Z",
+		Name: strings.TrimSpace("CoWitness " + NodeName), IdentityClass: "system",
+	}
+	observed := make(map[string]*observedIndicator)
+	var order []string
+	observe := func(i *Interaction, name, pattern string) {
+		o, ok := observed[pattern]
+		if !ok {
+			o = &observedIndicator{name: name, pattern: pattern, first: i.Time, last: i.Time, protocols: make(map[string]bool), engagements: make(map[string]bool)}
+			observed[pattern] = o
+			order = append(order, pattern)
+		}
+		o.count++
+		o.protocols[i.Protocol] = true
+		if i.Engagement != "" {
+			o.engagements[i.Engagement] = true
+		}
+		if i.Time.Before(o.first) {
+			o.first = i.Time
+		}
+		if i.Time.After(o.last) {
+			o.last = i.Time
+		}
+	}
+	for _, i := range list {
+		if i.Noise {
+			continue
+		}
+		if ip := net.ParseIP(i.RemoteIP); ip != nil {
+			kind := "ipv6-addr"
+			if ip.To4() != nil {
+				kind = "ipv4-addr"
+			}
+			observe(i, "Source address "+i.RemoteIP, fmt.Sprintf("[%s:value = '%s']", kind, stixString(i.RemoteIP)))
+		}
+		if i.UserAgent != "" {
+			observe(i, "User agent "+i.UserAgent, fmt.Sprintf("[network-traffic:extensions.'http-request-ext'.request_header.'User-Agent' = '%s']", stixString(i.UserAgent)))
+		}
+		if i.JA3 != "" {
+			observe(i, "JA3 fingerprint "+i.JA3, fmt.Sprintf("[x-ja3:hash = '%s']", stixString(i.JA3)))
+		}
+	}
+
+	objects := []interface{}{identity}
+	for _, pattern := range order {
+		o := observed[pattern]
+		indicator := stixIndicator{
+			Type: "indicator", SpecVersion: "2.1", ID: "indicator--" + uuidV5(pattern),
+			CreatedByRef: identity.ID,
+			Created:      o.first.UTC().Format(stixTimeFormat),
+			Modified:     o.last.UTC().Format(stixTimeFormat),
+			Name:         o.name,
+			Description: fmt.Sprintf("Observed by CoWitness %d times over %s between %s and %s.",
+				o.count, strings.Join(sortedKeys(o.protocols), ", "), o.first.UTC().Format(time.RFC3339), o.last.UTC().Format(time.RFC3339)),
+			IndicatorTypes: []string{"anomalous-activity"},
+			Pattern:        pattern,
+			PatternType:    "stix",
+			ValidFrom:      o.first.UTC().Format(stixTimeFormat),
+			Labels:         sortedKeys(o.engagements),
+		}
+		objects = append(objects, indicator)
+	}
+	return objects
+}
+
+func newSTIXBundle(list []*Interaction) *stixBundle {
+	return &stixBundle{Type: "bundle", ID: "bundle--" + uuidV4(), Objects: stixIndicators(list)}
+}
+
+// stixString escapes a value for a single quoted STIX pattern string.
+func stixString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func uuidV5(name string) string {
+	h := sha1.New()
+	h.Write(stixNamespace[:])
+	h.Write([]byte(name))
+	sum := h.Sum(nil)
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return formatUUID(sum[:16])
+}
+
+func uuidV4() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// handleTAXII serves a minimal read-only TAXII 2.1 server with a single
+// collection holding the indicators built from the interaction store.
+// Object fetches are audited like interaction queries.
+func handleTAXII(store interactionStore, audit *auditLog) http.HandlerFunc {
+	collectionID := uuidV5("taxii-collection:" + taxiiCollection)
+	collection := map[string]interface{}{
+		"id": collectionID, "title": "CoWitness interactions", "can_read": true, "can_write": false,
+		"media_types": []string{stixMediaType},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeTAXII(w, http.StatusMethodNotAllowed, map[string]string{"title": http.StatusText(http.StatusMethodNotAllowed)})
+			return
+		}
+		switch r.URL.Path {
+		case "/taxii2/":
+			writeTAXII(w, http.StatusOK, map[string]interface{}{"title": "CoWitness", "default": taxiiAPIRoot, "api_roots": []string{taxiiAPIRoot}})
+		case taxiiAPIRoot:
+			writeTAXII(w, http.StatusOK, map[string]interface{}{"title": "CoWitness", "versions": []string{taxiiMediaType}, "max_content_length": 0})
+		case taxiiAPIRoot + "collections/":
+			writeTAXII(w, http.StatusOK, map[string]interface{}{"collections": []interface{}{collection}})
+		case taxiiAPIRoot + "collections/" + collectionID + "/":
+			writeTAXII(w, http.StatusOK, collection)
+		case taxiiAPIRoot + "collections/" + collectionID + "/objects/":
+			q, err := parseInteractionQuery(r.URL.Query())
+			if err != nil {
+				writeTAXII(w, http.StatusBadRequest, map[string]string{"title": err.Error()})
+				return
+			}
+			if v := r.URL.Query().Get("added_after"); v != "" {
+				if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+					writeTAXII(w, http.StatusBadRequest, map[string]string{"title": "added_after: " + err.Error()})
+					return
+				}
+			}
+			q.Limit = maxQueryLimit
+			audit.record(r, "taxii.objects", taxiiCollection, r.URL.RawQuery)
+			list, err := store.Query(q)
+			if err != nil {
+				log.Println(err)
+				writeTAXII(w, http.StatusInternalServerError, map[string]string{"title": http.StatusText(http.StatusInternalServerError)})
+				return
+			}
+			writeTAXII(w, http.StatusOK, map[string]interface{}{"more": false, "objects": stixIndicators(list)})
+		default:
+			writeTAXII(w, http.StatusNotFound, map[string]string{"title": http.StatusText(http.StatusNotFound)})
+		}
+	}
+}
+
+func writeTAXII(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", taxiiMediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
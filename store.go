@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	memoryStoreSize   = 10000
+	defaultQueryLimit = 100
+	maxQueryLimit     = 10000
+)
+
+var StoreURL string
+
+// AnnotationsFile keeps the tags and notes of the memory store, which is
+// refilled from the write-ahead log on start but would lose them otherwise.
+const AnnotationsFile = "./annotations.json"
+
+var errInteractionNotFound = errors.New("interaction not found")
+
+// interactionStore keeps interactions queryable for the operator API. Every
+// backend answers the same interactionQuery.
+type interactionStore interface {
+	interactionSink
+	Query(q interactionQuery) ([]*Interaction, error)
+	Annotate(id string, a annotation) (*Interaction, error)
+	// Purge deletes the interactions of an engagement recorded before a
+	// time and returns how many there were.
+	Purge(engagement string, before time.Time) (int, error)
+}
+
+// annotation changes the tags and note operators attach to an interaction.
+// Fields left nil are kept as they are.
+type annotation struct {
+	Tags *[]string `json:"tags"`
+	Note *string   `json:"note"`
+}
+
+func (a annotation) apply(i *Interaction) {
+	if a.Tags != nil {
+		i.Tags = *a.Tags
+	}
+	if a.Note != nil {
+		i.Note = *a.Note
+	}
+}
+
+type interactionQuery struct {
+	Node       string
+	Engagement string
+	Protocol   string
+	Verdict    string
+	RemoteIP   string
+	Token      string
+	Upload     string
+	Tag        string
+	Search     string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+func parseInteractionQuery(values url.Values) (interactionQuery, error) {
+	q := interactionQuery{
+		Node:       values.Get("node"),
+		Engagement: values.Get("engagement"),
+		Protocol:   values.Get("protocol"),
+		Verdict:    values.Get("verdict"),
+		RemoteIP:   values.Get("ip"),
+		Token:      values.Get("token"),
+		Upload:     values.Get("upload"),
+		Tag:        values.Get("tag"),
+		Search:     values.Get("q"),
+		Limit:      defaultQueryLimit,
+	}
+
+	var err error
+	if v := values.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("since: %v", err)
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("until: %v", err)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("limit: expected a positive number, got %q", v)
+		}
+	}
+	if q.Limit > maxQueryLimit {
+		q.Limit = maxQueryLimit
+	}
+	return q, nil
+}
+
+func (q interactionQuery) matches(i *Interaction) bool {
+	switch {
+	case q.Node != "" && i.Node != q.Node:
+		return false
+	case q.Engagement != "" && i.Engagement != q.Engagement:
+		return false
+	case q.Protocol != "" && i.Protocol != q.Protocol:
+		return false
+	case q.Verdict != "" && i.Verdict != q.Verdict:
+		return false
+	case q.RemoteIP != "" && i.RemoteIP != q.RemoteIP:
+		return false
+	case q.Token != "" && i.Token != q.Token:
+		return false
+	case q.Upload != "" && i.Upload != q.Upload:
+		return false
+	case q.Tag != "" && !hasTag(i, q.Tag):
+		return false
+	case q.Search != "" && !containsText(i, q.Search):
+		return false
+	case !q.Since.IsZero() && i.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !i.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+func hasTag(i *Interaction, tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// containsText reports whether every word of search occurs, case-insensitively,
+// in the names, URL, headers, body or note of an interaction.
+func containsText(i *Interaction, search string) bool {
+	var b strings.Builder
+	for _, s := range []string{i.QName, i.Host, i.Path, i.Query, i.UserAgent, i.Body, i.DecodedBody, i.User, i.Data, i.Note} {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	for name, values := range i.Headers {
+		b.WriteString(name + ": " + strings.Join(values, ", ") + "\n")
+	}
+	text := strings.ToLower(b.String())
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func openInteractionStore(storeURL string) (interactionStore, error) {
+	if storeURL == "" {
+		s := newMemoryStore(memoryStoreSize)
+		if err := s.loadAnnotations(AnnotationsFile); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		return newPostgresStore(storeURL)
+	}
+	return nil, fmt.Errorf("unsupported store %q, expected a postgres:// URL", u.Scheme)
+}
+
+// memoryStore is the default backend, a ring of the most recent interactions.
+// Annotations are also saved to a file, when one is set, and applied again
+// to interactions replayed after a restart.
+type memoryStore struct {
+	mu          sync.Mutex
+	ring        []*Interaction
+	next        int
+	count       int
+	path        string
+	annotations map[string]annotation
+}
+
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{ring: make([]*Interaction, size), annotations: make(map[string]annotation)}
+}
+
+func (s *memoryStore) loadAnnotations(path string) error {
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.annotations); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func (s *memoryStore) saveAnnotationsLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.annotations, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *memoryStore) Write(i *Interaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.annotations[i.ID]; ok {
+		annotated := *i
+		a.apply(&annotated)
+		i = &annotated
+	}
+	s.ring[s.next] = i
+	s.next = (s.next + 1) % len(s.ring)
+	if s.count < len(s.ring) {
+		s.count++
+	}
+}
+
+// Query returns matches newest first, like the SQL backends.
+func (s *memoryStore) Query(q interactionQuery) ([]*Interaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*Interaction
+	for n := 1; n <= s.count && len(result) < q.Limit; n++ {
+		i := s.ring[(s.next-n+len(s.ring))%len(s.ring)]
+		if q.matches(i) {
+			result = append(result, i)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Annotate(id string, a annotation) (*Interaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Annotate a copy, the original may still be on its way to other sinks.
+	for n := 1; n <= s.count; n++ {
+		slot := (s.next - n + len(s.ring)) % len(s.ring)
+		if s.ring[slot].ID == id {
+			saved := s.annotations[id]
+			if a.Tags != nil {
+				saved.Tags = a.Tags
+			}
+			if a.Note != nil {
+				saved.Note = a.Note
+			}
+			s.annotations[id] = saved
+			if err := s.saveAnnotationsLocked(); err != nil {
+				return nil, err
+			}
+			i := *s.ring[slot]
+			a.apply(&i)
+			s.ring[slot] = &i
+			return &i, nil
+		}
+	}
+	return nil, errInteractionNotFound
+}
+
+func (s *memoryStore) Purge(engagement string, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]*Interaction, 0, s.count)
+	for n := s.count; n >= 1; n-- {
+		i := s.ring[(s.next-n+len(s.ring))%len(s.ring)]
+		if i.Engagement != engagement || !i.Time.Before(before) {
+			kept = append(kept, i)
+		} else {
+			delete(s.annotations, i.ID)
+		}
+	}
+	purged := s.count - len(kept)
+	if purged == 0 {
+		return 0, nil
+	}
+	if err := s.saveAnnotationsLocked(); err != nil {
+		return 0, err
+	}
+	s.ring = make([]*Interaction, len(s.ring))
+	copy(s.ring, kept)
+	s.next = len(kept) % len(s.ring)
+	s.count = len(kept)
+	return purged, nil
+}
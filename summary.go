@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startupWait is how long the startup summary waits for the listeners to
+// bind before it is logged anyway.
+const startupWait = 5 * time.Second
+
+// summarizedFlags are the settings the startup summary shows in its own
+// sections, left out of the changed settings.
+var summarizedFlags = map[string]bool{
+	"listen": true, "api-addr": true, "dns-ip": true, "dns-name": true, "ttl": true,
+	"node-name": true, "engagement": true, "tls-cert": true, "tls-key": true, "tls-cert-dir": true,
+	"store": true, "event-log": true, "event-format": true, "webhook-url": true, "webhook-events": true,
+	"kafka-brokers": true, "kafka-topic": true, "nats-url": true, "nats-subject": true,
+	"misp-url": true, "misp-publish-tokens": true, "archive-url": true, "forward-to": true, "config": true,
+}
+
+// boundListeners collects the addresses the listeners actually bound, for
+// the startup summary.
+var boundListeners struct {
+	sync.Mutex
+	pending   sync.WaitGroup
+	listeners []boundListener
+}
+
+type boundListener struct {
+	module  string
+	network string
+	addr    net.Addr
+}
+
+// listenerStarting is called before a listener binds in the background, so
+// the startup summary waits for it.
+func listenerStarting() {
+	boundListeners.pending.Add(1)
+}
+
+// listenerBound records the address a listener bound, after listenerStarting.
+func listenerBound(module, network string, addr net.Addr) {
+	boundListeners.Lock()
+	boundListeners.listeners = append(boundListeners.listeners, boundListener{module, network, addr})
+	boundListeners.Unlock()
+	boundListeners.pending.Done()
+}
+
+// logStartupSummary logs the effective configuration once the listeners are
+// up, in one block, so a screenshot of the boot output documents the
+// engagement: where it listens, the zone it answers for, the certificates
+// clients see, where interactions are stored and who is notified. The other
+// settings are listed when they differ from their defaults.
+func logStartupSummary(tlsConfig *tls.Config) {
+	done := make(chan struct{})
+	go func() {
+		boundListeners.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(startupWait):
+	}
+
+	var b bytes.Buffer
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	row := func(label, value string) {
+		fmt.Fprintf(tw, "  %s\t%s\n", label, value)
+	}
+	rows := func(label string, values []string) {
+		for _, v := range values {
+			row(label, v)
+			label = ""
+		}
+	}
+
+	listeners, tlsUsed, sshUsed := summarizeListeners()
+	if APIAddr != "" {
+		api := fmt.Sprintf("%-6s %s/tcp (operator API)", "API", APIAddr)
+		if APICert != "" {
+			api = fmt.Sprintf("%-6s %s/tcp (operator API, TLS)", "API", APIAddr)
+		}
+		listeners = append(listeners, api)
+	}
+	rows("Listeners", listeners)
+	if addrs := hostAddresses(); len(addrs) > 0 {
+		row("Host addresses", strings.Join(addrs, ", "))
+	}
+
+	zone := fmt.Sprintf("%s -> %s, TTL %ds", DNSResponseName, DNSResponseIP, DefaultTTL)
+	if _, err := os.Stat(ZoneFile); err == nil {
+		zone += ", records from " + ZoneFile
+	}
+	row("Zone", zone)
+	node := NodeName
+	if Engagement != "" {
+		node += ", engagement " + Engagement
+	}
+	row("Node", node)
+
+	if tlsUsed && tlsConfig != nil {
+		var certs []string
+		for _, cert := range tlsConfig.Certificates {
+			certs = append(certs, describeCertificate(cert))
+		}
+		if TLSCertDir != "" {
+			certs = append(certs, "by SNI from "+TLSCertDir)
+		}
+		rows("Certificates", certs)
+	}
+	if sshUsed {
+		sshSigner.once.Do(func() { sshSigner.signer, sshSigner.err = sshHostKey() })
+		if sshSigner.err == nil {
+			row("SSH host key", ssh.FingerprintSHA256(sshSigner.signer.PublicKey()))
+		}
+	}
+
+	storage := fmt.Sprintf("memory, the last %d interactions", memoryStoreSize)
+	if StoreURL != "" {
+		storage = redactURL(StoreURL)
+	}
+	row("Storage", storage)
+	row("Event log", fmt.Sprintf("%s (%s)", EventLogFile, EventFormat))
+	notifiers := summarizeNotifiers()
+	if len(notifiers) == 0 {
+		notifiers = []string{"none"}
+	}
+	rows("Notifiers", notifiers)
+	rows("Changed settings", changedSettings())
+	tw.Flush()
+
+	infof("Startup summary:\n%s", b.String())
+}
+
+// summarizeListeners lists the bound listeners, a module bound to the same
+// address over several networks on one line.
+func summarizeListeners() (lines []string, tlsUsed, sshUsed bool) {
+	boundListeners.Lock()
+	defer boundListeners.Unlock()
+	var order []string
+	networks := make(map[string][]string)
+	for _, l := range boundListeners.listeners {
+		key := fmt.Sprintf("%s\t%s", strings.ToUpper(l.module), summaryAddr(l.addr))
+		if networks[key] == nil {
+			order = append(order, key)
+		}
+		networks[key] = append(networks[key], l.network)
+		if l.module == "https" || tcpModules[l.module].tls {
+			tlsUsed = true
+		}
+		if l.module == "ssh" {
+			sshUsed = true
+		}
+	}
+	sort.Strings(order)
+	for _, key := range order {
+		module, addr, _ := strings.Cut(key, "\t")
+		lines = append(lines, fmt.Sprintf("%-6s %s/%s", module, addr, strings.Join(networks[key], "+")))
+	}
+	return lines, tlsUsed, sshUsed
+}
+
+// summaryAddr writes a wildcard address as *:port.
+func summaryAddr(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "*"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// hostAddresses lists the global unicast addresses of the host, which
+// wildcard listeners answer on.
+func hostAddresses() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var list []string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+			list = append(list, n.IP.String())
+		}
+	}
+	return list
+}
+
+// describeCertificate names a certificate with its SHA-256 fingerprint and
+// expiry.
+func describeCertificate(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return "none"
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	fingerprint := strings.ToUpper(fmt.Sprintf("% x", sum[:]))
+	fingerprint = strings.ReplaceAll(fingerprint, " ", ":")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "SHA256 " + fingerprint
+	}
+	names := leaf.DNSNames
+	if len(names) == 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+	source := TLSCert
+	if source == "" {
+		source = "self-signed"
+	}
+	return fmt.Sprintf("%s (%s, expires %s) SHA256 %s", strings.Join(names, ", "), source, leaf.NotAfter.UTC().Format("2006-01-02"), fingerprint)
+}
+
+// summarizeNotifiers lists where interactions are sent besides the store.
+func summarizeNotifiers() []string {
+	var list []string
+	if WebhookURL != "" {
+		list = append(list, fmt.Sprintf("webhook %s (%s)", redactURLPath(WebhookURL), WebhookEvents))
+	}
+	if KafkaBrokers != "" {
+		list = append(list, fmt.Sprintf("Kafka topic %s on %s", KafkaTopic, KafkaBrokers))
+	}
+	if NATSURL != "" {
+		list = append(list, fmt.Sprintf("NATS subject %s on %s", NATSSubject, redactURL(NATSURL)))
+	}
+	if MISPURL != "" {
+		misp := "MISP " + MISPURL
+		if MISPPublishTokens {
+			misp += " (token trips)"
+		}
+		list = append(list, misp)
+	}
+	if ArchiveURL != "" {
+		list = append(list, "archive "+ArchiveURL)
+	}
+	if ForwardURL != "" {
+		list = append(list, "forwarding to "+redactURL(ForwardURL))
+	}
+	return list
+}
+
+// changedSettings lists the settings that differ from their defaults and
+// have no section of their own, credentials redacted.
+func changedSettings() []string {
+	var list []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if summarizedFlags[f.Name] || f.Value.String() == f.DefValue {
+			return
+		}
+		list = append(list, fmt.Sprintf("-%s=%s", f.Name, displayValue(f)))
+	})
+	return list
+}
+
+// redactURL hides the password of a URL.
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+// redactURLPath keeps only the scheme and host of a URL, as webhook paths
+// often carry a token.
+func redactURLPath(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return u.Scheme + "://" + u.Host + "/..."
+	}
+	return u.Scheme + "://" + u.Host
+}
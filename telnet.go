@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+	telnetEcho = 1
+
+	maxTelnetLine     = 4096
+	maxTelnetCommands = 20
+)
+
+var telnetVerbs = map[byte]string{telnetDONT: "DONT", telnetDO: "DO", telnetWONT: "WONT", telnetWILL: "WILL"}
+
+var telnetOptions = map[byte]string{
+	0: "BINARY", 1: "ECHO", 3: "SUPPRESS-GO-AHEAD", 5: "STATUS", 24: "TERMINAL-TYPE", 31: "NAWS",
+	32: "TERMINAL-SPEED", 33: "LFLOW", 34: "LINEMODE", 35: "X-DISPLAY-LOCATION", 36: "ENVIRON", 39: "NEW-ENVIRON",
+}
+
+// serveTelnet presents a login prompt that accepts any credentials and a
+// shell that answers the first commands typed, the way IoT bots expect, while
+// recording the option negotiation, the login and the commands.
+func serveTelnet(s *moduleSession) {
+	zone := strings.TrimSuffix(DNSResponseName, ".")
+	// Ask for the terminal type and window size, then the terminal type itself.
+	if s.write([]byte{telnetIAC, telnetDO, 24, telnetIAC, telnetDO, 31, telnetIAC, telnetWILL, 3, telnetIAC, telnetSB, 24, 1, telnetIAC, telnetSE}) != nil {
+		return
+	}
+	if s.write([]byte("\r\n"+zone+" login: ")) != nil {
+		return
+	}
+	user, err := s.readTelnetLine()
+	if err != nil {
+		return
+	}
+	s.record("login: " + user)
+
+	s.write([]byte{telnetIAC, telnetWILL, telnetEcho})
+	if s.write([]byte("Password: ")) != nil {
+		return
+	}
+	password, err := s.readTelnetLine()
+	if err != nil {
+		return
+	}
+	s.credentials(user, password)
+	s.write([]byte{telnetIAC, telnetWONT, telnetEcho})
+
+	for n := 0; n < maxTelnetCommands; n++ {
+		if s.write([]byte("\r\n$ ")) != nil {
+			return
+		}
+		line, err := s.readTelnetLine()
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s.record(line)
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "exit" || fields[0] == "logout":
+			return
+		case strings.HasSuffix(fields[0], "busybox") && len(fields) > 1:
+			s.write([]byte(fields[1] + ": applet not found"))
+		case fields[0] == "enable" || fields[0] == "system" || fields[0] == "shell" || fields[0] == "sh":
+		default:
+			s.write([]byte("sh: " + fields[0] + ": not found"))
+		}
+	}
+	s.note("command limit reached")
+}
+
+// readTelnetLine reads a line of input, recording and removing the option
+// negotiation interleaved with it.
+func (s *moduleSession) readTelnetLine() (string, error) {
+	s.conn.SetDeadline(time.Now().Add(moduleIdleTimeout))
+	var line []byte
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+		switch {
+		case b == telnetIAC:
+			if err := s.readTelnetCommand(); err != nil {
+				return string(line), err
+			}
+		case b == '\n':
+			return string(line), nil
+		case b == '\r' || b == 0:
+		case len(line) < maxTelnetLine:
+			line = append(line, b)
+		}
+	}
+}
+
+func (s *moduleSession) readTelnetCommand() error {
+	command, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch command {
+	case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+		option, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		s.record("negotiation: " + telnetVerbs[command] + " " + telnetOptionName(option))
+	case telnetSB:
+		var data []byte
+		for {
+			b, err := s.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == telnetIAC {
+				if b, err = s.r.ReadByte(); err != nil {
+					return err
+				}
+				if b == telnetSE {
+					break
+				}
+			}
+			if len(data) < maxTelnetLine {
+				data = append(data, b)
+			}
+		}
+		if len(data) > 0 {
+			s.record("subnegotiation: " + telnetSubnegotiation(data))
+		}
+	}
+	return nil
+}
+
+// telnetSubnegotiation describes the terminal type and window size reports,
+// the subnegotiations most clients send.
+func telnetSubnegotiation(data []byte) string {
+	switch {
+	case data[0] == 24 && len(data) > 1 && data[1] == 0:
+		return "TERMINAL-TYPE " + string(data[2:])
+	case data[0] == 31 && len(data) == 5:
+		return fmt.Sprintf("NAWS %dx%d", int(data[1])<<8|int(data[2]), int(data[3])<<8|int(data[4]))
+	}
+	return fmt.Sprintf("%s % x", telnetOptionName(data[0]), data[1:])
+}
+
+func telnetOptionName(option byte) string {
+	if name, ok := telnetOptions[option]; ok {
+		return name
+	}
+	return fmt.Sprintf("option %d", option)
+}
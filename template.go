@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// responseVars are what templated responses can echo back, so a tester
+// sees from the answer itself what the server observed: TXT records in the
+// zone and response rule bodies may contain {{.ClientIP}}, {{.Token}},
+// {{.Timestamp}} and the other fields below.
+type responseVars struct {
+	ID        string
+	Protocol  string
+	ClientIP  string
+	Host      string
+	Method    string
+	Path      string
+	UserAgent string
+	QName     string
+	QType     string
+	Token     string
+	Node      string
+	Timestamp string
+	Time      time.Time
+}
+
+func newResponseVars(i *Interaction) responseVars {
+	return responseVars{
+		ID:        i.ID,
+		Protocol:  i.Protocol,
+		ClientIP:  i.RemoteIP,
+		Host:      i.Host,
+		Method:    i.Method,
+		Path:      i.Path,
+		UserAgent: i.UserAgent,
+		QName:     i.QName,
+		QType:     i.QType,
+		Token:     i.Token,
+		Node:      i.Node,
+		Timestamp: i.Time.Format(time.RFC3339),
+		Time:      i.Time,
+	}
+}
+
+// responseTemplates caches parsed templates by their text, as the same few
+// records and rules are answered over and over.
+var responseTemplates sync.Map
+
+func parseResponseTemplate(text string) (*template.Template, error) {
+	if t, ok := responseTemplates.Load(text); ok {
+		return t.(*template.Template), nil
+	}
+	t, err := template.New("response").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	responseTemplates.Store(text, t)
+	return t, nil
+}
+
+// checkResponseTemplate reports templates that don't parse or use unknown
+// variables, for validating records and rules when they are loaded.
+func checkResponseTemplate(text string) error {
+	if !strings.Contains(text, "{{") {
+		return nil
+	}
+	t, err := parseResponseTemplate(text)
+	if err != nil {
+		return err
+	}
+	return t.Execute(io.Discard, responseVars{})
+}
+
+// expandResponse fills in the variables of text for interaction i. Text
+// without template actions is returned as it is, and so is a template that
+// fails, after logging why.
+func expandResponse(text string, i *Interaction) string {
+	if i == nil || !strings.Contains(text, "{{") {
+		return text
+	}
+	t, err := parseResponseTemplate(text)
+	if err != nil {
+		log.Printf("Response template %q: %v\n", text, err)
+		return text
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, newResponseVars(i)); err != nil {
+		log.Printf("Response template %q: %v\n", text, err)
+		return text
+	}
+	return b.String()
+}
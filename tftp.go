@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	tftpRRQ   = 1
+	tftpWRQ   = 2
+	tftpData  = 3
+	tftpAck   = 4
+	tftpError = 5
+
+	tftpBlockSize = 512
+	tftpTimeout   = 2 * time.Second
+	tftpRetries   = 5
+)
+
+var TFTPDir string
+
+// handleTFTP records TFTP read and write requests. Files in -tftp-dir are
+// served to read requests, everything else is answered with an error.
+func handleTFTP(p *udpPacket) []byte {
+	if len(p.data) < 4 {
+		p.record("# short packet")
+		p.summary = "Malformed request"
+		return nil
+	}
+	opcode := binary.BigEndian.Uint16(p.data)
+	fields := strings.Split(string(p.data[2:]), "\x00")
+	if (opcode != tftpRRQ && opcode != tftpWRQ) || len(fields) < 2 {
+		p.record("# unexpected opcode %d", opcode)
+		p.interaction.Data += hexDump(p.data)
+		p.summary = fmt.Sprintf("Unexpected opcode: %d", opcode)
+		return nil
+	}
+
+	request := "RRQ"
+	if opcode == tftpWRQ {
+		request = "WRQ"
+	}
+	filename, mode := fields[0], strings.ToLower(fields[1])
+	p.interaction.Method = request
+	p.interaction.Path = filename
+	p.record("%s %s mode %s", request, filename, mode)
+	for n := 2; n+1 < len(fields) && fields[n] != ""; n += 2 {
+		p.record("option %s=%s", fields[n], fields[n+1])
+	}
+	p.summary = fmt.Sprintf("Request: %s, File: %s, Mode: %s", request, filename, mode)
+
+	if opcode == tftpWRQ {
+		return tftpErrorPacket(2, "Access violation")
+	}
+	data, err := readTFTPFile(filename)
+	if err != nil {
+		p.summary += ", Served: no"
+		return tftpErrorPacket(1, "File not found")
+	}
+	p.record("# serving %d bytes", len(data))
+	p.summary += fmt.Sprintf(", Served: %d bytes", len(data))
+	go sendTFTPFile(p.addr, data)
+	return nil
+}
+
+// readTFTPFile reads a requested file from -tftp-dir, without leaving it.
+func readTFTPFile(name string) ([]byte, error) {
+	if TFTPDir == "" {
+		return nil, os.ErrNotExist
+	}
+	path := filepath.Join(TFTPDir, filepath.Clean("/"+strings.ReplaceAll(name, "\\", "/")))
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(path)
+}
+
+// sendTFTPFile sends a file in 512 byte blocks from a new port, as TFTP
+// transfers run on their own transfer ID.
+func sendTFTPFile(addr *net.UDPAddr, data []byte) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	ack := make([]byte, 512)
+	for block := 1; ; block++ {
+		start := (block - 1) * tftpBlockSize
+		end := start + tftpBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		packet := binary.BigEndian.AppendUint16(nil, tftpData)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(block))
+		packet = append(packet, data[start:end]...)
+
+		acked := false
+		for try := 0; try < tftpRetries && !acked; try++ {
+			if _, err := conn.WriteTo(packet, addr); err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(tftpTimeout))
+			for {
+				n, from, err := conn.ReadFrom(ack)
+				if err != nil {
+					break
+				}
+				if !from.(*net.UDPAddr).IP.Equal(addr.IP) || from.(*net.UDPAddr).Port != addr.Port || n < 4 {
+					continue
+				}
+				opcode, number := binary.BigEndian.Uint16(ack), binary.BigEndian.Uint16(ack[2:])
+				if opcode == tftpError {
+					return
+				}
+				if opcode == tftpAck && number == uint16(block) {
+					acked = true
+					break
+				}
+			}
+		}
+		if !acked || end-start < tftpBlockSize {
+			return
+		}
+	}
+}
+
+func tftpErrorPacket(code uint16, message string) []byte {
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.BigEndian, uint16(tftpError))
+	binary.Write(&packet, binary.BigEndian, code)
+	packet.WriteString(message + "\x00")
+	return packet.Bytes()
+}
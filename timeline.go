@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// timelineMaxDetail is the most characters of a transcript shown in one
+// timeline row.
+const timelineMaxDetail = 300
+
+// timelineStep is one row of a timeline. A connection over TLS gives two,
+// the handshake and what was sent over it, so a timeline reads in the order
+// the target went through them: DNS, TLS, then HTTP or SMTP.
+type timelineStep struct {
+	time        time.Time
+	protocol    string
+	detail      string
+	interaction *Interaction
+}
+
+func timelineSteps(list []*Interaction) []timelineStep {
+	var steps []timelineStep
+	for _, i := range list {
+		if i.TLSHandshake != "" {
+			detail := i.TLSHandshake
+			if i.JA3 != "" {
+				detail += ", JA3 " + i.JA3
+			}
+			steps = append(steps, timelineStep{i.Time, "tls", detail, i})
+			if i.Protocol == "http" && i.Method == "" {
+				continue
+			}
+		}
+		steps = append(steps, timelineStep{i.Time, i.Protocol, timelineDetail(i), i})
+	}
+	return steps
+}
+
+// timelineDetail describes what was asked for or sent in an interaction.
+func timelineDetail(i *Interaction) string {
+	var parts []string
+	switch {
+	case i.Protocol == "dns":
+		parts = append(parts, i.QType+" query for "+i.QName)
+	case i.Protocol == "http":
+		target := i.Method + " " + i.Host + i.Path
+		if i.Query != "" {
+			target += "?" + i.Query
+		}
+		parts = append(parts, target)
+		if i.UserAgent != "" {
+			parts = append(parts, "User-Agent "+i.UserAgent)
+		}
+	default:
+		if i.Port != 0 {
+			parts = append(parts, fmt.Sprintf("port %d", i.Port))
+		}
+		if i.User != "" {
+			parts = append(parts, "login as "+i.User)
+		}
+		if i.Data != "" {
+			transcript := strings.Join(strings.Fields(strings.ReplaceAll(i.Data, "\n", " ⏎ ")), " ")
+			if len(transcript) > timelineMaxDetail {
+				transcript = strings.ToValidUTF8(transcript[:timelineMaxDetail], "") + "…"
+			}
+			parts = append(parts, transcript)
+		}
+	}
+	if i.Token != "" {
+		parts = append(parts, "canary token "+i.Token)
+	}
+	if i.Screenshot != "" {
+		parts = append(parts, "screenshot "+i.Screenshot)
+	}
+	if i.Note != "" {
+		parts = append(parts, "note: "+i.Note)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writeTimeline writes the interactions of one source IP, oldest first, as a
+// Markdown section meant to be pasted into the evidence of a finding: a
+// summary of the source followed by every step it took across protocols,
+// with the time elapsed since the first.
+func writeTimeline(w io.Writer, ip string, list []*Interaction) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "## Interactions from %s\n\n", ip)
+	if len(list) == 0 {
+		b.WriteString("No interactions recorded.\n")
+		return b.Flush()
+	}
+
+	first, last := list[0].Time.UTC(), list[len(list)-1].Time.UTC()
+	counts := make(map[string]int)
+	var protocols []string
+	engagements, networks, agents, fingerprints, tokens, verdicts := map[string]bool{}, map[string]bool{}, map[string]bool{}, map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, i := range list {
+		if counts[i.Protocol] == 0 {
+			protocols = append(protocols, i.Protocol)
+		}
+		counts[i.Protocol]++
+		if i.Engagement != "" {
+			engagements[i.Engagement] = true
+		}
+		if network := i.Enrichment["asn"]; network != "" {
+			networks[network] = true
+		}
+		if i.UserAgent != "" {
+			agents[i.UserAgent] = true
+		}
+		if i.JA3 != "" {
+			fingerprints[i.JA3] = true
+		}
+		if i.Token != "" {
+			tokens[i.Token] = true
+		}
+		if i.Verdict != "" {
+			verdicts[strings.TrimSpace(i.Verdict+" "+i.Intel)] = true
+		}
+	}
+	seen := make([]string, len(protocols))
+	for n, p := range protocols {
+		seen[n] = fmt.Sprintf("%s (%d)", strings.ToUpper(p), counts[p])
+	}
+	fmt.Fprintf(b, "- **First seen**: %s\n", first.Format(time.RFC3339))
+	fmt.Fprintf(b, "- **Last seen**: %s (%s later)\n", last.Format(time.RFC3339), last.Sub(first).Round(time.Millisecond))
+	fmt.Fprintf(b, "- **Interactions**: %d, %s\n", len(list), strings.Join(seen, " → "))
+	for _, field := range []struct {
+		name string
+		set  map[string]bool
+	}{
+		{"Engagement", engagements},
+		{"Network", networks},
+		{"Canary tokens", tokens},
+		{"User agents", agents},
+		{"JA3 fingerprints", fingerprints},
+		{"Threat intel", verdicts},
+	} {
+		if len(field.set) > 0 {
+			fmt.Fprintf(b, "- **%s**: %s\n", field.name, markdownCell(strings.Join(sortedKeys(field.set), "; ")))
+		}
+	}
+
+	b.WriteString("\n| Time (UTC) | Elapsed | Protocol | Detail | Interaction |\n|---|---|---|---|---|\n")
+	for _, step := range timelineSteps(list) {
+		fmt.Fprintf(b, "| %s | +%s | %s | %s | %s |\n",
+			step.time.UTC().Format("2006-01-02 15:04:05.000"),
+			step.time.Sub(first).Round(time.Millisecond),
+			strings.ToUpper(step.protocol),
+			markdownCell(step.detail),
+			step.interaction.ID)
+	}
+	return b.Flush()
+}
+
+// markdownCell escapes text for a Markdown table cell, as it comes from
+// whoever called back and could otherwise break the table or add links.
+func markdownCell(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.NewReplacer(`\`, `\\`, "|", `\|`, "`", "\\`", "<", "&lt;", ">", "&gt;", "[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS extensions that reveal how a client tried to connect.
+const (
+	extServerName   = 0
+	extPreSharedKey = 41
+	extEarlyData    = 42
+	extECH          = 0xfe0d
+)
+
+// helloOffers is what a ClientHello asked for beyond the handshake itself:
+// resuming a session, sending 0-RTT data, or hiding its real ClientHello
+// with Encrypted Client Hello. CoWitness has no ECH keys and never accepts
+// early data, so both show up as offered only.
+type helloOffers struct {
+	serverName string
+	resumption bool
+	earlyData  bool
+	ech        bool
+}
+
+func parseHelloOffers(hello []byte) helloOffers {
+	var offers helloOffers
+	s := cryptobyte.String(hello)
+	var sessionID, ciphers, compression, extensions cryptobyte.String
+	if !s.Skip(2+32) || !s.ReadUint8LengthPrefixed(&sessionID) || !s.ReadUint16LengthPrefixed(&ciphers) ||
+		!s.ReadUint8LengthPrefixed(&compression) || !s.ReadUint16LengthPrefixed(&extensions) {
+		return offers
+	}
+	for !extensions.Empty() {
+		var kind uint16
+		var body cryptobyte.String
+		if !extensions.ReadUint16(&kind) || !extensions.ReadUint16LengthPrefixed(&body) {
+			return offers
+		}
+		switch kind {
+		case extServerName:
+			// A list holding one host_name entry in practice.
+			var list, name cryptobyte.String
+			var nameType uint8
+			if body.ReadUint16LengthPrefixed(&list) && list.ReadUint8(&nameType) && nameType == 0 && list.ReadUint16LengthPrefixed(&name) {
+				offers.serverName = string(name)
+			}
+		case extPreSharedKey:
+			offers.resumption = true
+		case extEarlyData:
+			offers.earlyData = true
+		case extECH:
+			offers.ech = true
+		}
+	}
+	return offers
+}
+
+// describeTLSHandshake summarizes a handshake for the interaction, e.g.
+// "TLS 1.3, TLS_AES_128_GCM_SHA256, ALPN h2, resumed, ECH offered (outer SNI
+// cdn.example.com)".
+func describeTLSHandshake(state *tls.ConnectionState, offers helloOffers) string {
+	parts := []string{"handshake refused"}
+	if state.HandshakeComplete {
+		parts = []string{tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)}
+		if state.NegotiatedProtocol != "" {
+			parts = append(parts, "ALPN "+state.NegotiatedProtocol)
+		}
+	}
+	switch {
+	case state.DidResume:
+		parts = append(parts, "resumed")
+	case offers.resumption:
+		parts = append(parts, "resumption offered")
+	}
+	if offers.earlyData {
+		parts = append(parts, "early data offered")
+	}
+	if offers.ech {
+		ech := "ECH offered"
+		if offers.serverName != "" {
+			ech += " (outer SNI " + offers.serverName + ")"
+		}
+		parts = append(parts, ech)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+	return "unknown TLS version"
+}
+
+// connHelloOffers returns what the ClientHello of conn offered, when conn
+// was accepted through a ja3Listener.
+func connHelloOffers(conn net.Conn) helloOffers {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if jc, ok := conn.(*ja3Conn); ok {
+		return jc.helloOffers()
+	}
+	return helloOffers{}
+}
+
+func requestTLSHandshake(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	var offers helloOffers
+	if jc, ok := r.Context().Value(ja3ContextKey{}).(*ja3Conn); ok {
+		offers = jc.helloOffers()
+	}
+	return describeTLSHandshake(r.TLS, offers)
+}
+
+// logRefusedEarlyData records HTTPS connections whose ClientHello offered
+// 0-RTT data. Go's TLS server aborts those handshakes, so they never reach
+// a request and would otherwise leave no trace.
+func logRefusedEarlyData(services *httpServices, port int) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		tc, ok := conn.(*tls.Conn)
+		if !ok || state != http.StateClosed {
+			return
+		}
+		cs := tc.ConnectionState()
+		offers := connHelloOffers(conn)
+		if cs.HandshakeComplete || !offers.earlyData {
+			return
+		}
+		i := &Interaction{
+			ID:           newID(),
+			Time:         time.Now().UTC(),
+			Node:         NodeName,
+			Engagement:   Engagement,
+			Protocol:     "http",
+			RemoteIP:     addrIP(conn.RemoteAddr()),
+			Port:         port,
+			Host:         offers.serverName,
+			TLS:          true,
+			TLSHandshake: describeTLSHandshake(&cs, offers),
+		}
+		if jc, ok := tc.NetConn().(*ja3Conn); ok {
+			i.JA3 = jc.fingerprint()
+		}
+		services.events.Write(i)
+		logger := services.httpLogger
+		if services.httpsLogger != nil {
+			logger = services.httpsLogger
+		}
+		logger.Printf("IP address: %s, Listener: https:%d, TLS: %s\n", i.RemoteIP, port, i.TLSHandshake)
+	}
+}
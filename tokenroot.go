@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TokenRootDir holds the document roots of URL tokens, one directory each
+// named after the token.
+const TokenRootDir = "./token-roots"
+
+// tokenRootIndex is served at a directory of a token's document root.
+const tokenRootIndex = "index.html"
+
+// mintRoot creates a URL token serving its own document root under its
+// address, so a payload can be hosted for a while without touching the web
+// root: /t/<id> serves the index file and /t/<id>/<path> the rest, each
+// request firing the token. fill copies the content into the new root and
+// returns the index file. The root is removed once the token expires.
+func (s *tokenStore) mintRoot(description string, ttl time.Duration, maxUses int, fill func(dir string) (string, error)) (*CanaryToken, error) {
+	t, err := s.newToken("url", description, ttl, maxUses)
+	if err != nil {
+		return nil, err
+	}
+	t.Root = filepath.Join(TokenRootDir, t.ID)
+	if err := os.MkdirAll(t.Root, 0700); err != nil {
+		return nil, err
+	}
+	if t.Index, err = fill(t.Root); err != nil {
+		os.RemoveAll(t.Root)
+		return nil, err
+	}
+	if err := s.add(t); err != nil {
+		os.RemoveAll(t.Root)
+		return nil, err
+	}
+	return t, nil
+}
+
+// copyTokenRoot returns a fill function for mintRoot copying a file, which
+// becomes the index, or a directory, whose index.html is the index. Only
+// regular files are copied, symbolic links are left out.
+func copyTokenRoot(src string) func(dir string) (string, error) {
+	return func(dir string) (string, error) {
+		info, err := os.Stat(src)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			name := filepath.Base(src)
+			return name, copyTokenFile(src, filepath.Join(dir, name))
+		}
+		err = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			switch {
+			case info.IsDir():
+				return os.MkdirAll(filepath.Join(dir, rel), 0700)
+			case info.Mode().IsRegular():
+				return copyTokenFile(p, filepath.Join(dir, rel))
+			}
+			return nil
+		})
+		return tokenRootIndex, err
+	}
+}
+
+func copyTokenFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeTokenRoot returns a fill function for mintRoot writing files given by
+// relative path and base64 content, as the API takes them. The index is
+// index, the only file when there is one, or index.html.
+func writeTokenRoot(files map[string]string, index string) func(dir string) (string, error) {
+	return func(dir string) (string, error) {
+		if len(files) == 0 {
+			return "", fmt.Errorf("a document root needs at least one file")
+		}
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			clean := path.Clean("/" + name)[1:]
+			if clean == "" || clean != name {
+				return "", fmt.Errorf("invalid file name %q, expected a relative path", name)
+			}
+			data, err := base64.StdEncoding.DecodeString(files[name])
+			if err != nil {
+				return "", fmt.Errorf("file %s: %v", name, err)
+			}
+			p := filepath.Join(dir, filepath.FromSlash(clean))
+			if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(p, data, 0600); err != nil {
+				return "", err
+			}
+		}
+		switch {
+		case index != "":
+			if _, ok := files[index]; !ok {
+				return "", fmt.Errorf("index %q is not one of the files", index)
+			}
+			return index, nil
+		case len(names) == 1:
+			return names[0], nil
+		}
+		return tokenRootIndex, nil
+	}
+}
+
+// serveTokenRoot serves the file at rest, a path within the token's root.
+// Directories serve their index.html, and are never listed.
+func serveTokenRoot(w http.ResponseWriter, r *http.Request, t *CanaryToken, rest string) {
+	name := t.Index
+	if rest != "" {
+		name = path.Clean("/" + rest)[1:]
+	}
+	p := filepath.Join(t.Root, filepath.FromSlash(name))
+	info, err := os.Stat(p)
+	if err == nil && info.IsDir() {
+		p = filepath.Join(p, tokenRootIndex)
+		info, err = os.Stat(p)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, p, info.ModTime(), f)
+}
+
+// removeExpiredRoots deletes the document roots of expired tokens. The
+// tokens themselves stay, answering 404, until they are purged.
+func (s *tokenStore) removeExpiredRoots() {
+	s.mu.Lock()
+	var roots []*CanaryToken
+	now := time.Now()
+	for _, t := range s.tokens {
+		if t.Root != "" && t.expired(now) {
+			roots = append(roots, t)
+		}
+	}
+	s.mu.Unlock()
+	for _, t := range roots {
+		if _, err := os.Stat(t.Root); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(t.Root); err != nil {
+			log.Println(err)
+			continue
+		}
+		infof("Removed the document root of expired canary token %s (%s)\n", t.ID, t.Description)
+	}
+}
+
+// tokenRootPath splits a path under TokenURLPrefix into the token ID and the
+// path within its document root.
+func tokenRootPath(p string) (string, string) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(p, TokenURLPrefix), "/")
+	return id, rest
+}
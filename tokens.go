@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	TokenStore     = "./tokens.json"
+	TokenURLPrefix = "/t/"
+	tokenScanTime  = 5 * time.Second
+)
+
+var tokenKinds = []string{"dns", "url", "email"}
+
+// TokenPurgeAfter is how long expired tokens keep answering NXDOMAIN or 404
+// before they are deleted from tokens.json.
+var TokenPurgeAfter time.Duration
+
+// transparentGIF is returned for URL tokens so they can be embedded as images.
+var transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+type CanaryToken struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	Engagement  string    `json:"engagement,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires,omitempty"`
+	MaxUses     int       `json:"max_uses,omitempty"`
+	Fired       int       `json:"fired"`
+	FirstFired  time.Time `json:"first_fired,omitempty"`
+	LastFired   time.Time `json:"last_fired,omitempty"`
+	// Root is the document root a URL token serves, in TokenRootDir, and
+	// Index the file served at the token's address.
+	Root  string `json:"root,omitempty"`
+	Index string `json:"index,omitempty"`
+}
+
+// Address renders the token the way it is handed out for the given zone.
+func (t *CanaryToken) Address(zone string) string {
+	zone = strings.TrimSuffix(zone, ".")
+	if zone == "" {
+		zone = "<zone>"
+	}
+	switch t.Kind {
+	case "url":
+		return "http://" + zone + TokenURLPrefix + t.ID
+	case "email":
+		return "canary@" + t.ID + "." + zone
+	}
+	return t.ID + "." + zone
+}
+
+// expiredAt returns when the token stopped firing, after its expiry time or
+// its last allowed use, or the zero time while it is live.
+func (t *CanaryToken) expiredAt(now time.Time) time.Time {
+	if t.MaxUses > 0 && t.Fired >= t.MaxUses {
+		return t.LastFired
+	}
+	if !t.Expires.IsZero() && !now.Before(t.Expires) {
+		return t.Expires
+	}
+	return time.Time{}
+}
+
+func (t *CanaryToken) expired(now time.Time) bool {
+	return !t.expiredAt(now).IsZero()
+}
+
+// tokenStore is shared between the running server and the token subcommand
+// through tokens.json, so every write merges in tokens minted elsewhere.
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*CanaryToken
+	mod    time.Time
+	alerts *log.Logger
+}
+
+func newTokenStore(path string, alerts *log.Logger) (*tokenStore, error) {
+	s := &tokenStore{path: path, tokens: make(map[string]*CanaryToken), alerts: alerts}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *tokenStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reloadLocked()
+}
+
+func (s *tokenStore) reloadLocked() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.mod) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []*CanaryToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	for _, t := range list {
+		if _, ok := s.tokens[t.ID]; !ok {
+			s.tokens[t.ID] = t
+		}
+	}
+	s.mod = info.ModTime()
+	return nil
+}
+
+func (s *tokenStore) watch() {
+	for range time.Tick(tokenScanTime) {
+		if err := s.reload(); err != nil {
+			log.Println(err)
+		}
+		s.removeExpiredRoots()
+		if err := s.purge(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// purge deletes tokens that expired more than TokenPurgeAfter ago, so stale
+// canaries don't raise alerts months after an engagement ended.
+func (s *tokenStore) purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	purged := 0
+	for id, t := range s.tokens {
+		if at := t.expiredAt(now); !at.IsZero() && now.Sub(at) >= TokenPurgeAfter {
+			delete(s.tokens, id)
+			purged++
+			infof("Purged expired canary token %s (%s)\n", t.ID, t.Description)
+		}
+	}
+	if purged == 0 {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+func (s *tokenStore) saveLocked() error {
+	if err := s.reloadLocked(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.mod = info.ModTime()
+	}
+	return nil
+}
+
+func (s *tokenStore) list() []*CanaryToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+func (s *tokenStore) listLocked() []*CanaryToken {
+	list := make([]*CanaryToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// mint creates a token. It expires after ttl and once it fired maxUses
+// times, when those are set.
+func (s *tokenStore) mint(kind, description string, ttl time.Duration, maxUses int) (*CanaryToken, error) {
+	t, err := s.newToken(kind, description, ttl, maxUses)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.add(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *tokenStore) newToken(kind, description string, ttl time.Duration, maxUses int) (*CanaryToken, error) {
+	if !validTokenKind(kind) {
+		return nil, fmt.Errorf("unknown token kind %q, expected one of %s", kind, strings.Join(tokenKinds, ", "))
+	}
+	if ttl < 0 || maxUses < 0 {
+		return nil, fmt.Errorf("the ttl and maximum uses of a token can't be negative")
+	}
+
+	t := &CanaryToken{ID: newID(), Kind: kind, Description: description, Engagement: Engagement, Created: time.Now().UTC(), MaxUses: maxUses}
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+	return t, nil
+}
+
+func (s *tokenStore) add(t *CanaryToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.ID] = t
+	if err := s.saveLocked(); err != nil {
+		delete(s.tokens, t.ID)
+		return err
+	}
+	return nil
+}
+
+func validTokenKind(kind string) bool {
+	for _, k := range tokenKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDNS finds a live DNS or email token among the labels of a query name.
+// Email tokens fire when the sending MTA looks up the mail domain.
+func (s *tokenStore) matchDNS(name string) *CanaryToken {
+	if t := s.findDNS(name); t != nil && !t.expired(time.Now()) {
+		return t
+	}
+	return nil
+}
+
+// expiredDNS reports whether a query name carries an expired token, which
+// is answered with NXDOMAIN until the token is purged.
+func (s *tokenStore) expiredDNS(name string) bool {
+	t := s.findDNS(name)
+	return t != nil && t.expired(time.Now())
+}
+
+func (s *tokenStore) findDNS(name string) *CanaryToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, label := range strings.Split(strings.ToLower(name), ".") {
+		if t, ok := s.tokens[label]; ok && t.Kind != "url" {
+			return t
+		}
+	}
+	return nil
+}
+
+// matchURL finds the live URL token a path belongs to; expired ones get the
+// same 404 as unknown paths. Paths below the token's address only belong to
+// tokens with a document root.
+func (s *tokenStore) matchURL(path string) *CanaryToken {
+	id, rest := tokenRootPath(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tokens[id]; ok && t.Kind == "url" && !t.expired(time.Now()) && (rest == "" || t.Root != "") {
+		return t
+	}
+	return nil
+}
+
+func (s *tokenStore) fire(t *CanaryToken, protocol, ipAddress, detail string) {
+	s.mu.Lock()
+	t.Fired++
+	t.LastFired = time.Now().UTC()
+	if t.FirstFired.IsZero() {
+		t.FirstFired = t.LastFired
+	}
+	err := s.saveLocked()
+	s.mu.Unlock()
+	if err != nil {
+		log.Println(err)
+	}
+
+	if !arming.armed(t.Engagement) {
+		log.Printf("Canary token %s fired over %s from %s while engagement %q is disarmed, not alerting\n", t.ID, protocol, ipAddress, t.Engagement)
+		return
+	}
+	s.alerts.Printf("Token: %s, Kind: %s, Description: %s, Protocol: %s, IP address: %s, Detail: %s\n", t.ID, t.Kind, t.Description, protocol, ipAddress, detail)
+	log.Printf("ALERT: canary token %s (%s) fired over %s from %s: %s\n", t.ID, t.Description, protocol, ipAddress, detail)
+}
+
+// fireURL fires the token the request's URL belongs to, if any, and returns
+// it.
+func (s *tokenStore) fireURL(r *http.Request) *CanaryToken {
+	t := s.matchURL(r.URL.Path)
+	if t != nil {
+		s.fire(t, "HTTP", remoteIP(r), fmt.Sprintf("%s %s, User agent: %s", r.Method, r.URL.Path, r.UserAgent()))
+	}
+	return t
+}
+
+func (s *tokenStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := s.fireURL(r)
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A disarmed engagement's token roots serve the pixel instead.
+	if t.Root != "" && arming.armed(t.Engagement) {
+		_, rest := tokenRootPath(r.URL.Path)
+		serveTokenRoot(w, r, t, rest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(transparentGIF)
+}
+
+// runTokenCommand implements the "token" subcommand.
+func runTokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cowitness token mint|list [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	zone := fs.String("zone", "", "zone the tokens are served from, used to print full addresses")
+	kind := fs.String("kind", "dns", "token kind: dns, url or email")
+	description := fs.String("desc", "", "description included in every alert for this token")
+	ttl := fs.Duration("ttl", 0, "time after which the token stops firing, e.g. 720h (never expires when 0)")
+	maxUses := fs.Int("max-uses", 0, "number of times the token fires before it expires (unlimited when 0)")
+	root := fs.String("root", "", "file or directory a url token serves under its address, copied into "+TokenRootDir+" and removed when the token expires")
+	fs.StringVar(&Engagement, "engagement", "", "engagement the token belongs to, used to group reports")
+	fs.Parse(args[1:])
+
+	store, err := newTokenStore(TokenStore, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "mint":
+		var t *CanaryToken
+		if *root != "" {
+			if *kind != "url" {
+				log.Fatalf("-root needs -kind url")
+			}
+			t, err = store.mintRoot(*description, *ttl, *maxUses, copyTokenRoot(*root))
+		} else {
+			t, err = store.mint(*kind, *description, *ttl, *maxUses)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		openAuditLog(AuditLogFile).recordLocal("token.mint", t.ID, t.Kind+": "+t.Description)
+		fmt.Println(t.Address(*zone))
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tKIND\tADDRESS\tFIRED\tLAST FIRED\tEXPIRES\tDESCRIPTION")
+		for _, t := range store.list() {
+			last := "-"
+			if !t.LastFired.IsZero() {
+				last = t.LastFired.Format(time.RFC3339)
+			}
+			expires := "-"
+			switch {
+			case t.expired(time.Now()):
+				expires = "expired"
+			case !t.Expires.IsZero() && t.MaxUses > 0:
+				expires = fmt.Sprintf("%s or after %d use(s)", t.Expires.Format(time.RFC3339), t.MaxUses-t.Fired)
+			case !t.Expires.IsZero():
+				expires = t.Expires.Format(time.RFC3339)
+			case t.MaxUses > 0:
+				expires = fmt.Sprintf("after %d use(s)", t.MaxUses-t.Fired)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", t.ID, t.Kind, t.Address(*zone), t.Fired, last, expires, t.Description)
+		}
+		tw.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown token command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	tuiHistory       = 1000
+	tuiReconnectTime = 5 * time.Second
+	tuiMaxEventSize  = 8 << 20
+	tuiQueueSize     = 256
+)
+
+// runTUICommand implements the "tui" subcommand, a terminal UI following the
+// interactions of an instance through its operator API: live interactions,
+// counters and quick filters, for an SSH session on the callback host where
+// tailing the logs shows too little and the dashboard is out of reach.
+func runTUICommand(args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	apiURL := fs.String("api", "http://127.0.0.1:8053", "address of the operator API")
+	token := fs.String("api-token", os.Getenv("COWITNESS_API_TOKEN"), "bearer token of the operator API (default $COWITNESS_API_TOKEN)")
+	caFile := fs.String("api-ca", "", "CA certificate to verify an HTTPS operator API with, e.g. ca/ca.crt")
+	engagement := fs.String("engagement", "", "only show the interactions of this engagement")
+	fs.Parse(args)
+
+	client := &tuiClient{url: strings.TrimSuffix(*apiURL, "/"), token: *token, engagement: *engagement, http: &http.Client{}}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates in %s", *caFile)
+		}
+		client.http.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	recent, err := client.recent()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := &tuiModel{client: client, msgs: make(chan tea.Msg, tuiQueueSize), ids: make(map[string]bool), counts: make(map[string]int), sources: make(map[string]bool), tags: make(map[string]int)}
+	m.merge(recent)
+	go client.stream(m.msgs)
+	if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// tuiClient reads interactions from the operator API.
+type tuiClient struct {
+	url, token, engagement string
+	http                   *http.Client
+}
+
+func (c *tuiClient) get(path string, values url.Values) (*http.Response, error) {
+	if c.engagement != "" {
+		values.Set("engagement", c.engagement)
+	}
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body); body.Error == "" {
+			body.Error = resp.Status
+		}
+		return nil, fmt.Errorf("%s: %s", req.URL.Path, body.Error)
+	}
+	return resp, nil
+}
+
+// recent returns the latest interactions, newest first.
+func (c *tuiClient) recent() ([]*Interaction, error) {
+	resp, err := c.get("/api/interactions", url.Values{"limit": {strconv.Itoa(tuiHistory)}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list []*Interaction
+	return list, json.NewDecoder(resp.Body).Decode(&list)
+}
+
+// stream sends the live interactions to the UI, reconnecting when the
+// stream breaks.
+func (c *tuiClient) stream(msgs chan<- tea.Msg) {
+	for {
+		msgs <- tuiStatusMsg{err: c.follow(msgs)}
+		time.Sleep(tuiReconnectTime)
+	}
+}
+
+// follow reads the stream until it breaks. Once it is connected the latest
+// interactions are queried again, to catch up on those recorded before.
+func (c *tuiClient) follow(msgs chan<- tea.Msg) error {
+	resp, err := c.get("/api/interactions/stream", url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msgs <- tuiStatusMsg{connected: true}
+	if list, err := c.recent(); err == nil {
+		msgs <- tuiRecentMsg(list)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), tuiMaxEventSize)
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "dropped":
+			n, _ := strconv.Atoi(strings.TrimPrefix(line, "data: "))
+			msgs <- tuiDroppedMsg(n)
+		case strings.HasPrefix(line, "data: "):
+			i := &Interaction{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), i); err == nil {
+				msgs <- tuiInteractionMsg{i}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("the stream was closed")
+}
+
+type (
+	tuiInteractionMsg struct{ interaction *Interaction }
+	tuiRecentMsg      []*Interaction
+	tuiDroppedMsg     int
+	tuiStatusMsg      struct {
+		connected bool
+		err       error
+	}
+)
+
+// tuiModel is the state of the terminal UI. The interactions are kept
+// newest first, the last tuiHistory of them, and the counters cover every
+// interaction received since it started.
+type tuiModel struct {
+	client *tuiClient
+	msgs   chan tea.Msg
+
+	list    []*Interaction
+	ids     map[string]bool
+	counts  map[string]int
+	sources map[string]bool
+	tags    map[string]int
+	tokens  int
+	noise   int
+	dropped int
+
+	filter    interactionQuery
+	hideNoise bool
+	searching bool
+	input     string
+
+	// selected is the ID of the selected interaction, or empty to follow
+	// the newest.
+	selected string
+	offset   int
+	detail   *Interaction
+	scroll   int
+
+	paused  bool
+	pending []*Interaction
+	status  string
+
+	width, height int
+}
+
+func (m *tuiModel) Init() tea.Cmd { return m.receive }
+
+// receive waits for the next message from the stream.
+func (m *tuiModel) receive() tea.Msg { return <-m.msgs }
+
+// add records an interaction received live.
+func (m *tuiModel) add(i *Interaction) {
+	if !m.count(i) {
+		return
+	}
+	m.list = append([]*Interaction{i}, m.list...)
+	m.trim()
+}
+
+// merge records interactions from a query, skipping those already shown.
+func (m *tuiModel) merge(list []*Interaction) {
+	for _, i := range list {
+		if m.count(i) {
+			m.list = append(m.list, i)
+		}
+	}
+	sort.SliceStable(m.list, func(a, b int) bool { return m.list[a].Time.After(m.list[b].Time) })
+	m.trim()
+}
+
+func (m *tuiModel) count(i *Interaction) bool {
+	if m.ids[i.ID] {
+		return false
+	}
+	m.ids[i.ID] = true
+	m.counts[i.Protocol]++
+	m.sources[i.RemoteIP] = true
+	for _, tag := range i.Tags {
+		m.tags[tag]++
+	}
+	if i.Token != "" {
+		m.tokens++
+	}
+	if i.Noise {
+		m.noise++
+	}
+	return true
+}
+
+func (m *tuiModel) trim() {
+	for len(m.list) > tuiHistory {
+		delete(m.ids, m.list[len(m.list)-1].ID)
+		m.list = m.list[:len(m.list)-1]
+	}
+}
+
+func (m *tuiModel) visible() []*Interaction {
+	var list []*Interaction
+	for _, i := range m.list {
+		if m.filter.matches(i) && !(m.hideNoise && i.Noise) {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+func (m *tuiModel) cursor(list []*Interaction) int {
+	for n, i := range list {
+		if i.ID == m.selected {
+			return n
+		}
+	}
+	return 0
+}
+
+func (m *tuiModel) move(list []*Interaction, delta int) {
+	n := m.cursor(list) + delta
+	if n >= len(list) {
+		n = len(list) - 1
+	}
+	if n <= 0 {
+		m.selected = ""
+		return
+	}
+	m.selected = list[n].ID
+}
+
+func (m *tuiModel) rows() int {
+	if m.height < 8 {
+		return 3
+	}
+	return m.height - 5
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tuiInteractionMsg:
+		if m.paused {
+			m.pending = append(m.pending, msg.interaction)
+		} else {
+			m.add(msg.interaction)
+		}
+		return m, m.receive
+	case tuiRecentMsg:
+		m.merge(msg)
+		return m, m.receive
+	case tuiDroppedMsg:
+		m.dropped += int(msg)
+		return m, m.receive
+	case tuiStatusMsg:
+		m.status = ""
+		if msg.err != nil {
+			m.status = "reconnecting: " + msg.err.Error()
+		}
+		return m, m.receive
+	case tea.KeyMsg:
+		if m.searching {
+			return m, m.editSearch(msg)
+		}
+		if m.detail != nil {
+			return m, m.scrollDetail(msg)
+		}
+		return m, m.key(msg)
+	}
+	return m, nil
+}
+
+func (m *tuiModel) key(msg tea.KeyMsg) tea.Cmd {
+	list := m.visible()
+	switch msg.String() {
+	case "q", "ctrl+c":
+		return tea.Quit
+	case "up", "k":
+		m.move(list, -1)
+	case "down", "j":
+		m.move(list, 1)
+	case "pgup":
+		m.move(list, -m.rows())
+	case "pgdown":
+		m.move(list, m.rows())
+	case "home", "g":
+		m.selected = ""
+	case "end", "G":
+		m.move(list, len(list))
+	case "enter":
+		if len(list) > 0 {
+			m.detail, m.scroll = list[m.cursor(list)], 0
+		}
+	case "/":
+		m.searching, m.input = true, m.filter.Search
+	case "p":
+		m.filter.Protocol = cycle(m.counts, m.filter.Protocol)
+	case "t":
+		m.filter.Tag = cycle(m.tags, m.filter.Tag)
+	case "s":
+		if m.filter.RemoteIP != "" {
+			m.filter.RemoteIP = ""
+		} else if len(list) > 0 {
+			m.filter.RemoteIP = list[m.cursor(list)].RemoteIP
+		}
+	case "n":
+		m.hideNoise = !m.hideNoise
+	case "c":
+		m.filter, m.hideNoise = interactionQuery{}, false
+	case " ":
+		if m.paused = !m.paused; !m.paused {
+			for _, i := range m.pending {
+				m.add(i)
+			}
+			m.pending = nil
+		}
+	}
+	return nil
+}
+
+func (m *tuiModel) editSearch(msg tea.KeyMsg) tea.Cmd {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return tea.Quit
+	case tea.KeyEnter:
+		m.filter.Search, m.searching, m.selected = strings.TrimSpace(m.input), false, ""
+	case tea.KeyEsc:
+		m.searching = false
+	case tea.KeyBackspace:
+		if r := []rune(m.input); len(r) > 0 {
+			m.input = string(r[:len(r)-1])
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.input += string(msg.Runes)
+	}
+	return nil
+}
+
+func (m *tuiModel) scrollDetail(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "ctrl+c":
+		return tea.Quit
+	case "esc", "q", "enter":
+		m.detail = nil
+	case "up", "k":
+		m.scroll--
+	case "down", "j":
+		m.scroll++
+	case "pgup":
+		m.scroll -= m.rows()
+	case "pgdown":
+		m.scroll += m.rows()
+	}
+	if m.scroll < 0 {
+		m.scroll = 0
+	}
+	return nil
+}
+
+// cycle returns the value after current in the sorted keys of seen, or ""
+// after the last one.
+func cycle(seen map[string]int, current string) string {
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for n, k := range keys {
+		if k == current && n+1 < len(keys) {
+			return keys[n+1]
+		}
+	}
+	if current == "" && len(keys) > 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+func (m *tuiModel) View() string {
+	width := m.width
+	if width <= 0 {
+		width = 100
+	}
+	var b strings.Builder
+	line := func(style, text string) {
+		text = runewidth.Truncate(tuiClean(text), width, "…")
+		if style != "" {
+			text = style + runewidth.FillRight(text, width) + "\x1b[0m"
+		}
+		b.WriteString(text + "\n")
+	}
+
+	status := "live"
+	switch {
+	case m.status != "":
+		status = m.status
+	case m.paused:
+		status = fmt.Sprintf("paused, %d new", len(m.pending))
+	}
+	line("\x1b[1;37;41m", fmt.Sprintf(" CoWitness %s · %s · %s", Version, m.client.url, status))
+
+	protocols := make([]string, 0, len(m.counts))
+	total := 0
+	for p, n := range m.counts {
+		protocols = append(protocols, fmt.Sprintf("%s %d", p, n))
+		total += n
+	}
+	sort.Strings(protocols)
+	counters := fmt.Sprintf(" %d interactions", total)
+	if len(protocols) > 0 {
+		counters += " (" + strings.Join(protocols, ", ") + ")"
+	}
+	counters += fmt.Sprintf(" · %d sources · %d token trips · %d noise", len(m.sources), m.tokens, m.noise)
+	if m.dropped > 0 {
+		counters += fmt.Sprintf(" · %d dropped by the server", m.dropped)
+	}
+	line("", counters)
+
+	if m.detail != nil {
+		data, _ := json.MarshalIndent(m.detail, "", "  ")
+		lines := strings.Split(string(data), "\n")
+		if m.scroll > len(lines)-1 {
+			m.scroll = len(lines) - 1
+		}
+		line("\x1b[2m", " Interaction "+m.detail.ID+" · ↑↓ scroll · esc back")
+		for n := m.scroll; n < len(lines) && n < m.scroll+m.rows()+1; n++ {
+			line("", lines[n])
+		}
+		return b.String()
+	}
+
+	list := m.visible()
+	var filters []string
+	for _, f := range []struct{ name, value string }{
+		{"protocol", m.filter.Protocol}, {"tag", m.filter.Tag}, {"source", m.filter.RemoteIP}, {"search", m.filter.Search},
+	} {
+		if f.value != "" {
+			filters = append(filters, f.name+" "+strconv.Quote(f.value))
+		}
+	}
+	if m.hideNoise {
+		filters = append(filters, "noise hidden")
+	}
+	if len(filters) == 0 {
+		filters = append(filters, "none")
+	}
+	line("", fmt.Sprintf(" Showing %d of %d · filters: %s", len(list), len(m.list), strings.Join(filters, ", ")))
+	line("\x1b[1m", fmt.Sprintf(" %-8s  %-6s  %-15s  %s", "TIME", "PROTO", "SOURCE", "DETAIL"))
+
+	rows, cursor := m.rows(), m.cursor(list)
+	if cursor < m.offset {
+		m.offset = cursor
+	}
+	if cursor >= m.offset+rows {
+		m.offset = cursor - rows + 1
+	}
+	if m.offset > len(list) {
+		m.offset = 0
+	}
+	for n := m.offset; n < m.offset+rows; n++ {
+		if n >= len(list) {
+			b.WriteString("\n")
+			continue
+		}
+		i := list[n]
+		detail := timelineDetail(i)
+		if len(i.Tags) > 0 {
+			detail = "[" + strings.Join(i.Tags, ", ") + "] " + detail
+		}
+		style := ""
+		switch {
+		case n == cursor:
+			style = "\x1b[7m"
+		case i.Token != "":
+			style = "\x1b[1;33m"
+		case i.Noise:
+			style = "\x1b[2m"
+		}
+		line(style, fmt.Sprintf(" %-8s  %-6s  %-15s  %s", i.Time.Local().Format("15:04:05"), i.Protocol, i.RemoteIP, detail))
+	}
+
+	if m.searching {
+		line("", " search: "+m.input+"█")
+	} else {
+		line("\x1b[2m", " ↑↓ select · enter details · / search · p protocol · t tag · s source · n noise · c clear · space pause · q quit")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// tuiClean replaces control characters, so captured payloads can't send
+// escape sequences to the terminal.
+func tuiClean(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	maxUDPPacket     = 65535
+	maxUDPDumpBytes  = 4096
+	udpReplyDeadline = 5 * time.Second
+)
+
+// udpModule is a protocol spoken by the UDP listeners enabled with -listen.
+// handle inspects one datagram, fills in the interaction and returns the
+// reply to send, if any.
+type udpModule struct {
+	protocol string
+	handle   func(p *udpPacket) []byte
+}
+
+var udpModules = map[string]udpModule{
+	"udp":       {protocol: "udp", handle: handleRawUDP},
+	"snmptrap":  {protocol: "snmp", handle: handleSNMPTrap},
+	"tftp":      {protocol: "tftp", handle: handleTFTP},
+	"ntp":       {protocol: "ntp", handle: handleNTP},
+	"wireguard": {protocol: "vpn", handle: handleWireGuard},
+	"openvpn":   {protocol: "vpn", handle: handleOpenVPN},
+}
+
+// udpPacket is one datagram received by a UDP module.
+type udpPacket struct {
+	conn        net.PacketConn
+	addr        *net.UDPAddr
+	data        []byte
+	services    *moduleServices
+	interaction *Interaction
+	summary     string
+}
+
+func startUDPListener(l moduleListener, services *moduleServices) {
+	module := udpModules[l.Module]
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", l.Port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	listenerStarting()
+	listenerBound(l.Module, "udp", conn.LocalAddr())
+
+	go func() {
+		infof("Starting %s server on UDP port %d\n", strings.ToUpper(l.Module), l.Port)
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			handleUDPPacket(conn, addr.(*net.UDPAddr), append([]byte(nil), buf[:n]...), module, l, services)
+		}
+	}()
+}
+
+func handleUDPPacket(conn net.PacketConn, addr *net.UDPAddr, data []byte, module udpModule, l moduleListener, services *moduleServices) {
+	p := &udpPacket{
+		conn:     conn,
+		addr:     addr,
+		data:     data,
+		services: services,
+		interaction: &Interaction{
+			ID:         newID(),
+			Time:       time.Now().UTC(),
+			Node:       NodeName,
+			Engagement: Engagement,
+			Protocol:   module.protocol,
+			RemoteIP:   addr.IP.String(),
+			Port:       l.Port,
+		},
+	}
+	if reply := module.handle(p); reply != nil {
+		conn.SetWriteDeadline(time.Now().Add(udpReplyDeadline))
+		conn.WriteTo(reply, addr)
+	}
+	services.events.Write(p.interaction)
+
+	logMessage := fmt.Sprintf("IP address: %s, Listener: %s:%d, Bytes: %d", p.interaction.RemoteIP, l.Module, l.Port, len(data))
+	if p.summary != "" {
+		logMessage += ", " + p.summary
+	}
+	services.loggers[module.protocol].Println(logMessage)
+}
+
+// record appends a line to the interaction transcript.
+func (p *udpPacket) record(format string, args ...interface{}) {
+	p.interaction.Data += fmt.Sprintf(format, args...) + "\n"
+}
+
+// hexDump formats the start of a payload for the interaction transcript.
+func hexDump(data []byte) string {
+	if len(data) > maxUDPDumpBytes {
+		return hex.Dump(data[:maxUDPDumpBytes]) + fmt.Sprintf("... %d more bytes\n", len(data)-maxUDPDumpBytes)
+	}
+	return hex.Dump(data)
+}
+
+// handleRawUDP records any datagram with a guess at its protocol and a hex
+// dump of the payload, without replying.
+func handleRawUDP(p *udpPacket) []byte {
+	guess := guessUDPProtocol(p.interaction.Port, p.data)
+	p.interaction.Data = "guessed protocol: " + guess + "\n" + hexDump(p.data)
+	p.summary = "Guessed protocol: " + guess
+	return nil
+}
+
+var udpWellKnownPorts = map[int]string{
+	53: "dns", 67: "dhcp", 69: "tftp", 123: "ntp", 137: "netbios-ns", 161: "snmp", 162: "snmp-trap",
+	500: "ike", 514: "syslog", 1194: "openvpn", 1812: "radius", 1900: "ssdp", 4500: "ike",
+	5060: "sip", 5353: "mdns", 11211: "memcached", 51820: "wireguard",
+}
+
+// guessUDPProtocol recognizes common UDP protocols by their payload, falling
+// back to the well-known use of the port.
+func guessUDPProtocol(port int, data []byte) string {
+	text := string(data)
+	header := data
+	if len(header) > 16 {
+		header = header[:16]
+	}
+	switch {
+	case len(data) == 0:
+	case strings.HasPrefix(text, "M-SEARCH ") || strings.HasPrefix(text, "NOTIFY * HTTP/"):
+		return "ssdp"
+	case strings.Contains(strings.SplitN(text, "\r\n", 2)[0], " sip:") || strings.HasPrefix(text, "SIP/2.0 "):
+		return "sip"
+	case data[0] == '<' && len(data) > 2 && data[1] >= '0' && data[1] <= '9':
+		return "syslog"
+	case data[0] == 0x30 && bytes.Contains(header, []byte{0x02, 0x01}):
+		if port == 162 {
+			return "snmp-trap"
+		}
+		return "snmp"
+	case len(data) >= 48 && (data[0]&0x07 == 3 || data[0]&0x07 == 1) && (data[0]>>3)&0x07 >= 1 && (data[0]>>3)&0x07 <= 4:
+		return "ntp"
+	case len(data) > 4 && data[0] == 0 && (data[1] == 1 || data[1] == 2) && bytes.Count(data[2:], []byte{0}) >= 2:
+		return "tftp"
+	case len(data) == 148 && data[0] == 1 && data[1] == 0 && data[2] == 0 && data[3] == 0:
+		return "wireguard"
+	case (data[0] == 0x38 || data[0] == 0x50) && len(data) >= 14:
+		// P_CONTROL_HARD_RESET_CLIENT_V2 and V3 with key id 0
+		return "openvpn"
+	}
+	if name, ok := udpWellKnownPorts[port]; ok {
+		return name
+	}
+	return "unknown"
+}
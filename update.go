@@ -0,0 +1,354 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// UpdateRepo is the GitHub repository releases are fetched from.
+	UpdateRepo = "stolenusername/cowitness"
+
+	updateTimeout   = 5 * time.Minute
+	updateMaxBinary = 200 << 20
+	updateChecksums = "checksums.txt"
+)
+
+// UpdateKey is the minisign public key release checksums are signed with,
+// set at build time with -ldflags "-X main.UpdateKey=RWQ...". Without it
+// cowitness update needs -key.
+var UpdateKey = ""
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *githubRelease) asset(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+// runUpdateCommand implements the "update" subcommand. It replaces the
+// running binary with a release from GitHub, after checking the archive
+// against checksums.txt and checksums.txt against its minisign signature,
+// so a fleet of disposable hosts can be kept current with one command each.
+// The binary is replaced in place, restart the service to run it.
+func runUpdateCommand(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	repo := fs.String("repo", UpdateRepo, "GitHub repository releases are fetched from")
+	version := fs.String("version", "", "release to install, e.g. v1.2 (default the latest)")
+	key := fs.String("key", UpdateKey, "minisign public key, or a file holding it, release checksums must be signed with")
+	check := fs.Bool("check", false, "only report whether a newer release is available")
+	force := fs.Bool("force", false, "install the release even when it is the running version or an older one")
+	fs.StringVar(&OutboundProxy, "proxy", "", "proxy for the downloads (default HTTPS_PROXY and HTTP_PROXY)")
+	fs.Parse(args)
+
+	client := newOutboundClient(updateTimeout, nil)
+	release, err := fetchRelease(client, *repo, *version)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *version != "" && release.TagName != *version {
+		log.Fatalf("Asked for release %s, got %s", *version, release.TagName)
+	}
+	if *version == "" && olderRelease(release.TagName, Version) && !*force {
+		log.Fatalf("The latest release %s is older than the running %s, pass -force to install it", release.TagName, Version)
+	}
+	if release.TagName == Version && !*force {
+		fmt.Printf("CoWitness %s is the latest release\n", Version)
+		return
+	}
+	if *check {
+		fmt.Printf("CoWitness %s is available, running %s\n", release.TagName, Version)
+		return
+	}
+	if *key == "" {
+		log.Fatalf("No release signing key built in, pass the minisign public key with -key")
+	}
+	publicKey, err := parseMinisignKey(*key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	checksums, err := download(client, release.asset(updateChecksums), 1<<20)
+	if err != nil {
+		log.Fatalf("%s: %v", updateChecksums, err)
+	}
+	signature, err := download(client, release.asset(updateChecksums+".minisig"), 4<<10)
+	if err != nil {
+		log.Fatalf("%s.minisig: %v", updateChecksums, err)
+	}
+	comment, err := verifyMinisign(publicKey, checksums, signature)
+	if err != nil {
+		log.Fatalf("%s of %s: %v", updateChecksums, release.TagName, err)
+	}
+
+	archive := releaseArchive(release.TagName)
+	if err := checkReleaseTag(comment, checksums, release.TagName); err != nil {
+		log.Fatalf("%s of %s: %v", updateChecksums, release.TagName, err)
+	}
+	want, err := checksumOf(checksums, archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := download(client, release.asset(archive), updateMaxBinary)
+	if err != nil {
+		log.Fatalf("%s: %v", archive, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != want {
+		log.Fatalf("%s doesn't match its checksum", archive)
+	}
+	binary, err := extractBinary(data, "cowitness")
+	if err != nil {
+		log.Fatalf("%s: %v", archive, err)
+	}
+
+	path, err := os.Executable()
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := replaceBinary(path, binary); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Updated %s from %s to %s, restart CoWitness to run it\n", path, Version, release.TagName)
+}
+
+func fetchRelease(client *http.Client, repo, version string) (*githubRelease, error) {
+	url := "https://api.github.com/repos/" + repo + "/releases/latest"
+	if version != "" {
+		url = "https://api.github.com/repos/" + repo + "/releases/tags/" + version
+	}
+	data, err := download(client, url, 1<<20)
+	if err != nil {
+		return nil, fmt.Errorf("release of %s: %v", repo, err)
+	}
+	var release githubRelease
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("release of %s: %v", repo, err)
+	}
+	return &release, nil
+}
+
+// download fetches url, refusing bodies larger than limit.
+func download(client *http.Client, url string, limit int64) ([]byte, error) {
+	if url == "" {
+		return nil, errors.New("not part of the release")
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s: larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+// releaseArchive returns the name of the archive of tag for this platform.
+func releaseArchive(tag string) string {
+	return fmt.Sprintf("cowitness_%s_%s_%s.tar.gz", strings.TrimPrefix(tag, "v"), runtime.GOOS, runtime.GOARCH)
+}
+
+// checkReleaseTag makes sure signed checksums belong to release tag, so the
+// signed checksums of an older release can't be passed off as a newer one:
+// the trusted comment names the tag, as release builds sign with
+// "-t cowitness <tag>", or the checksums list the tag's archive.
+func checkReleaseTag(comment string, checksums []byte, tag string) error {
+	for _, field := range strings.Fields(comment) {
+		if field == tag {
+			return nil
+		}
+	}
+	if _, err := checksumOf(checksums, releaseArchive(tag)); err == nil {
+		return nil
+	}
+	return fmt.Errorf("signed for another release, not %s", tag)
+}
+
+// olderRelease reports whether tag is an older release than current, both
+// versions such as v1.2.3. It reports false when either isn't one.
+func olderRelease(tag, current string) bool {
+	a, ok := parseReleaseVersion(tag)
+	b, ok2 := parseReleaseVersion(current)
+	if !ok || !ok2 {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return a[n] < b[n]
+		}
+	}
+	return false
+}
+
+func parseReleaseVersion(tag string) ([3]int, bool) {
+	var v [3]int
+	parts := strings.Split(strings.TrimPrefix(tag, "v"), ".")
+	if len(parts) > len(v) {
+		return v, false
+	}
+	for n, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return v, false
+		}
+		v[n] = number
+	}
+	return v, true
+}
+
+// checksumOf finds the SHA-256 of name in a sha256sum style checksums file.
+func checksumOf(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no release archive %s for this platform", name)
+}
+
+// extractBinary returns the file called name from a .tar.gz archive.
+func extractBinary(archive []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %s in the archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && filepath.Base(h.Name) == name {
+			return io.ReadAll(io.LimitReader(tr, updateMaxBinary))
+		}
+	}
+}
+
+// replaceBinary writes the new binary next to path and renames it over
+// path, so the running process keeps its file and a failed write leaves the
+// old binary in place.
+func replaceBinary(path string, binary []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cowitness-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// minisignKey is a minisign Ed25519 public key.
+type minisignKey struct {
+	id  []byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey reads a minisign public key, either the base64 line
+// itself or a .pub file holding it.
+func parseMinisignKey(value string) (*minisignKey, error) {
+	if data, err := os.ReadFile(value); err == nil {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		value = lines[len(lines)-1]
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+		return nil, errors.New("invalid minisign public key")
+	}
+	return &minisignKey{id: raw[2:10], key: ed25519.PublicKey(raw[10:])}, nil
+}
+
+// verifyMinisign checks a minisign signature of message, both the signature
+// of the file and the global signature covering its trusted comment, and
+// returns the trusted comment.
+func verifyMinisign(k *minisignKey, message, signature []byte) (string, error) {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", errors.New("malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 74 {
+		return "", errors.New("malformed minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return "", errors.New("malformed minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], k.id) {
+		return "", errors.New("signed with another key")
+	}
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(message)
+		message = sum[:]
+	default:
+		return "", errors.New("unsupported minisign signature algorithm")
+	}
+	if !ed25519.Verify(k.key, message, sig[10:]) {
+		return "", errors.New("invalid signature")
+	}
+	comment := strings.TrimSuffix(strings.TrimPrefix(lines[2], "trusted comment: "), "\r")
+	if !ed25519.Verify(k.key, append(append([]byte(nil), sig[10:]...), comment...), global) {
+		return "", errors.New("invalid signature of the trusted comment")
+	}
+	return comment, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignSigner makes minisign keys and signatures the way minisign -S does.
+type minisignSigner struct {
+	id      []byte
+	private ed25519.PrivateKey
+	public  string
+}
+
+func newMinisignSigner(t *testing.T, id string) *minisignSigner {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &minisignSigner{id: []byte(id), private: private}
+	s.public = base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), s.id...), public...))
+	return s
+}
+
+func (s *minisignSigner) sign(message []byte, comment string) []byte {
+	hash := blake2b.Sum512(message)
+	sig := append(append([]byte("ED"), s.id...), ed25519.Sign(s.private, hash[:])...)
+	global := ed25519.Sign(s.private, append(append([]byte(nil), sig[10:]...), comment...))
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(sig) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestParseMinisignKey(t *testing.T) {
+	signer := newMinisignSigner(t, "keyid001")
+	key, err := parseMinisignKey(signer.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key.id) != "keyid001" || len(key.key) != ed25519.PublicKeySize {
+		t.Errorf("parsed key ID %q with %d bytes", key.id, len(key.key))
+	}
+
+	file := filepath.Join(t.TempDir(), "minisign.pub")
+	if err := os.WriteFile(file, []byte("untrusted comment: minisign public key\n"+signer.public+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseMinisignKey(file); err != nil {
+		t.Errorf("key file: %v", err)
+	}
+
+	for _, bad := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("Ed short")), "Q" + signer.public[1:]} {
+		if _, err := parseMinisignKey(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	signer := newMinisignSigner(t, "keyid001")
+	key, err := parseMinisignKey(signer.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("0123abcd  cowitness_1.2_linux_amd64.tar.gz\n")
+	signature := signer.sign(message, "cowitness v1.2")
+
+	comment, err := verifyMinisign(key, message, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != "cowitness v1.2" {
+		t.Errorf("trusted comment %q", comment)
+	}
+
+	other, err := parseMinisignKey(newMinisignSigner(t, "keyid002").public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameID, err := parseMinisignKey(newMinisignSigner(t, "keyid001").public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(signature), "\n")
+	lines[2] = "trusted comment: cowitness v1.3"
+	tamperedComment := []byte(strings.Join(lines, "\n"))
+
+	tests := []struct {
+		name      string
+		key       *minisignKey
+		message   []byte
+		signature []byte
+	}{
+		{"tampered message", key, []byte("0123abcd  cowitness_1.3_linux_amd64.tar.gz\n"), signature},
+		{"tampered comment", key, message, tamperedComment},
+		{"other key ID", other, message, signature},
+		{"other key with the same ID", sameID, message, signature},
+		{"truncated signature", key, message, signature[:len(signature)/2]},
+	}
+	for _, test := range tests {
+		if _, err := verifyMinisign(test.key, test.message, test.signature); err == nil {
+			t.Errorf("%s: verified", test.name)
+		}
+	}
+}
+
+func TestChecksumOf(t *testing.T) {
+	checksums := []byte("AB12  cowitness_1.2_linux_amd64.tar.gz\ncd34 *cowitness_1.2_darwin_arm64.tar.gz\nbroken line\n")
+	tests := []struct {
+		name, want string
+	}{
+		{"cowitness_1.2_linux_amd64.tar.gz", "ab12"},
+		{"cowitness_1.2_darwin_arm64.tar.gz", "cd34"},
+	}
+	for _, test := range tests {
+		if got, err := checksumOf(checksums, test.name); err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+	if _, err := checksumOf(checksums, "cowitness_1.2_linux_arm64.tar.gz"); err == nil {
+		t.Error("missing archive found")
+	}
+}
+
+func TestCheckReleaseTag(t *testing.T) {
+	old := []byte("ab12  " + releaseArchive("v1.0") + "\n")
+	if err := checkReleaseTag("cowitness v1.0", old, "v1.0"); err != nil {
+		t.Error(err)
+	}
+	if err := checkReleaseTag("timestamp:1700000000\tfile:checksums.txt", old, "v1.0"); err != nil {
+		t.Errorf("archive of the tag not accepted: %v", err)
+	}
+	if err := checkReleaseTag("cowitness v1.0", old, "v1.3"); err == nil {
+		t.Error("older release's checksums accepted for v1.3")
+	}
+}
+
+func TestOlderRelease(t *testing.T) {
+	tests := []struct {
+		tag, current string
+		older        bool
+	}{
+		{"v1.0", "v1.1", true},
+		{"v1.1", "v1.1", false},
+		{"v1.2", "v1.1", false},
+		{"v1.1.1", "v1.1", false},
+		{"v1.9", "v1.10", true},
+		{"nightly", "v1.1", false},
+	}
+	for _, test := range tests {
+		if got := olderRelease(test.tag, test.current); got != test.older {
+			t.Errorf("olderRelease(%q, %q) = %v", test.tag, test.current, got)
+		}
+	}
+}
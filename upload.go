@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	UploadDir       = "./uploads"
+	UploadURLPrefix = "/upload"
+	MaxUploadSize   = 100 << 20
+	maxUploadField  = 4096
+)
+
+type uploadedFile struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	MD5       string `json:"md5"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// uploadRecord is written next to the captured files as meta.json.
+type uploadRecord struct {
+	ID          string            `json:"id"`
+	Time        time.Time         `json:"time"`
+	IP          string            `json:"ip"`
+	UserAgent   string            `json:"user_agent"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	ContentType string            `json:"content_type,omitempty"`
+	Files       []uploadedFile    `json:"files"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// deferUpload holds back the interaction of a request to the upload endpoint
+// until handleUpload stored the files, so it is recorded with the upload ID
+// and the hashes. It reports false for other requests and for requests not
+// served through spoolBodies.
+func deferUpload(r *http.Request, i *Interaction, events interactionSink) bool {
+	spool, ok := r.Context().Value(spoolKey{}).(*spooledRequest)
+	if !ok || !strings.HasPrefix(r.URL.Path, UploadURLPrefix) {
+		return false
+	}
+	spool.upload, spool.events = i, events
+	return true
+}
+
+// handleUpload accepts PUT bodies, multipart POSTs and raw POST bodies and
+// stores every file under its own interaction directory in UploadDir. Each
+// upload is cut off at MaxUploadSize, within the disk quota.
+func handleUpload(w http.ResponseWriter, r *http.Request, uploadLogger *log.Logger) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	record := &uploadRecord{
+		ID:          newID(),
+		Time:        time.Now().UTC(),
+		IP:          remoteIP(r),
+		UserAgent:   r.UserAgent(),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	dir := filepath.Join(UploadDir, record.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	mediaType, _, _ := mime.ParseMediaType(record.ContentType)
+	var err error
+	if r.Method == http.MethodPost && mediaType == "multipart/form-data" {
+		err = storeMultipart(dir, r, record)
+	} else {
+		name := path.Base(strings.TrimPrefix(r.URL.Path, UploadURLPrefix))
+		err = storeUploadedFile(dir, name, r.Body, record)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if err := writeUploadRecord(dir, record); err != nil {
+		log.Println(err)
+	}
+	var files strings.Builder
+	for n, f := range record.Files {
+		uploadLogger.Printf("Upload: %s, File: %s, Size: %d, SHA256: %s, MD5: %s, IP address: %s, User agent: %s\n", record.ID, f.Name, f.Size, f.SHA256, f.MD5, record.IP, record.UserAgent)
+		fmt.Fprintf(&files, "File: %s, Size: %d, SHA256: %s, MD5: %s", filepath.Join(dir, fmt.Sprintf("%d-%s", n, f.Name)), f.Size, f.SHA256, f.MD5)
+		if f.Truncated {
+			files.WriteString(", truncated")
+		}
+		files.WriteByte('\n')
+	}
+	if spool, ok := r.Context().Value(spoolKey{}).(*spooledRequest); ok && spool.upload != nil {
+		spool.upload.Upload = record.ID
+		spool.upload.Data = files.String()
+	}
+	log.Printf("Captured upload %s from %s (%d file(s))\n", record.ID, record.IP, len(record.Files))
+
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errDiskQuota):
+		http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, record.ID)
+	}
+}
+
+func storeMultipart(dir string, r *http.Request, record *uploadRecord) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadField))
+			if record.Fields == nil {
+				record.Fields = make(map[string]string)
+			}
+			record.Fields[part.FormName()] = string(value)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := storeUploadedFile(dir, part.FileName(), part, record); err != nil {
+			return err
+		}
+	}
+}
+
+// storeUploadedFile streams src to disk while hashing it with SHA-256 and
+// MD5, within the disk quota shared with spooled bodies. A partially received
+// file is kept and flagged, since a truncated exfil is still evidence.
+func storeUploadedFile(dir, name string, src io.Reader, record *uploadRecord) error {
+	name = filepath.Base(name)
+	if name == "." || name == "/" || name == "meta.json" || strings.HasPrefix(name, ".") {
+		name = "body"
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("%d-%s", len(record.Files), name))
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sha, md := sha256.New(), md5.New()
+	size, copyErr := io.Copy(io.MultiWriter(quotaWriter{f, bodyQuota}, sha, md), src)
+	record.Files = append(record.Files, uploadedFile{
+		Name:      name,
+		Size:      size,
+		SHA256:    hex.EncodeToString(sha.Sum(nil)),
+		MD5:       hex.EncodeToString(md.Sum(nil)),
+		Truncated: copyErr != nil,
+	})
+	return copyErr
+}
+
+func writeUploadRecord(dir string, record *uploadRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "meta.json"), data, 0600)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// inTempDir runs the rest of the test in a scratch directory, for the
+// handlers writing to relative paths.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// newTestHTTPHandler returns the HTTP handler recording into sink.
+func newTestHTTPHandler(t *testing.T, sink interactionSink) http.Handler {
+	t.Helper()
+	dir := inTempDir(t)
+	discard := log.New(io.Discard, "", 0)
+	noise, err := newNoiseFilter("log", "", discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads, err := newPayloadStore(filepath.Join(dir, "payloads"), filepath.Join(dir, "payloads.json"), discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := newTokenStore(filepath.Join(dir, "tokens.json"), discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHTTPHandler(nil, &httpServices{
+		rootDir:      dir,
+		httpLogger:   discard,
+		uploadLogger: discard,
+		secretLogger: discard,
+		alertLogger:  discard,
+		events:       sink,
+		noise:        noise,
+		payloads:     payloads,
+		tokens:       tokens,
+	})
+}
+
+func TestUploadRecordedOnInteraction(t *testing.T) {
+	sink := &collectSink{}
+	handler := newTestHTTPHandler(t, sink)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "loot.txt")
+	part.Write([]byte("hunter2"))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, UploadURLPrefix, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d", rec.Code)
+	}
+	id := strings.TrimSpace(rec.Body.String())
+
+	list := sink.interactions()
+	if len(list) != 1 {
+		t.Fatalf("%d interactions recorded, want 1", len(list))
+	}
+	i := list[0]
+	if i.Upload != id {
+		t.Errorf("upload %q, want %q", i.Upload, id)
+	}
+	for _, want := range []string{
+		filepath.Join(UploadDir, id, "0-loot.txt"),
+		"SHA256: f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7",
+		"MD5: 2ab96390c7dbe3439de74d0c9b0b1767",
+	} {
+		if !strings.Contains(i.Data, want) {
+			t.Errorf("%q not in %q", want, i.Data)
+		}
+	}
+	if !(interactionQuery{Search: "2ab96390c7dbe3439de74d0c9b0b1767"}).matches(i) || !(interactionQuery{Upload: id}).matches(i) {
+		t.Error("upload not found by hash or ID")
+	}
+}
+
+func TestUploadDiskQuota(t *testing.T) {
+	defer func(q *diskQuota) { bodyQuota = q }(bodyQuota)
+	bodyQuota = newDiskQuota(1024)
+	handler := newTestHTTPHandler(t, &collectSink{})
+
+	req := httptest.NewRequest(http.MethodPut, UploadURLPrefix+"/big.bin", bytes.NewReader(make([]byte, 4096)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusInsufficientStorage)
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for n := range p {
+		p[n] = 0
+	}
+	return len(p), nil
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes MaxUploadSize bytes")
+	}
+	handler := newTestHTTPHandler(t, &collectSink{})
+
+	req := httptest.NewRequest(http.MethodPut, UploadURLPrefix+"/big.bin", io.LimitReader(zeros{}, MaxUploadSize+1))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	matches, _ := filepath.Glob(filepath.Join(UploadDir, "*", "0-big.bin"))
+	if len(matches) != 1 {
+		t.Fatalf("upload not kept: %v", matches)
+	}
+	info, err := os.Stat(matches[0])
+	if err != nil || info.Size() != MaxUploadSize {
+		t.Fatalf("kept %v bytes, want %d: %v", info, MaxUploadSize, err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const UserStore = "./users.json"
+
+// Roles in increasing order of privilege. read-only sees interactions and
+// tokens, operator also mints tokens and changes response behaviour, admin
+// also manages users.
+const (
+	roleReadOnly = "read-only"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{roleReadOnly: 1, roleOperator: 2, roleAdmin: 3}
+
+type apiUser struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	TokenHash string    `json:"token_sha256,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+func (u *apiUser) can(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+// userStore is read from users.json whenever the file changes, so users added
+// with the user subcommand are picked up by a running server.
+type userStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*apiUser
+	mod   time.Time
+}
+
+func newUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, users: make(map[string]*apiUser)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *userStore) reloadLocked() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.mod) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []*apiUser
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.users = make(map[string]*apiUser)
+	for _, u := range list {
+		s.users[u.Name] = u
+	}
+	s.mod = info.ModTime()
+	return nil
+}
+
+func (s *userStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.mod = info.ModTime()
+	}
+	return nil
+}
+
+func (s *userStore) list() []*apiUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		log.Println(err)
+	}
+	return s.listLocked()
+}
+
+func (s *userStore) listLocked() []*apiUser {
+	list := make([]*apiUser, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// add creates a user and returns the bearer token, which is only stored
+// hashed. Users authenticating with a client certificate need no token.
+func (s *userStore) add(name, role string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("missing user name")
+	}
+	if _, ok := roleRank[role]; !ok {
+		return "", fmt.Errorf("unknown role %q, expected read-only, operator or admin", role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return "", err
+	}
+	if _, ok := s.users[name]; ok {
+		return "", fmt.Errorf("user %q already exists", name)
+	}
+	token := newID() + newID()
+	s.users[name] = &apiUser{Name: name, Role: role, TokenHash: hashToken(token), Created: time.Now().UTC()}
+	if err := s.saveLocked(); err != nil {
+		delete(s.users, name)
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return err
+	}
+	if _, ok := s.users[name]; !ok {
+		return fmt.Errorf("no user %q", name)
+	}
+	delete(s.users, name)
+	return s.saveLocked()
+}
+
+// authenticate resolves the caller from a bearer token or, failing that, from
+// the common name of a verified client certificate.
+func (s *userStore) authenticate(r *http.Request) *apiUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		log.Println(err)
+	}
+
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); bearer != "" {
+		hash := hashToken(bearer)
+		for _, u := range s.users {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(u.TokenHash)) == 1 {
+				return u
+			}
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if u, ok := s.users[r.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return u
+		}
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiUserKey struct{}
+
+// requireUser authenticates every API request. The -api-token bearer and,
+// while users.json holds no users, any client certificate signed by
+// -api-client-ca act as admin.
+func requireUser(users *userStore, bearer string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := users.authenticate(r)
+		if u == nil {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			switch {
+			case bearer != "" && subtle.ConstantTimeCompare([]byte(got), []byte(bearer)) == 1:
+				u = &apiUser{Name: "api-token", Role: roleAdmin}
+			case bearer == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(users.list()) == 0:
+				u = &apiUser{Name: r.TLS.VerifiedChains[0][0].Subject.CommonName, Role: roleAdmin}
+			}
+		}
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cowitness"`)
+			writeJSONError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiUserKey{}, u)))
+	})
+}
+
+func requestUser(r *http.Request) *apiUser {
+	u, _ := r.Context().Value(apiUserKey{}).(*apiUser)
+	return u
+}
+
+// requireRole rejects callers below role before calling next.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u := requestUser(r); u == nil || !u.can(role) {
+			writeJSONError(w, http.StatusForbidden, "this needs the "+role+" role")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleUsers(users *userStore, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			var list []apiUser
+			for _, u := range users.list() {
+				user := *u
+				user.TokenHash = ""
+				list = append(list, user)
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			var req struct {
+				Name string `json:"name"`
+				Role string `json:"role"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			token, err := users.add(req.Name, req.Role)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			audit.record(r, "user.add", req.Name, req.Role)
+			log.Printf("User %s added %s user %s via the API\n", requestUser(r).Name, req.Role, req.Name)
+			writeJSON(w, http.StatusCreated, map[string]string{"name": req.Name, "role": req.Role, "token": token})
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if err := users.remove(name); err != nil {
+				writeJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			audit.record(r, "user.remove", name, "")
+			log.Printf("User %s removed user %s via the API\n", requestUser(r).Name, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		}
+	}
+}
+
+// runUserCommand implements the "user" subcommand.
+func runUserCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cowitness user add|list|remove [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "user name, matching the common name of the user's client certificate")
+	role := fs.String("role", roleReadOnly, "role: read-only, operator or admin")
+	fs.Parse(args[1:])
+
+	users, err := newUserStore(UserStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "add":
+		token, err := users.add(*name, *role)
+		if err != nil {
+			log.Fatal(err)
+		}
+		openAuditLog(AuditLogFile).recordLocal("user.add", *name, *role)
+		fmt.Printf("Added %s user %s, API token: %s\n", *role, *name, token)
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\tCREATED")
+		for _, u := range users.list() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Name, u.Role, u.Created.Format(time.RFC3339))
+		}
+		tw.Flush()
+	case "remove":
+		if err := users.remove(*name); err != nil {
+			log.Fatal(err)
+		}
+		openAuditLog(AuditLogFile).recordLocal("user.remove", *name, "")
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown user command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserRoles(t *testing.T) {
+	users, err := newUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]string{}
+	for _, role := range []string{roleReadOnly, roleOperator, roleAdmin} {
+		if tokens[role], err = users.add(role+"-user", role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := users.add("root", "superuser"); err == nil {
+		t.Error("unknown role accepted")
+	}
+	if _, err := users.add(roleAdmin+"-user", roleAdmin); err == nil {
+		t.Error("duplicate user accepted")
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := requireUser(users, "static-token", http.HandlerFunc(requireRole(roleOperator, ok)))
+	tests := []struct {
+		name, bearer string
+		want         int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "guess", http.StatusUnauthorized},
+		{"read-only", tokens[roleReadOnly], http.StatusForbidden},
+		{"operator", tokens[roleOperator], http.StatusOK},
+		{"admin", tokens[roleAdmin], http.StatusOK},
+		{"-api-token", "static-token", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/tokens", nil)
+		if test.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.want)
+		}
+	}
+
+	if err := users.remove(roleOperator + "-user"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/interactions", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens[roleOperator])
+	if u := users.authenticate(req); u != nil {
+		t.Errorf("removed user authenticated as %s", u.Name)
+	}
+}
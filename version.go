@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.Version=v1.2 -X main.Commit=$(git rev-parse HEAD) -X main.BuildDate=$(date -u +%FT%TZ)"
+//
+// Without them the commit and date are taken from the VCS information Go
+// records when building from a git checkout.
+var (
+	Version   = "v1.1"
+	Commit    = ""
+	BuildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	Go        string `json:"go"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, Go: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	info, ok := debug.ReadBuildInfo()
+	if !ok || Commit != "" {
+		return b
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Commit = s.Value
+		case "vcs.time":
+			if b.BuildDate == "" {
+				b.BuildDate = s.Value
+			}
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// runVersionCommand implements the "version" subcommand.
+func runVersionCommand(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the build information as JSON")
+	fs.Parse(args)
+
+	b := currentBuild()
+	if *asJSON {
+		out, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Println("CoWitness", b.Version)
+	if b.Commit != "" {
+		commit := b.Commit
+		if b.Modified {
+			commit += " (modified)"
+		}
+		fmt.Printf("%-10s %s\n", "Commit:", commit)
+	}
+	if b.BuildDate != "" {
+		fmt.Printf("%-10s %s\n", "Built:", b.BuildDate)
+	}
+	fmt.Printf("%-10s %s\n", "Go:", b.Go)
+	fmt.Printf("%-10s %s\n", "Platform:", b.Platform)
+}
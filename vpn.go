@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+var wireguardMessages = map[byte]string{1: "handshake initiation", 2: "handshake response", 3: "cookie reply", 4: "transport data"}
+
+var openvpnOpcodes = map[byte]string{
+	1: "P_CONTROL_HARD_RESET_CLIENT_V1", 2: "P_CONTROL_HARD_RESET_SERVER_V1", 3: "P_CONTROL_SOFT_RESET_V1",
+	4: "P_CONTROL_V1", 5: "P_ACK_V1", 6: "P_DATA_V1", 7: "P_CONTROL_HARD_RESET_CLIENT_V2",
+	8: "P_CONTROL_HARD_RESET_SERVER_V2", 9: "P_DATA_V2", 10: "P_CONTROL_HARD_RESET_CLIENT_V3", 11: "P_CONTROL_WKC_V1",
+}
+
+// openvpnPlainResetSize is the size of a hard reset without tls-auth or
+// tls-crypt: opcode, session ID, an empty ACK array and the packet ID.
+const openvpnPlainResetSize = 1 + 8 + 1 + 4
+
+// handleWireGuard records WireGuard handshake initiations without answering,
+// so the peer never learns whether a server is listening.
+func handleWireGuard(p *udpPacket) []byte {
+	if len(p.data) < 4 || wireguardMessages[p.data[0]] == "" {
+		p.record("# not a WireGuard message")
+		p.interaction.Data += hexDump(p.data)
+		p.summary = "Unknown message"
+		return nil
+	}
+	message := wireguardMessages[p.data[0]]
+	p.record("message: %s", message)
+	p.summary = "Message: " + message
+	if p.data[0] == 1 && len(p.data) == 148 {
+		p.record("sender index: %d", binary.LittleEndian.Uint32(p.data[4:]))
+		p.record("ephemeral key: %s", base64.StdEncoding.EncodeToString(p.data[8:40]))
+		p.record("cookie: %t", !allZero(p.data[132:148]))
+		p.summary += ", Ephemeral key: " + base64.StdEncoding.EncodeToString(p.data[8:40])
+	}
+	return nil
+}
+
+// handleOpenVPN records OpenVPN UDP packets, mainly the hard resets that open
+// a session, without answering.
+func handleOpenVPN(p *udpPacket) []byte {
+	if len(p.data) < 9 || openvpnOpcodes[p.data[0]>>3] == "" {
+		p.record("# not an OpenVPN packet")
+		p.interaction.Data += hexDump(p.data)
+		p.summary = "Unknown packet"
+		return nil
+	}
+	opcode, keyID := p.data[0]>>3, p.data[0]&0x07
+	name := openvpnOpcodes[opcode]
+	p.record("opcode: %s", name)
+	p.record("key id: %d", keyID)
+	p.record("session id: %s", hex.EncodeToString(p.data[1:9]))
+	p.summary = fmt.Sprintf("Opcode: %s, Session: %s", name, hex.EncodeToString(p.data[1:9]))
+	if opcode == 7 || opcode == 10 {
+		wrapped := len(p.data) > openvpnPlainResetSize
+		p.record("tls-auth or tls-crypt: %t", wrapped)
+		p.summary += fmt.Sprintf(", TLS auth: %t", wrapped)
+	}
+	return nil
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	WALFile  string
+	WALSync  string
+	WALMaxMB int
+)
+
+// writeAheadLog appends every interaction to a log file as it enters the
+// pipeline, before the enrichment queues, plugins, scripts and rules, so the
+// one callback that proves a blind vulnerability survives a crash or an OOM
+// kill even when it was still queued anywhere on its way to PostgreSQL or the
+// memory store. Interactions that made it through the pipeline are marked
+// done in the log. On the next start the done ones are replayed into the
+// store and the others are sent through the pipeline again.
+//
+// -wal-sync picks how the log is flushed to disk: "always" syncs before the
+// interaction goes on, which survives a power loss at the cost of a disk
+// flush per interaction, a duration such as "1s" syncs at most that long
+// after a write, and "none" leaves it to the operating system, which still
+// survives the process dying. Done marks aren't synced on their own; one
+// lost to a power cut only means the interaction is processed again. The
+// log is rotated to <file>.1 when it reaches -wal-max-mb, so the replay
+// covers between one and two logs' worth of the most recent interactions.
+type writeAheadLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	max    int64
+	always bool
+	dirty  bool
+	next   interactionSink
+}
+
+// walDone is the line marking an interaction done.
+type walDone struct {
+	Done string `json:"wal_done"`
+}
+
+// parseWALSync validates -wal-sync and returns the sync interval, 0 for
+// always and -1 for none.
+func parseWALSync(value string) (time.Duration, error) {
+	switch value {
+	case "always":
+		return 0, nil
+	case "none":
+		return -1, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("expected always, none or a duration such as 1s")
+	}
+	return d, nil
+}
+
+func openWriteAheadLog(path, policy string, maxMB int) (*writeAheadLog, error) {
+	interval, err := parseWALSync(policy)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{path: path, max: int64(maxMB) << 20, always: interval == 0}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go w.syncEvery(interval)
+	}
+	return w, nil
+}
+
+func (w *writeAheadLog) open() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+func (w *writeAheadLog) Write(i *Interaction) {
+	w.hold(i)
+	w.next.Write(i)
+}
+
+// hold logs i without passing it on, for interactions recorded once their
+// request finishes, such as spooled bodies and uploads. The entry written
+// when they are passed on replaces this one.
+func (w *writeAheadLog) hold(i *Interaction) {
+	line, err := json.Marshal(i)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.append(append(line, '\n'), w.always)
+}
+
+// logAhead holds i in the write-ahead log when events starts with one.
+func logAhead(events interactionSink, i *Interaction) {
+	if w, ok := events.(*writeAheadLog); ok {
+		w.hold(i)
+	}
+}
+
+func (w *writeAheadLog) done(i *Interaction) {
+	line, err := json.Marshal(walDone{i.ID})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.append(append(line, '\n'), false)
+}
+
+func (w *writeAheadLog) append(line []byte, sync bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size > 0 && w.size+int64(len(line)) > w.max {
+		if err := w.rotateLocked(); err != nil {
+			log.Printf("Rotating the write-ahead log: %v\n", err)
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		log.Printf("Write-ahead log: %v\n", err)
+		return
+	}
+	if sync {
+		if err := w.file.Sync(); err != nil {
+			log.Printf("Write-ahead log: %v\n", err)
+		}
+		return
+	}
+	w.dirty = true
+}
+
+// walCommit marks the interactions reaching the end of the pipeline done.
+type walCommit struct {
+	wal  *writeAheadLog
+	next interactionSink
+}
+
+func (c *walCommit) Write(i *Interaction) {
+	c.next.Write(i)
+	c.wal.done(i)
+}
+
+func (w *writeAheadLog) rotateLocked() error {
+	w.file.Sync()
+	w.file.Close()
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *writeAheadLog) syncEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.mu.Lock()
+		if w.dirty {
+			if err := w.file.Sync(); err != nil {
+				log.Printf("Write-ahead log: %v\n", err)
+			}
+			w.dirty = false
+		}
+		w.mu.Unlock()
+	}
+}
+
+// readWriteAheadLog calls fn with the entries of the rotated and the current
+// log, and whether they are marked done. An interaction logged more than once
+// is only passed with its last entry. A line cut short by the crash is
+// skipped.
+func readWriteAheadLog(path string, fn func(i *Interaction, done bool) error) error {
+	files := []string{path + ".1", path}
+	last := make(map[string]int)
+	done := make(map[string]bool)
+	entry := 0
+	err := scanWriteAheadLog(files, true, func(line []byte) error {
+		var mark walDone
+		if json.Unmarshal(line, &mark) == nil && mark.Done != "" {
+			done[mark.Done] = true
+			return nil
+		}
+		var i struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(line, &i) == nil {
+			last[i.ID] = entry
+		}
+		entry++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entry = 0
+	return scanWriteAheadLog(files, false, func(line []byte) error {
+		var mark walDone
+		if json.Unmarshal(line, &mark) == nil && mark.Done != "" {
+			return nil
+		}
+		var i Interaction
+		err := json.Unmarshal(line, &i)
+		n := entry
+		entry++
+		if err != nil || last[i.ID] != n {
+			return nil
+		}
+		return fn(&i, done[i.ID])
+	})
+}
+
+// scanWriteAheadLog calls fn with every line of files, skipping damaged ones
+// and logging them when report is set.
+func scanWriteAheadLog(files []string, report bool, fn func(line []byte) error) error {
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lines := bufio.NewScanner(f)
+		lines.Buffer(make([]byte, 64<<10), maxPluginMessage)
+		for n := 1; lines.Scan(); n++ {
+			if !json.Valid(lines.Bytes()) {
+				if report {
+					log.Printf("%s:%d: skipping a damaged entry\n", file, n)
+				}
+				continue
+			}
+			if err := fn(lines.Bytes()); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		err = lines.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// replay writes the interactions marked done to store and sends the others
+// through the pipeline again. Interactions the store already has are skipped
+// by PostgreSQL; the memory store starts out empty, so it gets its recent
+// history back. It returns how many interactions went to each.
+func (w *writeAheadLog) replay(store interactionStore) (stored, resent int, err error) {
+	var pending []*Interaction
+	err = readWriteAheadLog(w.path, func(i *Interaction, done bool) error {
+		if !done {
+			pending = append(pending, i)
+			return nil
+		}
+		// The PostgreSQL store queues its writes, which would overflow on a
+		// long log, so replay to it directly.
+		if p, ok := store.(*postgresStore); ok {
+			if err := p.insert(i); err != nil {
+				return err
+			}
+		} else {
+			store.Write(i)
+		}
+		stored++
+		return nil
+	})
+	if err != nil {
+		return stored, 0, err
+	}
+	for _, i := range pending {
+		w.next.Write(i)
+	}
+	return stored, len(pending), nil
+}
+
+// startWriteAheadLog opens the log set with -wal-file. It returns nil when
+// -wal-file isn't set.
+func startWriteAheadLog() *writeAheadLog {
+	if WALFile == "" {
+		return nil
+	}
+	w, err := openWriteAheadLog(WALFile, WALSync, WALMaxMB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return w
+}
+
+// commit puts the marking of done interactions in front of next, the end of
+// the pipeline.
+func (w *writeAheadLog) commit(next interactionSink) interactionSink {
+	if w == nil {
+		return next
+	}
+	return &walCommit{wal: w, next: next}
+}
+
+// start puts the log in front of next, the start of the pipeline, and
+// replays it. It returns next as it is when there is no log.
+func (w *writeAheadLog) start(store interactionStore, next interactionSink) interactionSink {
+	if w == nil {
+		return next
+	}
+	w.next = next
+	stored, resent, err := w.replay(store)
+	if err != nil {
+		log.Fatalf("Replaying the write-ahead log: %v", err)
+	}
+	infof("Replayed %d interaction(s) from the write-ahead log %s, %d of them sent through the pipeline again\n", stored+resent, w.path, resent)
+	return w
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dropSink loses what it gets, like a crash with interactions still queued.
+type dropSink struct{}
+
+func (dropSink) Write(*Interaction) {}
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cowitness.wal")
+	w, err := openWriteAheadLog(path, "always", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := &collectSink{}
+	commit := w.commit(bus)
+	w.next = commit
+	w.Write(&Interaction{ID: "published", Protocol: "dns"})
+	w.next = dropSink{}
+	w.Write(&Interaction{ID: "queued", Protocol: "http"})
+	w.hold(&Interaction{ID: "spooled", Protocol: "http"})
+	w.hold(&Interaction{ID: "uploaded", Protocol: "http"})
+	w.next = commit
+	w.Write(&Interaction{ID: "uploaded", Protocol: "http", Upload: "u1"})
+	w.file.Close()
+
+	restarted, err := openWriteAheadLog(path, "always", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.file.Close()
+	store := newMemoryStore(16)
+	pipeline := &collectSink{}
+	restarted.next = pipeline
+	stored, resent, err := restarted.replay(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 2 || resent != 2 {
+		t.Errorf("stored %d and resent %d, want 2 and 2", stored, resent)
+	}
+
+	list, _ := store.Query(interactionQuery{Limit: 16})
+	got := map[string]*Interaction{}
+	for _, i := range list {
+		got[i.ID] = i
+	}
+	if len(list) != 2 || got["published"] == nil || got["uploaded"] == nil || got["uploaded"].Upload != "u1" {
+		t.Errorf("store holds %+v, want the published and the finished upload", list)
+	}
+	resentIDs := map[string]bool{}
+	for _, i := range pipeline.interactions() {
+		resentIDs[i.ID] = true
+	}
+	if !resentIDs["queued"] || !resentIDs["spooled"] {
+		t.Errorf("sent %v through the pipeline again, want queued and spooled", resentIDs)
+	}
+}
+
+func TestWriteAheadLogSkipsDamagedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cowitness.wal")
+	if err := os.WriteFile(path, []byte("{\"id\":\"a\"}\n{\"wal_done\":\"a\"}\n{\"id\":\"b\",\"proto"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var done, pending []string
+	err := readWriteAheadLog(path, func(i *Interaction, d bool) error {
+		if d {
+			done = append(done, i.ID)
+		} else {
+			pending = append(pending, i.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0] != "a" || len(pending) != 0 {
+		t.Errorf("done %v, pending %v, want done [a]", done, pending)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookAttempts     = 6
+	webhookFirstBackoff = time.Second
+)
+
+var (
+	WebhookURL        string
+	WebhookSecret     string
+	WebhookHeaders    string
+	WebhookEvents     string
+	WebhookDeadLetter string
+)
+
+// webhookSink posts interactions one by one to a webhook. Payloads are signed
+// with -webhook-secret so receivers can authenticate them. Failed deliveries
+// are retried with exponential backoff and end up in the dead letter log when
+// every attempt failed, so no event is silently lost.
+type webhookSink struct {
+	url        string
+	secret     string
+	headers    http.Header
+	tokensOnly bool
+	queue      *sinkQueue
+	client     *http.Client
+	deadLetter *log.Logger
+}
+
+type deadLetter struct {
+	Time        time.Time    `json:"time"`
+	URL         string       `json:"url"`
+	Attempts    int          `json:"attempts"`
+	Error       string       `json:"error"`
+	Interaction *Interaction `json:"interaction"`
+}
+
+func newWebhookSink(url, secret, headers, events, deadLetterFile string) (*webhookSink, error) {
+	h, err := parseWebhookHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	s := &webhookSink{
+		url:        url,
+		secret:     secret,
+		headers:    h,
+		tokensOnly: events == "tokens",
+		queue:      newSinkQueue("Webhook "+webhookHost(url), publishQueueSize),
+		client:     newOutboundClient(10*time.Second, nil),
+		deadLetter: log.New(openLogFile(deadLetterFile), "", 0),
+	}
+	go s.run()
+	infof("Sending %s interactions to webhook %s\n", events, url)
+	return s, nil
+}
+
+// webhookHost names a webhook by its host in logs and metrics, which the
+// full URL, holding a token now and then, shouldn't end up in.
+func webhookHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "webhook"
+	}
+	return u.Host
+}
+
+// parseWebhookHeaders reads comma separated Name=value pairs.
+func parseWebhookHeaders(value string) (http.Header, error) {
+	headers := make(http.Header)
+	if value == "" {
+		return headers, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -webhook-headers entry %q, expected Name=value", pair)
+		}
+		headers.Add(name, strings.TrimSpace(v))
+	}
+	return headers, nil
+}
+
+func (s *webhookSink) Write(i *Interaction) {
+	if i.Noise || (s.tokensOnly && i.Token == "") {
+		return
+	}
+	if !s.queue.offer(i) {
+		s.bury(i, 0, fmt.Errorf("webhook queue full"))
+	}
+}
+
+func (s *webhookSink) run() {
+	for i := range s.queue.queue {
+		s.deliver(i)
+	}
+}
+
+// deliver posts one interaction, retrying network errors, rate limiting and
+// server errors. Other client errors won't improve with retries.
+func (s *webhookSink) deliver(i *Interaction) {
+	body, err := json.Marshal(i)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	backoff := webhookFirstBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(i, body)
+		if err == nil {
+			verbosef("Delivered interaction %s to the webhook after %d attempt(s)\n", i.ID, attempt)
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			log.Printf("Webhook delivery of interaction %s failed after %d attempt(s): %v\n", i.ID, attempt, err)
+			s.bury(i, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *webhookSink) post(i *Interaction, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CoWitness")
+	req.Header.Set("X-CoWitness-Delivery", i.ID)
+	req.Header.Set("X-CoWitness-Timestamp", timestamp)
+	if s.secret != "" {
+		req.Header.Set("X-CoWitness-Signature", "sha256="+webhookSignature(s.secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+// webhookSignature signs the timestamp and body, so a captured delivery can't
+// be replayed later with a fresh timestamp.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bury records an interaction that couldn't be delivered in the dead letter
+// log, one JSON object per line, for replaying later.
+func (s *webhookSink) bury(i *Interaction, attempts int, err error) {
+	line, jsonErr := json.Marshal(deadLetter{Time: time.Now().UTC(), URL: s.url, Attempts: attempts, Error: err.Error(), Interaction: i})
+	if jsonErr != nil {
+		log.Println(jsonErr)
+		return
+	}
+	s.deadLetter.Println(string(line))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	WebRoot      string
+	WebRootMaxMB int64
+)
+
+type webRootFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// webRootManaged reports whether the web root can be changed through the
+// API: only when -web-root names a directory of its own, as the working
+// directory holds users.json, the scripts and the plugins.
+func webRootManaged(root string) bool {
+	if WebRoot == "" {
+		return false
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	absRoot, err1 := filepath.Abs(root)
+	absWD, err2 := filepath.Abs(wd)
+	return err1 == nil && err2 == nil && absRoot != absWD
+}
+
+// handleWebRoot manages the files served from -web-root, so a payload can be
+// changed without copying it to the callback host:
+//
+//	GET    /api/files            lists every file
+//	GET    /api/files/<path>     downloads a file
+//	PUT    /api/files/<path>     writes the request body to a file
+//	PUT    /api/files/<dir>/     with a zip body, unpacks it into a directory
+//	DELETE /api/files/<path>     deletes a file or directory
+func handleWebRoot(root string, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/files"), "/")
+		if r.Method != http.MethodGet && !requestUser(r).can(roleOperator) {
+			writeJSONError(w, http.StatusForbidden, "this needs the "+roleOperator+" role")
+			return
+		}
+		p, err := webRootPath(root, name)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			info, err := os.Stat(p)
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, "no such file")
+				return
+			}
+			if !info.IsDir() {
+				http.ServeFile(w, r, p)
+				return
+			}
+			files, err := listWebRoot(root, p)
+			if err != nil {
+				log.Println(err)
+				writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+			writeJSON(w, http.StatusOK, files)
+		case http.MethodPut:
+			r.Body = http.MaxBytesReader(w, r.Body, WebRootMaxMB<<20)
+			var written []webRootFile
+			if strings.HasSuffix(name, "/") || name == "" {
+				written, err = unzipWebRoot(root, name, r.Body)
+			} else {
+				var f webRootFile
+				if f, err = writeWebRootFile(root, p, r.Body); err == nil {
+					written = []webRootFile{f}
+				}
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			audit.record(r, "webroot.put", "/"+name, fmt.Sprintf("%d file(s)", len(written)))
+			log.Printf("User %s wrote %d file(s) to /%s in the web root via the API\n", requestUser(r).Name, len(written), name)
+			writeJSON(w, http.StatusOK, written)
+		case http.MethodDelete:
+			if p == filepath.Clean(root) {
+				writeJSONError(w, http.StatusBadRequest, "the web root itself can't be deleted")
+				return
+			}
+			if _, err := os.Lstat(p); err != nil {
+				writeJSONError(w, http.StatusNotFound, "no such file")
+				return
+			}
+			if err := os.RemoveAll(p); err != nil {
+				log.Println(err)
+				writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+			audit.record(r, "webroot.delete", "/"+name, "")
+			log.Printf("User %s deleted /%s from the web root via the API\n", requestUser(r).Name, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		}
+	}
+}
+
+// webRootPath returns where a slash separated name is in root. Names can't
+// leave the root, by dot segments or by symbolic links inside it.
+func webRootPath(root, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if strings.ContainsRune(clean, 0) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	p := filepath.Join(root, filepath.FromSlash(clean))
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	// The deepest existing ancestor decides where the file really goes.
+	for dir := p; ; dir = filepath.Dir(dir) {
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			if dir == filepath.Dir(dir) {
+				return "", err
+			}
+			continue
+		}
+		if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+			return "", fmt.Errorf("%q is outside the web root", name)
+		}
+		return p, nil
+	}
+}
+
+func listWebRoot(root, dir string) ([]webRootFile, error) {
+	files := []webRootFile{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, webRootFile{Path: "/" + filepath.ToSlash(rel), Size: info.Size(), Modified: info.ModTime().UTC()})
+		return nil
+	})
+	return files, err
+}
+
+// writeWebRootFile replaces the file at p with the content of r. It is
+// written next to it first, so the file is never served half written.
+func writeWebRootFile(root, p string, r io.Reader) (webRootFile, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return webRootFile{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return webRootFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		return webRootFile{}, err
+	}
+	rel, _ := filepath.Rel(root, p)
+	return webRootFile{Path: "/" + filepath.ToSlash(rel), Size: size, Modified: time.Now().UTC()}, nil
+}
+
+// unzipWebRoot unpacks a zip archive into the directory dir of the root.
+// Entries leaving it and anything but files and directories are refused, and
+// the unpacked files may add up to -web-root-max-mb.
+func unzipWebRoot(root, dir string, r io.Reader) ([]webRootFile, error) {
+	tmp, err := os.CreateTemp("", "cowitness-webroot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, fmt.Errorf("a directory upload needs a zip archive: %v", err)
+	}
+	var total uint64
+	for _, entry := range archive.File {
+		if total += entry.UncompressedSize64; total > uint64(WebRootMaxMB<<20) {
+			return nil, fmt.Errorf("the archive unpacks to more than %d MB", WebRootMaxMB)
+		}
+	}
+
+	var written []webRootFile
+	for _, entry := range archive.File {
+		clean := path.Clean("/" + entry.Name)[1:]
+		if clean == "" || clean != strings.TrimSuffix(entry.Name, "/") {
+			return written, fmt.Errorf("invalid archive entry %q", entry.Name)
+		}
+		p, err := webRootPath(root, path.Join(dir, clean))
+		if err != nil {
+			return written, err
+		}
+		switch mode := entry.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return written, err
+			}
+		case mode.IsRegular():
+			content, err := entry.Open()
+			if err != nil {
+				return written, err
+			}
+			f, err := writeWebRootFile(root, p, io.LimitReader(content, int64(entry.UncompressedSize64)))
+			content.Close()
+			if err != nil {
+				return written, err
+			}
+			written = append(written, f)
+		default:
+			return written, fmt.Errorf("archive entry %q is not a file or directory", entry.Name)
+		}
+	}
+	return written, nil
+}
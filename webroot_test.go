@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebRootPathTraversal(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "www")
+	if err := os.MkdirAll(filepath.Join(root, "css"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(base, "secret")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"index.html":            filepath.Join(root, "index.html"),
+		"css/new/site.css":      filepath.Join(root, "css", "new", "site.css"),
+		"../../etc/passwd":      filepath.Join(root, "etc", "passwd"),
+		"css/../../users.json":  filepath.Join(root, "users.json"),
+		"/./css//../index.html": filepath.Join(root, "index.html"),
+	} {
+		p, err := webRootPath(root, name)
+		if err != nil || p != want {
+			t.Errorf("%q: got %q, %v, want %q", name, p, err, want)
+		}
+	}
+	for _, name := range []string{"escape/key", "escape/new/key", "escape", "a\x00b"} {
+		if p, err := webRootPath(root, name); err == nil {
+			t.Errorf("%q: resolved to %q", name, p)
+		}
+	}
+}
+
+func TestUnzipWebRootRefusesTraversal(t *testing.T) {
+	for _, name := range []string{"../evil.html", "a/../../evil.html", "/abs.html"} {
+		var archive bytes.Buffer
+		zw := zip.NewWriter(&archive)
+		f, _ := zw.Create(name)
+		f.Write([]byte("pwned"))
+		zw.Close()
+
+		base := t.TempDir()
+		root := filepath.Join(base, "www")
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := unzipWebRoot(root, "", &archive); err == nil {
+			t.Errorf("%q unpacked", name)
+		}
+		if _, err := os.Stat(filepath.Join(base, "evil.html")); err == nil {
+			t.Errorf("%q written outside the web root", name)
+		}
+	}
+}
+
+func TestWebRootNeedsOperator(t *testing.T) {
+	root := t.TempDir()
+	audit := openAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	handler := handleWebRoot(root, audit)
+
+	for role, want := range map[string]int{roleReadOnly: http.StatusForbidden, roleOperator: http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPut, "/api/files/index.html", strings.NewReader("hello"))
+		req = req.WithContext(context.WithValue(req.Context(), apiUserKey{}, &apiUser{Name: role, Role: role}))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", role, rec.Code, want)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "index.html")); err != nil || string(data) != "hello" {
+		t.Errorf("operator's file: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+var (
+	RobotsTxtFile     string
+	FaviconFile       string
+	ACMEChallengeDir  string
+	SecurityContact   string
+	SuppressWellKnown bool
+)
+
+// registerWellKnownHandlers takes /robots.txt, /favicon.ico and /.well-known/
+// away from the file server so they behave the same regardless of what
+// happens to be in the web root.
+func registerWellKnownHandlers(mux *http.ServeMux, logRequest func(*http.Request)) {
+	if SuppressWellKnown {
+		logRequest = func(*http.Request) {}
+	}
+
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if RobotsTxtFile != "" {
+			http.ServeFile(w, r, RobotsTxtFile)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, defaultRobotsTxt)
+	})
+
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if FaviconFile == "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, FaviconFile)
+	})
+
+	mux.HandleFunc("/.well-known/", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		name := strings.TrimPrefix(r.URL.Path, "/.well-known/")
+		switch {
+		case strings.HasPrefix(name, "acme-challenge/"):
+			serveACMEChallenge(w, r, strings.TrimPrefix(name, "acme-challenge/"))
+		case name == "security.txt" && SecurityContact != "":
+			serveSecurityTxt(w)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// serveACMEChallenge answers HTTP-01 challenges from the directory a client
+// such as certbot was pointed at with --webroot.
+func serveACMEChallenge(w http.ResponseWriter, r *http.Request, token string) {
+	if ACMEChallengeDir == "" || token == "" || token != path.Base(token) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeFile(w, r, filepath.Join(ACMEChallengeDir, token))
+}
+
+func serveSecurityTxt(w http.ResponseWriter) {
+	contact := SecurityContact
+	if !strings.Contains(contact, ":") {
+		contact = "mailto:" + contact
+	}
+	expires := time.Now().UTC().AddDate(1, 0, 0).Truncate(24 * time.Hour)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Contact: %s\nExpires: %s\n", contact, expires.Format(time.RFC3339))
+}
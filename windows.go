@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// engagementWindow is a time window the rules of engagement allow testing
+// in, e.g. {"days": "Mon-Fri", "start": "09:00", "end": "17:00", "timezone":
+// "Europe/Berlin"}. Days are a list or range of weekdays, every day when
+// empty. A window ending before it starts runs past midnight into the next
+// day. Without a timezone the server's local time applies.
+type engagementWindow struct {
+	Days     string `json:"days,omitempty"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"`
+
+	days       [7]bool
+	start, end int
+	location   *time.Location
+}
+
+func (w *engagementWindow) parse() error {
+	var err error
+	if w.days, err = parseWeekdays(w.Days); err != nil {
+		return err
+	}
+	if w.start, err = parseClock(w.Start); err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return fmt.Errorf("end: %v", err)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("the window starts and ends at %s", w.Start)
+	}
+	w.location = time.Local
+	if w.Timezone != "" {
+		if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseWeekdays reads days such as "Mon-Fri" or "Sat,Sun".
+func parseWeekdays(value string) ([7]bool, error) {
+	var days [7]bool
+	if strings.TrimSpace(value) == "" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, ok := weekdays[strings.ToLower(strings.TrimSpace(from))]
+		if !ok {
+			return days, fmt.Errorf("invalid day %q, expected Mon to Sun", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(strings.TrimSpace(to))]; !ok {
+				return days, fmt.Errorf("invalid day %q, expected Mon to Sun", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock reads a time of day as HH:MM and returns it in minutes.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *engagementWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	if w.start < w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// inWindows reports whether t falls in one of windows. An engagement without
+// windows is always in its window.
+func inWindows(windows []*engagementWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// closedWindow returns a window open on another weekday only.
+func closedWindow(t *testing.T) *engagementWindow {
+	t.Helper()
+	other := time.Now().UTC().AddDate(0, 0, 3).Weekday().String()[:3]
+	w := &engagementWindow{Days: other, Start: "00:00", End: "23:59", Timezone: "UTC"}
+	if err := w.parse(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWindowContains(t *testing.T) {
+	w := &engagementWindow{Days: "Mon-Fri", Start: "22:00", End: "02:00", Timezone: "UTC"}
+	if err := w.parse(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time string
+		open bool
+	}{
+		{"2024-01-01T23:00:00Z", true},  // Monday night
+		{"2024-01-02T01:59:00Z", true},  // past midnight into Tuesday
+		{"2024-01-02T02:00:00Z", false}, // closed
+		{"2024-01-06T23:00:00Z", false}, // Saturday
+		{"2024-01-06T01:00:00Z", true},  // the end of Friday's window
+	}
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.time)
+		if open := w.contains(at); open != test.open {
+			t.Errorf("%s: open %v, want %v", test.time, open, test.open)
+		}
+	}
+}
+
+func TestTokenOutsideWindowDoesNotAlert(t *testing.T) {
+	tokens, token, alerts := newURLToken(t)
+	a := newEngagementArming(filepath.Join(t.TempDir(), "arming.json"))
+	a.schedule([]*engagementNamespace{{Name: token.Engagement, Windows: []*engagementWindow{closedWindow(t)}}})
+	useArming(t, a)
+
+	tokens.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, TokenURLPrefix+token.ID, nil))
+	if alerts.Len() != 0 {
+		t.Errorf("token alerted outside its engagement's window: %q", alerts.String())
+	}
+	if token.Fired != 1 {
+		t.Errorf("token fired %d times, want 1", token.Fired)
+	}
+}
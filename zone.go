@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ZoneFile       = "./zone.json"
+	wildcardPrefix = "*."
+
+	// maxDNSTTL caps TTLs at a week, longer values are clamped by most
+	// resolvers anyway.
+	maxDNSTTL = 604800
+)
+
+// ttlOverride sets the TTL of answers for a name, a query type or both. Names
+// are relative to the zone: "@" is the apex and "*.exfil" matches every name
+// under exfil.
+type ttlOverride struct {
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+	TTL  int    `json:"ttl"`
+
+	qtype uint16
+}
+
+// zoneRecord is a record served in place of the default answer, managed
+// through the API or by editing the zone file. Without a TTL of its own the
+// TTL overrides and the -ttl default apply.
+type zoneRecord struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Value   string    `json:"value"`
+	TTL     *int      `json:"ttl,omitempty"`
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+// zoneConfig is the layout of the zone file.
+type zoneConfig struct {
+	TTL     []*ttlOverride `json:"ttl,omitempty"`
+	Records []*zoneRecord  `json:"records,omitempty"`
+	Decoy   []*zoneRecord  `json:"decoy,omitempty"`
+}
+
+func loadZoneConfig(path string) (*zoneConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &zoneConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config zoneConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for n, o := range config.TTL {
+		if o.Name == "" && o.Type == "" {
+			return nil, fmt.Errorf("%s: ttl %d: needs a name, a type or both", path, n+1)
+		}
+		if o.TTL < 0 || o.TTL > maxDNSTTL {
+			return nil, fmt.Errorf("%s: ttl %d: invalid ttl %d, expected 0 to %d", path, n+1, o.TTL, maxDNSTTL)
+		}
+		o.Name = strings.ToLower(strings.TrimSuffix(o.Name, "."))
+		if o.Name != "" && o.Name != "@" {
+			if _, ok := dns.IsDomainName(strings.TrimPrefix(o.Name, wildcardPrefix)); !ok {
+				return nil, fmt.Errorf("%s: ttl %d: invalid name %q", path, n+1, o.Name)
+			}
+		}
+		if o.Type != "" {
+			qtype, ok := dns.StringToType[strings.ToUpper(o.Type)]
+			if !ok {
+				return nil, fmt.Errorf("%s: ttl %d: unknown type %q", path, n+1, o.Type)
+			}
+			o.qtype = qtype
+		}
+	}
+	for _, r := range config.Records {
+		if err := r.normalize(); err != nil {
+			return nil, fmt.Errorf("%s: records: %v", path, err)
+		}
+	}
+	for _, r := range config.Decoy {
+		if err := r.normalize(); err != nil {
+			return nil, fmt.Errorf("%s: decoy: %v", path, err)
+		}
+	}
+	return &config, nil
+}
+
+// normalize validates a record and puts its name and type in canonical form.
+func (r *zoneRecord) normalize() error {
+	r.Name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r.Name), "."))
+	if r.Name == "" {
+		r.Name = "@"
+	}
+	if r.Name != "@" {
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(r.Name, wildcardPrefix)); !ok {
+			return fmt.Errorf("invalid name %q", r.Name)
+		}
+	}
+	r.Type = strings.ToUpper(r.Type)
+	switch r.Type {
+	case "":
+		return fmt.Errorf("%s: missing type", r.Name)
+	case "SOA", "NS", "OPT", "ANY", "AXFR", "IXFR":
+		return fmt.Errorf("%s: %s records can't be managed", r.Name, r.Type)
+	}
+	if _, ok := dns.StringToType[r.Type]; !ok {
+		return fmt.Errorf("%s: unknown type %q", r.Name, r.Type)
+	}
+	if r.TTL != nil && (*r.TTL < 0 || *r.TTL > maxDNSTTL) {
+		return fmt.Errorf("%s %s: invalid ttl %d, expected 0 to %d", r.Name, r.Type, *r.TTL, maxDNSTTL)
+	}
+	if r.Type == "TXT" {
+		if err := checkResponseTemplate(r.Value); err != nil {
+			return fmt.Errorf("%s %s: invalid template %q: %v", r.Name, r.Type, r.Value, err)
+		}
+	}
+	if _, err := r.rr("check.invalid.", 0, nil); err != nil {
+		return fmt.Errorf("%s %s: invalid value %q: %v", r.Name, r.Type, r.Value, err)
+	}
+	return nil
+}
+
+// rr builds the resource record answering qname. TXT values are quoted when
+// they aren't already, so free text needs no zone file escaping, and their
+// template variables are filled in for interaction i when it isn't nil.
+func (r *zoneRecord) rr(qname string, ttl uint32, i *Interaction) (dns.RR, error) {
+	value := strings.TrimSpace(r.Value)
+	if value == "" {
+		return nil, fmt.Errorf("missing value")
+	}
+	if r.Type == "TXT" {
+		value = expandResponse(value, i)
+	}
+	if r.Type == "TXT" && !strings.HasPrefix(value, `"`) {
+		value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", qname, ttl, r.Type, value))
+	if err == nil && rr == nil {
+		err = fmt.Errorf("missing value")
+	}
+	return rr, err
+}
+
+// matchesName reports how well the record's name matches a relative query
+// name: 2 for an exact match, 1 for a wildcard and 0 otherwise.
+func (r *zoneRecord) matchesName(name string) int {
+	switch {
+	case r.Name == name:
+		return 2
+	case strings.HasPrefix(r.Name, wildcardPrefix) && strings.HasSuffix(name, r.Name[1:]):
+		return 1
+	}
+	return 0
+}
+
+// dnsZone holds the zone file and reloads it when it changes, so TTLs and
+// records can be changed during an engagement without restarting the DNS
+// server.
+type dnsZone struct {
+	mu     sync.RWMutex
+	path   string
+	config *zoneConfig
+	mod    time.Time
+}
+
+func newDNSZone(path string) *dnsZone {
+	z := &dnsZone{path: path, config: &zoneConfig{}}
+	z.reload()
+	return z
+}
+
+func (z *dnsZone) reload() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.reloadLocked(); err != nil {
+		log.Println(err)
+	}
+}
+
+// reloadLocked keeps the previous zone when the file is broken.
+func (z *dnsZone) reloadLocked() error {
+	var mod time.Time
+	if info, err := os.Stat(z.path); err == nil {
+		mod = info.ModTime()
+	}
+	if mod.Equal(z.mod) {
+		return nil
+	}
+	config, err := loadZoneConfig(z.path)
+	if err != nil {
+		return err
+	}
+	z.config = config
+	z.mod = mod
+	if len(config.TTL) > 0 || len(config.Records) > 0 {
+		infof("Loaded %d TTL override(s) and %d record(s)\n", len(config.TTL), len(config.Records))
+	}
+	return nil
+}
+
+func (z *dnsZone) saveLocked() error {
+	data, err := json.MarshalIndent(z.config, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := z.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, z.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(z.path); err == nil {
+		z.mod = info.ModTime()
+	}
+	return nil
+}
+
+func (z *dnsZone) records() []*zoneRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	list := make([]*zoneRecord, 0, len(z.config.Records))
+	for _, r := range z.config.Records {
+		copied := *r
+		list = append(list, &copied)
+	}
+	return list
+}
+
+// setRecord adds a record, or replaces the value and TTL of the record with
+// the same name and type. It reports whether the record is new.
+func (z *dnsZone) setRecord(r *zoneRecord) (bool, error) {
+	if err := r.normalize(); err != nil {
+		return false, err
+	}
+	r.Updated = time.Now().UTC()
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.reloadLocked(); err != nil {
+		return false, err
+	}
+
+	config := *z.config
+	config.Records = nil
+	created := true
+	for _, existing := range z.config.Records {
+		if existing.Name == r.Name && existing.Type == r.Type {
+			existing = r
+			created = false
+		}
+		config.Records = append(config.Records, existing)
+	}
+	if created {
+		config.Records = append(config.Records, r)
+	}
+	previous := z.config
+	z.config = &config
+	if err := z.saveLocked(); err != nil {
+		z.config = previous
+		return false, err
+	}
+	return created, nil
+}
+
+// deleteRecords removes the records of a name, only those of one type when
+// qtype is set, and returns how many were removed.
+func (z *dnsZone) deleteRecords(name, qtype string) (int, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	qtype = strings.ToUpper(qtype)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.reloadLocked(); err != nil {
+		return 0, err
+	}
+
+	config := *z.config
+	config.Records = nil
+	for _, r := range z.config.Records {
+		if r.Name != name || (qtype != "" && r.Type != qtype) {
+			config.Records = append(config.Records, r)
+		}
+	}
+	removed := len(z.config.Records) - len(config.Records)
+	if removed == 0 {
+		return 0, nil
+	}
+	previous := z.config
+	z.config = &config
+	if err := z.saveLocked(); err != nil {
+		z.config = previous
+		return 0, err
+	}
+	return removed, nil
+}
+
+// decoy returns the decoy zone served to zone transfers.
+func (z *dnsZone) decoy() []*zoneRecord {
+	if z == nil {
+		return nil
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.config.Decoy
+}
+
+// answer returns the records for a query: those of the query type, or a
+// CNAME, for the best matching name. It returns nil when no record matches,
+// and the default answers apply. TXT templates are filled in from the
+// interaction the query was recorded as.
+func (z *dnsZone) answer(qname string, qtype uint16, i *Interaction) []dns.RR {
+	if z == nil {
+		return nil
+	}
+	name, ok := relativeName(qname)
+	if !ok {
+		return nil
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var matched []*zoneRecord
+	best := 0
+	for _, r := range z.config.Records {
+		score := r.matchesName(name)
+		if score == 0 || (r.Type != dns.TypeToString[qtype] && r.Type != "CNAME") {
+			continue
+		}
+		if score > best {
+			matched, best = nil, score
+		}
+		if score == best {
+			matched = append(matched, r)
+		}
+	}
+
+	var answer []dns.RR
+	for _, r := range matched {
+		ttl := z.ttlLocked(name, dns.StringToType[r.Type])
+		if r.TTL != nil && !NoCache {
+			ttl = uint32(*r.TTL)
+		}
+		rr, err := r.rr(qname, ttl, i)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	return answer
+}
+
+func (z *dnsZone) watch() {
+	for range time.Tick(tokenScanTime) {
+		z.reload()
+	}
+}
+
+// ttl returns the TTL for an answer. The most specific override wins: an
+// exact name before a wildcard, and a name and type before either alone.
+// Without a matching override the -ttl default applies.
+func (z *dnsZone) ttl(qname string, qtype uint16) uint32 {
+	name, ok := relativeName(qname)
+	if z == nil || !ok {
+		return uint32(DefaultTTL)
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.ttlLocked(name, qtype)
+}
+
+func (z *dnsZone) ttlLocked(name string, qtype uint16) uint32 {
+	if NoCache {
+		return 0
+	}
+	ttl, best := DefaultTTL, 0
+	for _, o := range z.config.TTL {
+		score := 0
+		switch {
+		case o.Name == "":
+		case o.Name == name:
+			score += 4
+		case strings.HasPrefix(o.Name, wildcardPrefix) && strings.HasSuffix(name, o.Name[1:]):
+			score += 2
+		default:
+			continue
+		}
+		if o.qtype != 0 {
+			if o.qtype != qtype {
+				continue
+			}
+			score++
+		}
+		if score > best {
+			ttl, best = o.TTL, score
+		}
+	}
+	return uint32(ttl)
+}
+
+// relativeName strips the zone from a query name, "@" being the apex. It
+// reports false for names outside the zone.
+func relativeName(qname string) (string, bool) {
+	qname = strings.ToLower(qname)
+	switch {
+	case qname == DNSResponseName:
+		return "@", true
+	case strings.HasSuffix(qname, "."+DNSResponseName):
+		return strings.TrimSuffix(qname, "."+DNSResponseName), true
+	}
+	return "", false
+}
+
+// handleRecords lists the zone's records and adds or replaces one:
+//
+//	POST /api/records {"name": "stage2", "type": "A", "value": "192.0.2.10"}
+func handleRecords(zone *dnsZone, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, zone.records())
+		case http.MethodPost, http.MethodPut:
+			if !requestUser(r).can(roleOperator) {
+				writeJSONError(w, http.StatusForbidden, "this needs the "+roleOperator+" role")
+				return
+			}
+			var record zoneRecord
+			if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			created, err := zone.setRecord(&record)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			target := record.Name + " " + record.Type
+			audit.record(r, "record.set", target, record.Value)
+			log.Printf("User %s set DNS record %s to %s via the API\n", requestUser(r).Name, target, record.Value)
+			status := http.StatusOK
+			if created {
+				status = http.StatusCreated
+			}
+			writeJSON(w, status, record)
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		}
+	}
+}
+
+// handleRecordDelete removes records by name, and optionally type:
+// DELETE /api/records/stage2 or DELETE /api/records/stage2/TXT.
+func handleRecordDelete(zone *dnsZone, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		name, qtype, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/records/"), "/")
+		removed, err := zone.deleteRecords(name, qtype)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if removed == 0 {
+			writeJSONError(w, http.StatusNotFound, "no such record")
+			return
+		}
+		target := strings.TrimSpace(name + " " + qtype)
+		audit.record(r, "record.delete", target, "")
+		log.Printf("User %s deleted DNS record %s via the API\n", requestUser(r).Name, target)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}